@@ -3,20 +3,47 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"runtime/pprof"
+	"syscall"
 
 	"github.com/influxdata/influxdb-relay/relay"
 )
 
 var (
 	configFile = flag.String("config", "", "Configuration file to use")
+	validate   = flag.Bool("validate", false, "Check the configuration file and exit")
+
+	migrateFile  = flag.String("migrate", "", "Upstream influxdb-relay configuration file to convert")
+	telegrafFile = flag.String("migrate-telegraf", "", "Telegraf configuration file whose InfluxDB outputs are converted")
+
+	profileFile       = flag.String("profile", "", "Line protocol file to run through an HTTP relay of the configuration, without forwarding it")
+	profileRelay      = flag.String("profile-relay", "", "HTTP relay used by -profile (Default the first one)")
+	profilePrecision  = flag.String("profile-precision", "", "Precision of the timestamps of the -profile file")
+	profileIterations = flag.Int("profile-iterations", 1000, "Number of times the -profile file is processed")
+	cpuProfile        = flag.String("cpuprofile", "", "Write the CPU profile of -profile to this file")
+	memProfile        = flag.String("memprofile", "", "Write the allocation profile of -profile to this file")
 )
 
 func main() {
 	flag.Parse()
 
+	if *migrateFile != "" || *telegrafFile != "" {
+		cfg, err := relay.MigrateConfig(*migrateFile, *telegrafFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Problem converting config:", err)
+			os.Exit(1)
+		}
+		if err := relay.WriteConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Problem writing config:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *configFile == "" {
 		fmt.Fprintln(os.Stderr, "Missing configuration file")
 		flag.PrintDefaults()
@@ -26,6 +53,25 @@ func main() {
 	cfg, err := relay.LoadConfigFile(*configFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Problem loading config file:", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config file:", err)
+		os.Exit(1)
+	}
+
+	if *validate {
+		fmt.Println("Config file is valid")
+		return
+	}
+
+	if *profileFile != "" {
+		if err := profile(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Problem profiling:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	r, err := relay.New(cfg)
@@ -34,7 +80,9 @@ func main() {
 	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	// SIGTERM is sent by service managers, the relay stops accepting writes
+	// and answers the ones being served before exiting
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
@@ -44,3 +92,44 @@ func main() {
 	log.Println("starting relays...")
 	r.Run()
 }
+
+// profile runs the -profile file through the pipeline of a relay, with the
+// CPU and allocation profiles written out when asked for
+func profile(cfg relay.Config) error {
+	body, err := ioutil.ReadFile(*profileFile)
+	if err != nil {
+		return err
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	res, err := relay.Profile(cfg, *profileRelay, body, *profilePrecision, *profileIterations)
+	if err != nil {
+		return err
+	}
+	fmt.Println(res)
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := pprof.Lookup("heap").WriteTo(f, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
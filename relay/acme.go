@@ -0,0 +1,177 @@
+//go:build go1.14
+// +build go1.14
+
+package relay
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The certificates of the HTTPS listeners can be obtained from an ACME CA
+// such as Let's Encrypt (RFC 8555) by autocert. A certificate is ordered for
+// a domain on the first handshake asking for it, proving the control of the
+// domain with the http-01 challenge served on acme-http-addr (port 80 by
+// default, as the CA connects to it). It's renewed in the background once
+// it's close to expiring, in the meantime the current one is still served,
+// and the handshakes of the other domains never wait for an order.
+//
+// The account key and the certificates are kept in acme-cache-dir when it
+// is set, otherwise a new account and certificate are ordered whenever the
+// relay starts, which quickly hits the rate limits of Let's Encrypt.
+
+// acmeManagers holds the managers by certificate configuration, for the
+// relays sharing a listener or a virtual host to share their certificate,
+// and the http-01 challenge listeners by address. A manager is dropped once
+// the last listener using it released it, and a challenge listener is
+// closed along with its last manager.
+var acmeManagers = struct {
+	sync.Mutex
+	m          map[serverCert]*acmeManager
+	responders map[string]*acmeResponder
+}{
+	m:          make(map[serverCert]*acmeManager),
+	responders: make(map[string]*acmeResponder),
+}
+
+// acmeManager obtains and renews the certificates of a set of domains
+type acmeManager struct {
+	domains   []string
+	m         *autocert.Manager
+	challenge http.Handler
+	responder *acmeResponder
+
+	// listeners using the manager, guarded by acmeManagers
+	refs int
+}
+
+// acquireACME returns the GetCertificate of the ACME configuration of c,
+// creating its manager and starting its challenge listener when needed.
+// release must be called once the listener presenting it stops.
+func acquireACME(c serverCert) (get func(*tls.ClientHelloInfo) (*tls.Certificate, error), release func(), err error) {
+	acmeManagers.Lock()
+	defer acmeManagers.Unlock()
+
+	m := acmeManagers.m[c]
+	if m == nil {
+		m, err = newACMEManager(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		acmeManagers.m[c] = m
+	}
+	m.refs++
+
+	var once sync.Once
+	return m.m.GetCertificate, func() { once.Do(func() { releaseACME(c, m) }) }, nil
+}
+
+// newACMEManager returns the manager of c, acmeManagers must be held
+func newACMEManager(c serverCert) (*acmeManager, error) {
+	m := &acmeManager{domains: strings.Split(c.acmeDomains, ",")}
+	m.m = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  autocert.HostWhitelist(m.domains...),
+		RenewBefore: acmeRenewBefore,
+		Email:       c.acmeEmail,
+		Client: &acme.Client{
+			DirectoryURL: c.acmeDirectory,
+			HTTPClient:   &http.Client{Timeout: DefaultHTTPTimeout},
+		},
+	}
+	if c.acmeCacheDir != "" {
+		if err := os.MkdirAll(c.acmeCacheDir, 0700); err != nil {
+			return nil, err
+		}
+		m.m.Cache = autocert.DirCache(c.acmeCacheDir)
+	}
+	m.challenge = m.m.HTTPHandler(http.NotFoundHandler())
+
+	r := acmeManagers.responders[c.acmeHTTPAddr]
+	if r == nil {
+		l, err := net.Listen("tcp", c.acmeHTTPAddr)
+		if err != nil {
+			return nil, err
+		}
+		r = &acmeResponder{addr: c.acmeHTTPAddr, l: l}
+		go http.Serve(l, r)
+		log.Printf("Starting ACME challenge listener on %v", c.acmeHTTPAddr)
+		acmeManagers.responders[c.acmeHTTPAddr] = r
+	}
+	r.managers = append(r.managers, m)
+	m.responder = r
+
+	return m, nil
+}
+
+// releaseACME drops a reference on the manager of c
+func releaseACME(c serverCert, m *acmeManager) {
+	acmeManagers.Lock()
+	defer acmeManagers.Unlock()
+
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	delete(acmeManagers.m, c)
+
+	r := m.responder
+	for i, other := range r.managers {
+		if other == m {
+			r.managers = append(r.managers[:i:i], r.managers[i+1:]...)
+			break
+		}
+	}
+	if len(r.managers) == 0 {
+		r.l.Close()
+		delete(acmeManagers.responders, r.addr)
+		log.Printf("Stopped ACME challenge listener on %v", r.addr)
+	}
+}
+
+func (m *acmeManager) covers(name string) bool {
+	for _, d := range m.domains {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeResponder answers the http-01 challenges of the managers sharing its
+// address, by host
+type acmeResponder struct {
+	addr string
+	l    net.Listener
+
+	// guarded by acmeManagers
+	managers []*acmeManager
+}
+
+func (r *acmeResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := requestHost(req.Host)
+
+	var m *acmeManager
+	acmeManagers.Lock()
+	for _, other := range r.managers {
+		if other.covers(host) {
+			m = other
+			break
+		}
+	}
+	acmeManagers.Unlock()
+
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+	m.challenge.ServeHTTP(w, req)
+}
@@ -0,0 +1,14 @@
+//go:build !go1.14
+// +build !go1.14
+
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// acquireACME rejects acme-domains, autocert requires Go 1.14
+func acquireACME(c serverCert) (get func(*tls.ClientHelloInfo) (*tls.Certificate, error), release func(), err error) {
+	return nil, nil, errors.New("acme-domains requires a relay built with Go 1.14 or later")
+}
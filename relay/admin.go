@@ -0,0 +1,654 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin serves the endpoints reporting and changing the state of the relays
+// of a Service
+type Admin struct {
+	addr string
+	s    *Service
+
+	// mu guards l, which is nil until Run listened
+	mu      sync.Mutex
+	closing int64
+	l       net.Listener
+	stop    chan struct{}
+
+	purges *purgeStore
+
+	// tokens of the clients, the mutating endpoints are disabled without
+	tokens [][]byte
+
+	mux *http.ServeMux
+}
+
+func newAdmin(cfg AdminConfig, s *Service) (*Admin, error) {
+	purges, err := newPurgeStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Admin{
+		addr:   cfg.Addr,
+		s:      s,
+		stop:   make(chan struct{}),
+		purges: purges,
+		mux:    http.NewServeMux(),
+	}
+	for _, t := range cfg.Tokens {
+		a.tokens = append(a.tokens, []byte(t))
+	}
+
+	a.mux.HandleFunc("/explain", a.handleExplain)
+	a.mux.HandleFunc("/backend-errors", a.handleBackendErrors)
+	a.mux.HandleFunc("/status", a.handleStatus)
+	a.mux.HandleFunc("/tenants", a.handleTenants)
+	a.mux.HandleFunc("/migration", a.handleMigration)
+	a.mux.HandleFunc("/clock-skew", a.handleClockSkew)
+	a.mux.HandleFunc("/udp-stats", a.handleUDPStats)
+	a.mux.HandleFunc("/buffer-pool", a.handleBufferPool)
+	a.mux.HandleFunc("/aggregates", a.handleAggregates)
+	a.mux.HandleFunc("/dedup", a.handleDedup)
+	a.mux.HandleFunc("/purge", a.handlePurge)
+	a.mux.HandleFunc("/purge-restore", a.handlePurgeRestore)
+	a.mux.HandleFunc("/subscriptions", a.handleSubscriptions)
+
+	return a, nil
+}
+
+func (a *Admin) Name() string {
+	return "admin"
+}
+
+func (a *Admin) Run() error {
+	l, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	if atomic.LoadInt64(&a.closing) != 0 {
+		a.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	a.l = l
+	a.mu.Unlock()
+
+	log.Printf("Starting admin listener on %v", a.addr)
+
+	go a.purges.sweep(a.stop)
+
+	err = http.Serve(l, a)
+	if atomic.LoadInt64(&a.closing) != 0 {
+		return nil
+	}
+	return err
+}
+
+func (a *Admin) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !atomic.CompareAndSwapInt64(&a.closing, 0, 1) {
+		return nil
+	}
+	close(a.stop)
+	if a.l == nil {
+		return nil
+	}
+	return a.l.Close()
+}
+
+// readOnly reports whether r only reads the state of the service, the
+// explain samples are posted but nothing is forwarded
+func readOnly(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD":
+		return true
+	case "POST":
+		return r.URL.Path == "/explain"
+	}
+	return false
+}
+
+// ServeHTTP checks the token of the client before serving the endpoints
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(a.tokens) == 0 {
+		if !readOnly(r) {
+			jsonError(w, http.StatusForbidden, "endpoint disabled without admin tokens")
+			return
+		}
+		a.mux.ServeHTTP(w, r)
+		return
+	}
+
+	match := false
+	if t := []byte(presentedToken(r)); len(t) > 0 {
+		for _, token := range a.tokens {
+			if subtle.ConstantTimeCompare(t, token) == 1 {
+				match = true
+			}
+		}
+	}
+	if !match {
+		w.Header().Set("WWW-Authenticate", `Token realm="influxdb-relay admin"`)
+		jsonError(w, http.StatusUnauthorized, "authorization failed")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// handleExplain reports how the named HTTP relay would process a write.
+// The sample points are read from the request body as line protocol, or
+// built from the measurement and tags query parameters when the body is empty.
+func (a *Admin) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid explain method")
+		return
+	}
+
+	queryParams := r.URL.Query()
+
+	relay := a.s.GetRelay(queryParams.Get("relay"))
+	if relay == nil {
+		jsonError(w, http.StatusNotFound, "unknown relay")
+		return
+	}
+
+	h, ok := relay.(*HTTP)
+	if p, isShared := relay.(*sharedRelay); isShared {
+		h, ok = p.HTTP, true
+	}
+	if !ok {
+		jsonError(w, http.StatusBadRequest, "explain is only supported for HTTP relays")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "problem reading request body")
+		return
+	}
+
+	if len(body) == 0 {
+		body, err = samplePoint(queryParams.Get("measurement"), queryParams.Get("tags"))
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	e, err := h.explain(queryParams, body)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, e)
+}
+
+// httpBackendRelay is implemented by the relays writing to HTTP backends
+type httpBackendRelay interface {
+	httpBackends() []*httpBackend
+}
+
+// handleBackendErrors reports the error counters of every HTTP backend,
+// per relay and backend name
+func (a *Admin) handleBackendErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid backend-errors method")
+		return
+	}
+
+	errs := make(map[string]map[string]map[string]int64)
+	for _, relay := range a.s.relayList() {
+		hr, ok := relay.(httpBackendRelay)
+		if !ok {
+			continue
+		}
+
+		backends := make(map[string]map[string]int64)
+		for _, b := range hr.httpBackends() {
+			backends[b.name] = b.errorCounts()
+		}
+		errs[relay.Name()] = backends
+	}
+
+	writeJSON(w, http.StatusOK, errs)
+}
+
+// handleStatus reports the uptime of the service and of every relay, and
+// the state of the HTTP backends
+func (a *Admin) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid status method")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.s.status(time.Now()))
+}
+
+// handleClockSkew reports the clock offset of every HTTP backend, per relay
+// and backend name
+func (a *Admin) handleClockSkew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid clock-skew method")
+		return
+	}
+
+	skews := make(map[string]map[string]clockSkewInfo)
+	for _, relay := range a.s.relayList() {
+		hr, ok := relay.(httpBackendRelay)
+		if !ok {
+			continue
+		}
+
+		backends := make(map[string]clockSkewInfo)
+		for _, b := range hr.httpBackends() {
+			backends[b.name] = b.skew.info()
+		}
+		skews[relay.Name()] = backends
+	}
+
+	writeJSON(w, http.StatusOK, skews)
+}
+
+// handleAggregates reports the open windows and late points of the backends
+// with aggregate rules, per relay and backend name
+func (a *Admin) handleAggregates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid aggregates method")
+		return
+	}
+
+	stats := make(map[string]map[string]aggregateStats)
+	for _, relay := range a.s.relayList() {
+		hr, ok := relay.(httpBackendRelay)
+		if !ok {
+			continue
+		}
+
+		backends := make(map[string]aggregateStats)
+		for _, b := range hr.httpBackends() {
+			if b.aggregate != nil {
+				backends[b.name] = b.aggregate.stats()
+			}
+		}
+		if len(backends) > 0 {
+			stats[relay.Name()] = backends
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleDedup reports the duplicates dropped by the HTTP relays with a
+// dedup-window, per relay name
+func (a *Admin) handleDedup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid dedup method")
+		return
+	}
+
+	stats := make(map[string]dedupStats)
+	for _, relay := range a.s.relayList() {
+		h, ok := relay.(*HTTP)
+		if p, isShared := relay.(*sharedRelay); isShared {
+			h, ok = p.HTTP, true
+		}
+		if ok && h.dedup != nil {
+			stats[relay.Name()] = h.dedup.stats()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleUDPStats reports the datagrams received and dropped by every UDP
+// relay, per relay name
+func (a *Admin) handleUDPStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid udp-stats method")
+		return
+	}
+
+	stats := make(map[string]udpStatsInfo)
+	for _, relay := range a.s.relayList() {
+		if u, ok := relay.(*UDP); ok {
+			stats[relay.Name()] = u.statsInfo()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleBufferPool reports the memory held by the pool of request buffers
+func (a *Admin) handleBufferPool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid buffer-pool method")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bufPool.stats())
+}
+
+// tenantInfo is the description of a tenant returned by /tenants
+type tenantInfo struct {
+	Template  string  `json:"template"`
+	Name      string  `json:"name"`
+	Addr      string  `json:"bind-addr,omitempty"`
+	Database  string  `json:"database,omitempty"`
+	RateLimit float64 `json:"rate-limit,omitempty"`
+	RateBurst int     `json:"rate-burst,omitempty"`
+}
+
+func newTenantInfo(cfg TenantConfig) tenantInfo {
+	return tenantInfo{
+		Template:  cfg.Template,
+		Name:      cfg.Name,
+		Addr:      cfg.Addr,
+		Database:  cfg.Database,
+		RateLimit: cfg.RateLimit,
+		RateBurst: cfg.RateBurst,
+	}
+}
+
+// handleTenants lists the tenants on GET, creates one from the template,
+// name, bind-addr, database, rate-limit and rate-burst query parameters on
+// POST, and removes the one given by name on DELETE
+func (a *Admin) handleTenants(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+		tenants := []tenantInfo{}
+		for _, t := range a.s.Tenants() {
+			tenants = append(tenants, newTenantInfo(t))
+		}
+		writeJSON(w, http.StatusOK, tenants)
+
+	case "POST":
+		cfg := TenantConfig{
+			Template: queryParams.Get("template"),
+			Name:     queryParams.Get("name"),
+			Addr:     queryParams.Get("bind-addr"),
+			Database: queryParams.Get("database"),
+		}
+		if v := queryParams.Get("rate-limit"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, "invalid rate-limit")
+				return
+			}
+			cfg.RateLimit = f
+		}
+		if v := queryParams.Get("rate-burst"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, "invalid rate-burst")
+				return
+			}
+			cfg.RateBurst = n
+		}
+
+		if err := a.s.AddTenant(cfg); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, newTenantInfo(cfg))
+
+	case "DELETE":
+		if err := a.s.RemoveTenant(queryParams.Get("name")); err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid tenants method")
+	}
+}
+
+// handleMigration reports the acknowledgment parity of the relays in
+// migration mode, or exports the missed batches of the db (and rp) query
+// parameters of the named relay as line protocol
+func (a *Admin) handleMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid migration method")
+		return
+	}
+
+	queryParams := r.URL.Query()
+
+	if db := queryParams.Get("db"); db != "" {
+		relay := a.s.GetRelay(queryParams.Get("relay"))
+		h, ok := relay.(*HTTP)
+		if p, isShared := relay.(*sharedRelay); isShared {
+			h, ok = p.HTTP, true
+		}
+		if !ok || h.migration == nil {
+			jsonError(w, http.StatusNotFound, "unknown relay in migration mode")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		if err := h.migration.export(w, db, queryParams.Get("rp")); err != nil {
+			log.Printf("Problem exporting the migration report of relay %q: %v", h.Name(), err)
+		}
+		return
+	}
+
+	stats := make(map[string]migrationStats)
+	for _, relay := range a.s.relayList() {
+		h, ok := relay.(*HTTP)
+		if p, isShared := relay.(*sharedRelay); isShared {
+			h, ok = p.HTTP, true
+		}
+		if ok && h.migration != nil {
+			stats[relay.Name()] = h.migration.stats()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// retryBufferOf returns the retry buffer of the named backend of a relay
+func (a *Admin) retryBufferOf(relay, backend string) (*retryBuffer, error) {
+	hr, ok := a.s.GetRelay(relay).(httpBackendRelay)
+	if !ok {
+		return nil, errors.New("unknown relay")
+	}
+
+	for _, b := range hr.httpBackends() {
+		if b.name != backend {
+			continue
+		}
+		rb, ok := b.poster.(*retryBuffer)
+		if !ok {
+			return nil, errors.New("backend has no retry buffer")
+		}
+		return rb, nil
+	}
+	return nil, errors.New("unknown backend")
+}
+
+// handlePurge lists the purges which can still be restored on GET, and
+// purges the retry buffer of the relay and backend query parameters on POST
+func (a *Admin) handlePurge(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		purges, err := a.purges.list()
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, purges)
+
+	case "POST":
+		queryParams := r.URL.Query()
+		relay, backend := queryParams.Get("relay"), queryParams.Get("backend")
+
+		rb, err := a.retryBufferOf(relay, backend)
+		if err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		info, err := a.purges.purge(relay, backend, rb)
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, "problem saving the purged buffer: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid purge method")
+	}
+}
+
+// handlePurgeRestore adds the batches of the purge given by the id query
+// parameter back to the retry buffer they were purged from
+func (a *Admin) handlePurgeRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid purge-restore method")
+		return
+	}
+
+	info, ok := a.purges.get(r.URL.Query().Get("id"))
+	if !ok {
+		jsonError(w, http.StatusNotFound, "unknown or expired purge")
+		return
+	}
+
+	rb, err := a.retryBufferOf(info.Relay, info.Backend)
+	if err != nil {
+		jsonError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	n, err := a.purges.restore(info, rb)
+	if err == ErrBufferFull {
+		jsonError(w, http.StatusServiceUnavailable, fmt.Sprintf("retry buffer full after %d batches, the others are kept to be restored later", n))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Restored %d purged batches to relay %q backend %q", n, info.Relay, info.Backend)
+	writeJSON(w, http.StatusOK, map[string]int{"batches": n})
+}
+
+// handleSubscriptions lists the subscribers registered at runtime and the
+// state of their pushes on GET, registers one from the relay, name, url,
+// databases and measurements query parameters on POST, the last two being
+// comma separated patterns, and removes the one given by relay and name on
+// DELETE
+func (a *Admin) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	if r.Method == "GET" {
+		subs := []subscriptionStatus{}
+		for _, relay := range a.s.relayList() {
+			h, ok := relay.(*HTTP)
+			if p, isShared := relay.(*sharedRelay); isShared {
+				h, ok = p.HTTP, true
+			}
+			if ok {
+				subs = append(subs, h.subscriptionStatus()...)
+			}
+		}
+		writeJSON(w, http.StatusOK, subs)
+		return
+	}
+
+	if r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid subscriptions method")
+		return
+	}
+
+	relay := a.s.GetRelay(queryParams.Get("relay"))
+	h, ok := relay.(*HTTP)
+	if p, isShared := relay.(*sharedRelay); isShared {
+		h, ok = p.HTTP, true
+	}
+	if !ok {
+		jsonError(w, http.StatusNotFound, "unknown http relay")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := h.unsubscribe(queryParams.Get("name")); err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("Removed the subscription %q of relay %q", queryParams.Get("name"), h.Name())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	info := subscriptionInfo{
+		Name:         queryParams.Get("name"),
+		URL:          queryParams.Get("url"),
+		Databases:    splitList(queryParams.Get("databases")),
+		Measurements: splitList(queryParams.Get("measurements")),
+	}
+	if err := h.subscribe(info); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	info.Relay = h.Name()
+	log.Printf("Added the subscription %q of relay %q to %s", info.Name, h.Name(), info.URL)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// splitList splits a comma separated query parameter, nil when empty
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "problem encoding response")
+		return
+	}
+	data = append(data, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,424 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// The points of the measurements of an aggregate rule are rolled up over a
+// window before they are written to the outputs of the rule, the other
+// points and outputs are unaffected. A window is written once its end is
+// older than the delay of the rule, a point arriving after that is dropped
+// as the rollup of its window was already written.
+
+const (
+	aggregateMean  = "mean"
+	aggregateMin   = "min"
+	aggregateMax   = "max"
+	aggregateSum   = "sum"
+	aggregateCount = "count"
+	aggregateLast  = "last"
+
+	DefaultAggregateDelay = 10 * time.Second
+
+	aggregateFlushInterval = time.Second
+)
+
+type aggregateRule struct {
+	measurement string
+	window      time.Duration
+	delay       time.Duration
+	function    string
+}
+
+func newAggregateRule(cfg AggregateConfig) (aggregateRule, error) {
+	r := aggregateRule{
+		measurement: cfg.Measurement,
+		delay:       DefaultAggregateDelay,
+		function:    cfg.Function,
+	}
+	if r.measurement == "" {
+		return r, errors.New("aggregate without measurement")
+	}
+	if _, err := path.Match(r.measurement, ""); err != nil {
+		return r, fmt.Errorf("invalid aggregate measurement pattern %q", r.measurement)
+	}
+
+	switch r.function {
+	case "":
+		r.function = aggregateMean
+	case aggregateMean, aggregateMin, aggregateMax, aggregateSum, aggregateCount, aggregateLast:
+	default:
+		return r, fmt.Errorf("unknown aggregate function %q", r.function)
+	}
+
+	d, err := time.ParseDuration(cfg.Window)
+	if err != nil || d <= 0 {
+		return r, fmt.Errorf("invalid aggregate window %q of measurement %q", cfg.Window, r.measurement)
+	}
+	r.window = d
+
+	if cfg.Delay != "" {
+		d, err := time.ParseDuration(cfg.Delay)
+		if err != nil || d < 0 {
+			return r, fmt.Errorf("invalid aggregate delay %q of measurement %q", cfg.Delay, r.measurement)
+		}
+		r.delay = d
+	}
+
+	if len(cfg.Outputs) == 0 {
+		return r, fmt.Errorf("aggregate of measurement %q without outputs", r.measurement)
+	}
+	return r, nil
+}
+
+// checkAggregates checks the aggregate rules of a relay, and returns the
+// rules of every output. An output can only have one rule per measurement.
+func checkAggregates(cfgs []AggregateConfig, outputs []HTTPOutputConfig) (map[string][]aggregateRule, error) {
+	names := make(map[string]bool)
+	for _, o := range outputs {
+		name := o.Name
+		if name == "" {
+			name = o.Location
+		}
+		names[name] = true
+	}
+
+	rules := make(map[string][]aggregateRule)
+	for _, cfg := range cfgs {
+		r, err := newAggregateRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range cfg.Outputs {
+			if !names[o] {
+				return nil, fmt.Errorf("aggregate of measurement %q to unknown output %q", r.measurement, o)
+			}
+			for _, other := range rules[o] {
+				if other.measurement == r.measurement {
+					return nil, fmt.Errorf("several aggregates of measurement %q to output %q", r.measurement, o)
+				}
+			}
+			rules[o] = append(rules[o], r)
+		}
+	}
+	return rules, nil
+}
+
+// aggregator rolls up the points written to a backend, see AggregateConfig
+type aggregator struct {
+	relay   string
+	backend string
+	rules   []aggregateRule
+	p       poster
+
+	mu      sync.Mutex
+	windows map[aggregateKey]*aggregateWindow
+
+	// points dropped as their window was already written
+	late int64
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// aggregateKey identifies a window, the query has no precision as the
+// rollups are written in nanoseconds
+type aggregateKey struct {
+	query string
+	auth  string
+	rule  int
+	start int64
+}
+
+type aggregateWindow struct {
+	series map[string]*aggregateSeries
+}
+
+type aggregateSeries struct {
+	name   string
+	tags   models.Tags
+	fields map[string]*aggregateField
+}
+
+type aggregateField struct {
+	count    int64
+	sum      float64
+	min, max float64
+	integer  bool
+	numeric  bool
+
+	last     interface{}
+	lastTime int64
+}
+
+func newAggregator(relay, backend string, rules []aggregateRule, p poster) *aggregator {
+	a := &aggregator{
+		relay:   relay,
+		backend: backend,
+		rules:   rules,
+		p:       p,
+		windows: make(map[aggregateKey]*aggregateWindow),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// rule returns the index of the rule of a measurement, -1 if none
+func (a *aggregator) rule(measurement string) int {
+	for i, r := range a.rules {
+		if ok, _ := path.Match(r.measurement, measurement); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// post adds the points of the measurements of the rules to their windows,
+// and writes the other ones right away. A write only made of aggregated
+// points is answered as if it was written.
+func (a *aggregator) post(pl *payload, query string, auth string) (*responseData, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	points, err := models.ParsePointsWithPrecision(pl.Bytes(), now, params.Get("precision"))
+	if err != nil {
+		return nil, err
+	}
+
+	params.Del("precision")
+	windowQuery := params.Encode()
+
+	var rest *bytes.Buffer
+	a.mu.Lock()
+	for _, p := range points {
+		i := a.rule(p.Name())
+		if i < 0 {
+			if rest == nil {
+				rest = getBuf()
+			}
+			writePoint(rest, p, "")
+			continue
+		}
+
+		r := a.rules[i]
+		start := p.UnixNano() - p.UnixNano()%int64(r.window)
+		if p.UnixNano() < 0 && p.UnixNano()%int64(r.window) != 0 {
+			start -= int64(r.window)
+		}
+		if now.After(time.Unix(0, start).Add(r.window + r.delay)) {
+			atomic.AddInt64(&a.late, 1)
+			continue
+		}
+
+		k := aggregateKey{query: windowQuery, auth: auth, rule: i, start: start}
+		w := a.windows[k]
+		if w == nil {
+			w = &aggregateWindow{series: make(map[string]*aggregateSeries)}
+			a.windows[k] = w
+		}
+		w.add(p)
+	}
+	a.mu.Unlock()
+
+	if rest == nil {
+		return &responseData{StatusCode: 204}, nil
+	}
+
+	// the other points are written in nanoseconds as well
+	rp := newPayload(rest)
+	defer rp.release()
+	return a.p.post(rp, windowQuery, auth)
+}
+
+func (w *aggregateWindow) add(p models.Point) {
+	key := string(p.Key())
+	s := w.series[key]
+	if s == nil {
+		s = &aggregateSeries{
+			name:   p.Name(),
+			tags:   p.Tags(),
+			fields: make(map[string]*aggregateField),
+		}
+		w.series[key] = s
+	}
+
+	t := p.UnixNano()
+	for k, v := range p.Fields() {
+		f := s.fields[k]
+		if f == nil {
+			f = &aggregateField{numeric: true, integer: true}
+			s.fields[k] = f
+		}
+		f.add(v, t)
+	}
+}
+
+func (f *aggregateField) add(v interface{}, t int64) {
+	if f.count == 0 || t >= f.lastTime {
+		f.last, f.lastTime = v, t
+	}
+
+	var x float64
+	switch v := v.(type) {
+	case int64:
+		x = float64(v)
+	case float64:
+		x = v
+		f.integer = false
+	default:
+		f.numeric = false
+	}
+
+	if f.count == 0 || x < f.min {
+		f.min = x
+	}
+	if f.count == 0 || x > f.max {
+		f.max = x
+	}
+	f.sum += x
+	f.count++
+}
+
+// value returns the rollup of the field by function, false when the field
+// can't be rolled up by it (e.g. the mean of a string field)
+func (f *aggregateField) value(function string) (interface{}, bool) {
+	switch function {
+	case aggregateLast:
+		return f.last, true
+	case aggregateCount:
+		return f.count, true
+	}
+
+	if !f.numeric {
+		return nil, false
+	}
+
+	var x float64
+	switch function {
+	case aggregateMean:
+		return f.sum / float64(f.count), true
+	case aggregateMin:
+		x = f.min
+	case aggregateMax:
+		x = f.max
+	case aggregateSum:
+		x = f.sum
+	}
+	if f.integer {
+		return int64(x), true
+	}
+	return x, true
+}
+
+func (a *aggregator) run() {
+	defer close(a.done)
+
+	t := time.NewTicker(aggregateFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			a.flush(now)
+		case <-a.closing:
+			return
+		}
+	}
+}
+
+// stop drops the windows not written yet once the relay is removed, and
+// waits for a flush in progress
+func (a *aggregator) stop() {
+	close(a.closing)
+	<-a.done
+}
+
+// flush writes the windows whose end is older than the delay of their rule
+func (a *aggregator) flush(now time.Time) {
+	a.mu.Lock()
+	due := make(map[aggregateKey]*aggregateWindow)
+	for k, w := range a.windows {
+		r := a.rules[k.rule]
+		if !now.Before(time.Unix(0, k.start).Add(r.window + r.delay)) {
+			due[k] = w
+			delete(a.windows, k)
+		}
+	}
+	a.mu.Unlock()
+
+	for k, w := range due {
+		buf := getBuf()
+		n := w.write(buf, a.rules[k.rule].function, k.start)
+		if n == 0 {
+			putBuf(buf)
+			continue
+		}
+
+		p := newPayload(buf)
+		resp, err := a.p.post(p, k.query, k.auth)
+		p.release()
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if err != nil {
+			log.Printf("Problem writing %d aggregated points of relay %q to backend %q: %v", n, a.relay, a.backend, err)
+		}
+	}
+}
+
+// write serializes the rollups of the window, timestamped with its start,
+// and returns their number
+func (w *aggregateWindow) write(buf *bytes.Buffer, function string, start int64) int {
+	n := 0
+	for _, s := range w.series {
+		fields := make(models.Fields, len(s.fields))
+		for k, f := range s.fields {
+			if v, ok := f.value(function); ok {
+				fields[k] = v
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		p, err := models.NewPoint(s.name, s.tags, fields, time.Unix(0, start))
+		if err != nil {
+			continue
+		}
+		writePoint(buf, p, "")
+		n++
+	}
+	return n
+}
+
+// aggregateStats is the state of an aggregating backend reported by /aggregates
+type aggregateStats struct {
+	Windows int   `json:"open_windows"`
+	Late    int64 `json:"late_points"`
+}
+
+func (a *aggregator) stats() aggregateStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return aggregateStats{
+		Windows: len(a.windows),
+		Late:    atomic.LoadInt64(&a.late),
+	}
+}
@@ -0,0 +1,219 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// tokenAuth checks the token presented by the writers of a relay, in the
+// Authorization header as "Token <token>" (InfluxDB 2 clients), "Bearer
+// <token>", or as the password of basic authentication or of the p query
+// parameter (InfluxDB 1 clients, whatever the user name)
+type tokenAuth struct {
+	tokens [][]byte
+	// grant of every token, nil for the tokens allowed to write anywhere
+	grants []*authGrant
+
+	// checks the credentials against a backend, nil unless verify-backend
+	// is set. They're accepted when either the tokens or the backend accept them.
+	verifier *credentialVerifier
+
+	// forward the Authorization header of the clients to the backends
+	forward bool
+}
+
+// newTokenAuth returns nil when the relay doesn't authenticate its writers
+func newTokenAuth(cfg AuthConfig, outputs []HTTPOutputConfig) (*tokenAuth, error) {
+	if len(cfg.Tokens) == 0 && cfg.TokenFile == "" && cfg.VerifyBackend == "" {
+		return nil, nil
+	}
+
+	a := &tokenAuth{forward: cfg.ForwardAuthorization}
+	if cfg.VerifyBackend != "" {
+		v, err := newCredentialVerifier(cfg, outputs)
+		if err != nil {
+			return nil, err
+		}
+		a.verifier = v
+	}
+
+	for _, t := range cfg.Tokens {
+		if t == "" {
+			return nil, errors.New("empty auth token")
+		}
+		a.add(t, nil)
+	}
+
+	for _, g := range cfg.Grants {
+		grant, err := newAuthGrant(g.Databases, g.Measurements)
+		if err != nil {
+			return nil, err
+		}
+		if g.Token == "" {
+			return nil, errors.New("auth grant without token")
+		}
+		a.add(g.Token, grant)
+	}
+
+	if cfg.TokenFile != "" {
+		f, err := os.Open(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		// one token per line, optionally followed by the comma separated
+		// databases it's allowed to write to. Blank lines and comments are
+		// skipped.
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+
+			var grant *authGrant
+			if len(fields) > 1 {
+				g, err := newAuthGrant(strings.Split(fields[1], ","), nil)
+				if err != nil {
+					return nil, err
+				}
+				grant = g
+			}
+			a.add(fields[0], grant)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.tokens) == 0 && a.verifier == nil {
+		return nil, errors.New("no auth token")
+	}
+	return a, nil
+}
+
+func (a *tokenAuth) add(token string, grant *authGrant) {
+	a.tokens = append(a.tokens, []byte(token))
+	a.grants = append(a.grants, grant)
+}
+
+// measurements reports whether a grant restricts the measurements, which
+// requires the points of the writes to be parsed
+func (a *tokenAuth) measurements() bool {
+	for _, g := range a.grants {
+		if g != nil && len(g.measurements) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// authGrant restricts the databases and measurements a token can write to,
+// as path.Match patterns, any when empty
+type authGrant struct {
+	databases    []string
+	measurements []string
+}
+
+func newAuthGrant(databases, measurements []string) (*authGrant, error) {
+	for _, p := range append(append([]string(nil), databases...), measurements...) {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return nil, fmt.Errorf("invalid auth grant pattern %q", p)
+		}
+	}
+	return &authGrant{databases: databases, measurements: measurements}, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowDatabase reports whether the grant allows writing to db, a nil grant
+// allows everything
+func (g *authGrant) allowDatabase(db string) bool {
+	return g == nil || matchAny(g.databases, db)
+}
+
+// allowPoints returns the first point the grant doesn't allow, nil if none
+func (g *authGrant) allowPoints(points []models.Point) models.Point {
+	if g == nil || len(g.measurements) == 0 {
+		return nil
+	}
+	for _, p := range points {
+		if !matchAny(g.measurements, p.Name()) {
+			return p
+		}
+	}
+	return nil
+}
+
+// presentedToken returns the token of the Authorization header of r, or of
+// its p query parameter
+func presentedToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return r.URL.Query().Get("p")
+	}
+
+	i := strings.IndexByte(h, ' ')
+	if i < 0 {
+		return ""
+	}
+
+	scheme, value := h[:i], strings.TrimSpace(h[i+1:])
+	switch {
+	case strings.EqualFold(scheme, "Token"), strings.EqualFold(scheme, "Bearer"):
+		return value
+	case strings.EqualFold(scheme, "Basic"):
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return ""
+		}
+		if j := strings.IndexByte(string(data), ':'); j >= 0 {
+			return string(data[j+1:])
+		}
+	}
+	return ""
+}
+
+// allow reports whether r presents one of the tokens, every token is
+// compared in constant time, or else credentials accepted by the backend,
+// and returns the grant of the token, nil when it isn't restricted. The
+// error is errVerifyUnavailable when the backend couldn't tell.
+func (a *tokenAuth) allow(r *http.Request) (*authGrant, bool, error) {
+	if t := []byte(presentedToken(r)); len(t) > 0 {
+		match := -1
+		for i, token := range a.tokens {
+			if subtle.ConstantTimeCompare(t, token) == 1 {
+				match = i
+			}
+		}
+		if match >= 0 {
+			return a.grants[match], true, nil
+		}
+	}
+
+	if a.verifier == nil {
+		return nil, false, nil
+	}
+	ok, err := a.verifier.verify(r)
+	return nil, ok, err
+}
@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultVerifyCacheTTL = time.Minute
+
+	verifyTimeout = 5 * time.Second
+
+	// the cache is swept of its expired entries when it grows over this
+	verifyCacheSweepSize = 1024
+
+	// the cache never holds more entries than this, the rejected ones are
+	// dropped first when it's full of valid ones, then every entry, so that
+	// a client trying bogus credentials can't grow it without bound
+	verifyCacheMaxSize = 16384
+
+	// the rejected credentials are cached for at most this long, a user
+	// just created upstream isn't refused for the whole ttl
+	verifyRejectedTTL = 10 * time.Second
+)
+
+var errVerifyUnavailable = errors.New("unable to verify credentials")
+
+// credentialVerifier checks the credentials of the writers against an
+// InfluxDB backend, with a query they must be allowed to run. The outcome
+// is cached for ttl per credentials, so that revoking a user upstream takes
+// effect at the relay within ttl without a round trip per write, and the
+// rejections for verifyRejectedTTL at most.
+type credentialVerifier struct {
+	client   *http.Client
+	location string
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]verifyEntry
+}
+
+type verifyEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+func newCredentialVerifier(cfg AuthConfig, outputs []HTTPOutputConfig) (*credentialVerifier, error) {
+	var output *HTTPOutputConfig
+	for i := range outputs {
+		if outputs[i].Name == cfg.VerifyBackend || outputs[i].Name == "" && outputs[i].Location == cfg.VerifyBackend {
+			output = &outputs[i]
+			break
+		}
+	}
+	if output == nil {
+		return nil, fmt.Errorf("unknown verify-backend %q", cfg.VerifyBackend)
+	}
+	if output.Type != "" && output.Type != "influxdb" {
+		return nil, fmt.Errorf("verify-backend %q isn't an influxdb output", cfg.VerifyBackend)
+	}
+
+	u, err := url.Parse(output.Location)
+	if err != nil {
+		return nil, err
+	}
+	// the query endpoint next to the write one
+	u.Path = strings.TrimSuffix(u.Path, "write") + "query"
+	u.RawQuery = url.Values{"q": {"SHOW DATABASES"}}.Encode()
+
+	ttl := DefaultVerifyCacheTTL
+	if cfg.VerifyCacheTTL != "" {
+		d, err := time.ParseDuration(cfg.VerifyCacheTTL)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid verify-cache-ttl %q", cfg.VerifyCacheTTL)
+		}
+		ttl = d
+	}
+
+	tc, err := newTransportConfig(output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credentialVerifier{
+		client:   &http.Client{Timeout: verifyTimeout, Transport: sharedTransport(tc)},
+		location: u.String(),
+		ttl:      ttl,
+		cache:    make(map[[sha256.Size]byte]verifyEntry),
+	}, nil
+}
+
+// verify reports whether the credentials of r are accepted by the backend,
+// errVerifyUnavailable when the backend couldn't tell
+func (v *credentialVerifier) verify(r *http.Request) (bool, error) {
+	auth := r.Header.Get("Authorization")
+	query := r.URL.Query()
+	user, pass := query.Get("u"), query.Get("p")
+	if auth == "" && user == "" && pass == "" {
+		return false, nil
+	}
+
+	key := sha256.Sum256([]byte(auth + "\x00" + user + "\x00" + pass))
+	now := time.Now()
+
+	v.mu.Lock()
+	e, cached := v.cache[key]
+	v.mu.Unlock()
+	if cached && now.Before(e.expires) {
+		return e.ok, nil
+	}
+
+	ok, err := v.ask(auth, user, pass)
+	if err != nil {
+		return false, err
+	}
+
+	ttl := v.ttl
+	if !ok && ttl > verifyRejectedTTL {
+		ttl = verifyRejectedTTL
+	}
+
+	v.mu.Lock()
+	if len(v.cache) >= verifyCacheSweepSize {
+		v.evict(func(e verifyEntry) bool { return !now.Before(e.expires) })
+	}
+	if len(v.cache) >= verifyCacheMaxSize {
+		v.evict(func(e verifyEntry) bool { return !e.ok })
+	}
+	if len(v.cache) >= verifyCacheMaxSize {
+		v.cache = make(map[[sha256.Size]byte]verifyEntry)
+	}
+	v.cache[key] = verifyEntry{ok: ok, expires: now.Add(ttl)}
+	v.mu.Unlock()
+
+	return ok, nil
+}
+
+// evict drops the entries of the cache matching drop, v.mu must be held
+func (v *credentialVerifier) evict(drop func(verifyEntry) bool) {
+	for k, e := range v.cache {
+		if drop(e) {
+			delete(v.cache, k)
+		}
+	}
+}
+
+// ask runs the query with the credentials, a 401 or 403 rejects them
+func (v *credentialVerifier) ask(auth, user, pass string) (bool, error) {
+	req, err := http.NewRequest("GET", v.location, nil)
+	if err != nil {
+		return false, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if user != "" || pass != "" {
+		q := req.URL.Query()
+		q.Set("u", user)
+		q.Set("p", pass)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, errVerifyUnavailable
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, errVerifyUnavailable
+}
@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// classes of backend failures, used to label the error counters and logs
+const (
+	errClassTimeout    = "timeout"
+	errClassRefused    = "connection_refused"
+	errClassDNS        = "dns"
+	errClassTLS        = "tls"
+	errClassNetwork    = "network"
+	errClassBufferFull = "buffer_full"
+	errClassOther      = "other"
+
+	// buffered batches dropped after a status which isn't retried
+	errClassRejected = "rejected_batches"
+)
+
+// classifyError returns the class of an error returned by a poster
+func classifyError(err error) string {
+	if err == ErrBufferFull || err == errBufferEvicted {
+		return errClassBufferFull
+	}
+
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errClassTimeout
+	}
+
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, tls.RecordHeaderError:
+		return errClassTLS
+	case *net.DNSError:
+		return errClassDNS
+	case *net.OpError:
+		if se, ok := e.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return errClassRefused
+		}
+		if e.Op == "remote error" {
+			return errClassTLS
+		}
+		return errClassNetwork
+	}
+
+	if strings.HasPrefix(err.Error(), "tls:") {
+		return errClassTLS
+	}
+	return errClassOther
+}
+
+// isTransient reports whether err is a network error a new attempt is likely
+// to get past right away: a refused or reset connection, or a keep-alive
+// connection closed by the backend
+func isTransient(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			switch se.Err {
+			case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classifyStatus returns the class of a non-2xx response status
+func classifyStatus(code int) string {
+	switch code {
+	case 500, 502, 503, 504:
+		return fmt.Sprintf("http_%d", code)
+	}
+	return fmt.Sprintf("http_%dxx", code/100)
+}
+
+// backendErrors counts the failures of a backend per class, and throttles
+// their logging when logInterval is set. It keeps the time of the last post
+// which succeeded and of the last one which failed as well.
+type backendErrors struct {
+	logInterval time.Duration
+
+	mu         sync.Mutex
+	counts     map[string]int64
+	lastLog    map[string]time.Time
+	suppressed map[string]int64
+
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+func newBackendErrors(logInterval time.Duration) *backendErrors {
+	return &backendErrors{
+		logInterval: logInterval,
+		counts:      make(map[string]int64),
+		lastLog:     make(map[string]time.Time),
+		suppressed:  make(map[string]int64),
+	}
+}
+
+// observe accounts for the outcome of a post made by relay to backend b.
+// Errors and 5xx responses are logged, 4xx responses are only counted as
+// they're answered to the client.
+func (b *httpBackend) observe(relay string, resp *responseData, err error) {
+	b.observeSkew(relay, resp)
+
+	var class string
+	var status int
+	switch {
+	case err != nil:
+		class = classifyError(err)
+	case resp.StatusCode/100 != 2:
+		class = classifyStatus(resp.StatusCode)
+		status = resp.StatusCode
+	default:
+		b.errors.mu.Lock()
+		b.errors.lastSuccess = time.Now()
+		b.errors.mu.Unlock()
+		return
+	}
+
+	e := b.errors
+	e.mu.Lock()
+	e.counts[class]++
+	e.lastFailure = time.Now()
+
+	if status/100 == 4 {
+		e.mu.Unlock()
+		return
+	}
+
+	var suppressed int64
+	if e.logInterval > 0 {
+		now := time.Now()
+		if now.Sub(e.lastLog[class]) < e.logInterval {
+			e.suppressed[class]++
+			e.mu.Unlock()
+			return
+		}
+		e.lastLog[class] = now
+		suppressed = e.suppressed[class]
+		e.suppressed[class] = 0
+	}
+	e.mu.Unlock()
+
+	msg := fmt.Sprintf("Problem posting to relay %q backend %q: class=%s status=%d suppressed=%d", relay, b.name, class, status, suppressed)
+	if err != nil {
+		msg += fmt.Sprintf(" error=%q", err.Error())
+	}
+	log.Print(msg)
+}
+
+// errorCounts returns a copy of the counters of the backend, plus the
+// batches dropped by its retry buffer
+func (b *httpBackend) errorCounts() map[string]int64 {
+	b.errors.mu.Lock()
+	defer b.errors.mu.Unlock()
+
+	counts := make(map[string]int64, len(b.errors.counts))
+	for k, v := range b.errors.counts {
+		counts[k] = v
+	}
+	if rb, ok := b.poster.(*retryBuffer); ok {
+		if n := atomic.LoadInt64(&rb.rejected); n > 0 {
+			counts[errClassRejected] = n
+		}
+	}
+	return counts
+}
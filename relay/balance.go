@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// modes of an HTTP relay: every write is mirrored to all the backends, or
+// written to a single one picked in turn or with the fewest writes in
+// flight
+const (
+	modeMirror      = "mirror"
+	modeRoundRobin  = "round-robin"
+	modeLeastLoaded = "least-loaded"
+
+	// an unhealthy backend is given a write every balanceProbeInterval, to
+	// find out whether it's back
+	balanceProbeInterval = 10 * time.Second
+)
+
+func checkMode(mode string) error {
+	switch mode {
+	case "", modeMirror, modeRoundRobin, modeLeastLoaded:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// balancer picks the backend of every write of a relay which isn't
+// mirrored, among the available ones, or among all of them when none is
+type balancer struct {
+	mode string
+	next uint64
+}
+
+// newBalancer returns nil when the writes are mirrored
+func newBalancer(mode string) (*balancer, error) {
+	if err := checkMode(mode); err != nil {
+		return nil, err
+	}
+	if mode == "" || mode == modeMirror {
+		return nil, nil
+	}
+	return &balancer{mode: mode}, nil
+}
+
+// pick returns the backend a write goes to, as a slice of backends
+func (lb *balancer) pick(backends []*httpBackend, now time.Time) []*httpBackend {
+	if len(backends) <= 1 {
+		return backends
+	}
+	return lb.pickTurn(backends, now, atomic.AddUint64(&lb.next, 1))
+}
+
+// peek returns the backend pick would return for the next write, without
+// moving on to the next turn
+func (lb *balancer) peek(backends []*httpBackend, now time.Time) []*httpBackend {
+	if len(backends) <= 1 {
+		return backends
+	}
+	return lb.pickTurn(backends, now, atomic.LoadUint64(&lb.next)+1)
+}
+
+func (lb *balancer) pickTurn(backends []*httpBackend, now time.Time, turn uint64) []*httpBackend {
+	// indexes of the available backends, or of all of them when none is
+	var scratch [16]int
+	avail := scratch[:0]
+	for i, b := range backends {
+		if b.available(now) {
+			avail = append(avail, i)
+		}
+	}
+	if len(avail) == 0 {
+		for i := range backends {
+			avail = append(avail, i)
+		}
+	}
+
+	// the ties of least-loaded are broken in turn as well
+	start := int(turn % uint64(len(avail)))
+	best := avail[start]
+	if lb.mode == modeLeastLoaded {
+		for j := 1; j < len(avail); j++ {
+			k := avail[(start+j)%len(avail)]
+			if atomic.LoadInt64(&backends[k].inflight) < atomic.LoadInt64(&backends[best].inflight) {
+				best = k
+			}
+		}
+	}
+	return backends[best : best+1]
+}
+
+// available reports whether a backend can be given a write: it's healthy,
+// or its last failure is old enough for it to be probed again. A buffering
+// backend is only available once its buffer is drained.
+func (b *httpBackend) available(now time.Time) bool {
+	if rb, ok := b.poster.(*retryBuffer); ok && rb.isBuffering() {
+		return false
+	}
+
+	b.errors.mu.Lock()
+	defer b.errors.mu.Unlock()
+	return !b.errors.lastFailure.After(b.errors.lastSuccess) ||
+		now.Sub(b.errors.lastFailure) >= balanceProbeInterval
+}
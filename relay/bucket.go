@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// v2WritePath is the write endpoint of InfluxDB 2, served by InfluxDB 1.8
+// as well for the clients configured for 2.x
+const v2WritePath = "/api/v2/write"
+
+// bucketMap translates the bucket and org parameters of the writes of the
+// clients configured for InfluxDB 2 into the database and retention policy
+// of the 1.x backends. The buckets without mapping follow the convention of
+// InfluxDB 1.8, "db/rp" or "db" for the default retention policy.
+type bucketMap []bucketMapping
+
+type bucketMapping struct {
+	bucket string
+	org    string
+	db     string
+	rp     string
+}
+
+func newBucketMap(cfgs []BucketMapConfig) (bucketMap, error) {
+	var m bucketMap
+	seen := make(map[[2]string]bool)
+	for _, c := range cfgs {
+		if c.Bucket == "" {
+			return nil, errors.New("bucket-map without bucket")
+		}
+		if c.Database == "" {
+			return nil, fmt.Errorf("bucket-map of bucket %q without database", c.Bucket)
+		}
+		k := [2]string{c.Bucket, c.Org}
+		if seen[k] {
+			return nil, fmt.Errorf("duplicate bucket-map of bucket %q and org %q", c.Bucket, c.Org)
+		}
+		seen[k] = true
+
+		m = append(m, bucketMapping{bucket: c.Bucket, org: c.Org, db: c.Database, rp: c.RetentionPolicy})
+	}
+	return m, nil
+}
+
+// lookup returns the mapping of a bucket of org, the ones for any org coming
+// after those of the org
+func (m bucketMap) lookup(bucket, org string) *bucketMapping {
+	var any *bucketMapping
+	for i := range m {
+		b := &m[i]
+		switch {
+		case b.bucket != bucket:
+		case b.org == org:
+			return b
+		case b.org == "" && any == nil:
+			any = b
+		}
+	}
+	return any
+}
+
+// translate replaces the bucket, org and precision parameters of a write
+// with the db, rp and precision of InfluxDB 1.x
+func (m bucketMap) translate(params url.Values) error {
+	bucket := params.Get("bucket")
+	if bucket == "" {
+		return errors.New("missing parameter: bucket")
+	}
+
+	org := params.Get("org")
+	if org == "" {
+		org = params.Get("orgID")
+	}
+
+	db, rp := bucket, ""
+	if b := m.lookup(bucket, org); b != nil {
+		db, rp = b.db, b.rp
+	} else if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		db, rp = bucket[:i], bucket[i+1:]
+	}
+
+	params.Set("db", db)
+	if rp != "" {
+		params.Set("rp", rp)
+	} else {
+		params.Del("rp")
+	}
+
+	params.Del("bucket")
+	params.Del("org")
+	params.Del("orgID")
+
+	switch params.Get("precision") {
+	case "ns":
+		params.Set("precision", "n")
+	case "us":
+		params.Set("precision", "u")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// The utilization of a retry buffer is compared to the warning and critical
+// thresholds of its backend as writes are buffered and replayed, so that an
+// outage is noticed before the buffer is full and the writes are rejected.
+
+const (
+	DefaultBufferWarningPercent  = 80
+	DefaultBufferCriticalPercent = 95
+
+	// a buffer only goes back to a lower level once its utilization is that
+	// many points under the threshold, so that a buffer hovering around a
+	// threshold doesn't flood the logs
+	bufferLevelHysteresis = 5
+)
+
+// levels of a retry buffer
+const (
+	bufferLevelOK int32 = iota
+	bufferLevelWarning
+	bufferLevelCritical
+)
+
+var bufferLevelNames = [...]string{"ok", "warning", "critical"}
+
+func checkBufferThresholds(warning, critical float64) error {
+	if warning == 0 {
+		warning = DefaultBufferWarningPercent
+	}
+	if critical == 0 {
+		critical = DefaultBufferCriticalPercent
+	}
+	if warning < 0 || critical < 0 || critical > 100 {
+		return fmt.Errorf("buffer thresholds %v%% and %v%% not between 0 and 100", warning, critical)
+	}
+	if warning >= critical {
+		return fmt.Errorf("buffer-warning-percent %v not under buffer-critical-percent %v", warning, critical)
+	}
+	return nil
+}
+
+// levelOf returns the highest level whose threshold percent reaches
+func (r *retryBuffer) levelOf(percent float64) int32 {
+	switch {
+	case percent >= r.criticalPercent:
+		return bufferLevelCritical
+	case percent >= r.warningPercent:
+		return bufferLevelWarning
+	}
+	return bufferLevelOK
+}
+
+// utilization returns the size of the buffered batches, in percent of the
+// size of the buffer
+func (r *retryBuffer) utilization() float64 {
+	r.list.cond.L.Lock()
+	size := r.list.size
+	r.list.cond.L.Unlock()
+
+	return float64(size) * 100 / float64(r.maxBuffered)
+}
+
+// bufferLevel returns the current level of the buffer
+func (r *retryBuffer) bufferLevel() int32 {
+	return atomic.LoadInt32(&r.level)
+}
+
+// checkLevel updates the level of the buffer after its size changed, and
+// logs the transitions
+func (r *retryBuffer) checkLevel() {
+	percent := r.utilization()
+
+	old := atomic.LoadInt32(&r.level)
+	level := old
+	if up := r.levelOf(percent); up > old {
+		level = up
+	} else if down := r.levelOf(percent + bufferLevelHysteresis); down < old {
+		level = down
+	}
+	if level == old || !atomic.CompareAndSwapInt32(&r.level, old, level) {
+		return
+	}
+
+	if level > old {
+		threshold := r.warningPercent
+		if level == bufferLevelCritical {
+			threshold = r.criticalPercent
+		}
+		log.Printf("Retry buffer of backend %q is %.0f%% full, over its %s threshold of %v%%", r.name, percent, bufferLevelNames[level], threshold)
+		return
+	}
+	log.Printf("Retry buffer of backend %q is back to %.0f%% full, under its %s threshold", r.name, percent, bufferLevelNames[level+1])
+}
@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	DefaultPoolMaxBufferKB = 1024
+	DefaultPoolSizeMB      = 64
+)
+
+// bufferPool keeps the released buffers for reuse, up to a total capacity.
+// Unlike a sync.Pool, it doesn't keep the huge buffers of a burst of large
+// requests around: the buffers larger than maxBuffer are left to the GC,
+// so that the memory of the relay shrinks back once the burst is over.
+type bufferPool struct {
+	mu        sync.Mutex
+	free      []*bytes.Buffer
+	size      int
+	maxSize   int
+	maxBuffer int
+
+	// buffers taken from the pool or allocated, and released ones dropped
+	hits, misses, dropped int64
+}
+
+var bufPool = &bufferPool{
+	maxSize:   DefaultPoolSizeMB * MB,
+	maxBuffer: DefaultPoolMaxBufferKB * KB,
+}
+
+// configureBufPool sets the limits of the buffer pool, the buffers it holds
+// over them are dropped
+func configureBufPool(cfg BufferPoolConfig) {
+	p := bufPool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxSize, p.maxBuffer = DefaultPoolSizeMB*MB, DefaultPoolMaxBufferKB*KB
+	if cfg.SizeMB > 0 {
+		p.maxSize = cfg.SizeMB * MB
+	}
+	if cfg.MaxBufferKB > 0 {
+		p.maxBuffer = cfg.MaxBufferKB * KB
+	}
+
+	kept := p.free[:0]
+	p.size = 0
+	for _, b := range p.free {
+		if b.Cap() <= p.maxBuffer && p.size+b.Cap() <= p.maxSize {
+			kept = append(kept, b)
+			p.size += b.Cap()
+		}
+	}
+	for i := len(kept); i < len(p.free); i++ {
+		p.free[i] = nil
+	}
+	p.free = kept
+}
+
+func (p *bufferPool) get() *bytes.Buffer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.free)
+	if n == 0 {
+		p.misses++
+		return new(bytes.Buffer)
+	}
+
+	b := p.free[n-1]
+	p.free[n-1] = nil
+	p.free = p.free[:n-1]
+	p.size -= b.Cap()
+	p.hits++
+	return b
+}
+
+func (p *bufferPool) put(b *bytes.Buffer) {
+	b.Reset()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if b.Cap() > p.maxBuffer || p.size+b.Cap() > p.maxSize {
+		p.dropped++
+		return
+	}
+	p.free = append(p.free, b)
+	p.size += b.Cap()
+}
+
+// bufferPoolStats is the state of the buffer pool reported by /buffer-pool
+type bufferPoolStats struct {
+	Buffers int   `json:"pooled_buffers"`
+	Bytes   int   `json:"pooled_bytes"`
+	MaxSize int   `json:"max_bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Dropped int64 `json:"dropped"`
+}
+
+func (p *bufferPool) stats() bufferPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return bufferPoolStats{
+		Buffers: len(p.free),
+		Bytes:   p.size,
+		MaxSize: p.maxSize,
+		Hits:    p.hits,
+		Misses:  p.misses,
+		Dropped: p.dropped,
+	}
+}
+
+// 返回字节缓冲池
+func getBuf() *bytes.Buffer {
+	return bufPool.get()
+}
+
+func putBuf(b *bytes.Buffer) {
+	bufPool.put(b)
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cidrList is a list of networks, single addresses being taken as /32 or
+// /128 networks
+type cidrList []*net.IPNet
+
+func newCIDRList(cidrs []string) (cidrList, error) {
+	var l cidrList
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			l = append(l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+func (l cidrList) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of r, without port. When
+// the request comes from a trusted proxy the client is the last address of
+// X-Forwarded-For which isn't a trusted proxy, or X-Real-IP.
+func (h *HTTP) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	if len(h.trustedProxies) == 0 || !h.trustedProxies.contains(addr) {
+		return addr
+	}
+
+	if xff := r.Header["X-Forwarded-For"]; len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// a proxy we don't know about, don't trust what's before
+				return addr
+			}
+			addr = hop
+			if !h.trustedProxies.contains(hop) {
+				return addr
+			}
+		}
+		return addr
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return addr
+}
@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// clientAuth holds the verification of the client certificates of an
+// HTTPS listener, disabled when caFile is empty
+type clientAuth struct {
+	caFile  string
+	require bool
+}
+
+func newClientAuth(cfg HTTPConfig, cert serverCert) (clientAuth, error) {
+	c := clientAuth{caFile: cfg.SSLClientCA, require: cfg.SSLRequireClientCert}
+
+	if c.caFile == "" && (c.require || len(cfg.SSLAllowedCNs) > 0) {
+		return c, errors.New("ssl-require-client-cert and ssl-allowed-cn require ssl-client-ca")
+	}
+	if c.caFile != "" && !cert.enabled() {
+		return c, errors.New("ssl-client-ca requires ssl-combined-pem or ssl-cert")
+	}
+	return c, nil
+}
+
+// tlsConfig returns the configuration of a listener presenting cert, and
+// the release of its certificate, see serverCert.getter
+func (c clientAuth) tlsConfig(cert serverCert) (*tls.Config, func(), error) {
+	get, release, err := cert.getter()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := &tls.Config{
+		GetCertificate: get,
+	}
+
+	if c.caFile != "" {
+		data, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			release()
+			return nil, nil, fmt.Errorf("no certificate found in %q", c.caFile)
+		}
+
+		t.ClientCAs = pool
+		t.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.require {
+			t.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return t, release, nil
+}
+
+// allowedCNs is the set of common names of the client certificates allowed
+// to write through a relay
+type allowedCNs map[string]bool
+
+func newAllowedCNs(cns []string) allowedCNs {
+	if len(cns) == 0 {
+		return nil
+	}
+
+	a := make(allowedCNs)
+	for _, cn := range cns {
+		a[cn] = true
+	}
+	return a
+}
+
+// allow reports whether the connection presented a verified certificate
+// with an allowed common name
+func (a allowedCNs) allow(state *tls.ConnectionState) bool {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return false
+	}
+	return a[state.VerifiedChains[0][0].Subject.CommonName]
+}
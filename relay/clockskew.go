@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// clockSkew keeps the last clock offset measured for a backend from the Date
+// header of its responses. Crossing the threshold in either direction is
+// logged once, and counted as a warning when the offset goes over it.
+type clockSkew struct {
+	threshold time.Duration
+
+	skew     int64 // time.Duration
+	known    int32
+	over     int32
+	warnings int64
+}
+
+func newClockSkew(threshold time.Duration) *clockSkew {
+	return &clockSkew{threshold: threshold}
+}
+
+// measureSkew returns the offset of the clock of the server which answered
+// a request sent and received at the given times, compared to the middle of
+// the round trip. The Date header has a resolution of a second, the offset
+// is taken from the middle of that second.
+func measureSkew(h http.Header, sent, received time.Time) (time.Duration, bool) {
+	d, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+
+	mid := sent.Add(received.Sub(sent) / 2)
+	return d.Add(500 * time.Millisecond).Sub(mid), true
+}
+
+// observeSkew accounts for the clock offset measured in resp, if any
+func (b *httpBackend) observeSkew(relay string, resp *responseData) {
+	if resp == nil || !resp.SkewKnown {
+		return
+	}
+
+	c := b.skew
+	atomic.StoreInt64(&c.skew, int64(resp.Skew))
+	atomic.StoreInt32(&c.known, 1)
+	if c.threshold <= 0 {
+		return
+	}
+
+	abs := resp.Skew
+	if abs < 0 {
+		abs = -abs
+	}
+
+	switch {
+	case abs > c.threshold && atomic.CompareAndSwapInt32(&c.over, 0, 1):
+		atomic.AddInt64(&c.warnings, 1)
+		log.Printf("Clock of relay %q backend %q is off by %v, over the %v threshold: timestamps set by the backend will differ from the relay", relay, b.name, resp.Skew, c.threshold)
+	case abs <= c.threshold && atomic.CompareAndSwapInt32(&c.over, 1, 0):
+		log.Printf("Clock of relay %q backend %q is back within %v, off by %v", relay, b.name, c.threshold, resp.Skew)
+	}
+}
+
+// clockSkewInfo is the clock offset of a backend reported by /clock-skew
+type clockSkewInfo struct {
+	Known         bool    `json:"known"`
+	SkewSeconds   float64 `json:"skew_seconds"`
+	OverThreshold bool    `json:"over_threshold"`
+	Warnings      int64   `json:"warnings"`
+}
+
+func (c *clockSkew) info() clockSkewInfo {
+	return clockSkewInfo{
+		Known:         atomic.LoadInt32(&c.known) != 0,
+		SkewSeconds:   time.Duration(atomic.LoadInt64(&c.skew)).Seconds(),
+		OverThreshold: atomic.LoadInt32(&c.over) != 0,
+		Warnings:      atomic.LoadInt64(&c.warnings),
+	}
+}
@@ -0,0 +1,454 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	DefaultCollectdFlushInterval = time.Second
+	DefaultCollectdBatchSizeKB   = 64
+)
+
+// collectd network protocol part types,
+// see https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	collectdHost           = 0x0000
+	collectdTime           = 0x0001
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+	collectdTimeHR         = 0x0008
+	collectdEncryption     = 0x0210
+)
+
+// collectd data source types
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+var (
+	errCollectdMalformed = errors.New("malformed collectd packet")
+	errCollectdEncrypted = errors.New("encrypted collectd packets are not supported")
+)
+
+// Collectd is a relay for the collectd binary network protocol,
+// values are converted to line protocol and written to HTTP backends
+type Collectd struct {
+	addr  string
+	name  string
+	query string
+
+	// data source names per type, read from types.db
+	types map[string][]string
+
+	batchSize     int
+	flushInterval time.Duration
+
+	closing int64
+	l       *net.UDPConn
+
+	backends []*httpBackend
+}
+
+func NewCollectd(cfg CollectdConfig) (Relay, error) {
+	c := new(Collectd)
+
+	c.name = cfg.Name
+	c.addr = cfg.Addr
+
+	if cfg.Database == "" {
+		return nil, fmt.Errorf("collectd relay %q is missing a database", c.Name())
+	}
+
+	q := url.Values{}
+	q.Set("db", cfg.Database)
+	if cfg.RetentionPolicy != "" {
+		q.Set("rp", cfg.RetentionPolicy)
+	}
+	c.query = q.Encode()
+
+	c.types = make(map[string][]string)
+	if cfg.TypesDB != "" {
+		f, err := os.Open(cfg.TypesDB)
+		if err != nil {
+			return nil, err
+		}
+		c.types, err = parseTypesDB(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing types.db %q: %v", cfg.TypesDB, err)
+		}
+	}
+
+	c.batchSize = DefaultCollectdBatchSizeKB * KB
+	if cfg.BatchSizeKB > 0 {
+		c.batchSize = cfg.BatchSizeKB * KB
+	}
+
+	c.flushInterval = DefaultCollectdFlushInterval
+	if cfg.FlushInterval != "" {
+		d, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing flush interval '%v'", err)
+		}
+		c.flushInterval = d
+	}
+
+	for i := range cfg.Outputs {
+		backend, err := newHTTPBackend(&cfg.Outputs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		c.backends = append(c.backends, backend)
+	}
+
+	l, err := net.ListenPacket("udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ul, ok := l.(*net.UDPConn)
+	if !ok {
+		return nil, errors.New("problem listening for UDP")
+	}
+
+	if cfg.ReadBuffer != 0 {
+		if err := ul.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			return nil, err
+		}
+	}
+
+	c.l = ul
+
+	return c, nil
+}
+
+func (c *Collectd) Name() string {
+	if c.name == "" {
+		return c.addr
+	}
+	return c.name
+}
+
+func (c *Collectd) Run() error {
+	// buffer that can hold the largest possible UDP payload
+	var buf [65536]byte
+
+	queue := make(chan packet, 1024)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.process(queue)
+	}()
+
+	log.Printf("Starting collectd relay %q on %v", c.Name(), c.l.LocalAddr())
+
+	for {
+		n, remote, err := c.l.ReadFromUDP(buf[:])
+		if err != nil {
+			if atomic.LoadInt64(&c.closing) == 0 {
+				log.Printf("Error reading packet in relay %q from %v: %v", c.Name(), remote, err)
+			} else {
+				err = nil
+			}
+			close(queue)
+			<-done
+			return err
+		}
+
+		b := getUDPBuf()
+		b.Grow(n)
+		_, _ = b.Write(buf[:n])
+		queue <- packet{time.Now(), b, remote}
+	}
+}
+
+func (c *Collectd) httpBackends() []*httpBackend {
+	return c.backends
+}
+
+func (c *Collectd) Stop() error {
+	atomic.StoreInt64(&c.closing, 1)
+	return c.l.Close()
+}
+
+// process converts the queued packets and writes them to the backends in
+// batches, whenever the batch grows past batchSize or every flushInterval
+func (c *Collectd) process(queue <-chan packet) {
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	out := getBuf()
+	for {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				c.flush(out)
+				return
+			}
+
+			if err := c.convert(p.data.Bytes(), p.timestamp, out); err != nil {
+				log.Printf("Error parsing packet in relay %q from %v: %v", c.Name(), p.from, err)
+			}
+			putUDPBuf(p.data)
+
+			if out.Len() >= c.batchSize {
+				c.flush(out)
+				out = getBuf()
+			}
+
+		case <-ticker.C:
+			if out.Len() > 0 {
+				c.flush(out)
+				out = getBuf()
+			}
+		}
+	}
+}
+
+// flush posts the batch to every backend without waiting for them, the
+// buffer is returned to the pool once all of them are done with it
+func (c *Collectd) flush(out *bytes.Buffer) {
+	if out.Len() == 0 {
+		putBuf(out)
+		return
+	}
+
+	pl := newPayload(out)
+	defer pl.release()
+
+	for _, b := range c.backends {
+		b := b
+		pl.retain()
+		go func() {
+			defer pl.release()
+			resp, err := b.post(pl, c.query, "")
+			if err == nil && resp.StatusCode/100 == 4 {
+				log.Printf("4xx response for relay %q backend %q: %v", c.Name(), b.name, resp.StatusCode)
+			}
+			b.observe(c.Name(), resp, err)
+		}()
+	}
+}
+
+// collectdValueList holds the identifier parts which apply to the following values
+type collectdValueList struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	time           time.Time
+}
+
+// convert parses a collectd packet and appends the values to out as line protocol
+func (c *Collectd) convert(data []byte, now time.Time, out *bytes.Buffer) error {
+	var vl collectdValueList
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errCollectdMalformed
+		}
+
+		typ := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 4 || length > len(data) {
+			return errCollectdMalformed
+		}
+
+		part := data[4:length]
+		data = data[length:]
+
+		switch typ {
+		case collectdHost:
+			vl.host = collectdString(part)
+		case collectdPlugin:
+			vl.plugin = collectdString(part)
+		case collectdPluginInstance:
+			vl.pluginInstance = collectdString(part)
+		case collectdType:
+			vl.typ = collectdString(part)
+		case collectdTypeInstance:
+			vl.typeInstance = collectdString(part)
+
+		case collectdTime:
+			if len(part) != 8 {
+				return errCollectdMalformed
+			}
+			vl.time = time.Unix(int64(binary.BigEndian.Uint64(part)), 0)
+
+		case collectdTimeHR:
+			if len(part) != 8 {
+				return errCollectdMalformed
+			}
+			// high resolution time is in units of 2^-30 seconds
+			v := binary.BigEndian.Uint64(part)
+			vl.time = time.Unix(int64(v>>30), int64((v&(1<<30-1))*1e9>>30))
+
+		case collectdValues:
+			values, err := collectdParseValues(part)
+			if err != nil {
+				return err
+			}
+			if err := c.writeValues(&vl, values, now, out); err != nil {
+				return err
+			}
+
+		case collectdEncryption:
+			return errCollectdEncrypted
+
+		default:
+			// intervals, notifications and signatures are ignored
+		}
+	}
+
+	return nil
+}
+
+func (c *Collectd) writeValues(vl *collectdValueList, values []float64, now time.Time, out *bytes.Buffer) error {
+	names := c.types[vl.typ]
+	if len(names) != len(values) {
+		// the type is unknown or doesn't match types.db
+		names = nil
+	}
+
+	tags := make(models.Tags)
+	for k, v := range map[string]string{
+		"host":          vl.host,
+		"instance":      vl.pluginInstance,
+		"type":          vl.typ,
+		"type_instance": vl.typeInstance,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+
+	t := vl.time
+	if t.IsZero() {
+		t = now
+	}
+
+	for i, v := range values {
+		// NaN and infinite values can't be represented in line protocol
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+
+		ds := "value"
+		if names != nil {
+			ds = names[i]
+		} else if len(values) > 1 {
+			ds = fmt.Sprintf("value%d", i)
+		}
+
+		p, err := models.NewPoint(vl.plugin+"_"+ds, tags, models.Fields{"value": v}, t)
+		if err != nil {
+			return err
+		}
+
+		out.WriteString(p.PrecisionString(""))
+		out.WriteByte('\n')
+	}
+
+	return nil
+}
+
+func collectdParseValues(part []byte) ([]float64, error) {
+	if len(part) < 2 {
+		return nil, errCollectdMalformed
+	}
+
+	n := int(binary.BigEndian.Uint16(part[0:2]))
+	if len(part) != 2+n*9 {
+		return nil, errCollectdMalformed
+	}
+
+	kinds := part[2 : 2+n]
+	raw := part[2+n:]
+
+	values := make([]float64, n)
+	for i := range values {
+		b := raw[i*8 : i*8+8]
+		switch kinds[i] {
+		case collectdGauge:
+			// gauges are the only little endian values on the wire
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case collectdDerive:
+			values[i] = float64(int64(binary.BigEndian.Uint64(b)))
+		case collectdCounter, collectdAbsolute:
+			values[i] = float64(binary.BigEndian.Uint64(b))
+		default:
+			return nil, errCollectdMalformed
+		}
+	}
+
+	return values, nil
+}
+
+// collectdString decodes a null terminated string part
+func collectdString(part []byte) string {
+	if i := bytes.IndexByte(part, 0); i >= 0 {
+		part = part[:i]
+	}
+	return string(part)
+}
+
+// parseTypesDB reads the data source names of every type from a collectd
+// types.db file, lines look like:
+//
+//	if_octets	rx:DERIVE:0:U, tx:DERIVE:0:U
+func parseTypesDB(r io.Reader) (map[string][]string, error) {
+	types := make(map[string][]string)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+
+		var names []string
+		for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			if ds == "" {
+				continue
+			}
+			i := strings.IndexByte(ds, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid data source %q", ds)
+			}
+			names = append(names, ds[:i])
+		}
+
+		types[fields[0]] = names
+	}
+
+	return types, s.Err()
+}
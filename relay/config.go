@@ -1,7 +1,14 @@
 package relay
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 
 	"github.com/naoina/toml"
 )
@@ -12,6 +19,259 @@ type Config struct {
 	// 参考sample.toml会发现配置项分为两大类: HTTP 和 UDP
 	HTTPRelays []HTTPConfig `toml:"http"`
 	UDPRelays  []UDPConfig  `toml:"udp"`
+
+	CollectdRelays []CollectdConfig `toml:"collectd"`
+	MQTTRelays     []MQTTConfig     `toml:"mqtt"`
+
+	// Admin configures the optional admin listener used for debugging endpoints
+	Admin AdminConfig `toml:"admin"`
+
+	// Usage configures the optional export of per database usage records
+	Usage UsageConfig `toml:"usage"`
+
+	// BufferPool limits the memory kept by the pool of request buffers
+	BufferPool BufferPoolConfig `toml:"buffer-pool"`
+
+	// StatsD configures the optional emission of the relay metrics to statsd
+	StatsD StatsDConfig `toml:"statsd"`
+
+	// Notify configures the optional notifiers of the health and buffering
+	// events of the backends
+	Notify NotifyConfig `toml:"notify"`
+
+	// HTTPTemplates are HTTP relay configurations tenants are created from
+	HTTPTemplates []HTTPConfig   `toml:"http-template"`
+	Tenants       []TenantConfig `toml:"tenant"`
+}
+
+// TenantConfig abstract config of a tenant relay created from a template
+type TenantConfig struct {
+	// Template is the name of the http-template the relay is created from
+	Template string `toml:"template"`
+
+	// Name identifies the tenant relay, it is also its path prefix when the
+	// tenant has no listener of its own
+	Name string `toml:"name"`
+
+	// Addr of a dedicated listener. When empty the tenant is served under
+	// /<name>/ on the listener of the template.
+	Addr string `toml:"bind-addr"`
+
+	// Database, RateLimit and RateBurst override the ones of the template
+	Database  string  `toml:"database"`
+	RateLimit float64 `toml:"rate-limit"`
+	RateBurst int     `toml:"rate-burst"`
+}
+
+// StatsDConfig abstract statsd metrics emission config
+type StatsDConfig struct {
+	// Addr of the UDP listener of statsd or of the DogStatsD agent, e.g.
+	// "127.0.0.1:8125" (Default empty, disabled)
+	Addr string `toml:"addr"`
+
+	// Interval between two emissions, the format used is the same seen in
+	// time.ParseDuration (Default 10s)
+	Interval string `toml:"interval"`
+
+	// Prefix of the metric names (Default influxdb_relay)
+	Prefix string `toml:"prefix"`
+
+	// Send the relay, backend and error class as DogStatsD tags instead of
+	// parts of the metric names, along with Tags, e.g. "env:prod"
+	DogStatsD bool     `toml:"dogstatsd"`
+	Tags      []string `toml:"tags"`
+}
+
+// NotifyConfig abstract notifications config, disabled when there is no
+// notifier
+type NotifyConfig struct {
+	// Interval between two checks of the backends, the format used is the
+	// same seen in time.ParseDuration (Default 10s)
+	Interval string `toml:"interval"`
+
+	Webhooks []WebhookConfig `toml:"webhook"`
+}
+
+// WebhookConfig abstract config of a notifier the events are posted to
+type WebhookConfig struct {
+	// Type of the notifier: "webhook" posts the events as JSON, "slack" as
+	// messages of an incoming webhook, "pagerduty" as alerts of the Events
+	// API v2 (Default webhook)
+	Type string `toml:"type"`
+
+	// URL the events are posted to, the incoming webhook of Slack (Default
+	// the Events API for pagerduty)
+	URL string `toml:"url"`
+
+	// Routing key of the PagerDuty service, required by pagerduty
+	RoutingKey string `toml:"routing-key"`
+
+	// Events posted to the notifier among "buffering", "recovered",
+	// "buffer-filling", "dropped", "unhealthy" and "healthy" (Default
+	// empty, every event)
+	Events []string `toml:"events"`
+
+	// Headers added to the posts, e.g. an Authorization token
+	Headers map[string]string `toml:"headers"`
+
+	// Timeout of a post, the format used is the same seen in
+	// time.ParseDuration (Default 10s)
+	Timeout string `toml:"timeout"`
+}
+
+// UsageConfig abstract usage export config
+type UsageConfig struct {
+	// Interval between two exports, the format used is the same seen in
+	// time.ParseDuration (Default 1h)
+	Interval string `toml:"interval"`
+
+	// File the records are appended to, as "csv" or "line" protocol
+	// depending on Format (Default csv)
+	File   string `toml:"file"`
+	Format string `toml:"format"`
+
+	// Location of an InfluxDB write endpoint the records are posted to as
+	// line protocol, in Database
+	Location string `toml:"location"`
+	Database string `toml:"database"`
+}
+
+// AuthConfig abstract writers authentication config, disabled when there
+// is no token
+type AuthConfig struct {
+	// Tokens accepted in the Authorization header, as "Token <token>",
+	// "Bearer <token>" or the password of basic authentication, or in the
+	// p query parameter
+	Tokens []string `toml:"tokens"`
+
+	// Tokens only allowed to write to some databases or measurements
+	Grants []AuthGrantConfig `toml:"grant"`
+
+	// File of more tokens, one per line, read at startup. A token can be
+	// followed by the comma separated databases it's allowed to write to.
+	TokenFile string `toml:"token-file"`
+
+	// Name of an influxdb output the credentials of the writers are checked
+	// against, with a SHOW DATABASES query, when they aren't one of the
+	// tokens (Default empty, not checked)
+	VerifyBackend string `toml:"verify-backend"`
+
+	// Time the outcome of a check against the verify-backend is cached,
+	// per credentials (Default 1m)
+	VerifyCacheTTL string `toml:"verify-cache-ttl"`
+
+	// Forward the Authorization header and the u and p query parameters of
+	// the writers to the backends, they're removed otherwise and the
+	// backends are authenticated with the headers of the outputs (Default
+	// false)
+	ForwardAuthorization bool `toml:"forward-authorization"`
+}
+
+// TenantMapConfig abstract tenant header mapping config
+type TenantMapConfig struct {
+	// Tenant is the value of the tenant-header
+	Tenant string `toml:"tenant"`
+
+	// Database and retention policy the writes of the tenant go to, whatever
+	// their db and rp parameters
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// Names of the outputs the writes of the tenant are forwarded to
+	// (Default empty, every output)
+	Outputs []string `toml:"outputs"`
+}
+
+// QuotaConfig abstract write quota config of the databases matching a
+// pattern, every database having its own quota
+type QuotaConfig struct {
+	// Database name or path.Match pattern, e.g. "tenant_*". The first quota
+	// matching the database of a write applies.
+	Database string `toml:"database"`
+
+	// Maximum number of points per second written to the database, with
+	// bursts of up to burst points (Default 0, unlimited, and a burst of
+	// one second)
+	PointsPerSecond float64 `toml:"points-per-second"`
+	Burst           int     `toml:"burst"`
+
+	// Maximum size of the points written to the database during a UTC day
+	// (Default 0, unlimited)
+	MBPerDay int `toml:"mb-per-day"`
+}
+
+// BucketMapConfig abstract mapping of an InfluxDB 2 bucket to a database
+type BucketMapConfig struct {
+	// Bucket and optionally Org of the writes (Default empty org, any)
+	Bucket string `toml:"bucket"`
+	Org    string `toml:"org"`
+
+	// Database and retention policy the writes to the bucket go to (Default
+	// empty retention policy, the default one)
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+}
+
+// CORSConfig abstract cross-origin requests config, disabled when no origin
+// is allowed
+type CORSConfig struct {
+	// Origins allowed to send requests, e.g. "https://grafana.example.com",
+	// or "*" for any
+	AllowedOrigins []string `toml:"allowed-origins"`
+
+	// Methods and headers allowed in the requests (Default GET, HEAD, POST
+	// and OPTIONS, and Authorization, Content-Type and Content-Encoding)
+	AllowedMethods []string `toml:"allowed-methods"`
+	AllowedHeaders []string `toml:"allowed-headers"`
+
+	// Time the browsers cache the answer to a preflight request (Default
+	// empty, the default of the browser)
+	MaxAge string `toml:"max-age"`
+
+	// Let the browsers send their cookies and credentials, can't be used
+	// with any origin
+	AllowCredentials bool `toml:"allow-credentials"`
+}
+
+// AuthGrantConfig abstract token grant config
+type AuthGrantConfig struct {
+	Token string `toml:"token"`
+
+	// Databases and measurements the token is allowed to write to, as
+	// path.Match patterns (Default empty, any)
+	Databases    []string `toml:"databases"`
+	Measurements []string `toml:"measurements"`
+}
+
+// BufferPoolConfig abstract buffer pool config
+type BufferPoolConfig struct {
+	// Largest buffer kept for reuse once released, the larger ones (e.g. of
+	// a burst of huge requests) are left to the GC (Default 1024)
+	MaxBufferKB int `toml:"max-buffer-kb"`
+
+	// Total capacity of the buffers kept for reuse (Default 64)
+	SizeMB int `toml:"size-mb"`
+}
+
+// AdminConfig abstract admin listener config
+type AdminConfig struct {
+	// Addr should be set to the desired listening host:port, the admin
+	// listener is disabled when left empty
+	Addr string `toml:"bind-addr"`
+
+	// Directory the purged retry buffers are moved to (Default
+	// influxdb-relay-purged in the temporary directory)
+	PurgeDir string `toml:"purge-dir"`
+
+	// Time the purged retry buffers can be restored, 0 destroys them right
+	// away (Default 24h). The format used is the same seen in time.ParseDuration
+	PurgeGracePeriod string `toml:"purge-grace-period"`
+
+	// Tokens the clients of the admin listener must present, as the
+	// Authorization header or the p query parameter. Without tokens only
+	// the endpoints reporting the state of the service are served, the ones
+	// changing it (tenants, purges, subscriptions) are refused
+	Tokens []string `toml:"tokens"`
 }
 
 // HTTPConfig abstract http config
@@ -25,14 +285,360 @@ type HTTPConfig struct {
 	// Set certificate in order to handle HTTPS requests
 	SSLCombinedPem string `toml:"ssl-combined-pem"`
 
+	// Alternatively to SSLCombinedPem, the certificate and the key can be
+	// set as separate PEM files, with an optional file of intermediate
+	// certificates sent along with the certificate
+	SSLCert  string `toml:"ssl-cert"`
+	SSLKey   string `toml:"ssl-key"`
+	SSLChain string `toml:"ssl-chain"`
+
+	// Alternatively, obtain and renew the certificate of these domains
+	// from an ACME CA, Let's Encrypt unless ACMEDirectory is set. The
+	// http-01 challenges are answered on ACMEHTTPAddr (Default :80), and
+	// the account and certificates are kept in ACMECacheDir.
+	ACMEDomains   []string `toml:"acme-domains"`
+	ACMECacheDir  string   `toml:"acme-cache-dir"`
+	ACMEEmail     string   `toml:"acme-email"`
+	ACMEDirectory string   `toml:"acme-directory"`
+	ACMEHTTPAddr  string   `toml:"acme-http-addr"`
+
+	// Verify the certificates of the HTTPS clients against this CA bundle,
+	// and reject the clients without one when SSLRequireClientCert is set
+	SSLClientCA          string `toml:"ssl-client-ca"`
+	SSLRequireClientCert bool   `toml:"ssl-require-client-cert"`
+
+	// Only accept writes from clients with a verified certificate whose
+	// common name is in this list (Default empty, any client)
+	SSLAllowedCNs []string `toml:"ssl-allowed-cn"`
+
+	// Serve the relay under this path prefix, e.g. /tenantA for
+	// /tenantA/write. Relays with a path prefix share the listener of their
+	// bind-addr, and must use the same certificate as the other relays on
+	// it without a virtual host.
+	PathPrefix string `toml:"path-prefix"`
+
+	// Serve the relay for the requests to this host only, as given by their
+	// Host header. Relays with a virtual host share the listener of their
+	// bind-addr, and may present their own certificate to the clients
+	// asking for the host over HTTPS (SNI).
+	VirtualHost string `toml:"virtual-host"`
+
 	// Default retention policy to set for forwarded requests
 	// 请求转发到influxdb之前可以写入配置好的数据保存策略
 	DefaultRetentionPolicy string `toml:"default-retention-policy"`
 
+	// Database every write is forwarded to, replacing the one asked for by
+	// the client. Used to pin a tenant to its database.
+	Database string `toml:"database"`
+
+	// Maximum number of points per second accepted from the clients, with
+	// bursts of up to rate-burst points (Default 0, unlimited, and a burst
+	// of one second). Writes over the limit are answered with a 429.
+	RateLimit float64 `toml:"rate-limit"`
+	RateBurst int     `toml:"rate-burst"`
+
+	// Apply rate-limit and rate-burst to every client address separately
+	// instead of the relay as a whole
+	RateLimitPerClient bool `toml:"rate-limit-per-client"`
+
+	// Quotas of points per second and bytes per day of every database,
+	// writes over them are answered with a 429, see QuotaConfig
+	Quotas []QuotaConfig `toml:"quota"`
+
+	// How the writes are forwarded: "mirror" to every backend, or to a
+	// single healthy backend picked in turn with "round-robin" or with the
+	// fewest writes in flight with "least-loaded" (Default mirror)
+	Mode string `toml:"mode"`
+
+	// Time a primary output must be unhealthy for before the standby
+	// outputs are promoted (Default 30s), and maximum size in MB of the
+	// writes held meanwhile, which are posted to the standbys on promotion
+	// (Default 64MB)
+	// The format used is the same seen in time.ParseDuration
+	FailoverDelay    string `toml:"failover-delay"`
+	FailoverBufferMB int    `toml:"failover-buffer-mb"`
+
+	// Expect the PROXY protocol header (v1 or v2) sent by HAProxy or a load
+	// balancer in TCP mode at the start of every connection, and use the
+	// client address it carries
+	AcceptProxyProtocol bool `toml:"accept-proxy-protocol"`
+
+	// Listen with SO_REUSEPORT, so that a new relay process can listen on
+	// the same address before the old one stops (linux only)
+	ReusePort bool `toml:"reuse-port"`
+
+	// Time the writes being served are given to complete when the relay
+	// stops, it no longer accepts connections meanwhile (Default 30s)
+	// The format used is the same seen in time.ParseDuration
+	ShutdownTimeout string `toml:"shutdown-timeout"`
+
+	// Maximum time to read a whole request, its headers, to write the
+	// response of a request once its headers are read, and to wait for the
+	// next request on a keep-alive connection (Default 0, unlimited)
+	// The format used is the same seen in time.ParseDuration
+	ReadTimeout       string `toml:"read-timeout"`
+	ReadHeaderTimeout string `toml:"read-header-timeout"`
+	WriteTimeout      string `toml:"write-timeout"`
+	IdleTimeout       string `toml:"idle-timeout"`
+
+	// Maximum size of the headers of a request in bytes (Default 1MB)
+	MaxHeaderBytes int `toml:"max-header-bytes"`
+
+	// Log every request with the client address, status, size and duration
+	AccessLog bool `toml:"access-log"`
+
+	// Addresses or CIDR networks of the proxies whose X-Forwarded-For and
+	// X-Real-IP headers give the client address, used for the access log,
+	// rate-limit-per-client, allowed-clients and denied-clients
+	TrustedProxies []string `toml:"trusted-proxies"`
+
+	// Only accept requests from these addresses or CIDR networks (Default
+	// empty, any client)
+	AllowedClients []string `toml:"allowed-clients"`
+
+	// Reject the requests from these addresses or CIDR networks, even when
+	// they're in allowed-clients (Default empty, none)
+	DeniedClients []string `toml:"denied-clients"`
+
+	// Auth requires the writers to present a token, see AuthConfig
+	Auth AuthConfig `toml:"auth"`
+
+	// CORS allows browser clients of other origins to write, see CORSConfig
+	CORS CORSConfig `toml:"cors"`
+
+	// Header identifying the tenant of a request (e.g. X-Tenant-ID), whose
+	// database is given by TenantMap. The requests without the header or of
+	// an unknown tenant are rejected (Default empty, disabled)
+	TenantHeader string            `toml:"tenant-header"`
+	TenantMap    []TenantMapConfig `toml:"tenant-map"`
+
+	// Database and retention policy of the buckets of the writes of the
+	// clients configured for InfluxDB 2, on /api/v2/write or with a bucket
+	// parameter. The other buckets are taken as "db/rp" or "db"
+	BucketMap []BucketMapConfig `toml:"bucket-map"`
+
+	// Maximum time to wait for the backends before answering the client,
+	// independently of their own timeouts and retries (Default 0, no deadline)
+	// The format used is the same seen in time.ParseDuration
+	FanoutTimeout string `toml:"fanout-timeout"`
+
+	// Acknowledge the write after this long when a retry buffer of one of
+	// the backends accepted it, even though other backends are still being
+	// posted to (Default 0, wait for a backend to answer). This bounds the
+	// latency seen by the clients whatever the slowest backend.
+	// The format used is the same seen in time.ParseDuration
+	LatencyBudget string `toml:"latency-budget"`
+
+	// Write a relay_heartbeat point tagged with the relay and the backend
+	// to every backend at this interval, in HeartbeatDatabase (Default
+	// empty, disabled). The format used is the same seen in
+	// time.ParseDuration
+	HeartbeatInterval string `toml:"heartbeat-interval"`
+	HeartbeatDatabase string `toml:"heartbeat-database"`
+
+	// Write the metrics of the relay and of every backend (latencies,
+	// errors, retry buffer sizes, dropped writes) to every backend at this
+	// interval, in SelfMetricsDatabase (Default empty, disabled). The format
+	// used is the same seen in time.ParseDuration
+	SelfMetricsInterval string `toml:"self-metrics-interval"`
+	SelfMetricsDatabase string `toml:"self-metrics-database"`
+
+	// Skip lines which fail to parse and forward the rest of the write,
+	// instead of rejecting the whole request
+	LenientParse bool `toml:"lenient-parse"`
+
+	// Append lines skipped by lenient-parse to this file
+	DeadLetterFile string `toml:"dead-letter-file"`
+
+	// Append the writes acknowledged by the outputs with the "old"
+	// migration role but missed by one with the "new" role to this file
+	MigrationReport string `toml:"migration-report"`
+
+	// Handling of the writes with an empty or whitespace only body, "accept"
+	// answers them with a 204 and "reject" with a 400. They're never
+	// forwarded to the backends (Default accept)
+	EmptyBody string `toml:"empty-body"`
+
+	// Answer of the writes taken by some backends but failed or buffered by
+	// others, "no-content" is a 204 as soon as a backend took the write,
+	// "accepted" a 202 and "warning" a 204 with a Warning header. The last
+	// two wait for every backend, or for their retry buffer to take the
+	// write (Default no-content)
+	PartialSuccess string `toml:"partial-success"`
+
+	// Add an X-Relay-Backend-<name> header per backend to the answers of the
+	// writes, with the status of the backend, "buffered", "pending" or
+	// "error". The relay then waits for every backend, or for their retry
+	// buffer to take the write
+	BackendStatusHeaders bool `toml:"backend-status-headers"`
+
+	// Answer of /ping, "static" is always a 204, "proxy" relays the ping to
+	// the PingBackend output and "healthy" is a 503 when no backend is
+	// healthy (Default static)
+	PingMode    string `toml:"ping-mode"`
+	PingBackend string `toml:"ping-backend"`
+
+	// Relay the /query endpoint to one of the QueryBackends outputs, picked
+	// in turn among the healthy ones, a query which can't reach its backend
+	// being sent to the next one (Default false, /query isn't relayed)
+	ProxyQueries bool `toml:"proxy-queries"`
+
+	// Outputs the queries are relayed to, by name (Default every influxdb
+	// output which isn't a shadow)
+	QueryBackends []string `toml:"query-backends"`
+
+	// Output the Flux queries of /api/v2/query are relayed to, e.g. for
+	// the Flux datasource of Grafana (Default empty, not relayed)
+	FluxBackend string `toml:"flux-backend"`
+
+	// Timeout of a relayed query, its response included (Default 60s)
+	// The format used is the same seen in time.ParseDuration
+	QueryTimeout string `toml:"query-timeout"`
+
+	// X-Influxdb-Version header of the answers, some client libraries parse
+	// it. "auto" reports the lowest version of the influxdb outputs, checked
+	// every minute (Default relay)
+	InfluxDBVersion string `toml:"influxdb-version"`
+
+	// Maximum size of a request body in KB once decompressed (Default 0,
+	// unlimited). Larger writes are answered with a 413, which Telegraf
+	// handles by splitting its batch.
+	MaxBodySizeKB int `toml:"max-body-size-kb"`
+
+	// Writes whose Content-Length is larger than this, in KB, are streamed
+	// to the backends as they're read instead of being held in memory,
+	// their points are forwarded unchanged (Default 0, never streamed)
+	StreamThresholdKB int `toml:"stream-threshold-kb"`
+
+	// Forward the gzip bodies to the backends as they are instead of
+	// decompressing them, their points are forwarded unchanged
+	GzipPassthrough bool `toml:"gzip-passthrough"`
+
+	// Maximum length of a single line in bytes (Default 0, unlimited).
+	// Longer lines reject the write, or are skipped with lenient-parse
+	MaxLineLength int `toml:"max-line-length"`
+
+	// Cut the string fields of lines longer than max-line-length instead
+	// of rejecting them
+	TruncateLongLines bool `toml:"truncate-long-lines"`
+
+	// Coalesce the writes with the same query and credentials for up to
+	// this long before forwarding them, the clients being answered once their
+	// batch is (Default 0, disabled). The format used is the same seen in
+	// time.ParseDuration
+	BatchWait string `toml:"batch-wait"`
+
+	// Size a batch of coalesced writes is forwarded at, before the end of
+	// its wait, in KB (Default 64)
+	BatchSizeKB int `toml:"batch-size-kb"`
+
+	// Drop the points already written during this window, e.g. sent again by
+	// agents retrying after a timeout (Default 0, disabled). The format used
+	// is the same seen in time.ParseDuration
+	DedupWindow string `toml:"dedup-window"`
+
+	// DatabaseRename renames the database of the writes, before they are
+	// processed and forwarded
+	DatabaseRename []DatabaseRenameConfig `toml:"database-rename"`
+
+	// TagRename renames tags, and TagDrop removes tags from the points.
+	// Applied before the other tag rules, which see the new names.
+	TagRename map[string]string `toml:"tag-rename"`
+	TagDrop   []string          `toml:"tag-drop"`
+
+	// TagNormalize rewrites tag values to reduce accidental cardinality
+	TagNormalize []TagNormalizeConfig `toml:"tag-normalize"`
+
+	// Tags are added to every point, replacing the ones of the same name
+	Tags map[string]string `toml:"tags"`
+
+	// FieldDrop removes fields from the points
+	FieldDrop []FieldDropConfig `toml:"field-drop"`
+
+	// StringLimits caps the length of string field values
+	StringLimits []StringLimitConfig `toml:"string-limit"`
+
+	// Aggregate rolls up the points of some measurements before they are
+	// written to some of the outputs
+	Aggregate []AggregateConfig `toml:"aggregate"`
+
 	// Outputs is a list of backed servers where writes will be forwarded
 	Outputs []HTTPOutputConfig `toml:"output"`
 }
 
+type DatabaseRenameConfig struct {
+	// Match is the database renamed
+	Match string `toml:"match"`
+
+	// Regex renames the databases it matches instead, the whole name must
+	// match. To can refer to its groups ($1, ${name})
+	Regex string `toml:"regex"`
+
+	// To is the new name of the database
+	To string `toml:"to"`
+}
+
+type TagNormalizeConfig struct {
+	// Tag the rules apply to, "*" matches every tag without rules of its own
+	// (Default *)
+	Tag string `toml:"tag"`
+
+	// Lowercase the values
+	Lowercase bool `toml:"lowercase"`
+
+	// Remove leading and trailing whitespace
+	TrimSpace bool `toml:"trim-space"`
+
+	// Rewrite the usual spellings of booleans (yes, on, 1, T...) to true or false
+	Booleans bool `toml:"booleans"`
+
+	// Synonyms maps values to their canonical spelling, applied last
+	Synonyms map[string]string `toml:"synonyms"`
+}
+
+type FieldDropConfig struct {
+	// Measurement pattern of the points the rule applies to, in the syntax
+	// of path.Match (Default *)
+	Measurement string `toml:"measurement"`
+
+	// Field pattern of the fields removed, in the syntax of path.Match
+	Field string `toml:"field"`
+}
+
+type AggregateConfig struct {
+	// Measurement pattern of the points rolled up, in the syntax of path.Match
+	Measurement string `toml:"measurement"`
+
+	// Window the points are rolled up over, e.g. 1m
+	// The format used is the same seen in time.ParseDuration
+	Window string `toml:"window"`
+
+	// Function rolling up the values of a field, one of "mean", "min",
+	// "max", "sum", "count" or "last" (Default mean). Only last and count
+	// apply to the string and boolean fields, the others are left out.
+	Function string `toml:"function"`
+
+	// Time the points of a window are waited for after its end (Default
+	// 10s). The format used is the same seen in time.ParseDuration
+	Delay string `toml:"delay"`
+
+	// Outputs the rollups are written to instead of the points, by name
+	Outputs []string `toml:"outputs"`
+}
+
+type StringLimitConfig struct {
+	// Field the limit applies to, "*" matches every string field without a
+	// limit of its own (Default *)
+	Field string `toml:"field"`
+
+	// MaxLength is the maximum length of the value in bytes
+	MaxLength int `toml:"max-length"`
+
+	// Action taken on longer values, one of "truncate", "drop-field" or
+	// "drop-point" (Default truncate)
+	Action string `toml:"action"`
+}
+
 type HTTPOutputConfig struct {
 	// Name of the backend server
 	Name string `toml:"name"`
@@ -40,6 +646,21 @@ type HTTPOutputConfig struct {
 	// Location should be set to the URL of the backend server's write endpoint
 	Location string `toml:"location"`
 
+	// Type of the backend, either "influxdb", "victoriametrics",
+	// "prometheus" for a remote_write endpoint, "file" to spool the writes
+	// to the local directory set as location or "subscriber" to push them
+	// to a downstream service, see Measurements (Default influxdb)
+	Type string `toml:"type"`
+
+	// Extra query string arguments of "victoriametrics" outputs,
+	// e.g. "extra_label=dc=eu"
+	ExtraQuery string `toml:"extra-query"`
+
+	// Size and age after which the files of a "file" output are rotated
+	// (Default 64MB and 1h)
+	RotateSizeMB   int    `toml:"rotate-size-mb"`
+	RotateInterval string `toml:"rotate-interval"`
+
 	// Timeout sets a per-backend timeout for write requests. (Default 10s)
 	// The format used is the same seen in time.ParseDuration
 	Timeout string `toml:"timeout"`
@@ -47,17 +668,142 @@ type HTTPOutputConfig struct {
 	// Buffer failed writes up to maximum count. (Default 0, retry/buffering disabled)
 	BufferSizeMB int `toml:"buffer-size-mb"`
 
+	// Copy the writes kept in the retry buffer instead of sharing them with the
+	// other backends. Sharing saves memory when several backends buffer the
+	// same writes, copying avoids pinning large request buffers (Default false)
+	BufferCopy bool `toml:"buffer-copy"`
+
+	// Order the buffered writes are retried in, "oldest-first",
+	// "newest-first" to make the recent data visible before the backlog of
+	// an outage, or "largest-first" (Default oldest-first)
+	BufferOrder string `toml:"buffer-order"`
+
+	// What happens to a write when the buffer is full, "reject-new" drops
+	// it, "drop-oldest" evicts the oldest buffered batches to make room
+	// for it (Default reject-new)
+	BufferFull string `toml:"buffer-full"`
+
+	// Utilization of the buffer, in percent of buffer-size-mb, over which
+	// it's logged, reported in the metrics and notified as filling up, ahead
+	// of the writes being rejected (Default 80 and 95)
+	BufferWarningPercent  float64 `toml:"buffer-warning-percent"`
+	BufferCriticalPercent float64 `toml:"buffer-critical-percent"`
+
+	// Number of buffered batches replayed concurrently once the backend is
+	// back, to drain a large backlog over a high latency link. The batches
+	// are no longer written in order with more than one. (Default 1)
+	ReplayWorkers int `toml:"replay-workers"`
+
+	// Statuses of the backend responses the writes are buffered and retried
+	// on: codes (e.g. "429"), classes (e.g. "5xx") or codes never retried
+	// (e.g. "!501"). An exact code takes precedence over its class. (Default ["5xx"])
+	RetryStatuses []string `toml:"retry-statuses"`
+
+	// File the buffered batches rejected by the backend are
+	// appended to, they're only logged and dropped otherwise (Default none)
+	DeadLetterFile string `toml:"dead-letter-file"`
+
 	// Maximum batch size in KB (Default 512)
 	MaxBatchKB int `toml:"max-batch-kb"`
 
+	// Maximum size of a post to the backend in KB, the larger writes are
+	// split on line boundaries into several sequential posts (Default 0,
+	// unlimited)
+	MaxPostSizeKB int `toml:"max-post-size-kb"`
+
+	// Headers added to every post to the backend, replacing the ones of the
+	// client (e.g. X-Scope-OrgID, or the token of a gateway)
+	Headers map[string]string `toml:"headers"`
+
+	// Credentials of the backend, sent with basic authentication when the
+	// client supplied none (Default empty, none)
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// DatabaseMap maps the database of the writes to the one they are written
+	// to on the backend, "*" maps every database without a mapping of its own
+	DatabaseMap map[string]string `toml:"database-map"`
+
+	// RetentionPolicy the writes are forwarded to whatever their own, or
+	// RetentionPolicyMap maps the retention policy of the writes ("" for the
+	// writes without one, "*" for every one without a mapping of its own).
+	// Applied after the default-retention-policy of the relay.
+	RetentionPolicy    string            `toml:"retention-policy"`
+	RetentionPolicyMap map[string]string `toml:"retention-policy-map"`
+
+	// Number of immediate retries of a write failing with a refused or reset
+	// connection, before it is buffered or reported as failed (Default 0)
+	ImmediateRetries int `toml:"immediate-retries"`
+
 	// Maximum delay between retry attempts.
 	// The format used is the same seen in time.ParseDuration (Default 10s)
 	MaxDelayInterval string `toml:"max-delay-interval"`
 
+	// Log errors of the same class at most once per interval, the number of
+	// suppressed lines is reported with the next one (Default 0, log every error)
+	// The format used is the same seen in time.ParseDuration
+	ErrorLogInterval string `toml:"error-log-interval"`
+
+	// Percentage of the writes of an HTTP relay mirrored to the backend,
+	// picked at random, e.g. for an analytics cluster which only needs a
+	// sample of the traffic (Default 0, every write)
+	Percentage float64 `toml:"percentage"`
+
+	// Databases the backend gets the writes of, as path.Match patterns of
+	// the database asked for by the client, e.g. for a canary backend only
+	// validated with a few databases. With a percentage, the backend gets
+	// that share of the writes of these databases (Default empty, every
+	// database)
+	Databases []string `toml:"databases"`
+
+	// Measurements pushed to a subscriber output, as path.Match patterns.
+	// A subscriber is a shadow, the writes never wait for it (Default
+	// empty, every measurement)
+	Measurements []string `toml:"measurements"`
+
+	// Role of the backend, "primary" or "standby". A standby only gets the
+	// writes once a primary has been unhealthy for the failover-delay of
+	// the relay, until all the primaries are healthy again (Default primary)
+	Role string `toml:"role"`
+
+	// Post the writes to the backend without waiting for it: its answers
+	// and failures never reach the client, and it can't have a retry
+	// buffer, e.g. for an experimental destination (Default false)
+	Shadow bool `toml:"shadow"`
+
+	// Role of the backend during a cluster migration, "old" or "new". The
+	// writes are answered by the old cluster, and the ones the new cluster
+	// missed are reported (Default empty, not part of a migration)
+	Migration string `toml:"migration"`
+
+	// Log a warning when the clock of the backend, as given by the Date
+	// header of its responses, is off by more than this (Default 0, no
+	// warning). The format used is the same seen in time.ParseDuration
+	ClockSkewThreshold string `toml:"clock-skew-threshold"`
+
 	// Skip TLS verification in order to use self signed certificate.
 	// WARNING: It's insecure. Use it only for developing and don't use in production.
 	// todo: ?
 	SkipTLSVerification bool `toml:"skip-tls-verification"`
+
+	// Don't offer HTTP/2 to https locations (Default false, HTTP/2 is
+	// used when the backend supports it)
+	DisableHTTP2 bool `toml:"disable-http2"`
+
+	// Maximum number of idle connections kept open to the backend (Default 64)
+	MaxIdleConnsPerHost int `toml:"max-idle-conns-per-host"`
+
+	// Maximum number of connections to the backend, writes wait for a
+	// connection beyond it (Default 0, unlimited). Requires Go 1.11
+	MaxConnsPerHost int `toml:"max-conns-per-host"`
+
+	// Time an idle connection is kept open (Default 90s). Requires Go 1.11
+	// The format used is the same seen in time.ParseDuration
+	IdleConnTimeout string `toml:"idle-conn-timeout"`
+
+	// Timeout of the connection to the backend (Default 30s)
+	// The format used is the same seen in time.ParseDuration
+	DialTimeout string `toml:"dial-timeout"`
 }
 
 type UDPConfig struct {
@@ -67,14 +813,57 @@ type UDPConfig struct {
 	// Addr is where the UDP relay will listen for packets
 	Addr string `toml:"bind-addr"`
 
-	// Precision sets the precision of the timestamps (input and output)
+	// Precision sets the precision of the timestamps (input, and output
+	// unless set on the output)
 	Precision string `toml:"precision"`
 
 	// ReadBuffer sets the socket buffer for incoming connections
 	ReadBuffer int `toml:"read-buffer"`
 
+	// Listen with SO_REUSEPORT, so that a new relay process can listen on
+	// the same address before the old one stops (linux only)
+	ReusePort bool `toml:"reuse-port"`
+
+	// Size the socket buffer is doubled toward whenever the kernel drops
+	// datagrams, on linux (Default 0, never raised)
+	ReadBufferMax int `toml:"read-buffer-max"`
+
+	// Maximum length of a single line in bytes, longer lines are dropped
+	// (Default 0, unlimited)
+	MaxLineLength int `toml:"max-line-length"`
+
+	// Cut the string fields of lines longer than max-line-length instead
+	// of dropping them
+	TruncateLongLines bool `toml:"truncate-long-lines"`
+
+	// Keep 1 in sample-rate datagrams at random, the others are dropped
+	// before they are parsed (Default 0, keep them all)
+	SampleRate int `toml:"sample-rate"`
+
+	// Keep 1 in the rate of their measurement of the points of the
+	// measurements listed, in the datagrams kept by sample-rate
+	SampleRates map[string]int `toml:"sample-rates"`
+
 	// Outputs is a list of backend servers where writes will be forwarded
 	Outputs []UDPOutputConfig `toml:"output"`
+
+	// Database and RetentionPolicy the points are written to on the HTTP
+	// outputs
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// Maximum size of the batches of datagrams posted to the HTTP outputs
+	// in KB (Default 64)
+	BatchSizeKB int `toml:"batch-size-kb"`
+
+	// Maximum time datagrams are held before they are posted to the HTTP
+	// outputs (Default 1s). The format used is the same seen in
+	// time.ParseDuration
+	FlushInterval string `toml:"flush-interval"`
+
+	// HTTPOutputs is a list of HTTP backends the datagrams are written to
+	// in batches
+	HTTPOutputs []HTTPOutputConfig `toml:"http-output"`
 }
 
 type UDPOutputConfig struct {
@@ -86,9 +875,91 @@ type UDPOutputConfig struct {
 
 	// MTU sets the maximum output payload size, default is 1024
 	MTU int `toml:"mtu"`
+
+	// Precision of the timestamps written to the backend, the points are
+	// converted when it differs from the one of the relay (Default the
+	// precision of the relay)
+	Precision string `toml:"precision"`
+
+	// Buffer the datagrams which couldn't be sent up to a maximum size in
+	// KB, and send them again until they are (Default 0, retry/buffering disabled)
+	BufferSizeKB int `toml:"buffer-size-kb"`
+
+	// Maximum delay between retry attempts.
+	// The format used is the same seen in time.ParseDuration (Default 10s)
+	MaxDelayInterval string `toml:"max-delay-interval"`
 }
 
-// LoadConfigFile parses the specified file into a Config object
+type CollectdConfig struct {
+	// Name identifies the collectd relay
+	Name string `toml:"name"`
+
+	// Addr is where the collectd relay will listen for packets
+	Addr string `toml:"bind-addr"`
+
+	// Database and RetentionPolicy the converted points are written to
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+
+	// TypesDB is the path of the collectd types.db file used to name values
+	TypesDB string `toml:"typesdb"`
+
+	// ReadBuffer sets the socket buffer for incoming connections
+	ReadBuffer int `toml:"read-buffer"`
+
+	// Maximum size of the batches posted to the backends in KB (Default 64)
+	BatchSizeKB int `toml:"batch-size-kb"`
+
+	// Maximum time values are held before they are posted (Default 1s)
+	// The format used is the same seen in time.ParseDuration
+	FlushInterval string `toml:"flush-interval"`
+
+	// Outputs is a list of HTTP backends where the converted points will be written
+	Outputs []HTTPOutputConfig `toml:"output"`
+}
+
+type MQTTConfig struct {
+	// Name identifies the MQTT relay
+	Name string `toml:"name"`
+
+	// Broker is the URL of the MQTT broker, tcp://host:port or ssl://host:port
+	Broker string `toml:"broker"`
+
+	// ClientID presented to the broker (Default influxdb-relay)
+	ClientID string `toml:"client-id"`
+
+	// Credentials used to connect to the broker
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// Keep alive interval of the connection (Default 30s)
+	// The format used is the same seen in time.ParseDuration
+	KeepAlive string `toml:"keep-alive"`
+
+	// Precision of the timestamps in the payloads
+	Precision string `toml:"precision"`
+
+	// Topics is a list of subscriptions and the database the points are written to
+	Topics []MQTTTopicConfig `toml:"topic"`
+
+	// Outputs is a list of HTTP backends where the points will be written
+	Outputs []HTTPOutputConfig `toml:"output"`
+}
+
+type MQTTTopicConfig struct {
+	// Topic filter to subscribe to, may contain the + and # wildcards
+	Topic string `toml:"topic"`
+
+	// QoS of the subscription, 0 or 1 (Default 0)
+	QoS int `toml:"qos"`
+
+	// Database and RetentionPolicy the points of matching messages are written to
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+}
+
+// LoadConfigFile parses the specified file into a Config object, in the
+// format given by its extension: .json, .yaml/.yml or TOML for anything else
 // 配置文件的载入放在config相关文件,可以避免在main.go加入了文件的读写逻辑
 func LoadConfigFile(filename string) (cfg Config, err error) {
 	f, err := os.Open(filename)
@@ -97,6 +968,127 @@ func LoadConfigFile(filename string) (cfg Config, err error) {
 	}
 	defer f.Close()
 
+	return LoadConfig(f, configFormat(filename))
+}
+
+// LoadConfig parses a configuration in format, "toml", "json" or "yaml",
+// from r. The JSON and YAML documents use the same keys as the TOML one.
+// Environment variables are expanded in the string values once decoded,
+// so that a value can't break the syntax of the document.
+func LoadConfig(r io.Reader, format string) (cfg Config, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch format {
+	case "toml", "":
+	case "json", "yaml":
+		if data, err = convertConfig(data, format); err != nil {
+			return cfg, err
+		}
+	default:
+		return cfg, fmt.Errorf("unknown config format %q", format)
+	}
+
 	// good tasty.
-	return cfg, toml.NewDecoder(f).Decode(&cfg)
+	if err := toml.NewDecoder(bytes.NewReader(data)).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, expandEnvValues(reflect.ValueOf(&cfg).Elem())
+}
+
+// expandEnvValues expands the environment variables of every string of v,
+// see expandEnv
+func expandEnvValues(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandEnvValues(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				// unexported
+				continue
+			}
+			if err := expandEnvValues(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnvValues(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// the values of a map can't be set in place
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := expandEnvValues(e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		s, err := expandEnv(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+// expandEnv replaces the ${VAR} and ${VAR:-default} references in s by
+// the value of the environment variable. $${ is an escaped literal ${, and
+// a $ not followed by { is left untouched.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var out bytes.Buffer
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+
+		if i > 0 && s[i-1] == '$' {
+			out.WriteString(s[:i])
+			out.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+
+		out.WriteString(s[:i])
+		s = s[i+2:]
+
+		j := strings.IndexByte(s, '}')
+		if j < 0 {
+			return "", errors.New("unterminated ${ in config")
+		}
+		ref := s[:j]
+		s = s[j+1:]
+
+		name, def, hasDef := ref, "", false
+		if k := strings.Index(ref, ":-"); k >= 0 {
+			name, def, hasDef = ref[:k], ref[k+2:], true
+		}
+
+		v, ok := os.LookupEnv(name)
+		switch {
+		case ok && (v != "" || !hasDef):
+		case hasDef:
+			v = def
+		default:
+			return "", fmt.Errorf("environment variable %q referenced in config is not set", name)
+		}
+
+		out.WriteString(v)
+	}
 }
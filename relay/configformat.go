@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON and YAML configurations are decoded into plain values and written
+// back as TOML, so that the three formats share the toml tags of Config and
+// the behaviour of its decoder.
+
+// configFormat returns the format of a configuration file from its extension
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "toml"
+}
+
+// convertConfig converts a JSON or YAML configuration to TOML
+func convertConfig(data []byte, format string) ([]byte, error) {
+	var doc interface{}
+	var err error
+	switch format {
+	case "json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&doc)
+	case "yaml":
+		doc, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s config: %v", format, err)
+	}
+
+	if doc == nil {
+		return nil, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s config is not a mapping", format)
+	}
+
+	var buf bytes.Buffer
+	for _, k := range sortedKeys(m) {
+		if m[k] == nil {
+			continue
+		}
+		if !isTOMLKey(k) {
+			return nil, fmt.Errorf("invalid key %q in %s config", k, format)
+		}
+		buf.WriteString(k)
+		buf.WriteString(" = ")
+		if err := writeTOMLValue(&buf, m[k]); err != nil {
+			return nil, fmt.Errorf("invalid value for %q in %s config: %v", k, format, err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTOMLValue writes v inline, tables included
+func writeTOMLValue(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(tomlQuote(v))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		buf.WriteString(tomlFloat(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			buf.WriteString(strconv.FormatInt(i, 10))
+		} else if f, err := v.Float64(); err == nil {
+			buf.WriteString(tomlFloat(f))
+		} else {
+			return err
+		}
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if e == nil {
+				return fmt.Errorf("null array element")
+			}
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeTOMLValue(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		buf.WriteString("{ ")
+		first := true
+		for _, k := range sortedKeys(v) {
+			if v[k] == nil {
+				continue
+			}
+			if !isTOMLKey(k) {
+				return fmt.Errorf("invalid key %q", k)
+			}
+			if !first {
+				buf.WriteString(", ")
+			}
+			first = false
+			buf.WriteString(k)
+			buf.WriteString(" = ")
+			if err := writeTOMLValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(" }")
+	default:
+		return fmt.Errorf("unsupported value %v", v)
+	}
+	return nil
+}
+
+func tomlFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// isTOMLKey reports whether k can be written as a bare key
+func isTOMLKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const corsAnyOrigin = "*"
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "OPTIONS"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Content-Encoding"}
+)
+
+// cors answers the cross-origin requests of browser clients, e.g.
+// dashboards writing annotations to the relay directly
+type cors struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     string
+	headers     string
+	maxAge      string
+	credentials bool
+}
+
+// newCORS returns nil when no origin is allowed
+func newCORS(cfg CORSConfig) (*cors, error) {
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil, nil
+	}
+
+	c := &cors{origins: make(map[string]bool), credentials: cfg.AllowCredentials}
+	for _, o := range cfg.AllowedOrigins {
+		if o == corsAnyOrigin {
+			c.anyOrigin = true
+			continue
+		}
+		c.origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+	if c.anyOrigin && c.credentials {
+		return nil, errors.New("cors allow-credentials can't be used with any origin")
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	c.methods = strings.ToUpper(strings.Join(methods, ", "))
+
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	c.headers = strings.Join(headers, ", ")
+
+	if cfg.MaxAge != "" {
+		d, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil || d < 0 {
+			return nil, errors.New("invalid cors max-age " + strconv.Quote(cfg.MaxAge))
+		}
+		c.maxAge = strconv.Itoa(int(d / time.Second))
+	}
+	return c, nil
+}
+
+// handle sets the CORS headers of the response to a request from an allowed
+// origin, and answers the preflight requests, returning true if it did
+func (c *cors) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	if !c.anyOrigin && !c.origins[strings.ToLower(origin)] {
+		return false
+	}
+
+	h := w.Header()
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", corsAnyOrigin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		h.Set("Access-Control-Expose-Headers", "X-Influxdb-Error, X-Influxdb-Version, Retry-After")
+		return false
+	}
+
+	h.Set("Access-Control-Allow-Methods", c.methods)
+	h.Set("Access-Control-Allow-Headers", c.headers)
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// dbRename is a rule renaming the database of the writes
+type dbRename struct {
+	match string
+	regex *regexp.Regexp
+	to    string
+}
+
+// dbRenames are applied in order, the first matching rule renames the database
+type dbRenames []dbRename
+
+func newDBRenames(cfgs []DatabaseRenameConfig) (dbRenames, error) {
+	var r dbRenames
+	for _, cfg := range cfgs {
+		switch {
+		case cfg.To == "":
+			return nil, errors.New("database rename without a new name")
+		case cfg.Match != "" && cfg.Regex != "":
+			return nil, fmt.Errorf("database rename to %q with both match and regex", cfg.To)
+		case cfg.Match != "":
+			r = append(r, dbRename{match: cfg.Match, to: cfg.To})
+		case cfg.Regex != "":
+			// the whole name must match
+			re, err := regexp.Compile("^(?:" + cfg.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid database rename regex %q: %v", cfg.Regex, err)
+			}
+			r = append(r, dbRename{regex: re, to: cfg.To})
+		default:
+			return nil, fmt.Errorf("database rename to %q without match or regex", cfg.To)
+		}
+	}
+	return r, nil
+}
+
+// rename returns the new name of db, the replacement of a regex can refer to
+// its groups ($1, ${name})
+func (r dbRenames) rename(db string) string {
+	for _, rule := range r {
+		if rule.regex == nil {
+			if rule.match == db {
+				return rule.to
+			}
+			continue
+		}
+
+		if rule.regex.MatchString(db) {
+			return rule.regex.ReplaceAllString(db, rule.to)
+		}
+	}
+	return db
+}
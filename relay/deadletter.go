@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// deadLetter appends rejected line protocol to a local file so it can be
+// inspected or replayed by an operator later on
+type deadLetter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newDeadLetter(filename string) (*deadLetter, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadLetter{f: f}, nil
+}
+
+// write appends each line followed by a newline
+func (d *deadLetter) write(lines [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, l := range lines {
+		if _, err := d.f.Write(l); err != nil {
+			return err
+		}
+		if _, err := d.f.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatch appends a buffered batch rejected by a backend with status,
+// after a header giving its query. The credentials aren't written.
+func (d *deadLetter) writeBatch(b *batch, p *payload, status int) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%squery=%s status=%d\n", purgeBatchHeader, url.QueryEscape(b.query), status)
+	data := p.Bytes()
+	buf.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.f.Write(buf.Bytes())
+	return err
+}
+
+// close closes the file once the relay or the backend is removed, the later
+// writes fail
+func (d *deadLetter) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.f.Close()
+}
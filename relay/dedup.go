@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// dedup drops the points already written during the window, e.g. sent again
+// by an agent retrying a write the relay took too long to answer. Points are
+// identified by a hash of their database, retention policy, series,
+// timestamp and fields. The hashes are kept in two generations rotated every
+// window, so a point is remembered for one to two windows.
+type dedup struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	rotated  time.Time
+
+	duplicates int64
+}
+
+func newDedup(window string) (*dedup, error) {
+	if window == "" {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing dedup window '%v'", err)
+	}
+	if d <= 0 {
+		return nil, nil
+	}
+
+	return &dedup{
+		window:   d,
+		current:  make(map[uint64]struct{}),
+		previous: make(map[uint64]struct{}),
+		rotated:  time.Now(),
+	}, nil
+}
+
+// rotate drops the oldest generation when due, d.mu must be held
+func (d *dedup) rotate(now time.Time) {
+	switch {
+	case now.Sub(d.rotated) >= 2*d.window:
+		d.previous = make(map[uint64]struct{})
+		d.current = make(map[uint64]struct{})
+	case now.Sub(d.rotated) >= d.window:
+		d.previous = d.current
+		d.current = make(map[uint64]struct{})
+	default:
+		return
+	}
+	d.rotated = now
+}
+
+func (d *dedup) contains(h uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rotate(time.Now())
+	if _, ok := d.current[h]; ok {
+		return true
+	}
+	_, ok := d.previous[h]
+	return ok
+}
+
+// dedupBatch collects the hashes of the points of a write, they're only
+// remembered once the write is accepted
+type dedupBatch struct {
+	d      *dedup
+	scope  string
+	hashes []uint64
+}
+
+// batch returns the batch of a write to db and rp, nil when d is
+func (d *dedup) batch(db, rp string) *dedupBatch {
+	if d == nil {
+		return nil
+	}
+	return &dedupBatch{d: d, scope: db + "\x00" + rp}
+}
+
+// duplicate reports whether p was already written during the window
+func (b *dedupBatch) duplicate(p models.Point) bool {
+	h := pointHash(b.scope, p)
+	if b.d.contains(h) {
+		atomic.AddInt64(&b.d.duplicates, 1)
+		return true
+	}
+	b.hashes = append(b.hashes, h)
+	return false
+}
+
+// commit remembers the points of the write once a backend took it, the
+// points of a write which failed aren't, for the retries of the client to
+// go through
+func (b *dedupBatch) commit() {
+	d := b.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rotate(time.Now())
+	for _, h := range b.hashes {
+		d.current[h] = struct{}{}
+	}
+}
+
+// pointHash hashes the identity of p, the fields are sorted as their order
+// in the line may differ between identical points
+func pointHash(scope string, p models.Point) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(scope))
+	h.Write([]byte{0})
+	h.Write(p.Key())
+	h.Write([]byte{0})
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(p.UnixNano()))
+	h.Write(ts[:])
+
+	fields := p.Fields()
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "\x00%s=%T:%v", k, fields[k], fields[k])
+	}
+	return h.Sum64()
+}
+
+// dedupStats is the state of the deduplication of a relay reported by /dedup
+type dedupStats struct {
+	Duplicates int64 `json:"duplicates"`
+	Tracked    int   `json:"tracked_points"`
+}
+
+func (d *dedup) stats() dedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return dedupStats{
+		Duplicates: atomic.LoadInt64(&d.duplicates),
+		Tracked:    len(d.current) + len(d.previous),
+	}
+}
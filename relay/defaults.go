@@ -0,0 +1,254 @@
+package relay
+
+import (
+	"time"
+)
+
+// WithDefaults returns a copy of the configuration with the documented
+// defaults filled in, the way the relays apply them, and the durations
+// normalized (e.g. "10000ms" becomes "10s"). Invalid values are kept as
+// they are for Validate to report. The slices of the returned Config are
+// not shared with cfg.
+func (cfg Config) WithDefaults() Config {
+	cfg.HTTPRelays = httpDefaults(cfg.HTTPRelays)
+	cfg.HTTPTemplates = httpDefaults(cfg.HTTPTemplates)
+
+	udp := make([]UDPConfig, len(cfg.UDPRelays))
+	for i, u := range cfg.UDPRelays {
+		u.Outputs = append([]UDPOutputConfig(nil), u.Outputs...)
+		for j := range u.Outputs {
+			o := &u.Outputs[j]
+			if o.MTU == 0 {
+				o.MTU = defaultMTU
+			}
+			if o.BufferSizeKB > 0 {
+				o.MaxDelayInterval = durationDefault(o.MaxDelayInterval, DefaultMaxDelayInterval)
+			}
+		}
+		if len(u.HTTPOutputs) > 0 {
+			if u.BatchSizeKB <= 0 {
+				u.BatchSizeKB = DefaultUDPBatchSizeKB
+			}
+			u.FlushInterval = durationDefault(u.FlushInterval, DefaultUDPFlushInterval)
+		}
+		u.HTTPOutputs = outputDefaults(u.HTTPOutputs)
+		udp[i] = u
+	}
+	cfg.UDPRelays = udp
+
+	collectd := make([]CollectdConfig, len(cfg.CollectdRelays))
+	for i, c := range cfg.CollectdRelays {
+		if c.BatchSizeKB <= 0 {
+			c.BatchSizeKB = DefaultCollectdBatchSizeKB
+		}
+		c.FlushInterval = durationDefault(c.FlushInterval, DefaultCollectdFlushInterval)
+		c.Outputs = outputDefaults(c.Outputs)
+		collectd[i] = c
+	}
+	cfg.CollectdRelays = collectd
+
+	mqtt := make([]MQTTConfig, len(cfg.MQTTRelays))
+	for i, m := range cfg.MQTTRelays {
+		if m.ClientID == "" {
+			m.ClientID = DefaultMQTTClientID
+		}
+		m.KeepAlive = durationDefault(m.KeepAlive, DefaultMQTTKeepAlive)
+		m.Topics = append([]MQTTTopicConfig(nil), m.Topics...)
+		m.Outputs = outputDefaults(m.Outputs)
+		mqtt[i] = m
+	}
+	cfg.MQTTRelays = mqtt
+
+	cfg.Tenants = append([]TenantConfig(nil), cfg.Tenants...)
+
+	if cfg.Admin.Addr != "" {
+		cfg.Admin.PurgeGracePeriod = durationDefault(cfg.Admin.PurgeGracePeriod, DefaultPurgeGracePeriod)
+	}
+
+	if cfg.BufferPool.MaxBufferKB <= 0 {
+		cfg.BufferPool.MaxBufferKB = DefaultPoolMaxBufferKB
+	}
+	if cfg.BufferPool.SizeMB <= 0 {
+		cfg.BufferPool.SizeMB = DefaultPoolSizeMB
+	}
+
+	if cfg.StatsD.Addr != "" {
+		cfg.StatsD.Interval = durationDefault(cfg.StatsD.Interval, DefaultStatsDInterval)
+		if cfg.StatsD.Prefix == "" {
+			cfg.StatsD.Prefix = DefaultStatsDPrefix
+		}
+	}
+
+	if len(cfg.Notify.Webhooks) > 0 {
+		cfg.Notify.Interval = durationDefault(cfg.Notify.Interval, DefaultNotifyInterval)
+		hooks := make([]WebhookConfig, len(cfg.Notify.Webhooks))
+		for i, w := range cfg.Notify.Webhooks {
+			if w.Type == "" {
+				w.Type = notifierWebhook
+			}
+			if w.Type == notifierPagerDuty && w.URL == "" {
+				w.URL = DefaultPagerDutyURL
+			}
+			w.Timeout = durationDefault(w.Timeout, DefaultWebhookTimeout)
+			hooks[i] = w
+		}
+		cfg.Notify.Webhooks = hooks
+	}
+
+	cfg.Usage.Interval = durationDefault(cfg.Usage.Interval, DefaultUsageInterval)
+	if cfg.Usage.Format == "" {
+		cfg.Usage.Format = usageFormatCSV
+	}
+
+	return cfg
+}
+
+func httpDefaults(relays []HTTPConfig) []HTTPConfig {
+	out := make([]HTTPConfig, len(relays))
+	for i, h := range relays {
+		if h.FanoutTimeout != "" {
+			h.FanoutTimeout = durationDefault(h.FanoutTimeout, 0)
+		}
+		if h.LatencyBudget != "" {
+			h.LatencyBudget = durationDefault(h.LatencyBudget, 0)
+		}
+		if h.HeartbeatInterval != "" {
+			h.HeartbeatInterval = durationDefault(h.HeartbeatInterval, 0)
+		}
+		if h.SelfMetricsInterval != "" {
+			h.SelfMetricsInterval = durationDefault(h.SelfMetricsInterval, 0)
+		}
+		h.ShutdownTimeout = durationDefault(h.ShutdownTimeout, DefaultShutdownTimeout)
+		if h.ProxyQueries || h.FluxBackend != "" {
+			h.QueryTimeout = durationDefault(h.QueryTimeout, DefaultQueryTimeout)
+		}
+		for _, o := range h.Outputs {
+			if o.Role == roleStandby {
+				h.FailoverDelay = durationDefault(h.FailoverDelay, DefaultFailoverDelay)
+				if h.FailoverBufferMB <= 0 {
+					h.FailoverBufferMB = DefaultFailoverBufferMB
+				}
+				break
+			}
+		}
+		if len(h.ACMEDomains) > 0 {
+			h.ACMEDomains = append([]string(nil), h.ACMEDomains...)
+			if h.ACMEDirectory == "" {
+				h.ACMEDirectory = DefaultACMEDirectory
+			}
+			if h.ACMEHTTPAddr == "" {
+				h.ACMEHTTPAddr = DefaultACMEHTTPAddr
+			}
+		}
+
+		if h.Auth.VerifyBackend != "" {
+			h.Auth.VerifyCacheTTL = durationDefault(h.Auth.VerifyCacheTTL, DefaultVerifyCacheTTL)
+		}
+		h.Auth.Tokens = append([]string(nil), h.Auth.Tokens...)
+		h.Auth.Grants = append([]AuthGrantConfig(nil), h.Auth.Grants...)
+
+		h.TagNormalize = append([]TagNormalizeConfig(nil), h.TagNormalize...)
+		for j := range h.TagNormalize {
+			if h.TagNormalize[j].Tag == "" {
+				h.TagNormalize[j].Tag = tagNormalizeAny
+			}
+		}
+
+		h.FieldDrop = append([]FieldDropConfig(nil), h.FieldDrop...)
+		for j := range h.FieldDrop {
+			if h.FieldDrop[j].Measurement == "" {
+				h.FieldDrop[j].Measurement = "*"
+			}
+		}
+
+		h.StringLimits = append([]StringLimitConfig(nil), h.StringLimits...)
+		for j := range h.StringLimits {
+			l := &h.StringLimits[j]
+			if l.Field == "" {
+				l.Field = stringLimitAny
+			}
+			if l.Action == "" {
+				l.Action = stringLimitTruncate
+			}
+		}
+
+		h.Outputs = outputDefaults(h.Outputs)
+		out[i] = h
+	}
+	return out
+}
+
+func outputDefaults(outputs []HTTPOutputConfig) []HTTPOutputConfig {
+	out := make([]HTTPOutputConfig, len(outputs))
+	for i, o := range outputs {
+		if o.Name == "" {
+			o.Name = o.Location
+		}
+		if o.Type == "" {
+			o.Type = "influxdb"
+		}
+		o.Timeout = durationDefault(o.Timeout, DefaultHTTPTimeout)
+
+		if o.Type != "file" {
+			if o.MaxIdleConnsPerHost <= 0 {
+				o.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+			}
+			o.IdleConnTimeout = durationDefault(o.IdleConnTimeout, DefaultIdleConnTimeout)
+			o.DialTimeout = durationDefault(o.DialTimeout, DefaultDialTimeout)
+		}
+
+		// the retry settings only apply to buffered outputs
+		if o.BufferSizeMB > 0 {
+			if o.MaxBatchKB <= 0 {
+				o.MaxBatchKB = DefaultBatchSizeKB
+			}
+			o.MaxDelayInterval = durationDefault(o.MaxDelayInterval, DefaultMaxDelayInterval)
+			if o.BufferOrder == "" {
+				o.BufferOrder = bufferOldestFirst
+			}
+			if o.BufferFull == "" {
+				o.BufferFull = bufferRejectNew
+			}
+			if o.BufferWarningPercent == 0 {
+				o.BufferWarningPercent = DefaultBufferWarningPercent
+			}
+			if o.BufferCriticalPercent == 0 {
+				o.BufferCriticalPercent = DefaultBufferCriticalPercent
+			}
+			if o.ReplayWorkers <= 0 {
+				o.ReplayWorkers = 1
+			}
+			if len(o.RetryStatuses) == 0 {
+				o.RetryStatuses = []string{"5xx"}
+			}
+		}
+
+		if o.Type == "file" {
+			if o.RotateSizeMB <= 0 {
+				o.RotateSizeMB = DefaultSpoolRotateSizeMB
+			}
+			o.RotateInterval = durationDefault(o.RotateInterval, DefaultSpoolRotateInterval)
+		}
+
+		if o.ErrorLogInterval != "" {
+			o.ErrorLogInterval = durationDefault(o.ErrorLogInterval, 0)
+		}
+		if o.ClockSkewThreshold != "" {
+			o.ClockSkewThreshold = durationDefault(o.ClockSkewThreshold, 0)
+		}
+		out[i] = o
+	}
+	return out
+}
+
+// durationDefault returns value normalized, or def when value is empty
+func durationDefault(value string, def time.Duration) string {
+	if value == "" {
+		return def.String()
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return value
+	}
+	return d.String()
+}
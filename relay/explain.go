@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// explanation describes how a relay would handle a write, see Admin.handleExplain
+type explanation struct {
+	Relay   string           `json:"relay"`
+	Query   string           `json:"query"`
+	Points  []explainedPoint `json:"points"`
+	Skipped []string         `json:"skipped,omitempty"`
+	Routes  []string         `json:"routes"`
+
+	// every backend of the relay, along with the reason of the ones which
+	// wouldn't get the write
+	Backends []explainedBackend `json:"backends"`
+
+	// the queries of the backends which rewrite it
+	BackendQueries map[string]string `json:"backend_queries,omitempty"`
+}
+
+type explainedPoint struct {
+	Input      string   `json:"input"`
+	Output     string   `json:"output"`
+	Transforms []string `json:"transforms"`
+}
+
+type explainedBackend struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+
+	// why the backend wouldn't get the write, empty when it would
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// defaultRoute is reported for the writes going to the outputs of the relay,
+// rather than to the ones of a tenant
+const defaultRoute = "default"
+
+// role returns the role of a backend among the outputs of its relay
+func (b *httpBackend) role() string {
+	switch {
+	case b.standby:
+		return "standby"
+	case b.shadow:
+		return "shadow"
+	case b.secondary:
+		return "secondary"
+	}
+	return "primary"
+}
+
+// explain runs the sample body through the same steps as ServeHTTP without
+// forwarding anything to the backends. The tenant of the relays with a
+// tenant-header is given by the tenant query parameter. The backends picked
+// are the ones the next write would go to, the state of the balancer and
+// failover is left as it is.
+func (h *HTTP) explain(queryParams url.Values, body []byte) (*explanation, error) {
+	routes := []string{defaultRoute}
+	backends := h.backends
+	if h.tenants != nil {
+		name := queryParams.Get("tenant")
+		t := h.tenants.tenants[name]
+		if t == nil {
+			return nil, errors.New("unknown tenant")
+		}
+		queryParams.Del("tenant")
+		queryParams.Set("db", t.database)
+		if t.rp != "" {
+			queryParams.Set("rp", t.rp)
+		}
+		if t.backends != nil {
+			backends = t.backends
+			routes = []string{"tenant " + name}
+		}
+	}
+
+	if queryParams.Get("db") == "" {
+		return nil, errors.New("missing parameter: db")
+	}
+
+	db := queryParams.Get("db")
+	candidates := forDatabase(backends, db)
+	subs := h.subscriptions.list()
+	if len(subs) > 0 {
+		candidates = append(append([]*httpBackend(nil), candidates...), forDatabase(subs, db)...)
+	}
+
+	if len(h.dbRenames) > 0 {
+		queryParams.Set("db", h.dbRenames.rename(queryParams.Get("db")))
+	}
+
+	if queryParams.Get("rp") == "" && h.rp != "" {
+		queryParams.Set("rp", h.rp)
+	}
+
+	precision := queryParams.Get("precision")
+	_, points, rejected, err := h.parsePoints(body, time.Now(), precision)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &explanation{
+		Relay:  h.Name(),
+		Query:  queryParams.Encode(),
+		Routes: routes,
+	}
+
+	for _, p := range points {
+		out, transforms, err := h.transform(p)
+		if err != nil {
+			return nil, err
+		}
+
+		ep := explainedPoint{
+			Input:      p.String(),
+			Transforms: transforms,
+		}
+		if out != nil {
+			ep.Output = out.PrecisionString(precision)
+		}
+		if ep.Transforms == nil {
+			ep.Transforms = []string{}
+		}
+		e.Points = append(e.Points, ep)
+	}
+
+	for _, line := range rejected {
+		e.Skipped = append(e.Skipped, string(line))
+	}
+
+	picked := h.previewParticipants(candidates)
+	for _, b := range append(append([]*httpBackend(nil), h.backends...), subs...) {
+		eb := explainedBackend{Name: b.name, Role: b.role()}
+		if containsBackend(subs, b) {
+			eb.Role = "subscriber"
+		}
+		switch {
+		case containsBackend(picked, b):
+		case !containsBackend(backends, b) && !containsBackend(subs, b):
+			eb.Skipped = "not an output of the tenant"
+		case !containsBackend(candidates, b):
+			eb.Skipped = "databases don't match"
+		case b.standby:
+			eb.Skipped = "standby not promoted"
+		case h.balancer != nil:
+			eb.Skipped = "not picked by the balancer"
+		default:
+			eb.Skipped = "not sampled for this write"
+		}
+		e.Backends = append(e.Backends, eb)
+		if eb.Skipped != "" {
+			continue
+		}
+
+		if b.query != nil {
+			q, err := b.query.rewrite(e.Query)
+			if err != nil {
+				return nil, err
+			}
+			if e.BackendQueries == nil {
+				e.BackendQueries = make(map[string]string)
+			}
+			e.BackendQueries[b.name] = q
+		}
+	}
+
+	return e, nil
+}
+
+func containsBackend(backends []*httpBackend, b *httpBackend) bool {
+	for _, other := range backends {
+		if other == b {
+			return true
+		}
+	}
+	return false
+}
+
+// samplePoint builds a line protocol point from a measurement and a
+// comma separated list of key=value tags
+func samplePoint(measurement, tagList string) ([]byte, error) {
+	if measurement == "" {
+		return nil, errors.New("missing parameter: measurement")
+	}
+
+	tags := make(models.Tags)
+	if tagList != "" {
+		for _, kv := range strings.Split(tagList, ",") {
+			i := strings.IndexByte(kv, '=')
+			if i <= 0 {
+				return nil, errors.New("invalid tag: " + kv)
+			}
+			tags[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	p, err := models.NewPoint(measurement, tags, models.Fields{"value": 1.0}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(p.String()), nil
+}
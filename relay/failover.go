@@ -0,0 +1,229 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// roles of the outputs of an HTTP relay: the writes go to the primaries,
+// and to the standbys only while they're promoted
+const (
+	rolePrimary = "primary"
+	roleStandby = "standby"
+
+	DefaultFailoverDelay    = 30 * time.Second
+	DefaultFailoverBufferMB = 64
+)
+
+func checkRole(role string) error {
+	switch role {
+	case "", rolePrimary, roleStandby:
+		return nil
+	}
+	return fmt.Errorf("unknown role %q", role)
+}
+
+// failover promotes the standby backends of a relay once one of its
+// primaries has been unhealthy for delay, and demotes them when all the
+// primaries are healthy again. The writes of the delay are held meanwhile,
+// up to maxHeld bytes with the oldest dropped first, and posted to the
+// standbys when they're promoted so that they catch up with the writes the
+// primary missed.
+type failover struct {
+	relay   string
+	delay   time.Duration
+	maxHeld int
+
+	mu sync.Mutex
+	// when the unhealthy primaries went unhealthy
+	since    map[*httpBackend]time.Time
+	promoted bool
+	held     []heldWrite
+	heldSize int
+
+	promotions int64
+}
+
+type heldWrite struct {
+	pl    *payload
+	query string
+	auth  string
+}
+
+// newFailover returns nil when the relay has no standby
+func newFailover(relay string, backends []*httpBackend, delay time.Duration, maxHeld int) *failover {
+	for _, b := range backends {
+		if b.standby {
+			return &failover{
+				relay:   relay,
+				delay:   delay,
+				maxHeld: maxHeld,
+				since:   make(map[*httpBackend]time.Time),
+			}
+		}
+	}
+	return nil
+}
+
+// route updates the state of the primaries among all the backends of the
+// relay, and returns backends without the standbys unless they're promoted
+func (f *failover) route(all, backends []*httpBackend, now time.Time) []*httpBackend {
+	f.mu.Lock()
+	var standbys []*httpBackend
+	var catchUp []heldWrite
+	for _, b := range all {
+		if b.standby {
+			standbys = append(standbys, b)
+			continue
+		}
+		if b.shadow {
+			continue
+		}
+		if b.healthy() {
+			delete(f.since, b)
+		} else if _, ok := f.since[b]; !ok {
+			f.since[b] = now
+		}
+	}
+
+	failing := false
+	for _, t := range f.since {
+		failing = failing || now.Sub(t) >= f.delay
+	}
+	switch {
+	case failing && !f.promoted:
+		f.promoted = true
+		atomic.AddInt64(&f.promotions, 1)
+		catchUp, f.held, f.heldSize = f.held, nil, 0
+		log.Printf("Promoting the standby backends of relay %q, a primary is unhealthy for over %v, %d writes to catch up", f.relay, f.delay, len(catchUp))
+	case len(f.since) == 0 && (f.promoted || f.held != nil):
+		if f.promoted {
+			log.Printf("Demoting the standby backends of relay %q, the primaries are healthy", f.relay)
+		}
+		f.promoted = false
+		f.release()
+	}
+	promoted := f.promoted
+	f.mu.Unlock()
+
+	if catchUp != nil {
+		go f.catchUp(standbys, catchUp)
+	}
+
+	return withStandbys(backends, promoted)
+}
+
+// preview returns the backends route would for a write at now, without
+// updating the state of the primaries nor promoting or demoting the
+// standbys
+func (f *failover) preview(all, backends []*httpBackend, now time.Time) []*httpBackend {
+	f.mu.Lock()
+	promoted := f.promoted
+	unhealthy, failing := false, false
+	for _, b := range all {
+		if b.standby || b.shadow || b.healthy() {
+			continue
+		}
+		unhealthy = true
+		// the delay of a primary not seen unhealthy yet starts at now
+		t, ok := f.since[b]
+		if !ok {
+			t = now
+		}
+		failing = failing || now.Sub(t) >= f.delay
+	}
+	f.mu.Unlock()
+
+	switch {
+	case failing:
+		promoted = true
+	case !unhealthy:
+		promoted = false
+	}
+	return withStandbys(backends, promoted)
+}
+
+// withStandbys returns backends without the standbys unless they're promoted
+func withStandbys(backends []*httpBackend, promoted bool) []*httpBackend {
+	if promoted {
+		return backends
+	}
+	out := make([]*httpBackend, 0, len(backends))
+	for _, b := range backends {
+		if !b.standby {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// hold keeps a copy of a write while a primary is unhealthy and the
+// standbys aren't promoted yet
+func (f *failover) hold(pl *payload, query string, auth string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.promoted || len(f.since) == 0 || pl.Len() > f.maxHeld {
+		return
+	}
+
+	for f.heldSize+pl.Len() > f.maxHeld {
+		f.heldSize -= f.held[0].pl.Len()
+		f.held[0].pl.release()
+		f.held = f.held[1:]
+	}
+	f.held = append(f.held, heldWrite{pl: pl.clone(), query: query, auth: auth})
+	f.heldSize += pl.Len()
+}
+
+// release drops the held writes, f.mu must be held
+func (f *failover) release() {
+	for _, w := range f.held {
+		w.pl.release()
+	}
+	f.held, f.heldSize = nil, 0
+}
+
+// catchUp posts the writes held before the promotion to every standby
+func (f *failover) catchUp(standbys []*httpBackend, held []heldWrite) {
+	var wg sync.WaitGroup
+	for _, b := range standbys {
+		b := b
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, w := range held {
+				resp, err := b.post(w.pl, w.query, w.auth)
+				b.observe(f.relay, resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, w := range held {
+		w.pl.release()
+	}
+}
+
+// failoverStatus is the state of the standbys of a relay reported by /status
+type failoverStatus struct {
+	Promoted   bool  `json:"promoted"`
+	HeldWrites int   `json:"held_writes"`
+	HeldBytes  int   `json:"held_bytes"`
+	Promotions int64 `json:"promotions"`
+}
+
+func (f *failover) status() failoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return failoverStatus{
+		Promoted:   f.promoted,
+		HeldWrites: len(f.held),
+		HeldBytes:  f.heldSize,
+		Promotions: atomic.LoadInt64(&f.promotions),
+	}
+}
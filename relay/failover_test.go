@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func gzipBody(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// the writes held for the standbys keep the encoding of the gzip bodies
+// forwarded as they are, and are caught up with as gzip
+func TestPassthroughFailoverCatchUp(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	var mu sync.Mutex
+	var got []string
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lines := "not gzip: " + string(body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+				data, _ := ioutil.ReadAll(zr)
+				lines = string(data)
+			}
+		}
+		mu.Lock()
+		got = append(got, lines)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer standby.Close()
+
+	r, err := NewHTTP(HTTPConfig{
+		Name:            "test",
+		Addr:            "127.0.0.1:0",
+		GzipPassthrough: true,
+		FailoverDelay:   "50ms",
+		Outputs: []HTTPOutputConfig{
+			{Name: "primary", Location: primary.URL + "/write"},
+			{Name: "standby", Location: standby.URL + "/write", Role: roleStandby},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.(*HTTP)
+
+	write := func(lines string) {
+		req := httptest.NewRequest("POST", "/write?db=test", bytes.NewReader(gzipBody(t, lines)))
+		req.Header.Set("Content-Encoding", "gzip")
+		serveTest(h, req)
+	}
+
+	// the first write fails the primary, the second one is held until the
+	// standby is promoted by the third one
+	write("cpu value=1\n")
+	write("cpu value=2\n")
+	time.Sleep(60 * time.Millisecond)
+	write("cpu value=3\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("standby got %d writes, want 2", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"cpu value=2\n": true, "cpu value=3\n": true}
+	for _, lines := range got {
+		if !want[lines] {
+			t.Errorf("standby got %q", lines)
+		}
+		delete(want, lines)
+	}
+	for lines := range want {
+		t.Errorf("standby didn't get %q", lines)
+	}
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// fieldDrop removes the fields matching a field pattern from the points of
+// the measurements matching a measurement pattern, see FieldDropConfig
+type fieldDrop struct {
+	measurement string
+	field       string
+}
+
+type fieldDrops []fieldDrop
+
+func newFieldDrops(cfgs []FieldDropConfig) (fieldDrops, error) {
+	var d fieldDrops
+	for _, cfg := range cfgs {
+		m, f := cfg.Measurement, cfg.Field
+		if m == "" {
+			m = "*"
+		}
+		if f == "" {
+			return nil, fmt.Errorf("field-drop of measurement %q without field", m)
+		}
+
+		// the patterns are checked once, path.Match only reports malformed
+		// patterns when they are used
+		if _, err := path.Match(m, ""); err != nil {
+			return nil, fmt.Errorf("invalid measurement pattern %q", m)
+		}
+		if _, err := path.Match(f, ""); err != nil {
+			return nil, fmt.Errorf("invalid field pattern %q", f)
+		}
+
+		d = append(d, fieldDrop{measurement: m, field: f})
+	}
+	return d, nil
+}
+
+// apply removes the matching fields of p. The point is returned unchanged
+// when it has none of them and nil when no field is left, along with a
+// description of what was done.
+func (d fieldDrops) apply(p models.Point) (models.Point, []string, error) {
+	if len(d) == 0 {
+		return p, nil, nil
+	}
+
+	name := p.Name()
+	var fields models.Fields
+	var transforms []string
+
+	for _, rule := range d {
+		if ok, _ := path.Match(rule.measurement, name); !ok {
+			continue
+		}
+
+		if fields == nil {
+			fields = p.Fields()
+		}
+		for k := range fields {
+			if ok, _ := path.Match(rule.field, k); ok {
+				delete(fields, k)
+				transforms = append(transforms, fmt.Sprintf("dropped field %q", k))
+			}
+		}
+	}
+
+	if transforms == nil {
+		return p, nil, nil
+	}
+
+	if len(fields) == 0 {
+		return nil, append(transforms, "dropped point without fields"), nil
+	}
+
+	np, err := models.NewPoint(p.Name(), p.Tags(), fields, p.Time())
+	if err != nil {
+		return nil, nil, err
+	}
+	return np, transforms, nil
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const fluxQueryPath = "/api/v2/query"
+
+// newFluxBackend returns the backend the Flux queries of /api/v2/query are
+// relayed to, nil unless cfg has a flux-backend. Unlike the InfluxQL
+// queries they all go to this backend, e.g. the one InfluxDB 1.8 with
+// flux-enabled runs on.
+func newFluxBackend(cfg HTTPConfig, backends []*httpBackend) (*queryBackend, error) {
+	i, err := checkFluxBackend(cfg)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+
+	timeout, err := queryTimeout(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newQueryBackend(backends[i], &cfg.Outputs[i], "api/v2/query", timeout)
+}
+
+// checkFluxBackend returns the index of the flux-backend output, -1 when
+// there's none
+func checkFluxBackend(cfg HTTPConfig) (int, error) {
+	if cfg.FluxBackend == "" {
+		return -1, nil
+	}
+
+	i := outputIndex(cfg.Outputs, cfg.FluxBackend)
+	if i < 0 {
+		return -1, fmt.Errorf("unknown flux-backend %q", cfg.FluxBackend)
+	}
+	if o := cfg.Outputs[i]; o.Type != "" && o.Type != "influxdb" {
+		return -1, fmt.Errorf("flux-backend %q isn't an influxdb output", cfg.FluxBackend)
+	}
+	if err := checkQueryCredentials(cfg, cfg.Outputs[i]); err != nil {
+		return -1, err
+	}
+	return i, nil
+}
+
+// fluxQuery relays a Flux query of the clients of h, its JSON or Flux body
+// being streamed to the backend and its CSV answer streamed back
+func (h *HTTP) fluxQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid query method")
+		return
+	}
+
+	params := r.URL.Query()
+	if !h.authorizeQuery(w, r, params) {
+		return
+	}
+
+	resp, err := h.flux.do(r, r.Body, params)
+	if err != nil {
+		log.Printf("Problem relaying a Flux query of relay %q to backend %q: %v", h.Name(), h.flux.b.name, err)
+		h.flux.b.errors.mu.Lock()
+		h.flux.b.errors.lastFailure = time.Now()
+		h.flux.b.errors.mu.Unlock()
+		jsonError(w, http.StatusServiceUnavailable, "flux backend unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	copyQueryResponse(w, resp)
+}
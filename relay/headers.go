@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// outputHeaders are the headers added to every post to a backend, e.g. the
+// tenant or token required by a gateway in front of it. They replace the
+// ones of the client, the Authorization header included.
+type outputHeaders struct {
+	header http.Header
+	host   string
+
+	// Authorization header of the posts whose client supplied no
+	// credentials, built from the username and password of the output
+	defaultAuth string
+}
+
+// headers set by the posters from the write itself
+var reservedOutputHeaders = map[string]bool{
+	"Content-Type":     true,
+	"Content-Length":   true,
+	"Content-Encoding": true,
+}
+
+func newOutputHeaders(headers map[string]string) (outputHeaders, error) {
+	h := outputHeaders{header: make(http.Header)}
+	for k, v := range headers {
+		k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+		switch {
+		case k == "" || strings.ContainsAny(k, " \t\r\n:"):
+			return h, fmt.Errorf("invalid header name %q", k)
+		case strings.ContainsAny(v, "\r\n"):
+			return h, fmt.Errorf("invalid value of header %q", k)
+		case reservedOutputHeaders[k]:
+			return h, fmt.Errorf("header %q is set by the relay", k)
+		case k == "Host":
+			h.host = v
+		default:
+			h.header.Set(k, v)
+		}
+	}
+	return h, nil
+}
+
+// basicAuth returns the Authorization header of basic authentication
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func (h outputHeaders) set(req *http.Request) {
+	if h.defaultAuth != "" && req.Header.Get("Authorization") == "" {
+		if q := req.URL.Query(); q.Get("u") == "" && q.Get("p") == "" {
+			req.Header.Set("Authorization", h.defaultAuth)
+		}
+	}
+	for k, vs := range h.header {
+		req.Header[k] = vs
+	}
+	if h.host != "" {
+		req.Host = h.host
+	}
+}
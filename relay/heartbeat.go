@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const heartbeatMeasurement = "relay_heartbeat"
+
+// heartbeat periodically writes a relay_heartbeat point to every backend of
+// an HTTP relay, tagged with the relay and the backend. The points go through
+// the posters of the backends like any write, so a missing heartbeat tells a
+// broken relay to backend path from agents which stopped writing. Timestamps
+// are truncated to the interval, a heartbeat written twice in an interval
+// (e.g. by a retry buffer) leaves a single point.
+type heartbeat struct {
+	interval time.Duration
+	query    string
+
+	closing chan struct{}
+}
+
+// newHeartbeat returns nil when no interval is configured
+func newHeartbeat(cfg HTTPConfig) (*heartbeat, error) {
+	if cfg.HeartbeatInterval == "" {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(cfg.HeartbeatInterval)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing heartbeat interval '%v'", err)
+	}
+	if d <= 0 {
+		return nil, errors.New("heartbeat interval must be positive")
+	}
+	if cfg.HeartbeatDatabase == "" {
+		return nil, errors.New("heartbeat-interval requires heartbeat-database")
+	}
+
+	q := url.Values{"db": {cfg.HeartbeatDatabase}}
+	if cfg.DefaultRetentionPolicy != "" {
+		q.Set("rp", cfg.DefaultRetentionPolicy)
+	}
+
+	return &heartbeat{
+		interval: d,
+		query:    q.Encode(),
+		closing:  make(chan struct{}),
+	}, nil
+}
+
+// run writes the heartbeats of h until stop is called
+func (hb *heartbeat) run(h *HTTP) {
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			hb.beat(h, t)
+		case <-hb.closing:
+			return
+		}
+	}
+}
+
+func (hb *heartbeat) stop() {
+	close(hb.closing)
+}
+
+// beat writes one heartbeat to every backend of h, without waiting for them
+func (hb *heartbeat) beat(h *HTTP, now time.Time) {
+	now = now.Truncate(hb.interval)
+
+	for _, b := range h.backends {
+		p, err := models.NewPoint(heartbeatMeasurement, models.Tags{
+			"relay":   h.Name(),
+			"backend": b.name,
+		}, models.Fields{"value": int64(1)}, now)
+		if err != nil {
+			log.Printf("Problem creating heartbeat of relay %q for %q: %v", h.Name(), b.name, err)
+			continue
+		}
+
+		buf := getBuf()
+		buf.WriteString(p.PrecisionString(""))
+		buf.WriteByte('\n')
+
+		b := b
+		pl := newPayload(buf)
+		go func() {
+			defer pl.release()
+			resp, err := b.post(pl, hb.query, "")
+			b.observe(h.Name(), resp, err)
+		}()
+	}
+}
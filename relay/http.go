@@ -6,9 +6,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,23 +26,191 @@ type HTTP struct {
 	name   string
 	schema string
 
-	cert string
+	cert serverCert
 	rp   string
+	db   string
 
-	closing int64
-	l       net.Listener
+	clientAuth clientAuth
+	allowedCNs allowedCNs
+
+	rate       *rateLimiter
+	clientRate *clientRateLimiter
+	quotas     *quotas
+
+	proxyProtocol bool
+	accessLog     bool
+
+	// proxies whose X-Forwarded-For and X-Real-IP headers are trusted, the
+	// clients allowed to write, any when empty, and the ones which aren't
+	trustedProxies cidrList
+	allowedClients cidrList
+	deniedClients  cidrList
+
+	// tokens of the writers, nil when they aren't authenticated
+	auth *tokenAuth
+
+	// cross-origin requests, nil when disabled
+	cors *cors
+
+	// database of the writes per tenant header, nil when disabled
+	tenants *tenantHeader
+
+	lenient    bool
+	deadLetter *deadLetter
+
+	dbRenames dbRenames
+
+	// drops the points written again during a window, nil when disabled
+	dedup *dedup
+
+	// coalesces the small writes, nil when disabled
+	batcher *microBatcher
+
+	limit        *lineLimit
+	tagRewrite   *tagRewriter
+	tagNormalize tagNormalizers
+	staticTags   staticTags
+	fieldDrops   fieldDrops
+	stringLimits stringLimits
+
+	// number of lines dropped by lenient parsing
+	skippedLines int64
+
+	// requests received, reported to statsd
+	requests int64
+
+	usage *usageExporter
+
+	// maximum size of a request body once decompressed, 0 for unlimited
+	maxBodySize int64
+
+	// size over which the writes are streamed to the backends, 0 to never
+	// stream them
+	streamThreshold int64
+
+	// forward the gzip bodies without decompressing them
+	gzipPassthrough bool
+
+	// answer the writes with an empty body with a 400 instead of a 204
+	rejectEmpty bool
+
+	// maximum time waited for the backends before answering the client
+	fanoutTimeout time.Duration
+
+	// time after which a write accepted by a retry buffer is acknowledged
+	latencyBudget time.Duration
+
+	// answer of the writes some backends failed or buffered, empty to
+	// answer them as soon as a backend took the write
+	partialSuccess string
+
+	// report the outcome of every backend in the headers of the answers
+	backendHeaders bool
+
+	// database and retention policy of the buckets of the v2 writes
+	buckets bucketMap
+
+	// answers /ping from the backends, nil to always answer a 204
+	pinger *pinger
+
+	// relays the queries, nil unless proxy-queries is set
+	querier *querier
+
+	// backend of the Flux queries, nil unless flux-backend is set
+	flux *queryBackend
+
+	// X-Influxdb-Version of the answers, or the detector of the version of
+	// the backends when it's nil
+	version  string
+	versions *versionDetector
+
+	heartbeat *heartbeat
+
+	// writes the metrics of the relay to its backends, nil when disabled
+	selfMetrics *selfMetrics
+
+	// acknowledgment parity of the old and new clusters, nil unless
+	// migrating
+	migration *migrationTracker
+
+	// listen with SO_REUSEPORT
+	reusePort bool
+
+	// timeouts and limits of the server of the listener, which gives the
+	// writes being served time to complete when the relay stops
+	serverConfig serverConfig
+	server       *managedServer
 
 	backends []*httpBackend
+
+	// some backends only get a percentage of the writes
+	sampled bool
+
+	// picks the backend of every write, nil when they're mirrored
+	balancer *balancer
+
+	// promotes the standby backends, nil when there are none
+	failover *failover
+
+	// some backends are shadows, see shadow
+	shadowed bool
+
+	// subscribers registered at runtime
+	subscriptions subscriptions
+
+	// Stop may be called again, e.g. by a removal racing with Service.Stop
+	stopOnce  sync.Once
+	closeOnce sync.Once
 }
 
 // httpBackend代表运行着的influxdb实例
 type httpBackend struct {
 	poster
 	name string
+
+	errors *backendErrors
+
+	// the failures of secondary backends are never answered to the client
+	secondary bool
+
+	// role of the backend in a cluster migration
+	migration string
+
+	// percentage of the writes mirrored to the backend, 0 for every write
+	percentage float64
+
+	// only gets the writes while promoted, see failover
+	standby bool
+
+	// path.Match patterns of the databases of the writes the backend gets,
+	// every database when empty
+	databases []string
+
+	// the writes don't wait for the backend, see shadow
+	shadow bool
+
+	// writes being posted to the backend
+	inflight int64
+
+	skew *clockSkew
+
+	// durations of the posts of the client writes, for the self metrics
+	latency backendLatency
+
+	// rewrites the query of the writes, nil when it is kept as is
+	query *queryRewriter
+
+	// rolls up the points of some measurements, nil when none is
+	aggregate *aggregator
+
+	// files the writes are appended to, nil unless the output is a file
+	spool *spoolPoster
 }
 
+// poster writes a payload to a backend. The payload is only valid until
+// post returns, posters holding on to it must take their own reference.
 type poster interface {
-	post([]byte, string, string) (*responseData, error)
+	post(*payload, string, string) (*responseData, error)
 }
 
 type responseData struct {
@@ -49,33 +218,62 @@ type responseData struct {
 	ContentEncoding string
 	StatusCode      int
 	Body            []byte
+
+	// clock offset of the backend, when its response had a Date header
+	Skew      time.Duration
+	SkewKnown bool
 }
 
 type simplePoster struct {
 	client   *http.Client
 	location string
+	headers  outputHeaders
 }
 
-func (b *simplePoster) post(buf []byte, query string, auth string) (*responseData, error) {
+func (b *simplePoster) post(p *payload, query string, auth string) (*responseData, error) {
+	buf := p.Bytes()
 	req, err := http.NewRequest("POST", b.location, bytes.NewReader(buf))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	if p.encoding != "" {
+		req.Header.Set("Content-Encoding", p.encoding)
+	}
+	return b.do(req, query, auth)
+}
+
+// postStream posts the body read from r, which is sent chunked
+func (b *simplePoster) postStream(r io.Reader, encoding string, query string, auth string) (*responseData, error) {
+	req, err := http.NewRequest("POST", b.location, r)
+	if err != nil {
+		return nil, err
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return b.do(req, query, auth)
+}
 
+func (b *simplePoster) do(req *http.Request, query string, auth string) (*responseData, error) {
 	req.URL.RawQuery = query
 	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
 	if auth != "" {
 		req.Header.Set("Authorization", auth)
 	}
+	b.headers.set(req)
 
+	sent := time.Now()
 	resp, err := b.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	skew, known := measureSkew(resp.Header, sent, time.Now())
 
+	// the body is read to the end for the connection to be reused
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 
@@ -84,17 +282,29 @@ func (b *simplePoster) post(buf []byte, query string, auth string) (*responseDat
 	}
 
 	return &responseData{
-		ContentType:     resp.Header.Get("Conent-Type"),
-		ContentEncoding: resp.Header.Get("Conent-Encoding"),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
 		StatusCode:      resp.StatusCode,
 		Body:            data,
+		Skew:            skew,
+		SkewKnown:       known,
 	}, nil
 }
 
+const (
+	emptyBodyAccept = "accept"
+	emptyBodyReject = "reject"
+
+	partialSuccessNoContent = "no-content"
+	partialSuccessAccepted  = "accepted"
+	partialSuccessWarning   = "warning"
+)
+
 const (
 	DefaultHTTPTimeout      = 10 * time.Second
 	DefaultMaxDelayInterval = 10 * time.Second
 	DefaultBatchSizeKB      = 512
+	DefaultShutdownTimeout  = 30 * time.Second
 
 	KB = 1024
 	MB = 1024 * KB
@@ -107,16 +317,206 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 	h.addr = cfg.Addr
 	h.name = cfg.Name
 
-	h.cert = cfg.SSLCombinedPem
+	cert, err := newServerCert(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.cert = cert
+
+	ca, err := newClientAuth(cfg, cert)
+	if err != nil {
+		return nil, err
+	}
+	h.clientAuth = ca
+	h.allowedCNs = newAllowedCNs(cfg.SSLAllowedCNs)
 	h.rp = cfg.DefaultRetentionPolicy
+	h.db = cfg.Database
+	if cfg.RateLimitPerClient {
+		h.clientRate = newClientRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	} else {
+		h.rate = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	if h.quotas, err = newQuotas(cfg.Quotas); err != nil {
+		return nil, err
+	}
+	h.proxyProtocol = cfg.AcceptProxyProtocol
+	h.accessLog = cfg.AccessLog
+
+	if err := checkReusePort(cfg.ReusePort); err != nil {
+		return nil, err
+	}
+	h.reusePort = cfg.ReusePort
+	shutdownTimeout := DefaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		d, err := time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing shutdown timeout '%v'", err)
+		}
+		shutdownTimeout = d
+	}
+	if h.serverConfig, err = newServerConfig(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkServerLimits(h.serverConfig); err != nil {
+		return nil, err
+	}
+	h.server = newManagedServer(h, h.serverConfig, shutdownTimeout)
+
+	if h.trustedProxies, err = newCIDRList(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted-proxies: %v", err)
+	}
+	if h.allowedClients, err = newCIDRList(cfg.AllowedClients); err != nil {
+		return nil, fmt.Errorf("invalid allowed-clients: %v", err)
+	}
+	if h.deniedClients, err = newCIDRList(cfg.DeniedClients); err != nil {
+		return nil, fmt.Errorf("invalid denied-clients: %v", err)
+	}
+
+	if h.auth, err = newTokenAuth(cfg.Auth, cfg.Outputs); err != nil {
+		return nil, fmt.Errorf("invalid auth: %v", err)
+	}
+
+	if h.cors, err = newCORS(cfg.CORS); err != nil {
+		return nil, err
+	}
+
+	h.lenient = cfg.LenientParse
+	if cfg.DeadLetterFile != "" {
+		d, err := newDeadLetter(cfg.DeadLetterFile)
+		if err != nil {
+			return nil, err
+		}
+		h.deadLetter = d
+	}
+
+	if cfg.FanoutTimeout != "" {
+		d, err := time.ParseDuration(cfg.FanoutTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing fan-out timeout '%v'", err)
+		}
+		h.fanoutTimeout = d
+	}
+
+	if cfg.LatencyBudget != "" {
+		d, err := time.ParseDuration(cfg.LatencyBudget)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing latency budget '%v'", err)
+		}
+		h.latencyBudget = d
+	}
+
+	hb, err := newHeartbeat(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.heartbeat = hb
+
+	if h.selfMetrics, err = newSelfMetrics(cfg); err != nil {
+		return nil, err
+	}
+
+	mt, err := newMigrationTracker(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.migration = mt
+
+	switch cfg.EmptyBody {
+	case "", emptyBodyAccept:
+	case emptyBodyReject:
+		h.rejectEmpty = true
+	default:
+		return nil, fmt.Errorf("unknown empty-body %q", cfg.EmptyBody)
+	}
+
+	h.backendHeaders = cfg.BackendStatusHeaders
+
+	if h.pinger, err = newPinger(cfg); err != nil {
+		return nil, err
+	}
+
+	if h.buckets, err = newBucketMap(cfg.BucketMap); err != nil {
+		return nil, err
+	}
+
+	switch cfg.InfluxDBVersion {
+	case "":
+		h.version = DefaultInfluxDBVersion
+	case influxDBVersionAuto:
+		if h.versions, err = newVersionDetector(cfg.Outputs); err != nil {
+			return nil, err
+		}
+	default:
+		h.version = cfg.InfluxDBVersion
+	}
+
+	switch cfg.PartialSuccess {
+	case "", partialSuccessNoContent:
+	case partialSuccessAccepted, partialSuccessWarning:
+		h.partialSuccess = cfg.PartialSuccess
+	default:
+		return nil, fmt.Errorf("unknown partial-success %q", cfg.PartialSuccess)
+	}
+
+	h.maxBodySize = int64(cfg.MaxBodySizeKB) * KB
+	h.limit = newLineLimit(cfg.MaxLineLength, cfg.TruncateLongLines)
+
+	dd, err := newDedup(cfg.DedupWindow)
+	if err != nil {
+		return nil, err
+	}
+	h.dedup = dd
+
+	mb, err := newMicroBatcher(h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.batcher = mb
+
+	dr, err := newDBRenames(cfg.DatabaseRename)
+	if err != nil {
+		return nil, err
+	}
+	h.dbRenames = dr
+
+	tr, err := newTagRewriter(cfg.TagRename, cfg.TagDrop)
+	if err != nil {
+		return nil, err
+	}
+	h.tagRewrite = tr
+
+	tn, err := newTagNormalizers(cfg.TagNormalize)
+	if err != nil {
+		return nil, err
+	}
+	h.tagNormalize = tn
+
+	st, err := newStaticTags(cfg.Tags)
+	if err != nil {
+		return nil, err
+	}
+	h.staticTags = st
+
+	fd, err := newFieldDrops(cfg.FieldDrop)
+	if err != nil {
+		return nil, err
+	}
+	h.fieldDrops = fd
+
+	sl, err := newStringLimits(cfg.StringLimits)
+	if err != nil {
+		return nil, err
+	}
+	h.stringLimits = sl
 
 	// good tasty
 	h.schema = "http"
-	if h.cert != "" {
+	if h.cert.enabled() {
 		h.schema = "https"
 	}
 
 	// Outputs: influxdb实例.
+	full, primary := false, false
 	for i := range cfg.Outputs {
 		backend, err := newHTTPBackend(&cfg.Outputs[i])
 		if err != nil {
@@ -124,6 +524,75 @@ func NewHTTP(cfg HTTPConfig) (Relay, error) {
 		}
 
 		h.backends = append(h.backends, backend)
+		if backend.sampled() {
+			h.sampled = true
+		} else if !backend.standby && !backend.shadow && len(backend.databases) == 0 {
+			full = true
+		}
+		primary = primary || !backend.standby && !backend.shadow
+		h.shadowed = h.shadowed || backend.shadow
+	}
+	if len(h.backends) > 0 && !primary {
+		return nil, errors.New("every output is a standby or a shadow, none answers the writes")
+	}
+	if len(h.backends) > 0 && !full {
+		return nil, errors.New("every output has a percentage or databases, some writes would be written nowhere")
+	}
+
+	if h.balancer, err = newBalancer(cfg.Mode); err != nil {
+		return nil, err
+	}
+	if h.balancer != nil && h.sampled {
+		return nil, fmt.Errorf("percentage of the outputs with mode %q", cfg.Mode)
+	}
+
+	failoverDelay := DefaultFailoverDelay
+	if cfg.FailoverDelay != "" {
+		d, err := time.ParseDuration(cfg.FailoverDelay)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing failover delay '%v'", err)
+		}
+		failoverDelay = d
+	}
+	failoverBufferMB := DefaultFailoverBufferMB
+	if cfg.FailoverBufferMB > 0 {
+		failoverBufferMB = cfg.FailoverBufferMB
+	}
+	h.failover = newFailover(h.Name(), h.backends, failoverDelay, failoverBufferMB*MB)
+
+	if h.querier, err = newQuerier(cfg, h.backends); err != nil {
+		return nil, err
+	}
+	if h.flux, err = newFluxBackend(cfg, h.backends); err != nil {
+		return nil, err
+	}
+
+	aggregates, err := checkAggregates(cfg.Aggregate, cfg.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range h.backends {
+		if rules := aggregates[b.name]; len(rules) > 0 {
+			b.aggregate = newAggregator(h.Name(), b.name, rules, b.poster)
+		}
+	}
+
+	if h.tenants, err = newTenantHeader(cfg, h); err != nil {
+		return nil, err
+	}
+
+	if cfg.StreamThresholdKB > 0 {
+		if err := h.checkUnparsed("stream-threshold-kb"); err != nil {
+			return nil, err
+		}
+		h.streamThreshold = int64(cfg.StreamThresholdKB) * KB
+	}
+
+	if cfg.GzipPassthrough {
+		if err := h.checkUnparsed("gzip-passthrough"); err != nil {
+			return nil, err
+		}
+		h.gzipPassthrough = true
 	}
 
 	return h, nil
@@ -143,7 +612,82 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 		timeout = t
 	}
 
-	var p poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+	tc, err := newTransportConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := newOutputHeaders(cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+	}
+	if err := checkRole(cfg.Role); err != nil {
+		return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+	}
+	if err := checkPatterns("database", cfg.Databases); err != nil {
+		return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+	}
+	if err := checkPatterns("measurement", cfg.Measurements); err != nil {
+		return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+	}
+	if len(cfg.Measurements) > 0 && cfg.Type != outputSubscriber {
+		return nil, fmt.Errorf("backend %q: measurements of an output which isn't a subscriber", cfg.Name)
+	}
+	shadow := cfg.Shadow || cfg.Type == outputSubscriber
+	if shadow && cfg.BufferSizeMB > 0 {
+		return nil, fmt.Errorf("backend %q: shadow with a retry buffer", cfg.Name)
+	}
+	if cfg.Username != "" {
+		headers.defaultAuth = basicAuth(cfg.Username, cfg.Password)
+	}
+
+	var p poster
+	var spool *spoolPoster
+	switch cfg.Type {
+	case "", "influxdb":
+		sp := newSimplePoster(cfg.Location, timeout, tc)
+		sp.headers = headers
+		p = sp
+	case "prometheus":
+		pp := newPromPoster(cfg.Location, timeout, tc)
+		pp.headers = headers
+		p = pp
+	case "victoriametrics":
+		vp, err := newVMPoster(cfg, timeout, tc)
+		if err != nil {
+			return nil, err
+		}
+		vp.headers = headers
+		p = vp
+	case outputSubscriber:
+		sp := newSimplePoster(cfg.Location, timeout, tc)
+		sp.headers = headers
+		p = &subscriberPoster{measurements: cfg.Measurements, p: sp}
+	case "file":
+		sp, err := newSpoolPoster(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p, spool = sp, sp
+	default:
+		return nil, fmt.Errorf("unknown output type %q for backend %q", cfg.Type, cfg.Name)
+	}
+
+	if cfg.MaxPostSizeKB > 0 {
+		p = &splitPoster{max: cfg.MaxPostSizeKB * KB, p: p}
+	}
+
+	query, err := newQueryRewriter(cfg, p)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+	}
+	if query != nil {
+		p = query
+	}
+
+	if cfg.ImmediateRetries > 0 && cfg.Type != "file" {
+		p = &immediateRetrier{retries: cfg.ImmediateRetries, p: p}
+	}
 
 	// If configured, create a retryBuffer per backend.
 	// This way we serialize retries against each backend.
@@ -162,12 +706,76 @@ func newHTTPBackend(cfg *HTTPOutputConfig) (*httpBackend, error) {
 			batch = cfg.MaxBatchKB * KB
 		}
 
-		p = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
+		if err := checkBufferOrder(cfg.BufferOrder); err != nil {
+			return nil, err
+		}
+
+		if err := checkBufferFull(cfg.BufferFull); err != nil {
+			return nil, err
+		}
+
+		if err := checkBufferThresholds(cfg.BufferWarningPercent, cfg.BufferCriticalPercent); err != nil {
+			return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+		}
+
+		rb := newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, cfg.BufferCopy, cfg.BufferOrder, cfg.BufferFull, p)
+		rb.name = cfg.Name
+		if cfg.BufferWarningPercent > 0 {
+			rb.warningPercent = cfg.BufferWarningPercent
+		}
+		if cfg.BufferCriticalPercent > 0 {
+			rb.criticalPercent = cfg.BufferCriticalPercent
+		}
+		rb.startReplayWorkers(cfg.ReplayWorkers)
+		if rb.statuses, err = newRetryStatuses(cfg.RetryStatuses); err != nil {
+			return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+		}
+		if cfg.DeadLetterFile != "" {
+			d, err := newDeadLetter(cfg.DeadLetterFile)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %v", cfg.Name, err)
+			}
+			rb.deadLetter = d
+		}
+		p = rb
+	}
+
+	var skewThreshold time.Duration
+	if cfg.ClockSkewThreshold != "" {
+		d, err := time.ParseDuration(cfg.ClockSkewThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing clock skew threshold '%v'", err)
+		}
+		skewThreshold = d
+	}
+
+	var logInterval time.Duration
+	if cfg.ErrorLogInterval != "" {
+		d, err := time.ParseDuration(cfg.ErrorLogInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing error log interval '%v'", err)
+		}
+		logInterval = d
 	}
+
 	// 如果配置了缓冲区间,这post带有重试机制
 	return &httpBackend{
 		poster: p,
 		name:   cfg.Name,
+		errors: newBackendErrors(logInterval),
+
+		// VictoriaMetrics rejects some writes InfluxDB accepts (e.g. string
+		// only points), that must not fail the write for the client, neither
+		// must the new cluster during a migration
+		secondary:  cfg.Type == "victoriametrics" || cfg.Migration == migrationNew || shadow,
+		migration:  cfg.Migration,
+		percentage: cfg.Percentage,
+		standby:    cfg.Role == roleStandby,
+		databases:  cfg.Databases,
+		shadow:     shadow,
+		skew:       newClockSkew(skewThreshold),
+		query:      query,
+		spool:      spool,
 	}, nil
 }
 
@@ -180,52 +788,138 @@ func (h *HTTP) Name() string {
 
 // 1. 启动监听
 func (h *HTTP) Run() error {
-	l, err := net.Listen("tcp", h.addr)
+	l, err := listen("tcp", h.addr, h.reusePort)
 	if err != nil {
 		return err
 	}
 
+	if h.proxyProtocol {
+		l = newProxyListener(l)
+	}
+
 	// support HTTPS
-	if h.cert != "" {
-		cert, err := tls.LoadX509KeyPair(h.cert, h.cert)
+	if h.cert.enabled() {
+		t, release, err := h.clientAuth.tlsConfig(h.cert)
 		if err != nil {
+			l.Close()
 			return err
 		}
+		defer release()
 
-		l = tls.NewListener(l, &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
+		l = tls.NewListener(l, t)
 	}
 
-	h.l = l
-
 	log.Printf("Starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.addr)
 
-	// h实现了ServeHTTP接口
-	err = http.Serve(l, h)
-	// todo: what ?
-	if atomic.LoadInt64(&h.closing) != 0 {
-		return nil
+	if h.heartbeat != nil {
+		go h.heartbeat.run(h)
 	}
-	return err
+	if h.selfMetrics != nil {
+		go h.selfMetrics.run(h)
+	}
+	if h.versions != nil {
+		go h.versions.run()
+	}
+
+	// h实现了ServeHTTP接口
+	return h.server.serve(l)
 }
 
 func (h *HTTP) Stop() error {
-	atomic.StoreInt64(&h.closing, 1)
-	return h.l.Close()
+	h.stopOnce.Do(func() {
+		if h.heartbeat != nil {
+			h.heartbeat.stop()
+		}
+		if h.selfMetrics != nil {
+			h.selfMetrics.stop()
+		}
+		if h.versions != nil {
+			h.versions.stop()
+		}
+	})
+	return h.server.stop()
+}
+
+// close stops the goroutines of the backends and closes their files, which
+// run from the creation of the relay on. It's called once the relay is
+// removed from the service or the service is stopped, the writes still
+// buffered fail.
+func (h *HTTP) close() {
+	h.closeOnce.Do(func() {
+		for _, b := range h.backends {
+			b.close()
+		}
+		if h.deadLetter != nil {
+			h.deadLetter.close()
+		}
+	})
+}
+
+func (b *httpBackend) close() {
+	// the rollups are written through the retry buffer
+	if b.aggregate != nil {
+		b.aggregate.stop()
+	}
+	if rb, ok := b.poster.(*retryBuffer); ok {
+		rb.stop()
+	}
+	if b.spool != nil {
+		b.spool.close()
+	}
 }
 
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	atomic.AddInt64(&h.requests, 1)
+
+	if h.accessLog {
+		aw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer h.logAccess(r, aw, start)
+		w = aw
+	}
+
+	if h.allowedCNs != nil && !h.allowedCNs.allow(r.TLS) {
+		jsonError(w, http.StatusForbidden, "client certificate not allowed")
+		return
+	}
+
+	if len(h.allowedClients) > 0 || len(h.deniedClients) > 0 {
+		addr := h.clientAddr(r)
+		if len(h.allowedClients) > 0 && !h.allowedClients.contains(addr) || h.deniedClients.contains(addr) {
+			jsonError(w, http.StatusForbidden, "client address not allowed")
+			return
+		}
+	}
+
+	// InfluxDB sets the header on every response, some clients look for it
+	w.Header().Set("X-Influxdb-Version", h.influxDBVersion())
+
+	if h.partialSuccess == partialSuccessAccepted && isTelegraf(r) {
+		w = telegrafWriter{w}
+	}
+
+	// the preflight requests of the browsers are answered whatever the
+	// endpoint, and carry no credentials
+	if h.cors != nil && h.cors.handle(w, r) {
+		return
+	}
 
 	// 状态检查
 	if r.URL.Path == "/ping" && (r.Method == "GET" || r.Method == "HEAD") {
-		w.Header().Add("X-InfluxDB-Version", "relay")
-		w.WriteHeader(http.StatusNoContent)
+		h.ping(w, r)
+		return
+	}
+
+	if r.URL.Path == "/query" && h.querier != nil {
+		h.query(w, r)
+		return
+	}
+	if r.URL.Path == fluxQueryPath && h.flux != nil {
+		h.fluxQuery(w, r)
 		return
 	}
 
-	if r.URL.Path != "/write" {
+	if r.URL.Path != "/write" && r.URL.Path != v2WritePath && r.URL.Path != promWritePath {
 		jsonError(w, http.StatusNotFound, "invalid write endpoint")
 		return
 	}
@@ -241,7 +935,59 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var grant *authGrant
+	if h.auth != nil {
+		g, ok, err := h.auth.allow(r)
+		if err != nil {
+			jsonError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Token realm="influxdb-relay"`)
+			jsonError(w, http.StatusUnauthorized, "authorization failed")
+			return
+		}
+		if !h.auth.forward {
+			r.Header.Del("Authorization")
+		}
+		grant = g
+	}
+
 	queryParams := r.URL.Query()
+	verbose := verboseWrite(r, queryParams)
+
+	if h.auth != nil && !h.auth.forward {
+		queryParams.Del("u")
+		queryParams.Del("p")
+	}
+
+	// the clients configured for InfluxDB 2
+	if r.URL.Path == v2WritePath || queryParams.Get("bucket") != "" {
+		if err := h.buckets.translate(queryParams); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if h.db != "" {
+		queryParams.Set("db", h.db)
+	}
+
+	backends := h.backends
+	if h.tenants != nil {
+		t := h.tenants.tenant(r)
+		if t == nil {
+			jsonError(w, http.StatusForbidden, "unknown tenant")
+			return
+		}
+		queryParams.Set("db", t.database)
+		if t.rp != "" {
+			queryParams.Set("rp", t.rp)
+		}
+		if t.backends != nil {
+			backends = t.backends
+		}
+	}
 
 	// fail early if we're missing the database
 	// influxdb API要求参数db
@@ -251,6 +997,22 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !grant.allowDatabase(queryParams.Get("db")) {
+		jsonError(w, http.StatusForbidden, fmt.Sprintf("database %q not allowed", queryParams.Get("db")))
+		return
+	}
+
+	// the quotas are the ones of the database asked for, or of the tenant
+	db := queryParams.Get("db")
+	backends = forDatabase(backends, db)
+	if subs := h.subscriptions.list(); len(subs) > 0 {
+		backends = append(append([]*httpBackend(nil), backends...), forDatabase(subs, db)...)
+	}
+
+	if len(h.dbRenames) > 0 {
+		queryParams.Set("db", h.dbRenames.rename(queryParams.Get("db")))
+	}
+
 	// rp: retention_policy_name
 	if queryParams.Get("rp") == "" && h.rp != "" {
 		queryParams.Set("rp", h.rp)
@@ -258,15 +1020,33 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var body = r.Body
 
-	if r.Header.Get("Content-Encoding") == "gzip" {
+	// the gzip bodies are forwarded as they are when the relay doesn't
+	// have to look at their points
+	gzipped := strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip")
+	if gzipped && h.gzipPassthrough && r.URL.Path != promWritePath && h.usage == nil {
+		h.passthrough(w, r, backends, queryParams.Encode(), verbose)
+		return
+	}
+
+	if gzipped {
 		b, err := gzip.NewReader(r.Body)
 		if err != nil {
 			jsonError(w, http.StatusBadRequest, "unable to decode gzip body")
+			return
 		}
 		defer b.Close()
 		body = b
 	}
 
+	if h.maxBodySize > 0 {
+		body = ioutil.NopCloser(io.LimitReader(body, h.maxBodySize+1))
+	}
+
+	if r.URL.Path != promWritePath && h.streams(r) {
+		h.stream(w, body, "", backends, queryParams.Encode(), r.Header.Get("Authorization"))
+		return
+	}
+
 	bodyBuf := getBuf()
 	_, err := bodyBuf.ReadFrom(body)
 	if err != nil {
@@ -275,110 +1055,631 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Telegraf splits its batch in two and retries when it gets a 413
+	if h.maxBodySize > 0 && int64(bodyBuf.Len()) > h.maxBodySize {
+		putBuf(bodyBuf)
+		jsonError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	}
+
+	// the remote write requests are converted to line protocol, then
+	// processed like the other writes
+	if r.URL.Path == promWritePath {
+		lines, err := promWriteToLines(bodyBuf.Bytes())
+		putBuf(bodyBuf)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "unable to decode remote write request")
+			return
+		}
+		bodyBuf = lines
+
+		// the converted points always carry nanosecond timestamps
+		queryParams.Del("precision")
+	}
+
+	// several clients flush empty writes, they aren't worth a round trip to
+	// the backends
+	if len(bytes.TrimSpace(bodyBuf.Bytes())) == 0 {
+		putBuf(bodyBuf)
+		h.noop(w)
+		return
+	}
+
 	precision := queryParams.Get("precision")
 	// points代表要写入influxdb的数据点
 	// 写入前经过一轮精确度相关的处理
-	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
+	parsed, points, rejected, err := h.parsePoints(bodyBuf.Bytes(), start, precision)
 	if err != nil {
 		// 如果在这发生了错误要归还缓冲池
 		putBuf(bodyBuf)
-		jsonError(w, http.StatusBadRequest, "unable to parse points")
+		// Telegraf only drops the 400s mentioning "unable to parse", and
+		// retries the others forever
+		if err == errLineTooLong {
+			jsonError(w, http.StatusBadRequest, "unable to parse points: "+err.Error())
+		} else {
+			jsonError(w, http.StatusBadRequest, "unable to parse points")
+		}
+		return
+	}
+
+	if p := grant.allowPoints(points); p != nil {
+		putBuf(bodyBuf)
+		jsonError(w, http.StatusForbidden, fmt.Sprintf("measurement %q not allowed", p.Name()))
 		return
 	}
 
-	outBuf := getBuf()
-	for _, p := range points {
-		if _, err = outBuf.WriteString(p.PrecisionString(precision)); err != nil {
-			break
-		}
-		if err = outBuf.WriteByte('\n'); err != nil {
-			break
-		}
+	if len(rejected) > 0 {
+		h.skip(rejected)
+	}
+
+	// series keys of the written points, only collected for the usage export
+	var series []string
+	var seriesKeys *[]string
+	if h.usage != nil {
+		seriesKeys = &series
 	}
 
+	dups := h.dedup.batch(queryParams.Get("db"), queryParams.Get("rp"))
+
+	outBuf, written, err := h.rewrite(parsed, points, len(rejected) == 0, precision, seriesKeys, dups)
+
 	// done with the input points
 	// 归还bodyBuf.注意区分outBuf
 	putBuf(bodyBuf)
 
-	// err对应上面for循环中的err
+	// err对应rewrite中的transform错误
 	if err != nil {
-		putBuf(outBuf)
 		jsonError(w, http.StatusInternalServerError, "problem writing points")
 		return
 	}
 
-	// normalize query string
-	query := queryParams.Encode()
+	// nothing left to write, e.g. only comments or dropped points
+	if written == 0 {
+		putBuf(outBuf)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !h.allowRate(r, written, start) {
+		putBuf(outBuf)
+		jsonError(w, 429, "rate limit exceeded")
+		return
+	}
+	if !h.allowQuota(w, db, written, outBuf.Len(), start) {
+		putBuf(outBuf)
+		return
+	}
 
-	outBytes := outBuf.Bytes()
+	if h.usage != nil {
+		h.usage.record(queryParams.Get("db"), written, outBuf.Len(), series)
+	}
+
+	// normalize query string
+	if dups != nil {
+		// the points are only remembered once a backend took them. A retry
+		// arriving meanwhile is forwarded as well, the backends overwrite
+		// the points with the same values.
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if sw.status/100 == 2 {
+				dups.commit()
+			}
+		}()
+		w = sw
+	}
 
 	// check for authorization performed via the header
-	authHeader := r.Header.Get("Authorization")
+	if h.batcher != nil {
+		h.batcher.forward(w, outBuf, backends, queryParams.Encode(), r.Header.Get("Authorization"), verbose)
+		return
+	}
+	h.forwardPayload(w, newPayload(outBuf), backends, queryParams.Encode(), r.Header.Get("Authorization"), verbose)
+}
+
+// participants returns the backends a write goes to: the one picked by the
+// balancer, or the ones it's mirrored to, leaving out the ones with a
+// percentage the write isn't picked for and the standbys not promoted
+func (h *HTTP) participants(backends []*httpBackend) []*httpBackend {
+	return h.pickParticipants(backends, false)
+}
+
+// previewParticipants returns the backends participants would for a write
+// now without changing anything, for explain: the balancer stays on its
+// turn and the standbys aren't promoted or demoted. The backends with a
+// percentage are drawn all the same.
+func (h *HTTP) previewParticipants(backends []*httpBackend) []*httpBackend {
+	return h.pickParticipants(backends, true)
+}
+
+func (h *HTTP) pickParticipants(backends []*httpBackend, preview bool) []*httpBackend {
+	now := time.Now()
+	if h.failover != nil && preview {
+		backends = h.failover.preview(h.backends, backends, now)
+	} else if h.failover != nil {
+		backends = h.failover.route(h.backends, backends, now)
+	}
+	if h.balancer != nil && h.hasShadows() {
+		return h.pickWithShadows(backends, now, preview)
+	}
+	if h.balancer != nil && preview {
+		return h.balancer.peek(backends, now)
+	}
+	if h.balancer != nil {
+		return h.balancer.pick(backends, now)
+	}
+	if !h.sampled {
+		return backends
+	}
+
+	out := make([]*httpBackend, 0, len(backends))
+	for _, b := range backends {
+		if !b.sampled() || rand.Float64()*100 < b.percentage {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// forDatabase leaves out the backends which don't get the writes of db
+func forDatabase(backends []*httpBackend, db string) []*httpBackend {
+	for i, b := range backends {
+		if matchAny(b.databases, db) {
+			continue
+		}
+
+		// the backends are only copied when some are left out
+		out := append([]*httpBackend(nil), backends[:i]...)
+		for _, b := range backends[i+1:] {
+			if matchAny(b.databases, db) {
+				out = append(out, b)
+			}
+		}
+		return out
+	}
+	return backends
+}
+
+// sampled reports whether the backend only gets a share of the writes
+func (b *httpBackend) sampled() bool {
+	return b.percentage > 0 && b.percentage < 100
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(h.backends))
+// forwardPayload posts pl to the backends and answers w with the first
+// successful or 4xx response, taking over the reference held on pl. The
+// payload is returned to the pool once all the backends are done with it,
+// which may be after the response was written when some of them are slow or
+// the fan-out deadline expired. A verbose write waits for every backend and is
+// answered with the result of each of them, see writeReport, and so do all
+// the writes with a partial-success policy or backend-status-headers.
+func (h *HTTP) forwardPayload(w http.ResponseWriter, pl *payload, backends []*httpBackend, query string, authHeader string, verbose bool) {
+	backends = h.participants(backends)
+	if h.failover != nil {
+		h.failover.hold(pl, query, authHeader)
+	}
+	if h.hasShadows() {
+		backends = h.shadow(pl, backends, query, authHeader)
+	}
+
+	// every backend reports exactly once, with a nil response when the post
+	// failed. The channel is large enough for none of them to ever block on it.
+	var results = make(chan backendResult, len(backends))
+
+	// the retry buffers report the index of the backends whose write they
+	// accepted, only used with a latency budget or to report them
+	wait := verbose || h.partialSuccess != "" || h.backendHeaders
+	var accepted chan int
+	if h.latencyBudget > 0 || wait {
+		accepted = make(chan int, len(backends))
+	}
 
-	var responses = make(chan *responseData, len(h.backends))
+	// the longest retry interval of the backends whose buffer rejected the
+	// write, in nanoseconds
+	var fullRetry int64
+
+	var batch *migrationBatch
+	if h.migration != nil {
+		batch = h.migration.start(query, len(backends))
+	}
+
+	start := time.Now()
 
 	// 重点: 由relay向influxdb写入数据
-	for _, b := range h.backends {
+	for i, b := range backends {
 		// 使用下面这种写法的原因:
 		// 1. Go语言中的for循环会迭代使用b
 		// 2. 新开辟变量,将b付给新的那个变量,那个变量也叫做b,这样每次循环中使用到的b就不会指向同一内存
 		// 3. 这样做的本质是避免在闭包中共享了外层函数的变量状态(b变量)
 		// 4. 更"传统"的写法是为每个goroutine传入一个参数
-		b := b
+		i, b := i, b
 
+		// every backend holds its own reference, so the payload outlives
+		// this function for as long as the slowest of them needs it
+		pl.retain()
+		atomic.AddInt64(&b.inflight, 1)
 		go func() {
-			defer wg.Done()
+			defer pl.release()
+			defer atomic.AddInt64(&b.inflight, -1)
 			// post运行时候有两种可能:
 			// 1.带重试机制
 			// 2.不带重试机制
-			resp, err := b.post(outBytes, query, authHeader)
-			if err != nil {
-				log.Printf("Problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
-			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
-				}
-				responses <- resp
+			var resp *responseData
+			var err error
+			rb, buffered := b.poster.(*retryBuffer)
+			posted := time.Now()
+			switch {
+			case b.aggregate != nil:
+				resp, err = b.aggregate.post(pl, query, authHeader)
+			case buffered && accepted != nil:
+				resp, err = rb.postAccepted(pl, query, authHeader, func() { accepted <- i })
+			default:
+				resp, err = b.post(pl, query, authHeader)
+			}
+			latency := time.Since(posted)
+			b.latency.observe(latency)
+			b.observe(h.Name(), resp, err)
+			if buffered && (err == ErrBufferFull || err == errBufferEvicted) {
+				// at least a nanosecond, the answer rounds it up to a second
+				maxInt64(&fullRetry, int64(rb.maxInterval)|1)
 			}
+			if batch != nil {
+				batch.done(b, pl, resp, err)
+			}
+			results <- backendResult{index: i, resp: resp, err: err, latency: latency}
 		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(responses)
-		putBuf(outBuf)
-	}()
+	pl.release()
 
-	var errResponse *responseData
+	var deadline <-chan time.Time
+	if h.fanoutTimeout > 0 {
+		t := time.NewTimer(h.fanoutTimeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	// the budget doesn't apply to the writes waiting for every backend
+	var budget <-chan time.Time
+	if h.latencyBudget > 0 && !wait {
+		t := time.NewTimer(h.latencyBudget)
+		defer t.Stop()
+		budget = t.C
+	}
+
+	// the outcome of every backend, for the writes waiting for all of them
+	var report *writeReport
+	if wait {
+		report = newWriteReport(backends)
+	}
+
+	// the first 4xx and one of the other failed responses to return back to
+	// the client, whether a backend took the write
+	var userError, errResponse *responseData
+	succeeded := false
+
+	// number of writes held by retry buffers, and whether the budget is spent
+	buffered := 0
+	overBudget := false
+
+wait:
+	for pending := len(backends); pending > 0; pending-- {
+		var res backendResult
+		select {
+		case res = <-results:
+		case i := <-accepted:
+			buffered++
+			if report != nil {
+				// answered as buffered, its result is ignored
+				report.buffered(i, time.Since(start))
+				continue
+			}
+			// not a response, the backend is still pending
+			pending++
+			if overBudget {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			continue
+		case <-budget:
+			pending++
+			overBudget = true
+			if buffered > 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			continue
+		case <-deadline:
+			log.Printf("Fan-out deadline exceeded for relay %q, %d backends pending", h.Name(), pending)
+			break wait
+		}
+
+		if report != nil {
+			if report.Backends[res.index].Buffered {
+				pending++
+				continue
+			}
+			report.result(res)
+		}
+
+		resp := res.resp
+		if resp == nil {
+			continue
+		}
+		if backends[res.index].secondary && resp.StatusCode/100 != 2 {
+			continue
+		}
 
-	for resp := range responses {
 		switch resp.StatusCode / 100 {
 		case 2:
-			w.WriteHeader(http.StatusNoContent)
-			return
+			succeeded = true
 
 		case 4:
 			// user error
-			resp.Write(w)
-			return
+			if userError == nil {
+				userError = resp
+			}
 
 		default:
 			// hold on to one of the responses to return back to the client
 			errResponse = resp
 		}
+
+		if report == nil && (succeeded || userError != nil) {
+			break
+		}
+	}
+
+	code := http.StatusNoContent
+	if report != nil {
+		if h.backendHeaders {
+			report.setHeaders(w)
+		}
+		succeeded = succeeded || buffered > 0
+		if succeeded {
+			code = h.partialAnswer(w, report, backends)
+		}
+		if verbose {
+			report.answer(w, code, succeeded, userError, errResponse, time.Duration(atomic.LoadInt64(&fullRetry)))
+			return
+		}
 	}
 
-	// no successful writes
-	if errResponse == nil {
+	switch {
+	case succeeded:
+		w.WriteHeader(code)
+	case userError != nil:
+		userError.Write(w)
+	case errResponse != nil:
+		errResponse.Write(w)
+	default:
+		// no successful writes
+		if d := time.Duration(atomic.LoadInt64(&fullRetry)); d > 0 {
+			bufferFullError(w, d)
+			return
+		}
 		// failed to make any valid request...
 		jsonError(w, http.StatusServiceUnavailable, "unable to write points")
+	}
+}
+
+// partialAnswer returns the status of a write some backend took, and adds
+// the Warning header of the partial-success policy when some of the others
+// failed or buffered it. The secondary backends are left out.
+func (h *HTTP) partialAnswer(w http.ResponseWriter, report *writeReport, backends []*httpBackend) int {
+	failed, buffered := report.degraded(backends)
+	if failed+buffered == 0 {
+		return http.StatusNoContent
+	}
+
+	switch h.partialSuccess {
+	case partialSuccessAccepted:
+		return http.StatusAccepted
+	case partialSuccessWarning:
+		w.Header().Set("Warning", fmt.Sprintf(`199 - "partial write: %d of %d backends failed, %d buffered"`, failed, len(backends), buffered))
+	}
+	return http.StatusNoContent
+}
+
+// noop answers a write with an empty body
+func (h *HTTP) noop(w http.ResponseWriter) {
+	if h.rejectEmpty {
+		jsonError(w, http.StatusBadRequest, "empty write body")
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowRate applies the rate limit of the relay, or of the client of r, to
+// a write of n points
+func (h *HTTP) allowRate(r *http.Request, n int, now time.Time) bool {
+	switch {
+	case h.rate != nil:
+		return h.rate.allow(n, now)
+	case h.clientRate != nil:
+		return h.clientRate.allow(h.clientAddr(r), n, now)
+	}
+	return true
+}
+
+// allowQuota applies the quota of db to a write of n points and size bytes,
+// and answers the client with a 429 when it's over it. The usage of the
+// quota is reported in the headers of the response either way.
+func (h *HTTP) allowQuota(w http.ResponseWriter, db string, n, size int, now time.Time) bool {
+	if h.quotas == nil {
+		return true
+	}
 
-	errResponse.Write(w)
+	ok, u := h.quotas.allow(db, n, size, now)
+	if u == nil {
+		return true
+	}
+	u.setHeaders(w)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(u.retryAfter(), 10))
+		jsonError(w, 429, fmt.Sprintf("quota of database %q exceeded", db))
+	}
+	return ok
+}
+
+// statusWriter records the status and size of a response, for the access
+// log and the deduplication
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (h *HTTP) logAccess(r *http.Request, w *statusWriter, start time.Time) {
+	log.Printf("Access to relay %q: client=%s method=%s uri=%q status=%d size=%d duration=%v",
+		h.Name(), h.clientAddr(r), r.Method, r.RequestURI, w.status, w.size, time.Since(start))
+}
+
+func (h *HTTP) httpBackends() []*httpBackend {
+	return h.backends
+}
+
+// parsePoints parses the write body. In lenient mode the lines which fail to
+// parse or are too long are returned separately and only an entirely
+// unparsable body is an error. The body the points were parsed from is
+// returned first, it differs from buf when long lines were removed.
+func (h *HTTP) parsePoints(buf []byte, now time.Time, precision string) ([]byte, []models.Point, [][]byte, error) {
+	buf, long := h.limit.apply(buf, now, precision)
+	if len(long) > 0 && !h.lenient {
+		return nil, nil, nil, errLineTooLong
+	}
+
+	points, err := models.ParsePointsWithPrecision(buf, now, precision)
+	if err == nil {
+		if len(points) == 0 && len(long) > 0 {
+			return nil, nil, long, errLineTooLong
+		}
+		return buf, points, long, nil
+	}
+	if !h.lenient {
+		return nil, nil, nil, err
+	}
+
+	// only single lines are parsed again, so this is limited to failing writes
+	rejected := long
+	for rest := buf; len(rest) > 0; {
+		var line []byte
+		line, rest = nextLine(rest)
+		if _, lerr := models.ParsePointsWithPrecision(line, now, precision); lerr != nil {
+			rejected = append(rejected, line)
+		}
+	}
+
+	if len(points) == 0 {
+		return nil, nil, rejected, err
+	}
+	return buf, points, rejected, nil
+}
+
+// rewrite applies the transforms to the points parsed from the body parsed,
+// and serializes the ones left to a pooled buffer along with their number.
+// The lines of the body are reused for the untouched points when every line
+// was parsed. The series keys of the written points are appended to series
+// when it isn't nil, they're copied as they point into the body. The points
+// already written are dropped when dups isn't nil.
+func (h *HTTP) rewrite(parsed []byte, points []models.Point, allParsed bool, precision string, series *[]string, dups *dedupBatch) (*bytes.Buffer, int, error) {
+	// the lines of the body can only be reused when they match the points
+	lines := rawLines{parsed}
+	reuse := allParsed && lines.count() == len(points)
+
+	written := 0
+	outBuf := getBuf()
+	outBuf.Grow(len(parsed))
+	for _, in := range points {
+		var line []byte
+		if reuse {
+			line = lines.next()
+		}
+
+		p, _, err := h.transform(in)
+		if err != nil {
+			putBuf(outBuf)
+			return nil, 0, err
+		}
+		if p == nil {
+			continue
+		}
+		if dups != nil && dups.duplicate(p) {
+			continue
+		}
+		if series != nil {
+			*series = append(*series, string(p.Key()))
+		}
+		written++
+
+		if line != nil && p == in {
+			writeLine(outBuf, line, p, precision)
+		} else {
+			writePoint(outBuf, p, precision)
+		}
+	}
+
+	return outBuf, written, nil
+}
+
+// transform applies the configured rewrites to a parsed point, returning
+// nil when the point is dropped along with a description of every change
+func (h *HTTP) transform(p models.Point) (models.Point, []string, error) {
+	p, rewritten, err := h.tagRewrite.apply(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, normalized, err := h.tagNormalize.apply(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, tagged, err := h.staticTags.apply(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transforms := append(rewritten, normalized...)
+	transforms = append(transforms, tagged...)
+
+	p, dropped, err := h.fieldDrops.apply(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	transforms = append(transforms, dropped...)
+	if p == nil {
+		return nil, transforms, nil
+	}
+
+	p, limited, err := h.stringLimits.apply(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p, append(transforms, limited...), nil
+}
+
+// skip accounts for lines dropped by lenient parsing. The lines may point
+// into a pooled buffer so they must not be retained.
+func (h *HTTP) skip(lines [][]byte) {
+	atomic.AddInt64(&h.skippedLines, int64(len(lines)))
+	log.Printf("Skipped %d unparsable lines in relay %q", len(lines), h.Name())
+
+	if h.deadLetter != nil {
+		if err := h.deadLetter.write(lines); err != nil {
+			log.Printf("Problem writing dead letters for relay %q: %v", h.Name(), err)
+		}
+	}
 }
 
 func (rd *responseData) Write(w http.ResponseWriter) {
@@ -397,43 +1698,55 @@ func (rd *responseData) Write(w http.ResponseWriter) {
 
 func jsonError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", message)
 	data := fmt.Sprintf("{\"error\":%q}\n", message)
 	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
 	w.WriteHeader(code)
 	w.Write([]byte(data))
 }
 
-func newSimplePoster(location string, timeout time.Duration, skipTLSVerification bool) *simplePoster {
-	// Configure custom transport for http.Client
-	// Used for support skip-tls-verification option
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: skipTLSVerification,
-		},
+// bufferFullError answers a write rejected by full retry buffers with a 503
+// and a Retry-After header, so that clients such as Telegraf back off
+// rather than retry right away, for at most the retry interval d of the
+// backends.
+func bufferFullError(w http.ResponseWriter, d time.Duration) {
+	secs := retryAfterSeconds(d)
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", ErrBufferFull.Error())
+	data := fmt.Sprintf("{\"error\":%q,\"code\":\"buffer_full\",\"retry_after\":%d}\n", ErrBufferFull.Error(), secs)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(data))
+}
+
+// retryAfterSeconds rounds d up to the seconds of a Retry-After header
+func retryAfterSeconds(d time.Duration) int64 {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// maxInt64 atomically raises *addr to v
+func maxInt64(addr *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if v <= old || atomic.CompareAndSwapInt64(addr, old, v) {
+			return
+		}
 	}
+}
 
+func newSimplePoster(location string, timeout time.Duration, tc transportConfig) *simplePoster {
 	return &simplePoster{
 		client: &http.Client{
 			Timeout:   timeout,
-			Transport: transport,
+			Transport: sharedTransport(tc),
 		},
 		location: location,
 	}
 }
 
 var ErrBufferFull = errors.New("retry buffer full")
-
-var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
-
-// 返回字节缓冲池
-func getBuf() *bytes.Buffer {
-	if bb, ok := bufPool.Get().(*bytes.Buffer); ok {
-		return bb
-	}
-	return new(bytes.Buffer)
-}
-
-func putBuf(b *bytes.Buffer) {
-	b.Reset()
-	bufPool.Put(b)
-}
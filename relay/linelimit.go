@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+var errLineTooLong = errors.New("line exceeds max-line-length")
+
+// lineLimit enforces a maximum length on single lines of line protocol,
+// see HTTPConfig.MaxLineLength
+type lineLimit struct {
+	max      int
+	truncate bool
+}
+
+func newLineLimit(max int, truncate bool) *lineLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &lineLimit{max: max, truncate: truncate}
+}
+
+// apply removes the lines longer than the limit from buf, or replaces them
+// with a truncated copy when possible. The lines which are removed are returned
+// separately. buf is returned unchanged when every line fits.
+func (l *lineLimit) apply(buf []byte, now time.Time, precision string) ([]byte, [][]byte) {
+	if l == nil || !l.exceeded(buf) {
+		return buf, nil
+	}
+
+	var rejected [][]byte
+	out := make([]byte, 0, len(buf))
+
+	for len(buf) > 0 {
+		line := buf
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			line, buf = buf[:i], buf[i+1:]
+		} else {
+			buf = nil
+		}
+
+		if len(line) > l.max {
+			short, ok := l.shorten(line, now, precision)
+			if !ok {
+				rejected = append(rejected, line)
+				continue
+			}
+			line = short
+		}
+
+		out = append(out, line...)
+		out = append(out, '\n')
+	}
+
+	return out, rejected
+}
+
+// exceeded reports whether any line of buf is longer than the limit
+func (l *lineLimit) exceeded(buf []byte) bool {
+	for len(buf) > l.max {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 || i > l.max {
+			return true
+		}
+		buf = buf[i+1:]
+	}
+	return false
+}
+
+// shorten cuts the longest string fields of the point until it fits within
+// the limit. Lines without string fields, or which are too long even once the
+// string fields are emptied, can't be shortened.
+func (l *lineLimit) shorten(line []byte, now time.Time, precision string) ([]byte, bool) {
+	if !l.truncate {
+		return nil, false
+	}
+
+	points, err := models.ParsePointsWithPrecision(line, now, precision)
+	if err != nil || len(points) != 1 {
+		return nil, false
+	}
+
+	p := points[0]
+	fields := p.Fields()
+
+	s := p.PrecisionString(precision)
+	for len(s) > l.max {
+		// pick the longest string field, the loop ends once they're all empty
+		k, v := "", ""
+		for fk, fv := range fields {
+			if sv, ok := fv.(string); ok && len(sv) > len(v) {
+				k, v = fk, sv
+			}
+		}
+		if v == "" {
+			return nil, false
+		}
+
+		// escaped characters take more room than they do in the value, the
+		// next iteration cuts some more if needed
+		fields[k] = truncateString(v, len(v)-(len(s)-l.max))
+
+		np, err := models.NewPoint(p.Name(), p.Tags(), fields, p.Time())
+		if err != nil {
+			return nil, false
+		}
+		s = np.PrecisionString(precision)
+	}
+
+	return []byte(s), true
+}
+
+// truncateString cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
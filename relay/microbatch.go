@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultMicroBatchSizeKB is the size a micro-batch is forwarded at, before
+// its wait is over
+const DefaultMicroBatchSizeKB = 64
+
+// microBatcher coalesces the small writes of the clients with the same query,
+// credentials, backends and verbosity, forwarding them together once the
+// first one waited for batch-wait or the batch reached batch-size-kb. The
+// clients are answered with the response of their batch.
+type microBatcher struct {
+	h       *HTTP
+	wait    time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending map[microBatchKey]*microBatch
+}
+
+type microBatchKey struct {
+	query string
+	auth  string
+
+	// the addresses of the backends the writes go to, e.g. the ones of the
+	// database or of a tenant, and the runtime subscribers
+	backends string
+	verbose  bool
+}
+
+type microBatch struct {
+	buf      *bytes.Buffer
+	backends []*httpBackend
+	timer    *time.Timer
+
+	// closed once resp holds the response of the batch
+	done chan struct{}
+	resp *responseRecorder
+}
+
+// newMicroBatcher returns nil when batch-wait isn't set
+func newMicroBatcher(h *HTTP, cfg HTTPConfig) (*microBatcher, error) {
+	if cfg.BatchWait == "" {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(cfg.BatchWait)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing batch wait '%v'", err)
+	}
+	if d <= 0 {
+		return nil, nil
+	}
+
+	size := DefaultMicroBatchSizeKB
+	if cfg.BatchSizeKB > 0 {
+		size = cfg.BatchSizeKB
+	}
+
+	return &microBatcher{
+		h:       h,
+		wait:    d,
+		maxSize: size * KB,
+		pending: make(map[microBatchKey]*microBatch),
+	}, nil
+}
+
+// backendsKey identifies a list of backends, by address as the runtime
+// subscribers may have the name of an output
+func backendsKey(backends []*httpBackend) string {
+	var buf bytes.Buffer
+	for _, b := range backends {
+		fmt.Fprintf(&buf, "%p,", b)
+	}
+	return buf.String()
+}
+
+// forward adds outBuf to the batch of query, auth, backends and verbose,
+// returning it to the pool, and answers w once the batch was forwarded
+func (m *microBatcher) forward(w http.ResponseWriter, outBuf *bytes.Buffer, backends []*httpBackend, query string, auth string, verbose bool) {
+	k := microBatchKey{query: query, auth: auth, backends: backendsKey(backends), verbose: verbose}
+
+	m.mu.Lock()
+	b := m.pending[k]
+	if b == nil {
+		b = &microBatch{
+			buf:      getBuf(),
+			backends: backends,
+			done:     make(chan struct{}),
+		}
+		m.pending[k] = b
+		b.timer = time.AfterFunc(m.wait, func() { m.flush(k, b) })
+	}
+	b.buf.Write(outBuf.Bytes())
+	full := b.buf.Len() >= m.maxSize
+	m.mu.Unlock()
+
+	putBuf(outBuf)
+
+	if full && b.timer.Stop() {
+		m.flush(k, b)
+	}
+
+	<-b.done
+	b.resp.replay(w)
+}
+
+// flush forwards the batch, once
+func (m *microBatcher) flush(k microBatchKey, b *microBatch) {
+	m.mu.Lock()
+	if m.pending[k] == b {
+		delete(m.pending, k)
+	}
+	m.mu.Unlock()
+
+	b.resp = newResponseRecorder()
+	m.h.forwardPayload(b.resp, newPayload(b.buf), b.backends, k.query, k.auth, k.verbose)
+	close(b.done)
+}
+
+// responseRecorder keeps a response to be written to several clients
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) replay(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
@@ -0,0 +1,331 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultMigratedPort is the port of the relays created for the first
+// [[outputs.influxdb]] section of a telegraf configuration, the following
+// sections use the next ports
+const DefaultMigratedPort = 9096
+
+// MigrateConfig builds a Config from the configuration file of the upstream
+// influxdb-relay and the [[outputs.influxdb]] sections of a telegraf
+// configuration, either of which may be empty. The telegraf outputs become
+// the backends of new relays which telegraf should then write to instead.
+func MigrateConfig(relayFile, telegrafFile string) (Config, error) {
+	var cfg Config
+
+	if relayFile != "" {
+		c, err := LoadConfigFile(relayFile)
+		if err != nil {
+			return cfg, err
+		}
+		// the upstream format is a subset of ours, only the sections
+		// upstream knows about are kept
+		cfg.HTTPRelays = c.HTTPRelays
+		cfg.UDPRelays = c.UDPRelays
+	}
+
+	if telegrafFile != "" {
+		f, err := os.Open(telegrafFile)
+		if err != nil {
+			return cfg, err
+		}
+		outputs, err := parseTelegrafOutputs(f)
+		f.Close()
+		if err != nil {
+			return cfg, fmt.Errorf("error parsing telegraf config %q: %v", telegrafFile, err)
+		}
+
+		if err := migrateTelegrafOutputs(&cfg, outputs); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// telegrafOutput holds the settings of an [[outputs.influxdb]] section
+// which matter to the relay
+type telegrafOutput struct {
+	urls            []string
+	retentionPolicy string
+	timeout         string
+	skipVerify      bool
+}
+
+func migrateTelegrafOutputs(cfg *Config, outputs []telegrafOutput) error {
+	for i, o := range outputs {
+		name := "telegraf"
+		if len(outputs) > 1 {
+			name = fmt.Sprintf("telegraf-%d", i+1)
+		}
+		addr := fmt.Sprintf("127.0.0.1:%d", DefaultMigratedPort+i)
+
+		h := HTTPConfig{
+			Name:                   name,
+			Addr:                   addr,
+			DefaultRetentionPolicy: o.retentionPolicy,
+		}
+		u := UDPConfig{
+			Name: name + "-udp",
+			Addr: addr,
+		}
+
+		for _, loc := range o.urls {
+			p, err := url.Parse(loc)
+			if err != nil {
+				return fmt.Errorf("error parsing telegraf url %q: %v", loc, err)
+			}
+
+			switch p.Scheme {
+			case "http", "https":
+				p.Path = strings.TrimSuffix(p.Path, "/") + "/write"
+				h.Outputs = append(h.Outputs, HTTPOutputConfig{
+					Name:                p.Host,
+					Location:            p.String(),
+					Timeout:             o.timeout,
+					SkipTLSVerification: o.skipVerify,
+				})
+			case "udp", "udp4", "udp6":
+				u.Outputs = append(u.Outputs, UDPOutputConfig{
+					Name:     p.Host,
+					Location: p.Host,
+				})
+			default:
+				return fmt.Errorf("unsupported telegraf url %q", loc)
+			}
+		}
+
+		if len(h.Outputs) > 0 {
+			cfg.HTTPRelays = append(cfg.HTTPRelays, h)
+		}
+		if len(u.Outputs) > 0 {
+			cfg.UDPRelays = append(cfg.UDPRelays, u)
+		}
+	}
+
+	return nil
+}
+
+// parseTelegrafOutputs extracts the [[outputs.influxdb]] sections of a
+// telegraf configuration. Only the handful of keys the relay can use are
+// read, so this avoids decoding the whole (plugin specific) file.
+func parseTelegrafOutputs(r io.Reader) ([]telegrafOutput, error) {
+	var outputs []telegrafOutput
+	var cur *telegrafOutput
+
+	s := bufio.NewScanner(r)
+	var pending string
+	for s.Scan() {
+		line := strings.TrimSpace(stripTOMLComment(s.Text()))
+		if pending != "" {
+			// continuation of a multi-line array
+			line = pending + " " + line
+			pending = ""
+		}
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '[' && !strings.Contains(line, "=") {
+			cur = nil
+			if strings.Trim(line, "[] \t") == "outputs.influxdb" {
+				outputs = append(outputs, telegrafOutput{})
+				cur = &outputs[len(outputs)-1]
+			}
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		if strings.HasPrefix(value, "[") && strings.Count(value, "[") > strings.Count(value, "]") {
+			pending = line
+			continue
+		}
+
+		var err error
+		switch key {
+		case "urls":
+			cur.urls, err = parseTOMLStrings(value)
+		case "url":
+			// deprecated single url setting
+			var u string
+			u, err = parseTOMLString(value)
+			cur.urls = append(cur.urls, u)
+		case "retention_policy":
+			cur.retentionPolicy, err = parseTOMLString(value)
+		case "timeout":
+			cur.timeout, err = parseTOMLString(value)
+		case "insecure_skip_verify":
+			cur.skipVerify, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", key, err)
+		}
+	}
+
+	if pending != "" {
+		return nil, fmt.Errorf("unterminated array %q", pending)
+	}
+
+	return outputs, s.Err()
+}
+
+// stripTOMLComment removes a trailing comment which isn't part of a string
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLString(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	return strconv.Unquote(value)
+}
+
+func parseTOMLStrings(value string) ([]string, error) {
+	if len(value) < 2 || value[0] != '[' || value[len(value)-1] != ']' {
+		return nil, fmt.Errorf("not an array: %s", value)
+	}
+
+	var values []string
+	for _, v := range strings.Split(value[1:len(value)-1], ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		s, err := parseTOMLString(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// WriteConfig writes the HTTP and UDP relays of cfg in the format read by
+// LoadConfigFile
+func WriteConfig(w io.Writer, cfg Config) error {
+	var buf bytes.Buffer
+
+	for _, h := range cfg.HTTPRelays {
+		buf.WriteString("[[http]]\n")
+		writeTOMLString(&buf, "name", h.Name)
+		writeTOMLString(&buf, "bind-addr", h.Addr)
+		writeTOMLString(&buf, "ssl-combined-pem", h.SSLCombinedPem)
+		writeTOMLString(&buf, "ssl-cert", h.SSLCert)
+		writeTOMLString(&buf, "ssl-key", h.SSLKey)
+		writeTOMLString(&buf, "ssl-chain", h.SSLChain)
+		writeTOMLString(&buf, "default-retention-policy", h.DefaultRetentionPolicy)
+
+		buf.WriteString("output = [\n")
+		for _, o := range h.Outputs {
+			fields := []string{
+				"name=" + tomlQuote(o.Name),
+				"location=" + tomlQuote(o.Location),
+			}
+			if o.Timeout != "" {
+				fields = append(fields, "timeout="+tomlQuote(o.Timeout))
+			}
+			if o.BufferSizeMB > 0 {
+				fields = append(fields, "buffer-size-mb="+strconv.Itoa(o.BufferSizeMB))
+			}
+			if o.MaxBatchKB > 0 {
+				fields = append(fields, "max-batch-kb="+strconv.Itoa(o.MaxBatchKB))
+			}
+			if o.MaxDelayInterval != "" {
+				fields = append(fields, "max-delay-interval="+tomlQuote(o.MaxDelayInterval))
+			}
+			if o.SkipTLSVerification {
+				fields = append(fields, "skip-tls-verification=true")
+			}
+			fmt.Fprintf(&buf, "    { %s },\n", strings.Join(fields, ", "))
+		}
+		buf.WriteString("]\n\n")
+	}
+
+	for _, u := range cfg.UDPRelays {
+		buf.WriteString("[[udp]]\n")
+		writeTOMLString(&buf, "name", u.Name)
+		writeTOMLString(&buf, "bind-addr", u.Addr)
+		writeTOMLString(&buf, "precision", u.Precision)
+		if u.ReadBuffer != 0 {
+			fmt.Fprintf(&buf, "read-buffer = %d\n", u.ReadBuffer)
+		}
+
+		buf.WriteString("output = [\n")
+		for _, o := range u.Outputs {
+			fields := []string{
+				"name=" + tomlQuote(o.Name),
+				"location=" + tomlQuote(o.Location),
+			}
+			if o.MTU > 0 {
+				fields = append(fields, "mtu="+strconv.Itoa(o.MTU))
+			}
+			fmt.Fprintf(&buf, "    { %s },\n", strings.Join(fields, ", "))
+		}
+		buf.WriteString("]\n\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeTOMLString(buf *bytes.Buffer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(buf, "%s = %s\n", key, tomlQuote(value))
+	}
+}
+
+// tomlQuote returns s as a TOML basic string
+func tomlQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&buf, "\\u%04X", r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
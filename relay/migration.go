@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// During a cluster migration the writes are sent to the backends of both
+// clusters, the old one answering the clients as usual while the failures
+// of the new one are never answered. Every write is a batch whose
+// acknowledgments are compared once all the backends are done with it: the
+// batches the old cluster acknowledged but a backend of the new one didn't
+// are counted as missed, and appended to the migration report to be
+// backfilled.
+
+const (
+	migrationOld = "old"
+	migrationNew = "new"
+
+	migrationBatchHeader = "# missed batch "
+)
+
+// checkMigration checks the migration roles of the outputs, and reports
+// whether the relay is in migration mode
+func checkMigration(outputs []HTTPOutputConfig) (bool, error) {
+	var oldSeen, newSeen bool
+	for _, o := range outputs {
+		switch o.Migration {
+		case "":
+		case migrationOld:
+			oldSeen = true
+		case migrationNew:
+			newSeen = true
+		default:
+			return false, fmt.Errorf("unknown migration role %q", o.Migration)
+		}
+	}
+
+	if oldSeen != newSeen {
+		return false, errors.New("migration requires outputs of both the old and the new cluster")
+	}
+	return oldSeen, nil
+}
+
+// migrationTracker compares the acknowledgments of the old and new clusters
+type migrationTracker struct {
+	// batches written, acknowledged by both clusters, missed by the new
+	// one, and acknowledged by the new cluster only
+	batches int64
+	parity  int64
+	missed  int64
+	extra   int64
+
+	file string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// newMigrationTracker returns nil when the relay isn't in migration mode
+func newMigrationTracker(cfg HTTPConfig) (*migrationTracker, error) {
+	ok, err := checkMigration(cfg.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if cfg.MigrationReport != "" {
+			return nil, errors.New("migration-report requires outputs with a migration role")
+		}
+		return nil, nil
+	}
+
+	t := &migrationTracker{file: cfg.MigrationReport}
+	if t.file != "" {
+		f, err := os.OpenFile(t.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.f = f
+	}
+	return t, nil
+}
+
+// migrationBatch collects the acknowledgments of a write
+type migrationBatch struct {
+	t     *migrationTracker
+	query string
+
+	mu       sync.Mutex
+	pending  int
+	oldAcked bool
+	newAcked bool
+	missedBy []string
+}
+
+// start returns the batch of a write of query to n backends
+func (t *migrationTracker) start(query string, n int) *migrationBatch {
+	return &migrationBatch{t: t, query: query, pending: n}
+}
+
+// done records the outcome of the post of p to b, the last backend to
+// report completes the batch. p must still be held by the caller.
+func (m *migrationBatch) done(b *httpBackend, p *payload, resp *responseData, err error) {
+	ok := err == nil && resp.StatusCode/100 == 2
+
+	m.mu.Lock()
+	m.pending--
+	switch {
+	case b.migration == migrationOld && ok:
+		m.oldAcked = true
+	case b.migration == migrationNew && ok:
+		m.newAcked = true
+	case b.migration == migrationNew:
+		m.missedBy = append(m.missedBy, b.name)
+	}
+	last := m.pending == 0
+	m.mu.Unlock()
+
+	if last {
+		m.t.complete(m, p)
+	}
+}
+
+func (t *migrationTracker) complete(m *migrationBatch, p *payload) {
+	atomic.AddInt64(&t.batches, 1)
+
+	switch {
+	case m.oldAcked && len(m.missedBy) == 0:
+		atomic.AddInt64(&t.parity, 1)
+	case m.oldAcked:
+		atomic.AddInt64(&t.missed, 1)
+		if t.f != nil {
+			if err := t.write(m, p.Bytes()); err != nil {
+				log.Printf("Problem writing the migration report %q: %v", t.file, err)
+			}
+		}
+	case m.newAcked:
+		atomic.AddInt64(&t.extra, 1)
+	}
+}
+
+// write appends a missed batch to the report, after a header giving its
+// database, retention policy and the backends which missed it. The points
+// are written with nanosecond timestamps whatever the precision of the write.
+func (t *migrationTracker) write(m *migrationBatch, data []byte) error {
+	q, err := url.ParseQuery(m.query)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	points, err := models.ParsePointsWithPrecision(data, now, q.Get("precision"))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%sdb=%s rp=%s time=%s missed-by=%s\n", migrationBatchHeader,
+		url.QueryEscape(q.Get("db")), url.QueryEscape(q.Get("rp")),
+		now.UTC().Format(time.RFC3339), url.QueryEscape(strings.Join(m.missedBy, ",")))
+	for _, p := range points {
+		buf.WriteString(p.PrecisionString(""))
+		buf.WriteByte('\n')
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.f.Write(buf.Bytes())
+	return err
+}
+
+// migrationStats is the parity of a relay reported by /migration
+type migrationStats struct {
+	Batches int64 `json:"batches"`
+	Parity  int64 `json:"parity"`
+	Missed  int64 `json:"missed"`
+	Extra   int64 `json:"extra"`
+}
+
+func (t *migrationTracker) stats() migrationStats {
+	return migrationStats{
+		Batches: atomic.LoadInt64(&t.batches),
+		Parity:  atomic.LoadInt64(&t.parity),
+		Missed:  atomic.LoadInt64(&t.missed),
+		Extra:   atomic.LoadInt64(&t.extra),
+	}
+}
+
+// export writes the points of the missed batches of db to w, restricted to
+// the retention policy rp when it isn't empty, ready to be written to the
+// new cluster
+func (t *migrationTracker) export(w io.Writer, db, rp string) error {
+	if t.file == "" {
+		return errors.New("no migration report")
+	}
+
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	match := false
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(line, migrationBatchHeader) {
+			h, err := url.ParseQuery(strings.Replace(strings.TrimSpace(line[len(migrationBatchHeader):]), " ", "&", -1))
+			if err != nil {
+				return err
+			}
+			match = h.Get("db") == db && (rp == "" || h.Get("rp") == rp)
+			continue
+		}
+
+		if match {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	DefaultMQTTKeepAlive    = 30 * time.Second
+	DefaultMQTTClientID     = "influxdb-relay"
+	DefaultMQTTReconnectMax = 30 * time.Second
+)
+
+// MQTT 3.1.1 control packet types,
+// see http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+var errMQTTMalformed = errors.New("malformed MQTT packet")
+
+// MQTT is a relay subscribing to MQTT topics which carry line protocol
+// payloads, the points are written to HTTP backends
+type MQTT struct {
+	name      string
+	broker    *url.URL
+	clientID  string
+	username  string
+	password  string
+	keepAlive time.Duration
+	precision string
+
+	topics []*mqttTopic
+
+	closing int64
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	backends []*httpBackend
+}
+
+// mqttTopic maps a subscription filter to the database points are written to
+type mqttTopic struct {
+	filter string
+	qos    byte
+	query  string
+}
+
+func NewMQTT(cfg MQTTConfig) (Relay, error) {
+	m := new(MQTT)
+
+	m.name = cfg.Name
+	m.username = cfg.Username
+	m.password = cfg.Password
+	m.precision = cfg.Precision
+
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing MQTT broker '%v'", err)
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "tls":
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker scheme %q", u.Scheme)
+	}
+	m.broker = u
+
+	m.clientID = DefaultMQTTClientID
+	if cfg.ClientID != "" {
+		m.clientID = cfg.ClientID
+	}
+
+	m.keepAlive = DefaultMQTTKeepAlive
+	if cfg.KeepAlive != "" {
+		d, err := time.ParseDuration(cfg.KeepAlive)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing keep alive '%v'", err)
+		}
+		m.keepAlive = d
+	}
+
+	if len(cfg.Topics) == 0 {
+		return nil, fmt.Errorf("MQTT relay %q has no topics", m.Name())
+	}
+
+	for _, t := range cfg.Topics {
+		if t.Topic == "" || t.Database == "" {
+			return nil, fmt.Errorf("MQTT relay %q topics require a topic and a database", m.Name())
+		}
+		if t.QoS > 1 {
+			return nil, fmt.Errorf("unsupported QoS %d for topic %q", t.QoS, t.Topic)
+		}
+
+		q := url.Values{}
+		q.Set("db", t.Database)
+		if t.RetentionPolicy != "" {
+			q.Set("rp", t.RetentionPolicy)
+		}
+		if m.precision != "" {
+			q.Set("precision", m.precision)
+		}
+
+		m.topics = append(m.topics, &mqttTopic{
+			filter: t.Topic,
+			qos:    byte(t.QoS),
+			query:  q.Encode(),
+		})
+	}
+
+	for i := range cfg.Outputs {
+		backend, err := newHTTPBackend(&cfg.Outputs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		m.backends = append(m.backends, backend)
+	}
+
+	return m, nil
+}
+
+func (m *MQTT) Name() string {
+	if m.name == "" {
+		return m.broker.String()
+	}
+	return m.name
+}
+
+// Run connects to the broker and processes the published messages,
+// reconnecting with an increasing delay whenever the connection is lost
+func (m *MQTT) Run() error {
+	log.Printf("Starting MQTT relay %q subscribed to %v", m.Name(), m.broker.Host)
+
+	delay := retryInitial
+	for atomic.LoadInt64(&m.closing) == 0 {
+		err := m.session()
+		if atomic.LoadInt64(&m.closing) != 0 {
+			break
+		}
+		if err != nil {
+			log.Printf("Error with the connection of MQTT relay %q to %v: %v", m.Name(), m.broker.Host, err)
+		} else {
+			// the session was established, start over with a short delay
+			delay = retryInitial
+		}
+
+		time.Sleep(delay)
+
+		delay *= retryMultiplier
+		if delay > DefaultMQTTReconnectMax {
+			delay = DefaultMQTTReconnectMax
+		}
+	}
+
+	return nil
+}
+
+func (m *MQTT) httpBackends() []*httpBackend {
+	return m.backends
+}
+
+func (m *MQTT) Stop() error {
+	atomic.StoreInt64(&m.closing, 1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return nil
+	}
+
+	m.conn.Write([]byte{mqttDisconnect << 4, 0})
+	return m.conn.Close()
+}
+
+func (m *MQTT) dial() (net.Conn, error) {
+	host := m.broker.Host
+	if m.broker.Scheme == "tcp" {
+		if m.broker.Port() == "" {
+			host = net.JoinHostPort(host, "1883")
+		}
+		return net.DialTimeout("tcp", host, DefaultHTTPTimeout)
+	}
+
+	if m.broker.Port() == "" {
+		host = net.JoinHostPort(host, "8883")
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: DefaultHTTPTimeout}, "tcp", host, nil)
+}
+
+// session runs one connection to the broker until it fails. A nil error
+// is returned when the connection was lost after being established, and an
+// error when a QoS 1 message wasn't taken by any backend, for the reconnection
+// to be delayed.
+func (m *MQTT) session() error {
+	conn, err := m.dial()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if atomic.LoadInt64(&m.closing) != 0 {
+		m.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	m.conn = conn
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.conn = nil
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+
+	if err := m.handshake(conn, r); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go m.ping(conn, done)
+
+	for {
+		// the broker answers pings, so a silent connection is a dead one
+		conn.SetReadDeadline(time.Now().Add(m.keepAlive * 3 / 2))
+
+		typ, flags, body, err := mqttRead(r)
+		if err != nil {
+			if atomic.LoadInt64(&m.closing) != 0 {
+				return nil
+			}
+			log.Printf("Error reading MQTT packet in relay %q: %v", m.Name(), err)
+			return nil
+		}
+
+		if typ != mqttPublish {
+			continue
+		}
+
+		topic, id, payload, err := mqttParsePublish(flags, body)
+		if err != nil {
+			log.Printf("Error parsing MQTT message in relay %q: %v", m.Name(), err)
+			return nil
+		}
+
+		taken := m.post(topic, payload)
+
+		// QoS 1 messages are acknowledged once a backend took them, the
+		// others are delivered again by the broker once reconnected
+		if flags>>1&0x03 == 1 {
+			if !taken {
+				return fmt.Errorf("no backend took a message of topic %q, left for the broker to deliver again", topic)
+			}
+			if err := m.write(conn, mqttPuback<<4, []byte{byte(id >> 8), byte(id)}); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// handshake connects and subscribes to every configured topic
+func (m *MQTT) handshake(conn net.Conn, r *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(DefaultHTTPTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// the session is kept by the broker when a topic is subscribed with QoS
+	// 1, for the messages not acknowledged to be delivered again
+	var flags byte = 0x02 // clean session
+	for _, t := range m.topics {
+		if t.qos == 1 {
+			flags = 0
+		}
+	}
+	body := mqttAppendString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	if m.username != "" {
+		flags |= 0x80
+	}
+	if m.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(m.keepAlive/time.Second))
+
+	body = mqttAppendString(body, m.clientID)
+	if m.username != "" {
+		body = mqttAppendString(body, m.username)
+	}
+	if m.password != "" {
+		body = mqttAppendString(body, m.password)
+	}
+
+	if err := m.write(conn, mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	typ, _, resp, err := mqttRead(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(resp) != 2 {
+		return errMQTTMalformed
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("connection refused by broker, return code %d", resp[1])
+	}
+
+	body = []byte{0, 1} // packet identifier
+	for _, t := range m.topics {
+		body = mqttAppendString(body, t.filter)
+		body = append(body, t.qos)
+	}
+
+	if err := m.write(conn, mqttSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	typ, _, resp, err = mqttRead(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttSuback || len(resp) != 2+len(m.topics) {
+		return errMQTTMalformed
+	}
+	for i, code := range resp[2:] {
+		if code == 0x80 {
+			return fmt.Errorf("subscription to %q refused by broker", m.topics[i].filter)
+		}
+	}
+
+	return nil
+}
+
+func (m *MQTT) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(m.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.write(conn, mqttPingreq<<4, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// write sends a packet, the relay and the ping loop share the connection
+func (m *MQTT) write(conn net.Conn, header byte, body []byte) error {
+	buf := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	buf = append(buf, body...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := conn.Write(buf)
+	return err
+}
+
+// post writes the points of a message to every backend, and reports whether
+// the message is done with: a backend took or rejected its points, or it
+// can't be written at all
+func (m *MQTT) post(topic string, payload []byte) bool {
+	var t *mqttTopic
+	for _, s := range m.topics {
+		if mqttMatch(s.filter, topic) {
+			t = s
+			break
+		}
+	}
+	if t == nil {
+		return true
+	}
+
+	points, err := models.ParsePointsWithPrecision(payload, time.Now(), m.precision)
+	if err != nil {
+		log.Printf("Error parsing message in relay %q from topic %q: %v", m.Name(), topic, err)
+		return true
+	}
+
+	out := getBuf()
+	for _, p := range points {
+		out.WriteString(p.PrecisionString(m.precision))
+		out.WriteByte('\n')
+	}
+
+	pl := newPayload(out)
+	defer pl.release()
+
+	// whether a backend took the points, or rejected them with a 4xx as
+	// delivering them again wouldn't help
+	var taken int32
+
+	var wg sync.WaitGroup
+	wg.Add(len(m.backends))
+
+	for _, b := range m.backends {
+		b := b
+		go func() {
+			defer wg.Done()
+			resp, err := b.post(pl, t.query, "")
+			if err == nil && resp.StatusCode/100 == 4 {
+				log.Printf("4xx response for relay %q backend %q: %v", m.Name(), b.name, resp.StatusCode)
+			}
+			if err == nil && (resp.StatusCode/100 == 2 || resp.StatusCode/100 == 4) {
+				atomic.StoreInt32(&taken, 1)
+			}
+			b.observe(m.Name(), resp, err)
+		}()
+	}
+
+	wg.Wait()
+	return atomic.LoadInt32(&taken) == 1
+}
+
+// mqttRead reads the next control packet
+func mqttRead(r *bufio.Reader) (typ byte, flags byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	var n, shift uint
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errMQTTMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n |= uint(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body = make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header >> 4, header & 0x0f, body, nil
+}
+
+func mqttParsePublish(flags byte, body []byte) (topic string, id uint16, payload []byte, err error) {
+	if len(body) < 2 {
+		return "", 0, nil, errMQTTMalformed
+	}
+	l := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+l {
+		return "", 0, nil, errMQTTMalformed
+	}
+	topic = string(body[2 : 2+l])
+	body = body[2+l:]
+
+	if flags>>1&0x03 > 0 {
+		if len(body) < 2 {
+			return "", 0, nil, errMQTTMalformed
+		}
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+
+	return topic, id, body, nil
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttMatch reports whether topic matches filter, where + matches a single
+// level and # any number of trailing levels
+func mqttMatch(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
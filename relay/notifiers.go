@@ -0,0 +1,232 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// types of the notifiers of the config
+const (
+	notifierWebhook   = "webhook"
+	notifierSlack     = "slack"
+	notifierPagerDuty = "pagerduty"
+
+	DefaultWebhookTimeout = 10 * time.Second
+
+	// endpoint of the PagerDuty Events API v2
+	DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+func checkNotifierType(t string) error {
+	switch t {
+	case "", notifierWebhook, notifierSlack, notifierPagerDuty:
+		return nil
+	}
+	return fmt.Errorf("unknown notifier type %q", t)
+}
+
+// notifierName identifies a notifier of the config in the logs
+func notifierName(cfg WebhookConfig) string {
+	t := cfg.Type
+	if t == "" {
+		t = notifierWebhook
+	}
+	if cfg.URL == "" {
+		return t
+	}
+	return fmt.Sprintf("%s %q", t, cfg.URL)
+}
+
+// newNotifier returns the notifier of the type of cfg
+func newNotifier(cfg WebhookConfig) (Notifier, error) {
+	if err := checkNotifierType(cfg.Type); err != nil {
+		return nil, err
+	}
+
+	location := cfg.URL
+	if location == "" {
+		if cfg.Type != notifierPagerDuty {
+			return nil, fmt.Errorf("%s notifier without url", notifierName(cfg))
+		}
+		location = DefaultPagerDutyURL
+	}
+
+	p := &jsonPoster{
+		location: location,
+		client:   &http.Client{Timeout: DefaultWebhookTimeout},
+	}
+
+	if cfg.Timeout != "" {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q of notifier %s", cfg.Timeout, notifierName(cfg))
+		}
+		p.client.Timeout = d
+	}
+
+	h, err := newOutputHeaders(cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("notifier %s: %v", notifierName(cfg), err)
+	}
+	p.headers = h
+
+	switch cfg.Type {
+	case notifierSlack:
+		return &slackNotifier{p: p}, nil
+	case notifierPagerDuty:
+		if cfg.RoutingKey == "" {
+			return nil, errors.New("pagerduty notifier without routing-key")
+		}
+		return &pagerDutyNotifier{p: p, routingKey: cfg.RoutingKey}, nil
+	}
+	return &webhookNotifier{p: p}, nil
+}
+
+// jsonPoster posts JSON documents to a URL
+type jsonPoster struct {
+	location string
+	headers  outputHeaders
+	client   *http.Client
+}
+
+func (p *jsonPoster) post(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.location, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	p.headers.set(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookNotifier posts the events with the fields the webhooks got before
+// the other notifiers were added
+type webhookNotifier struct {
+	p *jsonPoster
+}
+
+type webhookEvent struct {
+	Event         string    `json:"event"`
+	Relay         string    `json:"relay"`
+	Backend       string    `json:"backend"`
+	Time          time.Time `json:"time"`
+	BufferedBytes int       `json:"buffered_bytes"`
+	BufferSize    int       `json:"buffer_size"`
+	BufferPercent float64   `json:"buffer_percent"`
+	Level         string    `json:"level"`
+	Dropped       int64     `json:"dropped,omitempty"`
+	Message       string    `json:"message"`
+}
+
+func (n *webhookNotifier) Notify(e NotifyEvent) error {
+	return n.p.post(webhookEvent{
+		Event:         e.Event,
+		Relay:         e.Relay,
+		Backend:       e.Backend,
+		Time:          e.Time,
+		BufferedBytes: e.BufferedBytes,
+		BufferSize:    e.BufferSize,
+		BufferPercent: e.BufferPercent,
+		Level:         e.Level,
+		Dropped:       e.Dropped,
+		Message:       e.Message,
+	})
+}
+
+// slackNotifier posts the events to an incoming webhook of Slack
+type slackNotifier struct {
+	p *jsonPoster
+}
+
+var slackEmojis = map[string]string{
+	severityInfo:     ":white_check_mark:",
+	severityWarning:  ":warning:",
+	severityError:    ":x:",
+	severityCritical: ":rotating_light:",
+}
+
+func (n *slackNotifier) Notify(e NotifyEvent) error {
+	return n.p.post(map[string]string{
+		"text": fmt.Sprintf("%s influxdb-relay %s: %s", slackEmojis[e.Severity], e.Event, e.Message),
+	})
+}
+
+// pagerDutyNotifier triggers an alert of the PagerDuty service for the
+// events of a backend, resolved once its buffer is written back or it's
+// healthy again
+type pagerDutyNotifier struct {
+	p          *jsonPoster
+	routingKey string
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     time.Time   `json:"timestamp"`
+	Component     string      `json:"component"`
+	Group         string      `json:"group"`
+	Class         string      `json:"class"`
+	CustomDetails NotifyEvent `json:"custom_details"`
+}
+
+func (n *pagerDutyNotifier) Notify(e NotifyEvent) error {
+	// one alert for the health of a backend, one for its buffer
+	action, kind := "trigger", "buffer"
+	switch e.Event {
+	case eventUnhealthy:
+		kind = "health"
+	case eventHealthy:
+		action, kind = "resolve", "health"
+	case eventRecovered:
+		action = "resolve"
+	}
+
+	pe := pagerDutyEvent{
+		RoutingKey:  n.routingKey,
+		EventAction: action,
+		DedupKey:    "influxdb-relay/" + e.Relay + "/" + e.Backend + "/" + kind,
+	}
+	if action == "trigger" {
+		pe.Payload = &pagerDutyPayload{
+			Summary:       e.Message,
+			Source:        e.Backend,
+			Severity:      e.Severity,
+			Timestamp:     e.Time,
+			Component:     e.Backend,
+			Group:         e.Relay,
+			Class:         e.Event,
+			CustomDetails: e,
+		}
+	}
+	return n.p.post(pe)
+}
@@ -0,0 +1,337 @@
+package relay
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNotifyInterval = 10 * time.Second
+
+	// a backend started buffering its writes, and wrote its buffer back
+	eventBuffering = "buffering"
+	eventRecovered = "recovered"
+
+	// the buffer of a backend went over its warning or critical threshold
+	eventBufferFilling = "buffer-filling"
+
+	// batches were dropped by a backend as its buffer was full, or
+	// rejected during replay
+	eventDropped = "dropped"
+
+	// a backend failed its last post or is buffering, and is healthy again,
+	// the health the ping, load balancing and failover rely on
+	eventUnhealthy = "unhealthy"
+	eventHealthy   = "healthy"
+)
+
+var notifyEvents = map[string]bool{
+	eventBuffering:     true,
+	eventRecovered:     true,
+	eventBufferFilling: true,
+	eventDropped:       true,
+	eventUnhealthy:     true,
+	eventHealthy:       true,
+}
+
+// severities of the events, the ones of PagerDuty
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityError    = "error"
+	severityCritical = "critical"
+)
+
+// NotifyEvent is an operational event of a backend of an HTTP relay. The
+// buffer fields are zero for the backends without a retry buffer.
+type NotifyEvent struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Relay    string    `json:"relay"`
+	Backend  string    `json:"backend"`
+	Time     time.Time `json:"time"`
+
+	BufferedBytes int     `json:"buffered_bytes"`
+	BufferSize    int     `json:"buffer_size"`
+	BufferPercent float64 `json:"buffer_percent"`
+	Level         string  `json:"level"`
+	Dropped       int64   `json:"dropped,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// Notifier sends the events to an operator, e.g. to a chat or an incident
+// management service. Notify is called for one event at a time.
+type Notifier interface {
+	Notify(e NotifyEvent) error
+}
+
+// notifyRoute is a notifier and the events it gets, every event when nil
+type notifyRoute struct {
+	name   string
+	n      Notifier
+	events map[string]bool
+}
+
+// healthChecker periodically checks the health and the retry buffers of the
+// HTTP backends and sends their transitions to the notifiers. The events are
+// detected at the interval, a backend buffering for less than that may go
+// unnoticed. The checks only run once the service runs and a notifier was
+// added.
+type healthChecker struct {
+	s        *Service
+	interval time.Duration
+
+	mu      sync.Mutex
+	routes  []notifyRoute
+	running bool
+	started bool
+
+	// state of every backend, by relay and backend name
+	state map[string]*notifyState
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+type notifyState struct {
+	unhealthy bool
+	buffering bool
+	level     int32
+	dropped   int64
+}
+
+func newHealthChecker(cfg NotifyConfig, s *Service) (*healthChecker, error) {
+	c := &healthChecker{
+		s:        s,
+		interval: DefaultNotifyInterval,
+		state:    make(map[string]*notifyState),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid notify interval %q", cfg.Interval)
+		}
+		c.interval = d
+	}
+
+	for _, nc := range cfg.Webhooks {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.add(notifierName(nc), n, nc.Events); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// add sends the events to n, every event when there's none. name identifies
+// the notifier in the logs.
+func (c *healthChecker) add(name string, n Notifier, events []string) error {
+	r := notifyRoute{name: name, n: n}
+	if len(events) > 0 {
+		r.events = make(map[string]bool)
+		for _, e := range events {
+			if !notifyEvents[e] {
+				return fmt.Errorf("unknown event %q of notifier %s", e, name)
+			}
+			r.events[e] = true
+		}
+	}
+
+	c.mu.Lock()
+	c.routes = append(c.routes, r)
+	c.launch()
+	c.mu.Unlock()
+	return nil
+}
+
+// AddNotifier sends the events of the backends to n along with the
+// notifiers of the config, every event when there's none. It can be called
+// while the service runs.
+func (s *Service) AddNotifier(name string, n Notifier, events ...string) error {
+	return s.health.add(name, n, events)
+}
+
+// start runs the checks along with the service, as soon as it has a notifier
+func (c *healthChecker) start() {
+	c.mu.Lock()
+	c.running = true
+	c.launch()
+	c.mu.Unlock()
+}
+
+// launch starts the checks when the service runs and a notifier was added,
+// once, c.mu must be held
+func (c *healthChecker) launch() {
+	if c.running && !c.started && len(c.routes) > 0 {
+		c.started = true
+		go c.run()
+	}
+}
+
+func (c *healthChecker) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, e := range c.check(now) {
+				c.notify(e)
+			}
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+func (c *healthChecker) Stop() error {
+	c.mu.Lock()
+	c.running = false
+	started := c.started
+	c.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+	close(c.closing)
+	<-c.done
+	return nil
+}
+
+// check returns the events of the backends since the last check
+func (c *healthChecker) check(now time.Time) []NotifyEvent {
+	var events []NotifyEvent
+
+	relays := c.s.relayList()
+	sort.Sort(relaysByName(relays))
+
+	seen := make(map[string]bool)
+	for _, r := range relays {
+		hr, ok := r.(httpBackendRelay)
+		if !ok {
+			continue
+		}
+		for _, b := range hr.httpBackends() {
+			key := r.Name() + "/" + b.name
+			seen[key] = true
+
+			counts := b.errorCounts()
+			dropped := counts[errClassBufferFull] + counts[errClassRejected]
+			unhealthy := !b.healthy()
+
+			st := c.state[key]
+			if st == nil {
+				// what happened before the backend was first seen isn't
+				// reported
+				st = &notifyState{unhealthy: unhealthy, dropped: dropped}
+				c.state[key] = st
+			}
+
+			e := NotifyEvent{
+				Relay:   r.Name(),
+				Backend: b.name,
+				Time:    now,
+			}
+
+			switch {
+			case unhealthy && !st.unhealthy:
+				e.Event, e.Severity = eventUnhealthy, severityError
+				e.Message = fmt.Sprintf("backend %q of relay %q is unhealthy", b.name, r.Name())
+				events = append(events, e)
+			case !unhealthy && st.unhealthy:
+				e.Event, e.Severity = eventHealthy, severityInfo
+				e.Message = fmt.Sprintf("backend %q of relay %q is healthy again", b.name, r.Name())
+				events = append(events, e)
+			}
+			st.unhealthy = unhealthy
+
+			rb, ok := b.poster.(*retryBuffer)
+			if !ok {
+				continue
+			}
+
+			size, _ := rb.buffered()
+			e.BufferedBytes = size
+			e.BufferSize = rb.maxBuffered
+			e.Level = bufferLevelNames[rb.bufferLevel()]
+			if rb.maxBuffered > 0 {
+				e.BufferPercent = float64(size) * 100 / float64(rb.maxBuffered)
+			}
+
+			buffering := rb.isBuffering()
+			switch {
+			case buffering && !st.buffering:
+				e.Event, e.Severity = eventBuffering, severityWarning
+				e.Message = fmt.Sprintf("backend %q of relay %q is buffering its writes", b.name, r.Name())
+				events = append(events, e)
+			case !buffering && st.buffering:
+				e.Event, e.Severity = eventRecovered, severityInfo
+				e.Message = fmt.Sprintf("backend %q of relay %q wrote its buffer back", b.name, r.Name())
+				events = append(events, e)
+			}
+			st.buffering = buffering
+
+			// notified once per level until the buffer drops back under it
+			level := rb.bufferLevel()
+			if level > st.level {
+				e.Event, e.Severity = eventBufferFilling, severityWarning
+				if level == bufferLevelCritical {
+					e.Severity = severityCritical
+				}
+				e.Message = fmt.Sprintf("buffer of backend %q of relay %q is %.0f%% full, over its %s threshold", b.name, r.Name(), e.BufferPercent, e.Level)
+				events = append(events, e)
+			}
+			st.level = level
+
+			if dropped < st.dropped {
+				// the relay was recreated, e.g. a tenant
+				st.dropped = 0
+			}
+			if dropped > st.dropped {
+				e.Event, e.Severity = eventDropped, severityError
+				e.Dropped = dropped - st.dropped
+				e.Message = fmt.Sprintf("backend %q of relay %q dropped %d batches", b.name, r.Name(), e.Dropped)
+				events = append(events, e)
+			}
+			st.dropped = dropped
+		}
+	}
+
+	// forget the backends of the removed relays
+	for key := range c.state {
+		if !seen[key] {
+			delete(c.state, key)
+		}
+	}
+
+	return events
+}
+
+// notify sends an event to the notifiers which get it
+func (c *healthChecker) notify(e NotifyEvent) {
+	c.mu.Lock()
+	routes := c.routes
+	c.mu.Unlock()
+
+	for _, r := range routes {
+		if r.events != nil && !r.events[e.Event] {
+			continue
+		}
+		if err := r.n.Notify(e); err != nil {
+			log.Printf("Problem notifying %s of event %q of backend %q: %v", r.name, e.Event, e.Backend, err)
+		}
+	}
+}
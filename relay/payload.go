@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// payload is a pooled buffer of line protocol shared by the backends a write
+// is fanned out to. It must not be modified once shared, every holder takes
+// a reference with retain and gives it back with release, the buffer returns
+// to the pool with the last reference. This lets a retry buffer keep the
+// payload of a failed write for as long as it needs without the writer
+// having to wait for it, or anyone making a copy.
+//
+// The rules for the code handling payloads:
+//   - a function receiving a payload may read it until it returns, and must
+//     retain it to keep it any longer (e.g. in a goroutine or a batch)
+//   - whoever retains a payload releases it exactly once
+//   - slices returned by Bytes are only valid while a reference is held,
+//     anything kept past that must be copied, or use clone
+//   - nothing writes to a shared payload, only the owner of the single
+//     reference of a payload it created may append to it, as a batch does
+//     with the payload its writes are merged into
+type payload struct {
+	buf  *bytes.Buffer
+	refs int32
+
+	// Content-Encoding of the buffer, set for the gzip bodies of the
+	// clients forwarded as they are
+	encoding string
+}
+
+// newPayload takes ownership of buf, which is put in the pool once released,
+// and returns a payload holding a single reference
+func newPayload(buf *bytes.Buffer) *payload {
+	return &payload{buf: buf, refs: 1}
+}
+
+func (p *payload) Bytes() []byte {
+	if p.buf == nil {
+		panic("payload used after release")
+	}
+	return p.buf.Bytes()
+}
+
+func (p *payload) Len() int {
+	return p.buf.Len()
+}
+
+// retain takes a new reference, the caller must already hold one
+func (p *payload) retain() *payload {
+	atomic.AddInt32(&p.refs, 1)
+	return p
+}
+
+// clone returns a copy of the payload, sized to its contents and holding
+// a single reference, for holders which must not pin the shared buffer
+func (p *payload) clone() *payload {
+	buf := bytes.NewBuffer(make([]byte, 0, p.Len()))
+	buf.Write(p.Bytes())
+	c := newPayload(buf)
+	c.encoding = p.encoding
+	return c
+}
+
+// release gives back a reference, the payload must not be used afterwards
+func (p *payload) release() {
+	switch n := atomic.AddInt32(&p.refs, -1); {
+	case n == 0:
+		putBuf(p.buf)
+		p.buf = nil
+	case n < 0:
+		panic("payload released too many times")
+	}
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestPayload(data string) *payload {
+	buf := getBuf()
+	buf.WriteString(data)
+	return newPayload(buf)
+}
+
+// expectPanic fails the test when f doesn't panic
+func expectPanic(t *testing.T, name string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s didn't panic", name)
+		}
+	}()
+	f()
+}
+
+func TestPayloadRetainRelease(t *testing.T) {
+	p := newTestPayload("cpu value=1\n")
+
+	if q := p.retain(); q != p {
+		t.Fatal("retain returned another payload")
+	}
+	p.retain()
+
+	p.release()
+	p.release()
+	if !bytes.Equal(p.Bytes(), []byte("cpu value=1\n")) {
+		t.Fatalf("payload %q while a reference is held", p.Bytes())
+	}
+
+	p.release()
+	if p.buf != nil {
+		t.Fatal("buffer kept after the last release")
+	}
+	expectPanic(t, "Bytes after the last release", func() { p.Bytes() })
+	expectPanic(t, "release after the last release", func() { p.release() })
+}
+
+func TestPayloadClone(t *testing.T) {
+	p := newTestPayload("cpu value=1\nmem used=2\n")
+	c := p.clone()
+
+	if !bytes.Equal(c.Bytes(), p.Bytes()) {
+		t.Fatalf("clone %q of %q", c.Bytes(), p.Bytes())
+	}
+	if cap(c.Bytes()) != c.Len() {
+		t.Errorf("clone of %d bytes has a capacity of %d", c.Len(), cap(c.Bytes()))
+	}
+
+	// the clone holds its own reference on its own buffer
+	p.release()
+	if !bytes.Equal(c.Bytes(), []byte("cpu value=1\nmem used=2\n")) {
+		t.Fatalf("clone %q after the release of the payload", c.Bytes())
+	}
+	c.release()
+	if c.buf != nil {
+		t.Fatal("clone kept after its release")
+	}
+}
+
+func TestBatchMerge(t *testing.T) {
+	first, second, third := newTestPayload("a v=1\n"), newTestPayload("b v=2\n"), newTestPayload("c v=3\n")
+
+	// the sender of the first write holds a reference until it's answered
+	first.retain()
+
+	b := &batch{payloads: []*payload{first}, size: first.Len()}
+	b.merge(second)
+	b.merge(third)
+
+	if len(b.payloads) != 1 || b.payloads[0] == first {
+		t.Fatalf("writes not merged into a payload of the batch")
+	}
+	if got := string(b.payloads[0].Bytes()); got != "a v=1\nb v=2\nc v=3\n" {
+		t.Errorf("merged payload %q", got)
+	}
+	if b.size != b.payloads[0].Len() {
+		t.Errorf("batch size %d, payload of %d bytes", b.size, b.payloads[0].Len())
+	}
+
+	// the merge didn't write to the shared payload, and released the others
+	if got := string(first.Bytes()); got != "a v=1\n" {
+		t.Errorf("first payload %q after the merge", got)
+	}
+	first.release()
+	if first.buf != nil {
+		t.Error("first payload still referenced by the batch")
+	}
+	if second.buf != nil || third.buf != nil {
+		t.Error("merged payloads still referenced")
+	}
+	b.payloads[0].release()
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	pingStatic  = "static"
+	pingProxy   = "proxy"
+	pingHealthy = "healthy"
+
+	pingTimeout = 5 * time.Second
+)
+
+// pinger answers /ping from the state of the backends, so that the load
+// balancers stop routing the writes to a relay whose backends are down:
+// "proxy" relays the ping to one backend and "healthy" fails when no
+// backend is healthy. The default "static" mode always answers a 204.
+type pinger struct {
+	mode string
+
+	// backend the pings are relayed to
+	client   *http.Client
+	location string
+}
+
+// newPinger returns nil in the static mode
+func newPinger(cfg HTTPConfig) (*pinger, error) {
+	switch cfg.PingMode {
+	case "", pingStatic:
+		return nil, nil
+	case pingHealthy:
+		return &pinger{mode: pingHealthy}, nil
+	case pingProxy:
+	default:
+		return nil, fmt.Errorf("unknown ping-mode %q", cfg.PingMode)
+	}
+
+	var output *HTTPOutputConfig
+	for i := range cfg.Outputs {
+		if cfg.Outputs[i].Name == cfg.PingBackend || cfg.Outputs[i].Name == "" && cfg.Outputs[i].Location == cfg.PingBackend {
+			output = &cfg.Outputs[i]
+			break
+		}
+	}
+	if output == nil {
+		return nil, fmt.Errorf("unknown ping-backend %q", cfg.PingBackend)
+	}
+	if output.Type != "" && output.Type != "influxdb" {
+		return nil, fmt.Errorf("ping-backend %q isn't an influxdb output", cfg.PingBackend)
+	}
+
+	u, err := url.Parse(output.Location)
+	if err != nil {
+		return nil, err
+	}
+	// the ping endpoint next to the write one
+	u.Path = strings.TrimSuffix(u.Path, "write") + "ping"
+	u.RawQuery = ""
+
+	tc, err := newTransportConfig(output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pinger{
+		mode:     pingProxy,
+		client:   &http.Client{Timeout: pingTimeout, Transport: sharedTransport(tc)},
+		location: u.String(),
+	}, nil
+}
+
+// ping answers a ping of the clients of h
+func (h *HTTP) ping(w http.ResponseWriter, r *http.Request) {
+	p := h.pinger
+	switch {
+	case p == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case p.mode == pingHealthy:
+		if !h.healthy() {
+			jsonError(w, http.StatusServiceUnavailable, "no healthy backend")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		p.proxy(w, r)
+	}
+}
+
+// proxy relays the ping to the backend, with its query (e.g. verbose)
+func (p *pinger) proxy(w http.ResponseWriter, r *http.Request) {
+	location := p.location
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(r.Method, location, nil)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "problem creating ping request")
+		return
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		jsonError(w, http.StatusServiceUnavailable, "ping backend unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, k := range []string{"Content-Type", "Content-Length", "X-Influxdb-Build", "X-Influxdb-Version"} {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// healthy reports whether a primary backend of h is healthy, or any backend
+// when they're all secondary
+func (h *HTTP) healthy() bool {
+	primary := false
+	for _, b := range h.backends {
+		if b.secondary {
+			continue
+		}
+		primary = true
+		if b.healthy() {
+			return true
+		}
+	}
+	if primary {
+		return false
+	}
+
+	for _, b := range h.backends {
+		if b.healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// healthy reports whether the last post to the backend didn't fail and its
+// retry buffer, if any, isn't buffering. A backend never posted to is
+// healthy.
+func (b *httpBackend) healthy() bool {
+	if rb, ok := b.poster.(*retryBuffer); ok && rb.isBuffering() {
+		return false
+	}
+
+	b.errors.mu.Lock()
+	defer b.errors.mu.Unlock()
+	return !b.errors.lastFailure.After(b.errors.lastSuccess)
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// ProfileResult is the cost of the processing of a write by an HTTP relay
+type ProfileResult struct {
+	Relay      string
+	Iterations int
+
+	// per write: the points parsed, written to the backends and skipped
+	Points  int
+	Written int
+	Skipped int
+
+	Duration       time.Duration
+	AllocsPerWrite uint64
+	BytesPerWrite  uint64
+}
+
+// NsPerPoint is the average processing time of a parsed point
+func (p ProfileResult) NsPerPoint() float64 {
+	if p.Points == 0 || p.Iterations == 0 {
+		return 0
+	}
+	return float64(p.Duration.Nanoseconds()) / float64(p.Points*p.Iterations)
+}
+
+func (p ProfileResult) String() string {
+	return fmt.Sprintf("relay %q: %d iterations of %d points (%d written, %d skipped) in %v, %.0f ns/point, %d allocs and %d bytes per write",
+		p.Relay, p.Iterations, p.Points, p.Written, p.Skipped, p.Duration, p.NsPerPoint(), p.AllocsPerWrite, p.BytesPerWrite)
+}
+
+// Profile runs the write body through the parsing, transforms and
+// serialization of the named HTTP relay of cfg (the first one when name is
+// empty) iterations times, the way ServeHTTP does, without forwarding
+// anything to the backends. It's meant to be run under a profiler to
+// measure the cost of a configuration before deploying it.
+func Profile(cfg Config, name string, body []byte, precision string, iterations int) (ProfileResult, error) {
+	var hc *HTTPConfig
+	for i := range cfg.HTTPRelays {
+		if name == "" || cfg.HTTPRelays[i].Name == name {
+			hc = &cfg.HTTPRelays[i]
+			break
+		}
+	}
+	if hc == nil {
+		return ProfileResult{}, fmt.Errorf("no http relay %q", name)
+	}
+	if iterations <= 0 {
+		return ProfileResult{}, errors.New("iterations must be positive")
+	}
+
+	r, err := NewHTTP(*hc)
+	if err != nil {
+		return ProfileResult{}, err
+	}
+	h := r.(*HTTP)
+
+	res := ProfileResult{Relay: h.Name(), Iterations: iterations}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := 0; i < iterations; i++ {
+		// the body is read in a pooled buffer by ServeHTTP as well
+		bodyBuf := getBuf()
+		bodyBuf.Write(body)
+
+		parsed, points, rejected, err := h.parsePoints(bodyBuf.Bytes(), start, precision)
+		if err != nil {
+			putBuf(bodyBuf)
+			return res, err
+		}
+
+		outBuf, written, err := h.rewrite(parsed, points, len(rejected) == 0, precision, nil, nil)
+		putBuf(bodyBuf)
+		if err != nil {
+			return res, err
+		}
+		putBuf(outBuf)
+
+		res.Points, res.Written, res.Skipped = len(points), written, len(rejected)
+	}
+
+	res.Duration = time.Since(start)
+	runtime.ReadMemStats(&after)
+	res.AllocsPerWrite = (after.Mallocs - before.Mallocs) / uint64(iterations)
+	res.BytesPerWrite = (after.TotalAlloc - before.TotalAlloc) / uint64(iterations)
+
+	return res, nil
+}
@@ -0,0 +1,419 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// promWritePath is the endpoint accepting Prometheus remote_write requests,
+// the same one InfluxDB 1.x serves
+const promWritePath = "/api/v1/prom/write"
+
+// protobuf wire types used by the remote_write messages
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+// protoField reads the next field of a protobuf message. Varint and fixed
+// values are returned in v, length delimited ones in data.
+func protoField(buf []byte) (num int, typ int, v uint64, data []byte, rest []byte, err error) {
+	key, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errProtoMalformed
+	}
+	buf = buf[n:]
+	num, typ = int(key>>3), int(key&0x07)
+
+	switch typ {
+	case protoVarint:
+		v, n = binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, 0, 0, nil, nil, errProtoMalformed
+		}
+		buf = buf[n:]
+
+	case protoFixed64:
+		if len(buf) < 8 {
+			return 0, 0, 0, nil, nil, errProtoMalformed
+		}
+		v = binary.LittleEndian.Uint64(buf)
+		buf = buf[8:]
+
+	case protoBytes:
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || l > uint64(len(buf)-n) {
+			return 0, 0, 0, nil, nil, errProtoMalformed
+		}
+		data = buf[n : n+int(l)]
+		buf = buf[n+int(l):]
+
+	case protoFixed32:
+		if len(buf) < 4 {
+			return 0, 0, 0, nil, nil, errProtoMalformed
+		}
+		v = uint64(binary.LittleEndian.Uint32(buf))
+		buf = buf[4:]
+
+	default:
+		return 0, 0, 0, nil, nil, errProtoMalformed
+	}
+
+	return num, typ, v, data, buf, nil
+}
+
+// promWriteToLines decodes a snappy compressed remote_write WriteRequest and
+// converts every sample to a point, named after the metric, with the other
+// labels as tags and a single value field. NaN samples, such as staleness
+// markers, can't be represented in line protocol and are skipped.
+func promWriteToLines(body []byte) (*bytes.Buffer, error) {
+	msg, err := snappyDecode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	out := getBuf()
+	for len(msg) > 0 {
+		num, typ, _, data, rest, err := protoField(msg)
+		if err != nil {
+			putBuf(out)
+			return nil, err
+		}
+		msg = rest
+
+		// WriteRequest.timeseries, metadata is ignored
+		if num != 1 || typ != protoBytes {
+			continue
+		}
+
+		if err := promTimeSeriesToLines(data, out); err != nil {
+			putBuf(out)
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+func promTimeSeriesToLines(msg []byte, out *bytes.Buffer) error {
+	var name string
+	tags := make(models.Tags)
+	var samples []promSample
+
+	for len(msg) > 0 {
+		num, typ, _, data, rest, err := protoField(msg)
+		if err != nil {
+			return err
+		}
+		msg = rest
+
+		if typ != protoBytes {
+			continue
+		}
+
+		switch num {
+		case 1:
+			k, v, err := promLabel(data)
+			if err != nil {
+				return err
+			}
+			if k == "__name__" {
+				name = v
+			} else if v != "" {
+				tags[k] = v
+			}
+
+		case 2:
+			s, err := promDecodeSample(data)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, s)
+		}
+	}
+
+	if name == "" {
+		return errors.New("time series without a metric name")
+	}
+
+	for _, s := range samples {
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+
+		p, err := models.NewPoint(name, tags, models.Fields{"value": s.value}, time.Unix(0, s.timestamp*int64(time.Millisecond)))
+		if err != nil {
+			return err
+		}
+
+		out.WriteString(p.PrecisionString(""))
+		out.WriteByte('\n')
+	}
+
+	return nil
+}
+
+func promLabel(msg []byte) (name, value string, err error) {
+	for len(msg) > 0 {
+		num, typ, _, data, rest, err := protoField(msg)
+		if err != nil {
+			return "", "", err
+		}
+		msg = rest
+
+		if typ != protoBytes {
+			continue
+		}
+
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			value = string(data)
+		}
+	}
+	return name, value, nil
+}
+
+func promDecodeSample(msg []byte) (promSample, error) {
+	var s promSample
+	for len(msg) > 0 {
+		num, typ, v, _, rest, err := protoField(msg)
+		if err != nil {
+			return s, err
+		}
+		msg = rest
+
+		switch {
+		case num == 1 && typ == protoFixed64:
+			s.value = math.Float64frombits(v)
+		case num == 2 && typ == protoVarint:
+			s.timestamp = int64(v)
+		}
+	}
+	return s, nil
+}
+
+// promPoster converts the line protocol forwarded to it into remote_write
+// requests, so Prometheus compatible storage can be used as a backend.
+// Every numeric field becomes a series named <measurement>_<field>, or just
+// <measurement> for the value field, with the tags as labels.
+type promPoster struct {
+	client   *http.Client
+	location string
+	headers  outputHeaders
+}
+
+func newPromPoster(location string, timeout time.Duration, tc transportConfig) *promPoster {
+	s := newSimplePoster(location, timeout, tc)
+	return &promPoster{
+		client:   s.client,
+		location: location,
+	}
+}
+
+func (b *promPoster) post(pl *payload, query string, auth string) (*responseData, error) {
+	// the credentials of the InfluxDB write are not passed on
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := models.ParsePointsWithPrecision(pl.Bytes(), time.Now(), params.Get("precision"))
+	if err != nil {
+		// rejected as InfluxDB would, a retry would never succeed
+		return &responseData{
+			ContentType: "application/json",
+			StatusCode:  http.StatusBadRequest,
+			Body:        []byte(fmt.Sprintf("{\"error\":%q}\n", err.Error())),
+		}, nil
+	}
+
+	body := snappyEncode(promWriteRequest(points))
+
+	req, err := http.NewRequest("POST", b.location, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	b.headers.set(req)
+
+	sent := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	skew, known := measureSkew(resp.Header, sent, time.Now())
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if err = resp.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	return &responseData{
+		ContentType: resp.Header.Get("Content-Type"),
+		StatusCode:  resp.StatusCode,
+		Body:        data,
+		Skew:        skew,
+		SkewKnown:   known,
+	}, nil
+}
+
+// promWriteRequest encodes the points as a WriteRequest message
+func promWriteRequest(points []models.Point) []byte {
+	var msg, series, scratch []byte
+
+	for _, p := range points {
+		tags := p.Tags()
+		var keys []string
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		ts := p.UnixNano() / int64(time.Millisecond)
+
+		for field, v := range p.Fields() {
+			var value float64
+			switch v := v.(type) {
+			case float64:
+				value = v
+			case int64:
+				value = float64(v)
+			case bool:
+				if v {
+					value = 1
+				}
+			default:
+				// strings can't be stored
+				continue
+			}
+
+			name := p.Name()
+			if field != "value" {
+				name += "_" + field
+			}
+
+			series = series[:0]
+			for _, l := range promLabels(name, tags, keys) {
+				scratch = appendProtoString(scratch[:0], 1, l[0])
+				scratch = appendProtoString(scratch, 2, l[1])
+				series = appendProtoBytes(series, 1, scratch)
+			}
+
+			scratch = appendProtoKey(scratch[:0], 1, protoFixed64)
+			scratch = appendFixed64(scratch, math.Float64bits(value))
+			scratch = appendProtoKey(scratch, 2, protoVarint)
+			scratch = appendUvarint(scratch, uint64(ts))
+			series = appendProtoBytes(series, 2, scratch)
+
+			msg = appendProtoBytes(msg, 1, series)
+		}
+	}
+
+	return msg
+}
+
+// promLabels returns the sanitized name and value pairs of a series, sorted
+// by name as remote_write requires. The receivers reject the series with
+// duplicate label names, the tags whose names sanitize to the one of an
+// earlier tag of keys get a numbered suffix.
+func promLabels(name string, tags models.Tags, keys []string) [][2]string {
+	labels := make([][2]string, 0, len(keys)+1)
+	labels = append(labels, [2]string{"__name__", promName(name)})
+	seen := map[string]bool{"__name__": true}
+	for _, k := range keys {
+		base := promLabelName(k)
+		l := base
+		for i := 2; seen[l]; i++ {
+			l = fmt.Sprintf("%s_%d", base, i)
+		}
+		seen[l] = true
+		labels = append(labels, [2]string{l, tags[k]})
+	}
+
+	sort.Sort(promLabelSlice(labels))
+	return labels
+}
+
+type promLabelSlice [][2]string
+
+func (s promLabelSlice) Len() int           { return len(s) }
+func (s promLabelSlice) Less(i, j int) bool { return s[i][0] < s[j][0] }
+func (s promLabelSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// promName replaces the characters which are invalid in metric names
+func promName(s string) string {
+	return promSanitize(s, true)
+}
+
+// promLabelName replaces the characters which are invalid in label names,
+// where the colons of the metric names aren't allowed
+func promLabelName(s string) string {
+	return promSanitize(s, false)
+}
+
+func promSanitize(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c == '_' || colons && c == ':' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		b[i] = '_'
+	}
+	return string(b)
+}
+
+func appendProtoKey(b []byte, num int, typ int) []byte {
+	return appendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = appendProtoKey(b, num, protoBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoString(b []byte, num int, s string) []byte {
+	b = appendProtoKey(b, num, protoBytes)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
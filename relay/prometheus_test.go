@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestPromLabels(t *testing.T) {
+	tags := models.Tags{
+		"a.b":       "1",
+		"a-b":       "2",
+		"a_b":       "3",
+		"host:port": "4",
+		"__name__":  "5",
+	}
+	keys := []string{"__name__", "a-b", "a.b", "a_b", "host:port"}
+
+	want := [][2]string{
+		{"__name__", "cpu:usage"},
+		{"__name___2", "5"},
+		{"a_b", "2"},
+		{"a_b_2", "1"},
+		{"a_b_3", "3"},
+		{"host_port", "4"},
+	}
+	if got := promLabels("cpu:usage", tags, keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels %q, want %q", got, want)
+	}
+}
+
+// a write which doesn't parse is rejected rather than retried
+func TestPromPosterUnparsable(t *testing.T) {
+	var posts int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	p := newPromPoster(backend.URL+"/api/v1/push", time.Second, transportConfig{})
+	pl := newTestPayload("cpu value=\n")
+	defer pl.release()
+
+	resp, err := p.post(pl, "db=test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if n := atomic.LoadInt64(&posts); n != 0 {
+		t.Errorf("%d posts to the backend, want none", n)
+	}
+}
@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The PROXY protocol (v1 and v2) is used by HAProxy and load balancers in TCP
+// mode to pass the address of the client, in a header sent before the
+// data, see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+// With accept-proxy-protocol, every connection must start with the header
+// and its source address is the remote address of the connection.
+
+const proxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyListener reads the PROXY protocol header of the accepted connections
+// in their own goroutine, so that slow clients don't hold the others back
+type proxyListener struct {
+	net.Listener
+
+	conns chan net.Conn
+	errs  chan error
+}
+
+func newProxyListener(l net.Listener) *proxyListener {
+	p := &proxyListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+	}
+	go p.accept()
+	return p
+}
+
+func (p *proxyListener) accept() {
+	for {
+		c, err := p.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			p.errs <- err
+			return
+		}
+
+		go func() {
+			pc, err := readProxyHeader(c)
+			if err != nil {
+				log.Printf("Dropped connection from %v on %v: %v", c.RemoteAddr(), p.Addr(), err)
+				c.Close()
+				return
+			}
+
+			select {
+			case p.conns <- pc:
+			case err := <-p.errs:
+				// the listener is closed
+				p.errs <- err
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	case err := <-p.errs:
+		p.errs <- err
+		return nil, err
+	}
+}
+
+// proxyConn is a connection whose remote address is the one of the client
+// given by the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the header at the start of c. The remote address of
+// c is kept for LOCAL (health check) and UNKNOWN connections.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(c)
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr()}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		addr, err = readProxyV2(r)
+	} else {
+		addr, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		pc.remote = addr
+	}
+	return pc, nil
+}
+
+// readProxyV1 reads a text header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the longest header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	s := string(line)
+	if !strings.HasPrefix(s, "PROXY ") || !strings.HasSuffix(s, "\r\n") {
+		return nil, errProxyHeader
+	}
+
+	f := strings.Split(strings.TrimSuffix(s, "\r\n"), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary header, whose signature was already checked
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errProxyHeader
+	}
+
+	switch fam {
+	case 0x11:
+		// TCP over IPv4
+		if len(data) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(data) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+
+	// UNSPEC, UDP and unix sockets
+	return nil, nil
+}
@@ -0,0 +1,307 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Purging the retry buffer of a backend moves the buffered batches to a file
+// of the purge directory instead of destroying them, so that a purge of the
+// wrong backend can be undone: the file can be restored to the buffer during
+// the grace period, after which it is removed. The batch being retried when
+// the purge happens stays in the buffer.
+
+const (
+	DefaultPurgeGracePeriod = 24 * time.Hour
+
+	purgeBatchHeader = "# batch "
+	purgeFileSuffix  = ".purge"
+	purgeSweep       = time.Minute
+)
+
+var errPurged = errors.New("write purged from the retry buffer")
+
+// purgeStore holds the purged batches, one file per purge named
+// <id>.<relay>.<backend>.purge, the id being the time of the purge
+type purgeStore struct {
+	dir   string
+	grace time.Duration
+}
+
+func newPurgeStore(cfg AdminConfig) (*purgeStore, error) {
+	s := &purgeStore{
+		dir:   cfg.PurgeDir,
+		grace: DefaultPurgeGracePeriod,
+	}
+	if s.dir == "" {
+		s.dir = filepath.Join(os.TempDir(), "influxdb-relay-purged")
+	}
+
+	if cfg.PurgeGracePeriod != "" {
+		d, err := time.ParseDuration(cfg.PurgeGracePeriod)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing purge grace period '%v'", err)
+		}
+		s.grace = d
+	}
+	return s, nil
+}
+
+// purgeInfo describes a purge held by the store
+type purgeInfo struct {
+	ID       string    `json:"id"`
+	Relay    string    `json:"relay"`
+	Backend  string    `json:"backend"`
+	Batches  int       `json:"batches,omitempty"`
+	Bytes    int64     `json:"bytes"`
+	PurgedAt time.Time `json:"purged_at"`
+	Expires  time.Time `json:"expires"`
+}
+
+// purge empties the retry buffer of backend, the writes waiting for their
+// batch to be written fail with errPurged
+func (s *purgeStore) purge(relay, backend string, r *retryBuffer) (purgeInfo, error) {
+	batches := r.list.drain()
+
+	now := time.Now()
+	info := purgeInfo{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Relay:    relay,
+		Backend:  backend,
+		Batches:  len(batches),
+		PurgedAt: now,
+		Expires:  now.Add(s.grace),
+	}
+
+	if s.grace > 0 && len(batches) > 0 {
+		n, err := s.save(info, batches)
+		if err != nil {
+			// nothing is lost, the batches go back to the buffer
+			r.list.requeue(batches)
+			return info, err
+		}
+		info.Bytes = n
+	}
+
+	failBatches(batches, errPurged)
+	r.checkLevel()
+
+	log.Printf("Purged %d batches of the retry buffer of relay %q backend %q", len(batches), relay, backend)
+	return info, nil
+}
+
+func (s *purgeStore) file(info purgeInfo) string {
+	return filepath.Join(s.dir, info.ID+"."+purgeEscape(info.Relay)+"."+purgeEscape(info.Backend)+purgeFileSuffix)
+}
+
+// purgeEscape escapes a name for the file name of a purge, dots included
+func purgeEscape(name string) string {
+	return strings.Replace(url.QueryEscape(name), ".", "%2E", -1)
+}
+
+// save writes batches to the file of info, every batch after a header giving
+// its query and credentials. The file is only readable by the relay user.
+func (s *purgeStore) save(info purgeInfo, batches []*batch) (int64, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	for _, b := range batches {
+		fmt.Fprintf(&buf, "%squery=%s auth=%s\n", purgeBatchHeader, url.QueryEscape(b.query), url.QueryEscape(b.auth))
+		for _, p := range b.payloads {
+			data := p.Bytes()
+			buf.Write(data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(s.file(info), buf.Bytes(), 0600); err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), nil
+}
+
+// list returns the purges held by the store, the expired ones are removed
+func (s *purgeStore) list() ([]purgeInfo, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+purgeFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	purges := []purgeInfo{}
+	now := time.Now()
+	for _, name := range names {
+		info, ok := parsePurgeFile(filepath.Base(name))
+		if !ok {
+			continue
+		}
+		info.Expires = info.PurgedAt.Add(s.grace)
+
+		if now.After(info.Expires) {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				log.Printf("Problem removing expired purge %q: %v", name, err)
+			}
+			continue
+		}
+
+		if fi, err := os.Stat(name); err == nil {
+			info.Bytes = fi.Size()
+		}
+		purges = append(purges, info)
+	}
+	return purges, nil
+}
+
+func (s *purgeStore) get(id string) (purgeInfo, bool) {
+	purges, err := s.list()
+	if err != nil {
+		return purgeInfo{}, false
+	}
+	for _, p := range purges {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return purgeInfo{}, false
+}
+
+func parsePurgeFile(name string) (purgeInfo, bool) {
+	f := strings.Split(strings.TrimSuffix(name, purgeFileSuffix), ".")
+	if len(f) != 3 {
+		return purgeInfo{}, false
+	}
+
+	ns, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return purgeInfo{}, false
+	}
+	relay, err := url.QueryUnescape(f[1])
+	if err != nil {
+		return purgeInfo{}, false
+	}
+	backend, err := url.QueryUnescape(f[2])
+	if err != nil {
+		return purgeInfo{}, false
+	}
+
+	return purgeInfo{
+		ID:       f[0],
+		Relay:    relay,
+		Backend:  backend,
+		PurgedAt: time.Unix(0, ns),
+	}, true
+}
+
+// purgedBatch is a batch read back from a purge file
+type purgedBatch struct {
+	query string
+	auth  string
+	data  []byte
+}
+
+func (s *purgeStore) read(info purgeInfo) ([]purgedBatch, error) {
+	f, err := os.Open(s.file(info))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var batches []purgedBatch
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return batches, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, purgeBatchHeader) {
+			h, err := url.ParseQuery(strings.Replace(strings.TrimSpace(line[len(purgeBatchHeader):]), " ", "&", -1))
+			if err != nil {
+				return nil, err
+			}
+			batches = append(batches, purgedBatch{query: h.Get("query"), auth: h.Get("auth")})
+			continue
+		}
+
+		if len(batches) == 0 {
+			return nil, errors.New("invalid purge file")
+		}
+		b := &batches[len(batches)-1]
+		b.data = append(b.data, line...)
+	}
+}
+
+// restore adds the batches of the purge back to r. When the buffer can't
+// hold all of them the others are kept in the file, to be restored later.
+func (s *purgeStore) restore(info purgeInfo, r *retryBuffer) (int, error) {
+	batches, err := s.read(info)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, b := range batches {
+		buf := getBuf()
+		buf.Write(b.data)
+		p := newPayload(buf)
+
+		if _, err := r.list.add(p, b.query, b.auth); err != nil {
+			p.release()
+			if werr := s.rewrite(info, batches[i:]); werr != nil {
+				return i, werr
+			}
+			return i, err
+		}
+	}
+
+	return len(batches), os.Remove(s.file(info))
+}
+
+// rewrite replaces the file of info by the batches not restored yet
+func (s *purgeStore) rewrite(info purgeInfo, batches []purgedBatch) error {
+	var buf bytes.Buffer
+	for _, b := range batches {
+		fmt.Fprintf(&buf, "%squery=%s auth=%s\n", purgeBatchHeader, url.QueryEscape(b.query), url.QueryEscape(b.auth))
+		buf.Write(b.data)
+	}
+
+	name := s.file(info)
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// sweep removes the expired purges until stop is closed
+func (s *purgeStore) sweep(stop <-chan struct{}) {
+	t := time.NewTicker(purgeSweep)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.list(); err != nil {
+				log.Printf("Problem sweeping the purge directory %q: %v", s.dir, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultQueryTimeout = 60 * time.Second
+
+	// maximum size of the body of a POST query, which is held in memory to
+	// be sent again to another backend
+	maxQueryBodySize = 4 * MB
+)
+
+// querier relays the /query endpoint of InfluxDB 1 to one of the backends
+// of a relay, picked in turn among the available ones, see available. A
+// query which can't be sent to its backend, e.g. a refused connection, is
+// sent to the next one and the backend is marked as failed; a query
+// answered by a backend, even with an error, isn't sent again as it may not
+// be idempotent.
+type querier struct {
+	backends []*queryBackend
+	next     uint32
+}
+
+type queryBackend struct {
+	b        *httpBackend
+	client   *http.Client
+	location string
+	headers  outputHeaders
+}
+
+// checkQueryBackends returns the indexes of the outputs the queries are
+// relayed to: the ones named by cfg.QueryBackends, or every influxdb output
+// which isn't a shadow
+func checkQueryBackends(cfg HTTPConfig) ([]int, error) {
+	var indexes []int
+	if len(cfg.QueryBackends) == 0 {
+		for i, o := range cfg.Outputs {
+			if (o.Type == "" || o.Type == "influxdb") && !o.Shadow {
+				if err := checkQueryCredentials(cfg, o); err != nil {
+					return nil, err
+				}
+				indexes = append(indexes, i)
+			}
+		}
+		if len(indexes) == 0 {
+			return nil, errors.New("proxy-queries without influxdb output")
+		}
+		return indexes, nil
+	}
+
+	for _, name := range cfg.QueryBackends {
+		i := outputIndex(cfg.Outputs, name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown query backend %q", name)
+		}
+		if o := cfg.Outputs[i]; o.Type != "" && o.Type != "influxdb" {
+			return nil, fmt.Errorf("query backend %q isn't an influxdb output", name)
+		}
+		if err := checkQueryCredentials(cfg, cfg.Outputs[i]); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// checkQueryCredentials refuses to relay the queries to an output with
+// credentials (username, password or an Authorization header) when the
+// relay doesn't authenticate its clients: anyone reaching the relay could
+// run any query, DROP DATABASE included, as the user of the output
+func checkQueryCredentials(cfg HTTPConfig, o HTTPOutputConfig) error {
+	credentials := o.Username != "" || o.Password != ""
+	for k := range o.Headers {
+		if http.CanonicalHeaderKey(strings.TrimSpace(k)) == "Authorization" {
+			credentials = true
+		}
+	}
+	if !credentials {
+		return nil
+	}
+
+	a := cfg.Auth
+	if len(a.Tokens) > 0 || a.TokenFile != "" || a.VerifyBackend != "" {
+		return nil
+	}
+	name := o.Name
+	if name == "" {
+		name = o.Location
+	}
+	return fmt.Errorf("queries relayed to output %q with credentials, without auth of the clients", name)
+}
+
+// outputIndex returns the index of the output named name, or whose
+// location is name when it has no name, -1 if none
+func outputIndex(outputs []HTTPOutputConfig, name string) int {
+	for i, o := range outputs {
+		if o.Name == name || o.Name == "" && o.Location == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// newQuerier returns nil unless the relay proxies the queries, the
+// backends being the ones of the outputs of cfg
+func newQuerier(cfg HTTPConfig, backends []*httpBackend) (*querier, error) {
+	if !cfg.ProxyQueries {
+		if len(cfg.QueryBackends) > 0 {
+			return nil, errors.New("query-backends without proxy-queries")
+		}
+		return nil, nil
+	}
+
+	timeout, err := queryTimeout(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes, err := checkQueryBackends(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	q := new(querier)
+	for _, i := range indexes {
+		qb, err := newQueryBackend(backends[i], &cfg.Outputs[i], "query", timeout)
+		if err != nil {
+			return nil, err
+		}
+		q.backends = append(q.backends, qb)
+	}
+	return q, nil
+}
+
+// newQueryBackend returns the client of the endpoint of the backend of
+// output next to its write one, e.g. "query"
+func newQueryBackend(b *httpBackend, output *HTTPOutputConfig, endpoint string, timeout time.Duration) (*queryBackend, error) {
+	u, err := url.Parse(output.Location)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "write") + endpoint
+	u.RawQuery = ""
+
+	tc, err := newTransportConfig(output)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := newOutputHeaders(output.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if output.Username != "" {
+		headers.defaultAuth = basicAuth(output.Username, output.Password)
+	}
+
+	return &queryBackend{
+		b:        b,
+		client:   &http.Client{Timeout: timeout, Transport: sharedTransport(tc)},
+		location: u.String(),
+		headers:  headers,
+	}, nil
+}
+
+// queryTimeout returns the timeout of the queries relayed by cfg
+func queryTimeout(cfg HTTPConfig) (time.Duration, error) {
+	if cfg.QueryTimeout == "" {
+		return DefaultQueryTimeout, nil
+	}
+	d, err := time.ParseDuration(cfg.QueryTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing query timeout '%v'", err)
+	}
+	return d, nil
+}
+
+// order returns the backends in the order a query tries them: the
+// available ones first, starting from the next one in turn among them
+func (q *querier) order(now time.Time) []*queryBackend {
+	var available, others []*queryBackend
+	for _, qb := range q.backends {
+		if qb.b.available(now) {
+			available = append(available, qb)
+		} else {
+			others = append(others, qb)
+		}
+	}
+	if len(available) == 0 {
+		available, others = others, nil
+	}
+
+	n := len(available)
+	start := int(atomic.AddUint32(&q.next, 1)-1) % n
+	out := make([]*queryBackend, 0, len(q.backends))
+	out = append(out, available[start:]...)
+	out = append(out, available[:start]...)
+	return append(out, others...)
+}
+
+// headers of the queries relayed to the backends
+var queryHeaders = []string{"Accept", "Accept-Encoding", "Authorization", "Content-Type"}
+
+// query relays a query of the clients of h, see querier
+func (h *HTTP) query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		jsonError(w, http.StatusMethodNotAllowed, "invalid query method")
+		return
+	}
+
+	params := r.URL.Query()
+	if !h.authorizeQuery(w, r, params) {
+		return
+	}
+
+	// the body is sent again to the next backend when one can't be reached
+	var body []byte
+	if r.Method == "POST" {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxQueryBodySize+1))
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, "problem reading request body")
+			return
+		}
+		if len(b) > maxQueryBodySize {
+			jsonError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		body = b
+	}
+
+	for _, qb := range h.querier.order(time.Now()) {
+		resp, err := qb.do(r, bytes.NewReader(body), params)
+		if err != nil {
+			log.Printf("Problem relaying a query of relay %q to backend %q, trying the next one: %v", h.Name(), qb.b.name, err)
+			qb.b.errors.mu.Lock()
+			qb.b.errors.lastFailure = time.Now()
+			qb.b.errors.mu.Unlock()
+			continue
+		}
+
+		copyQueryResponse(w, resp)
+		resp.Body.Close()
+		return
+	}
+
+	jsonError(w, http.StatusServiceUnavailable, "no query backend available")
+}
+
+// authorizeQuery checks the credentials of a query when the relay
+// authenticates its clients, and answers w when they're refused. The
+// credentials are removed from r and params unless they're forwarded.
+func (h *HTTP) authorizeQuery(w http.ResponseWriter, r *http.Request, params url.Values) bool {
+	if h.auth == nil {
+		return true
+	}
+
+	g, ok, err := h.auth.allow(r)
+	if err != nil {
+		jsonError(w, http.StatusServiceUnavailable, err.Error())
+		return false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Token realm="influxdb-relay"`)
+		jsonError(w, http.StatusUnauthorized, "authorization failed")
+		return false
+	}
+	// the databases of a query aren't known without parsing it
+	if g != nil {
+		jsonError(w, http.StatusForbidden, "token not allowed to query")
+		return false
+	}
+	if !h.auth.forward {
+		r.Header.Del("Authorization")
+		params.Del("u")
+		params.Del("p")
+	}
+	return true
+}
+
+// do sends the query r, with the given body and parameters, to the backend
+func (qb *queryBackend) do(r *http.Request, body io.Reader, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(r.Method, qb.location, body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = params.Encode()
+	for _, k := range queryHeaders {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	qb.headers.set(req)
+
+	return qb.client.Do(req)
+}
+
+// copyQueryResponse copies the response of a backend to w, flushing it as
+// it's read for the chunked queries
+func copyQueryResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, vs := range resp.Header {
+		switch k {
+		case "Connection", "Keep-Alive", "Transfer-Encoding":
+			continue
+		}
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	buf := make([]byte, 32*KB)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			f.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
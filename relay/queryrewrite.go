@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// queryMapAny maps every database or retention policy without a mapping of
+// its own
+const queryMapAny = "*"
+
+// queryRewriter rewrites the query string of the writes to a backend, e.g.
+// to consolidate the databases of several clients into one, or to write
+// every point to the retention policy of a storage tier
+type queryRewriter struct {
+	databases map[string]string
+
+	// rp is the retention policy of every write when not empty, otherwise
+	// the ones of the writes are mapped by rps
+	rp  string
+	rps map[string]string
+
+	p poster
+}
+
+// newQueryRewriter returns nil when the backend keeps the query of the client
+func newQueryRewriter(cfg *HTTPOutputConfig, p poster) (*queryRewriter, error) {
+	if len(cfg.DatabaseMap) == 0 && cfg.RetentionPolicy == "" && len(cfg.RetentionPolicyMap) == 0 {
+		return nil, nil
+	}
+
+	for from, to := range cfg.DatabaseMap {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid database mapping %q to %q", from, to)
+		}
+	}
+
+	if cfg.RetentionPolicy != "" && len(cfg.RetentionPolicyMap) > 0 {
+		return nil, errors.New("retention-policy and retention-policy-map are exclusive")
+	}
+	for from, to := range cfg.RetentionPolicyMap {
+		if to == "" {
+			return nil, fmt.Errorf("invalid retention policy mapping %q to %q", from, to)
+		}
+	}
+
+	return &queryRewriter{
+		databases: cfg.DatabaseMap,
+		rp:        cfg.RetentionPolicy,
+		rps:       cfg.RetentionPolicyMap,
+		p:         p,
+	}, nil
+}
+
+// rewrite returns the query sent to the backend for a write of query
+func (q *queryRewriter) rewrite(query string) (string, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	if to, ok := mapParam(q.databases, params.Get("db")); ok {
+		params.Set("db", to)
+	}
+
+	if q.rp != "" {
+		params.Set("rp", q.rp)
+	} else if to, ok := mapParam(q.rps, params.Get("rp")); ok {
+		params.Set("rp", to)
+	}
+
+	return params.Encode(), nil
+}
+
+// mapParam returns the mapping of value in m, or the one of "*"
+func mapParam(m map[string]string, value string) (string, bool) {
+	if to, ok := m[value]; ok {
+		return to, true
+	}
+	to, ok := m[queryMapAny]
+	return to, ok
+}
+
+func (q *queryRewriter) post(p *payload, query string, auth string) (*responseData, error) {
+	query, err := q.rewrite(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.p.post(p, query, auth)
+}
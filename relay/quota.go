@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotas limit the points per second and the bytes per day written to every
+// database matching a rule, e.g. of every tenant of a hosted service. The
+// days are UTC ones.
+type quotas struct {
+	rules []quotaRule
+
+	mu  sync.Mutex
+	dbs map[string]*dbQuota
+}
+
+type quotaRule struct {
+	database    string
+	rate        float64
+	burst       int
+	bytesPerDay int64
+}
+
+type dbQuota struct {
+	rule quotaRule
+	rate *rateLimiter
+
+	day   int64
+	bytes int64
+}
+
+// quotaUsage is the state of the quota of a database after a write
+type quotaUsage struct {
+	rule      quotaRule
+	bytes     int64
+	resetDay  time.Duration
+	retryRate bool
+}
+
+// newQuotas returns nil when there is no quota
+func newQuotas(cfgs []QuotaConfig) (*quotas, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	q := &quotas{dbs: make(map[string]*dbQuota)}
+	for _, c := range cfgs {
+		if c.Database == "" {
+			return nil, errors.New("quota without database")
+		}
+		if _, err := path.Match(c.Database, ""); err != nil {
+			return nil, fmt.Errorf("invalid quota database pattern %q", c.Database)
+		}
+		if c.PointsPerSecond < 0 || c.Burst < 0 || c.MBPerDay < 0 {
+			return nil, fmt.Errorf("negative quota of database %q", c.Database)
+		}
+		if c.PointsPerSecond == 0 && c.MBPerDay == 0 {
+			return nil, fmt.Errorf("quota of database %q without limit", c.Database)
+		}
+		q.rules = append(q.rules, quotaRule{
+			database:    c.Database,
+			rate:        c.PointsPerSecond,
+			burst:       c.Burst,
+			bytesPerDay: int64(c.MBPerDay) * MB,
+		})
+	}
+	return q, nil
+}
+
+// quota returns the state of the quota of db, nil when no rule matches it
+func (q *quotas) quota(db string) *dbQuota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if d, ok := q.dbs[db]; ok {
+		return d
+	}
+
+	for _, r := range q.rules {
+		if ok, _ := path.Match(r.database, db); ok {
+			d := &dbQuota{rule: r, rate: newRateLimiter(r.rate, r.burst)}
+			q.dbs[db] = d
+			return d
+		}
+	}
+	return nil
+}
+
+// allow reports whether a write of n points and size bytes to db may go
+// through at now, and accounts for it when it does
+func (q *quotas) allow(db string, n, size int, now time.Time) (bool, *quotaUsage) {
+	d := q.quota(db)
+	if d == nil {
+		return true, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now = now.UTC()
+	day := now.Unix() / 86400
+	if day != d.day {
+		d.day, d.bytes = day, 0
+	}
+
+	u := &quotaUsage{
+		rule:     d.rule,
+		resetDay: time.Unix((day+1)*86400, 0).Sub(now),
+	}
+
+	if d.rule.bytesPerDay > 0 && d.bytes >= d.rule.bytesPerDay {
+		u.bytes = d.bytes
+		return false, u
+	}
+	if d.rate != nil && !d.rate.allow(n, now) {
+		u.bytes = d.bytes
+		u.retryRate = true
+		return false, u
+	}
+
+	d.bytes += int64(size)
+	u.bytes = d.bytes
+	return true, u
+}
+
+// setHeaders reports the usage of the quota in the headers of the response
+func (u *quotaUsage) setHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	if u.rule.rate > 0 {
+		h.Set("X-Quota-Points-Per-Second", strconv.FormatFloat(u.rule.rate, 'f', -1, 64))
+	}
+	if u.rule.bytesPerDay > 0 {
+		remaining := u.rule.bytesPerDay - u.bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		h.Set("X-Quota-Bytes-Per-Day", strconv.FormatInt(u.rule.bytesPerDay, 10))
+		h.Set("X-Quota-Bytes-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-Quota-Reset", strconv.FormatInt(int64(u.resetDay/time.Second)+1, 10))
+	}
+}
+
+// retryAfter is the time until a rejected write may go through
+func (u *quotaUsage) retryAfter() int64 {
+	if u.retryRate {
+		return 1
+	}
+	return int64(u.resetDay/time.Second) + 1
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of points, refilled at rate points per
+// second up to burst. A write is let through as long as the bucket isn't
+// in debt, so that writes larger than the burst aren't rejected forever,
+// and the points it holds are taken from the bucket afterwards.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when rate is 0, burst defaults to one second
+// worth of points
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// allow reports whether a write of n points may go through at now, and
+// accounts for it when it does
+func (r *rateLimiter) allow(n int, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d := now.Sub(r.last); d > 0 {
+		r.tokens += d.Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+		r.last = now
+	}
+
+	if r.tokens < 0 {
+		return false
+	}
+	r.tokens -= float64(n)
+	return true
+}
+
+// clientRateLimiter gives every client address a token bucket of its own
+type clientRateLimiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*rateLimiter
+	lastSweep time.Time
+}
+
+// newClientRateLimiter returns nil when rate is 0
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &clientRateLimiter{
+		rate:      rate,
+		burst:     burst,
+		limiters:  make(map[string]*rateLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow reports whether a write of n points from client may go through at
+// now. The buckets which refilled since their last write are dropped every
+// minute, a new bucket being full anyway.
+func (c *clientRateLimiter) allow(client string, n int, now time.Time) bool {
+	c.mu.Lock()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, r := range c.limiters {
+			r.mu.Lock()
+			idle := now.Sub(r.last).Seconds()*r.rate >= r.burst-r.tokens
+			r.mu.Unlock()
+			if idle {
+				delete(c.limiters, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	r := c.limiters[client]
+	if r == nil {
+		r = newRateLimiter(c.rate, c.burst)
+		c.limiters[client] = r
+	}
+	c.mu.Unlock()
+
+	return r.allow(n, now)
+}
@@ -1,13 +1,37 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 type Service struct {
-	relays map[string]Relay
+	// mu guards relays and the state of the service, relays can be added
+	// and removed while it runs
+	mu      sync.RWMutex
+	relays  map[string]Relay
+	running bool
+	stopped bool
+	wg      sync.WaitGroup
+
+	// listeners shared by the relays with a path prefix, by address
+	listeners map[string]*sharedListener
+
+	// templates tenants are created from, and the tenants by name
+	templates map[string]*tenantTemplate
+	tenants   map[string]TenantConfig
+
+	// when the service and every relay were started, for /status
+	runSince time.Time
+	started  map[string]time.Time
+
+	admin  *Admin
+	usage  *usageExporter
+	statsd *statsdEmitter
+	health *healthChecker
 }
 
 type Relay interface {
@@ -16,25 +40,47 @@ type Relay interface {
 	Stop() error
 }
 
+// relayCloser is implemented by the relays whose backends run goroutines
+// and hold files from their creation on, released once the relay is
+// removed or the service stopped
+type relayCloser interface {
+	close()
+}
+
+func closeRelay(r Relay) {
+	if c, ok := r.(relayCloser); ok {
+		c.close()
+	}
+}
+
 // construct a Service instant by a config instant
 func New(config Config) (*Service, error) {
 	s := new(Service)
 	s.relays = make(map[string]Relay)
+	s.listeners = make(map[string]*sharedListener)
+	s.templates = make(map[string]*tenantTemplate)
+	s.tenants = make(map[string]TenantConfig)
+	s.started = make(map[string]time.Time)
 
-	// 遍历config.HTTPRelays,根据配置实例化服务于HTTP请求的对象
-	for _, cfg := range config.HTTPRelays {
-		h, err := NewHTTP(cfg)
+	configureBufPool(config.BufferPool)
+
+	if config.Usage.File != "" || config.Usage.Location != "" {
+		u, err := newUsageExporter(config.Usage)
 		if err != nil {
 			return nil, err
 		}
+		s.usage = u
+	}
+
+	// 遍历config.HTTPRelays,根据配置实例化服务于HTTP请求的对象
+	for _, cfg := range config.HTTPRelays {
 		// 检查配置文件中的配置outputs列表里是否存在重名.
 		// 如果存在重名情况, 停止加载其他配置
 		// 这里要注意的是当发生重名的情况后返回给main.go中的调用方后,调用方不会就此终止进程
 		// 而是以完成初始化的s.relays对象继续向下运行
-		if s.relays[h.Name()] != nil {
-			return nil, fmt.Errorf("duplicate relay: %q", h.Name())
+		if err := s.addHTTP(cfg, cfg.PathPrefix); err != nil {
+			return nil, err
 		}
-		s.relays[h.Name()] = h
 	}
 
 	for _, cfg := range config.UDPRelays {
@@ -42,35 +88,233 @@ func New(config Config) (*Service, error) {
 		if err != nil {
 			return nil, err
 		}
-		if s.relays[u.Name()] != nil {
-			return nil, fmt.Errorf("duplicate relay: %q", u.Name())
+		if err := s.AddRelay(u); err != nil {
+			return nil, err
 		}
-		s.relays[u.Name()] = u
+	}
+
+	for _, cfg := range config.CollectdRelays {
+		c, err := NewCollectd(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.AddRelay(c); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cfg := range config.MQTTRelays {
+		m, err := NewMQTT(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.AddRelay(m); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cfg := range config.HTTPTemplates {
+		if err := s.addTemplate(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cfg := range config.Tenants {
+		if err := s.AddTenant(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.StatsD.Addr != "" {
+		e, err := newStatsdEmitter(config.StatsD, s)
+		if err != nil {
+			return nil, err
+		}
+		s.statsd = e
+	}
+
+	// created without notifiers as well, for AddNotifier
+	h, err := newHealthChecker(config.Notify, s)
+	if err != nil {
+		return nil, err
+	}
+	s.health = h
+
+	if config.Admin.Addr != "" {
+		a, err := newAdmin(config.Admin, s)
+		if err != nil {
+			return nil, err
+		}
+		s.admin = a
 	}
 
 	return s, nil
 }
 
 func (s *Service) Run() {
-	var wg sync.WaitGroup
-	wg.Add(len(s.relays))
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.running = true
+	s.runSince = time.Now()
 
-	for k := range s.relays {
-		relay := s.relays[k]
+	if s.admin != nil {
+		s.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer s.wg.Done()
 
-			if err := relay.Run(); err != nil {
-				log.Printf("Error running relay %q: %v", relay.Name(), err)
+			if err := s.admin.Run(); err != nil {
+				log.Printf("Error running admin listener: %v", err)
 			}
 		}()
 	}
 
-	wg.Wait()
+	if s.usage != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.usage.Run()
+		}()
+	}
+
+	if s.statsd != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.statsd.Run()
+		}()
+	}
+
+	s.health.start()
+
+	for _, relay := range s.relays {
+		s.start(relay)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// start runs relay in the background, s.mu must be held
+func (s *Service) start(relay Relay) {
+	s.started[relay.Name()] = time.Now()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if err := relay.Run(); err != nil {
+			log.Printf("Error running relay %q: %v", relay.Name(), err)
+		}
+	}()
 }
 
 func (s *Service) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	running := s.running
+	if running {
+		for _, v := range s.relays {
+			v.Stop()
+		}
+	}
+	relays := make([]Relay, 0, len(s.relays))
 	for _, v := range s.relays {
-		v.Stop()
+		relays = append(relays, v)
+	}
+	s.mu.Unlock()
+
+	// the listeners are stopped, the backends may wait for a post in flight
+	for _, v := range relays {
+		closeRelay(v)
+	}
+
+	if s.admin != nil {
+		s.admin.Stop()
+	}
+
+	// the exporters only wait for Run to return once it was called
+	if running && s.usage != nil {
+		s.usage.Stop()
+	}
+
+	if running && s.statsd != nil {
+		s.statsd.Stop()
+	}
+
+	if running {
+		s.health.Stop()
+	}
+}
+
+// AddRelay adds r to the service, and starts it right away when the service
+// is running. The names of the relays must be unique.
+func (s *Service) AddRelay(r Relay) error {
+	switch h := r.(type) {
+	case *HTTP:
+		h.usage = s.usage
+	case *sharedRelay:
+		h.usage = s.usage
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return errors.New("service is stopped")
+	}
+	if s.relays[r.Name()] != nil {
+		return fmt.Errorf("duplicate relay: %q", r.Name())
+	}
+	s.relays[r.Name()] = r
+
+	if s.running {
+		s.start(r)
+	}
+	return nil
+}
+
+// RemoveRelay stops the named relay and removes it from the service, the
+// writes buffered for its backends are dropped
+func (s *Service) RemoveRelay(name string) error {
+	s.mu.Lock()
+	r := s.relays[name]
+	delete(s.relays, name)
+	delete(s.started, name)
+	running := s.running
+	s.mu.Unlock()
+
+	if r == nil {
+		return fmt.Errorf("unknown relay: %q", name)
+	}
+
+	var err error
+	if running {
+		err = r.Stop()
+	} else if p, ok := r.(*sharedRelay); ok {
+		// give back the route taken at creation
+		p.mux.remove(p.route)
+	}
+	closeRelay(r)
+	return err
+}
+
+// GetRelay returns the named relay, or nil when there is none
+func (s *Service) GetRelay(name string) Relay {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.relays[name]
+}
+
+// relayList returns the relays of the service at the time of the call
+func (s *Service) relayList() []Relay {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	relays := make([]Relay, 0, len(s.relays))
+	for _, r := range s.relays {
+		relays = append(relays, r)
 	}
+	return relays
 }
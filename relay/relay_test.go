@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveRelayStopsRetryBuffer(t *testing.T) {
+	var posts int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	s, err := New(Config{HTTPRelays: []HTTPConfig{{
+		Name: "test",
+		Addr: "127.0.0.1:0",
+		Outputs: []HTTPOutputConfig{{
+			Name:             "local",
+			Location:         backend.URL + "/write",
+			BufferSizeMB:     1,
+			MaxDelayInterval: "10ms",
+			ReplayWorkers:    2,
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.GetRelay("test").(*HTTP)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.backends[0].post(newTestPayload("cpu value=1\n"), "db=test", "")
+		done <- err
+	}()
+
+	// the write is buffered and replayed
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&posts) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("the buffered write wasn't replayed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := s.RemoveRelay("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != errBufferClosed {
+			t.Fatalf("buffered write failed with %v, want %v", err, errBufferClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffered write still waiting once the relay is removed")
+	}
+
+	n := atomic.LoadInt64(&posts)
+	time.Sleep(100 * time.Millisecond)
+	if m := atomic.LoadInt64(&posts); m != n {
+		t.Fatalf("%d posts after the relay was removed", m-n)
+	}
+
+	if _, err := h.backends[0].post(newTestPayload("cpu value=2\n"), "db=test", ""); err != errBufferClosed {
+		t.Fatalf("write after the removal failed with %v, want %v", err, errBufferClosed)
+	}
+	if m := atomic.LoadInt64(&posts); m != n {
+		t.Fatal("write posted after the relay was removed")
+	}
+}
@@ -1,7 +1,11 @@
 package relay
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,8 +16,110 @@ const (
 	retryMultiplier = 2
 )
 
+// orders the buffered batches are retried in
+const (
+	bufferOldestFirst  = "oldest-first"
+	bufferNewestFirst  = "newest-first"
+	bufferLargestFirst = "largest-first"
+)
+
+// policies of a full buffer
+const (
+	bufferRejectNew  = "reject-new"
+	bufferDropOldest = "drop-oldest"
+)
+
+// errBufferEvicted is returned to the writes evicted by newer ones
+var errBufferEvicted = errors.New("write evicted from the full retry buffer")
+
+// errBufferClosed is returned to the writes still buffered when the relay
+// of the backend is removed, and to the later ones
+var errBufferClosed = errors.New("retry buffer closed, its relay was removed")
+
+func checkBufferFull(policy string) error {
+	switch policy {
+	case "", bufferRejectNew, bufferDropOldest:
+		return nil
+	}
+	return fmt.Errorf("unknown buffer-full policy %q", policy)
+}
+
+func checkBufferOrder(order string) error {
+	switch order {
+	case "", bufferOldestFirst, bufferNewestFirst, bufferLargestFirst:
+		return nil
+	}
+	return fmt.Errorf("unknown buffer order %q", order)
+}
+
+// retryStatuses is the set of backend response statuses the writes are
+// buffered and retried on, given as exact codes (e.g. "429"), classes (e.g.
+// "5xx"), or codes never retried (e.g. "!501")
+type retryStatuses struct {
+	classes [6]bool
+	codes   map[int]bool
+}
+
+// defaultRetryStatuses only retries the 5xx responses
+var defaultRetryStatuses = &retryStatuses{classes: [6]bool{5: true}}
+
+func newRetryStatuses(list []string) (*retryStatuses, error) {
+	if len(list) == 0 {
+		return defaultRetryStatuses, nil
+	}
+
+	s := &retryStatuses{codes: make(map[int]bool)}
+	for _, e := range list {
+		v := strings.TrimPrefix(e, "!")
+		retry := v == e
+
+		if len(v) == 3 && strings.HasSuffix(v, "xx") && v[0] >= '1' && v[0] <= '5' {
+			if !retry {
+				return nil, fmt.Errorf("invalid retry status %q, only codes can be excluded", e)
+			}
+			s.classes[v[0]-'0'] = true
+			continue
+		}
+
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status %q", e)
+		}
+		s.codes[code] = retry
+	}
+	return s, nil
+}
+
+// retry reports whether a write answered with code is retried
+func (s *retryStatuses) retry(code int) bool {
+	if retry, ok := s.codes[code]; ok {
+		return retry
+	}
+	return code/100 < len(s.classes) && s.classes[code/100]
+}
+
 type Operation func() error
 
+// immediateRetryDelay is the pause before an immediate retry
+const immediateRetryDelay = 10 * time.Millisecond
+
+// immediateRetrier retries the posts failing with a transient network error
+// a few times in a row, so that a dropped connection doesn't make the
+// retry buffer switch to buffering
+type immediateRetrier struct {
+	retries int
+	p       poster
+}
+
+func (r *immediateRetrier) post(p *payload, query string, auth string) (*responseData, error) {
+	resp, err := r.p.post(p, query, auth)
+	for i := 0; i < r.retries && err != nil && isTransient(err); i++ {
+		time.Sleep(immediateRetryDelay)
+		resp, err = r.p.post(p, query, auth)
+	}
+	return resp, err
+}
+
 // Buffers and retries operations, if the buffer is full operations are dropped.
 // Only tries one operation at a time, the next operation is not attempted
 // until success or timeout of the previous operation.
@@ -28,9 +134,58 @@ type retryBuffer struct {
 	maxBuffered int
 	maxBatch    int
 
+	// buffer copies of the failed writes rather than references to the
+	// payloads shared with the other backends
+	copy bool
+
 	list *bufferList
 
 	p poster
+
+	// statuses the writes are retried on
+	statuses *retryStatuses
+
+	// name of the backend, for the logs
+	name string
+
+	// batches rejected during replay with a status which isn't retried
+	// (e.g. a 400), dropped as they'd never succeed, and the file they're
+	// appended to if any
+	rejected   int64
+	deadLetter *deadLetter
+
+	// set by the last replay post which succeeded, cleared by a failed one.
+	// The extra replay workers only post while it's set.
+	healthy     bool
+	healthyCond *sync.Cond
+
+	// set by stop, guarded by healthyCond. The replay workers return once
+	// it's closed.
+	closed  bool
+	closing chan struct{}
+	workers sync.WaitGroup
+
+	// utilization thresholds of the buffer in percent, and its current
+	// level, see checkLevel
+	warningPercent  float64
+	criticalPercent float64
+	level           int32
+}
+
+// isBuffering reports whether the writes are buffered rather than posted
+func (r *retryBuffer) isBuffering() bool {
+	return atomic.LoadInt32(&r.buffering) != 0
+}
+
+// buffered returns the size and number of the batches waiting to be replayed
+func (r *retryBuffer) buffered() (size int, batches int) {
+	r.list.cond.L.Lock()
+	defer r.list.cond.L.Unlock()
+
+	for b := r.list.head; b != nil; b = b.next {
+		batches++
+	}
+	return r.list.size, batches
 }
 
 type bufferList struct {
@@ -39,118 +194,318 @@ type bufferList struct {
 	size     int
 	maxSize  int
 	maxBatch int
+	order    string
+
+	// evict the oldest batches rather than reject the writes when full
+	dropOldest bool
+
+	// the buffer was stopped, pop returns nil and add fails
+	closed bool
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
+func newRetryBuffer(size, batch int, max time.Duration, copy bool, order, full string, p poster) *retryBuffer {
 	r := &retryBuffer{
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     max,
 		maxBuffered:     size,
 		maxBatch:        batch,
-		list:            newBufferList(size, batch),
+		copy:            copy,
+		list:            newBufferList(size, batch, order, full),
 		p:               p,
+		statuses:        defaultRetryStatuses,
+		healthyCond:     sync.NewCond(new(sync.Mutex)),
+		closing:         make(chan struct{}),
+		warningPercent:  DefaultBufferWarningPercent,
+		criticalPercent: DefaultBufferCriticalPercent,
 	}
+	r.workers.Add(1)
 	go r.run()
 	return r
 }
 
-func (r *retryBuffer) post(buf []byte, query string, auth string) (*responseData, error) {
+func (r *retryBuffer) post(p *payload, query string, auth string) (*responseData, error) {
+	return r.postAccepted(p, query, auth, nil)
+}
+
+// postAccepted is post, calling accepted once the write is held by the
+// buffer when it couldn't be written right away
+func (r *retryBuffer) postAccepted(p *payload, query string, auth string, accepted func()) (*responseData, error) {
 	if atomic.LoadInt32(&r.buffering) == 0 {
-		resp, err := r.p.post(buf, query, auth)
-		// TODO A 5xx caused by the point data could cause the relay to buffer forever
-		if err == nil && resp.StatusCode/100 != 5 {
+		resp, err := r.p.post(p, query, auth)
+		// the writes answered with a status of retry-statuses are buffered,
+		// a 5xx the points themselves cause keeps being retried unless its
+		// code is left out with "!<code>"
+		if err == nil && !r.statuses.retry(resp.StatusCode) {
 			return resp, err
 		}
 		atomic.StoreInt32(&r.buffering, 1)
 	}
 
-	// already buffering or failed request
-	batch, err := r.list.add(buf, query, auth)
+	// already buffering or failed request, the batch keeps its own
+	// reference until it is written
+	held := p
+	if r.copy {
+		held = p.clone()
+	} else {
+		p.retain()
+	}
+
+	batch, err := r.list.add(held, query, auth)
 	if err != nil {
+		held.release()
 		return nil, err
 	}
+	r.checkLevel()
+
+	if accepted != nil {
+		accepted()
+	}
 
 	batch.wg.Wait()
-	return batch.resp, nil
+	return batch.resp, batch.err
 }
 
 func (r *retryBuffer) run() {
-	buf := bytes.NewBuffer(make([]byte, 0, r.maxBatch))
+	defer r.workers.Done()
+
 	for {
-		buf.Reset()
-		batch := r.list.pop()
-
-		for _, b := range batch.bufs {
-			buf.Write(b)
-		}
-
-		interval := r.initialInterval
-		// 重试直到成功 ?
-		for {
-			resp, err := r.p.post(buf.Bytes(), batch.query, batch.auth)
-			if err == nil && resp.StatusCode/100 != 5 {
-				batch.resp = resp
-				atomic.StoreInt32(&r.buffering, 0)
-				batch.wg.Done()
-				break
+		b := r.list.pop()
+		if b == nil {
+			return
+		}
+		r.replay(b, false)
+	}
+}
+
+// startReplayWorkers adds n-1 replay workers to the one of the buffer. They
+// post concurrently with it once the backend is confirmed healthy by a
+// successful replay post, and as soon as one of their posts fails put their
+// batch back and wait again, so that an outage is still probed by a single
+// worker.
+func (r *retryBuffer) startReplayWorkers(n int) {
+	for i := 1; i < n; i++ {
+		r.workers.Add(1)
+		go r.runExtra()
+	}
+}
+
+func (r *retryBuffer) runExtra() {
+	defer r.workers.Done()
+
+	for {
+		r.healthyCond.L.Lock()
+		for !r.healthy && !r.closed {
+			r.healthyCond.Wait()
+		}
+		closed := r.closed
+		r.healthyCond.L.Unlock()
+		if closed {
+			return
+		}
+
+		b := r.list.pop()
+		if b == nil {
+			return
+		}
+		r.replay(b, true)
+	}
+}
+
+// stop fails the buffered writes and the later ones, and waits for the
+// replay workers to return, after the post they're in if any. It's called
+// once the relay of the backend is removed.
+func (r *retryBuffer) stop() {
+	close(r.closing)
+
+	r.healthyCond.L.Lock()
+	r.closed = true
+	r.healthyCond.Broadcast()
+	r.healthyCond.L.Unlock()
+
+	failBatches(r.list.close(), errBufferClosed)
+	r.workers.Wait()
+
+	// the later writes go to the closed list rather than to the backend
+	atomic.StoreInt32(&r.buffering, 1)
+
+	if r.deadLetter != nil {
+		r.deadLetter.close()
+	}
+}
+
+func (r *retryBuffer) setHealthy(healthy bool) {
+	r.healthyCond.L.Lock()
+	if healthy != r.healthy {
+		r.healthy = healthy
+		r.healthyCond.Broadcast()
+	}
+	r.healthyCond.L.Unlock()
+}
+
+// replay posts a batch until it succeeds or gets a status which isn't
+// retried. The batch of an extra worker is put back at the front of the
+// buffer after its first failure instead, for the worker to wait for the
+// backend to be healthy again.
+func (r *retryBuffer) replay(b *batch, extra bool) {
+	r.checkLevel()
+	p := b.payload()
+
+	interval := r.initialInterval
+	// 重试直到成功 ?
+	for {
+		resp, err := r.p.post(p, b.query, b.auth)
+		if err == nil && !r.statuses.retry(resp.StatusCode) {
+			if resp.StatusCode/100 != 2 {
+				r.reject(b, p, resp.StatusCode)
 			}
+			p.release()
+			b.resp = resp
+			atomic.StoreInt32(&r.buffering, 0)
+			r.setHealthy(true)
+			b.wg.Done()
+			return
+		}
+		r.setHealthy(false)
 
-			if interval != r.maxInterval {
-				// 当influxdb api status code = 5xx时
-				// 会休眠一段时间,这个时间的大小由初始时间 * 放大因子multiper
-				interval *= r.multiplier
-				if interval > r.maxInterval {
-					interval = r.maxInterval
-				}
+		if extra {
+			r.list.requeue([]*batch{b})
+			r.checkLevel()
+			return
+		}
+
+		if interval != r.maxInterval {
+			// 当influxdb api status code = 5xx时
+			// 会休眠一段时间,这个时间的大小由初始时间 * 放大因子multiper
+			interval *= r.multiplier
+			if interval > r.maxInterval {
+				interval = r.maxInterval
 			}
+		}
 
-			time.Sleep(interval)
+		select {
+		case <-time.After(interval):
+		case <-r.closing:
+			failBatches([]*batch{b}, errBufferClosed)
+			return
 		}
 	}
 }
 
+// reject accounts for a buffered batch the backend rejected, which is
+// answered to its writers and dropped rather than retried
+func (r *retryBuffer) reject(b *batch, p *payload, status int) {
+	atomic.AddInt64(&r.rejected, 1)
+	log.Printf("Backend %q rejected a buffered batch of %d bytes with status %d, dropping it", r.name, p.Len(), status)
+
+	if r.deadLetter == nil {
+		return
+	}
+	if err := r.deadLetter.writeBatch(b, p, status); err != nil {
+		log.Printf("Problem writing the rejected batch of backend %q to the dead letter file: %v", r.name, err)
+	}
+}
+
+// payload returns the writes of the batch as a single payload, taking over
+// the reference held by the batch. The writes of a batch are merged as they
+// are added, see merge.
+func (b *batch) payload() *payload {
+	return b.payloads[0]
+}
+
+// merge appends a write to the batch, taking over the reference of p. The
+// writes are copied into a buffer of the batch right away rather than
+// referenced, so that thousands of tiny buffered writes don't each pin
+// their request buffer until the batch is replayed.
+func (b *batch) merge(p *payload) {
+	b.size += p.Len()
+	if !b.merged {
+		buf := getBuf()
+		buf.Grow(b.size)
+		for _, bp := range b.payloads {
+			buf.Write(bp.Bytes())
+			bp.release()
+		}
+		b.payloads = []*payload{newPayload(buf)}
+		b.merged = true
+	}
+
+	b.payloads[0].buf.Write(p.Bytes())
+	p.release()
+}
+
 type batch struct {
 	query string
 	auth  string
-	bufs  [][]byte
-	size  int
-	full  bool
+	// payload of the writes, referenced until the batch is written. It's the
+	// one of the first write until a second one is merged into the batch.
+	payloads []*payload
+	size     int
+	full     bool
+	// the writes were copied into a single payload owned by the batch
+	merged bool
 
 	wg   sync.WaitGroup
 	resp *responseData
+	// set when the batch was purged from the buffer instead of written
+	err error
 
 	next *batch
 }
 
-func newBatch(buf []byte, query string, auth string) *batch {
+func newBatch(p *payload, query string, auth string) *batch {
 	b := new(batch)
-	b.bufs = [][]byte{buf}
-	b.size = len(buf)
+	b.payloads = []*payload{p}
+	b.size = p.Len()
 	b.query = query
 	b.auth = auth
 	b.wg.Add(1)
 	return b
 }
 
-func newBufferList(maxSize, maxBatch int) *bufferList {
+func newBufferList(maxSize, maxBatch int, order, full string) *bufferList {
+	if order == "" {
+		order = bufferOldestFirst
+	}
 	return &bufferList{
-		cond:     sync.NewCond(new(sync.Mutex)),
-		maxSize:  maxSize,
-		maxBatch: maxBatch,
+		cond:       sync.NewCond(new(sync.Mutex)),
+		maxSize:    maxSize,
+		maxBatch:   maxBatch,
+		order:      order,
+		dropOldest: full == bufferDropOldest,
 	}
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
+// pop will remove and return the next element of the list in the order of
+// the list, blocking if necessary, or nil once the list is closed
 func (l *bufferList) pop() *batch {
 	l.cond.L.Lock()
 
-	for l.size == 0 {
+	for l.size == 0 && !l.closed {
 		l.cond.Wait()
 	}
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil
+	}
 
-	b := l.head
-	l.head = l.head.next
+	// the oldest element is the first one, the newest the last one
+	next := &l.head
+	switch l.order {
+	case bufferNewestFirst:
+		for cur := &l.head; *cur != nil; cur = &(*cur).next {
+			next = cur
+		}
+	case bufferLargestFirst:
+		for cur := &l.head; *cur != nil; cur = &(*cur).next {
+			if (*cur).size > (*next).size {
+				next = cur
+			}
+		}
+	}
+
+	b := *next
+	*next = b.next
 	l.size -= b.size
 
 	l.cond.L.Unlock()
@@ -158,15 +513,93 @@ func (l *bufferList) pop() *batch {
 	return b
 }
 
-func (l *bufferList) add(buf []byte, query string, auth string) (*batch, error) {
+// drain removes and returns all the elements of the list
+func (l *bufferList) drain() []*batch {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	var batches []*batch
+	for b := l.head; b != nil; b = b.next {
+		batches = append(batches, b)
+	}
+	l.head = nil
+	l.size = 0
+
+	return batches
+}
+
+// close drains the list, which then stays empty
+func (l *bufferList) close() []*batch {
+	l.cond.L.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.cond.L.Unlock()
+
+	return l.drain()
+}
+
+// requeue puts drained batches back at the front of the list, in order, or
+// fails them once the list is closed
+func (l *bufferList) requeue(batches []*batch) {
+	if len(batches) == 0 {
+		return
+	}
+
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.closed {
+		failBatches(batches, errBufferClosed)
+		return
+	}
+
+	for i := len(batches) - 1; i >= 0; i-- {
+		b := batches[i]
+		b.next = l.head
+		l.head = b
+		l.size += b.size
+	}
+	l.cond.Signal()
+}
+
+// failBatches fails the writes of batches removed from the list with err
+func failBatches(batches []*batch, err error) {
+	for _, b := range batches {
+		for _, p := range b.payloads {
+			p.release()
+		}
+		b.payloads = nil
+		b.err = err
+		b.wg.Done()
+	}
+}
+
+func (l *bufferList) add(p *payload, query string, auth string) (*batch, error) {
 	l.cond.L.Lock()
 
-	if l.size+len(buf) > l.maxSize {
+	if l.closed {
+		l.cond.L.Unlock()
+		return nil, errBufferClosed
+	}
+
+	// a write larger than the whole buffer is rejected whatever the policy
+	if l.size+p.Len() > l.maxSize && (!l.dropOldest || p.Len() > l.maxSize) {
 		l.cond.L.Unlock()
 		return nil, ErrBufferFull
 	}
 
-	l.size += len(buf)
+	var evicted []*batch
+	for l.size+p.Len() > l.maxSize {
+		b := l.head
+		l.head = b.next
+		l.size -= b.size
+		evicted = append(evicted, b)
+	}
+	if evicted != nil {
+		defer failBatches(evicted, errBufferEvicted)
+	}
+
+	l.size += p.Len()
 	l.cond.Signal()
 
 	var cur **batch
@@ -179,7 +612,7 @@ func (l *bufferList) add(buf []byte, query string, auth string) (*batch, error)
 			continue
 		}
 
-		if (*cur).size+len(buf) > l.maxBatch {
+		if (*cur).size+p.Len() > l.maxBatch {
 			// prevent future writes from preceding this write
 			(*cur).full = true
 			continue
@@ -190,12 +623,10 @@ func (l *bufferList) add(buf []byte, query string, auth string) (*batch, error)
 
 	if *cur == nil {
 		// new tail element
-		*cur = newBatch(buf, query, auth)
+		*cur = newBatch(p, query, auth)
 	} else {
 		// append to current batch
-		b := *cur
-		b.size += len(buf)
-		b.bufs = append(b.bufs, buf)
+		(*cur).merge(p)
 	}
 
 	l.cond.L.Unlock()
@@ -0,0 +1,47 @@
+//go:build go1.11 && linux && !mips && !mipsle && !mips64 && !mips64le
+// +build go1.11,linux,!mips,!mipsle,!mips64,!mips64le
+
+package relay
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which syscall doesn't define on most linux
+// architectures
+const soReusePort = 0xf
+
+func checkReusePort(reusePort bool) error {
+	return nil
+}
+
+// listen listens on addr, with SO_REUSEPORT when reusePort is set so that
+// a new relay process can listen on the address before the old one stops
+func listen(network, addr string, reusePort bool) (net.Listener, error) {
+	if !reusePort {
+		return net.Listen(network, addr)
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// listenPacket is listen for UDP
+func listenPacket(network, addr string, reusePort bool) (net.PacketConn, error) {
+	if !reusePort {
+		return net.ListenPacket(network, addr)
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+//go:build !go1.11 || !linux || mips || mipsle || mips64 || mips64le
+// +build !go1.11 !linux mips mipsle mips64 mips64le
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// checkReusePort rejects reuse-port, which is only supported on linux with
+// Go 1.11 or later
+func checkReusePort(reusePort bool) error {
+	if reusePort {
+		return errors.New("reuse-port requires a relay built with Go 1.11 or later on linux")
+	}
+	return nil
+}
+
+func listen(network, addr string, reusePort bool) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+func listenPacket(network, addr string, reusePort bool) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
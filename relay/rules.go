@@ -0,0 +1,189 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Actions of the string length limits, see StringLimitConfig
+const (
+	StringLimitTruncate  = stringLimitTruncate
+	StringLimitDropField = stringLimitDropField
+	StringLimitDropPoint = stringLimitDropPoint
+)
+
+// AnyTag and AnyField make a rule apply to every tag or string field without
+// a rule of its own
+const (
+	AnyTag   = tagNormalizeAny
+	AnyField = stringLimitAny
+)
+
+// Rules builds the transform rules of an HTTP relay in Go, for the programs
+// embedding the relay which generate them (e.g. from a service catalog)
+// rather than templating the TOML configuration. The methods can be chained:
+//
+//	rules := relay.NewRules().
+//		NormalizeTag(relay.TagNormalizeConfig{Tag: "host", Lowercase: true}).
+//		Synonym("region", "eu-west", "eu").
+//		LimitString("message", 1024, relay.StringLimitTruncate)
+//	if err := rules.Apply(&cfg); err != nil {
+//		...
+//	}
+//
+// The writes are mirrored to every output of a relay, there are no routing
+// rules to build.
+type Rules struct {
+	renames map[string]string
+	drops   []string
+	tags    []TagNormalizeConfig
+	fields  []FieldDropConfig
+	limits  []StringLimitConfig
+}
+
+// NewRules returns an empty set of rules
+func NewRules() *Rules {
+	return new(Rules)
+}
+
+// RulesOf returns the rules of cfg, to be extended
+func RulesOf(cfg HTTPConfig) *Rules {
+	r := NewRules()
+	for from, to := range cfg.TagRename {
+		r.RenameTag(from, to)
+	}
+	for _, tag := range cfg.TagDrop {
+		r.DropTag(tag)
+	}
+	for _, t := range cfg.TagNormalize {
+		r.NormalizeTag(t)
+	}
+	for _, f := range cfg.FieldDrop {
+		r.DropField(f.Measurement, f.Field)
+	}
+	for _, l := range cfg.StringLimits {
+		r.LimitString(l.Field, l.MaxLength, l.Action)
+	}
+	return r
+}
+
+// RenameTag renames the tag from to to, replacing the tag to
+func (r *Rules) RenameTag(from, to string) *Rules {
+	if r.renames == nil {
+		r.renames = make(map[string]string)
+	}
+	r.renames[from] = to
+	return r
+}
+
+// DropTag removes tag from the points
+func (r *Rules) DropTag(tag string) *Rules {
+	r.drops = append(r.drops, tag)
+	return r
+}
+
+// NormalizeTag adds the normalization of the values of a tag. The
+// synonyms are copied, a tag can only have one normalization.
+func (r *Rules) NormalizeTag(t TagNormalizeConfig) *Rules {
+	if t.Tag == "" {
+		t.Tag = AnyTag
+	}
+	if t.Synonyms != nil {
+		s := make(map[string]string, len(t.Synonyms))
+		for k, v := range t.Synonyms {
+			s[k] = v
+		}
+		t.Synonyms = s
+	}
+
+	r.tags = append(r.tags, t)
+	return r
+}
+
+// Synonym rewrites value of tag to canonical, adding a normalization of the
+// tag when it has none
+func (r *Rules) Synonym(tag, value, canonical string) *Rules {
+	if tag == "" {
+		tag = AnyTag
+	}
+
+	for i := range r.tags {
+		if r.tags[i].Tag == tag {
+			if r.tags[i].Synonyms == nil {
+				r.tags[i].Synonyms = make(map[string]string)
+			}
+			r.tags[i].Synonyms[value] = canonical
+			return r
+		}
+	}
+
+	return r.NormalizeTag(TagNormalizeConfig{Tag: tag, Synonyms: map[string]string{value: canonical}})
+}
+
+// DropField removes the fields matching the field pattern from the points of
+// the measurements matching the measurement pattern ("*" when empty)
+func (r *Rules) DropField(measurement, field string) *Rules {
+	if measurement == "" {
+		measurement = "*"
+	}
+	r.fields = append(r.fields, FieldDropConfig{Measurement: measurement, Field: field})
+	return r
+}
+
+// LimitString caps the length of the values of a string field, action is
+// one of the StringLimit constants (Default StringLimitTruncate)
+func (r *Rules) LimitString(field string, maxLength int, action string) *Rules {
+	if field == "" {
+		field = AnyField
+	}
+	if action == "" {
+		action = StringLimitTruncate
+	}
+
+	r.limits = append(r.limits, StringLimitConfig{Field: field, MaxLength: maxLength, Action: action})
+	return r
+}
+
+// Validate checks the rules the way the relay does when it's created
+func (r *Rules) Validate() error {
+	for _, t := range r.tags {
+		for value := range t.Synonyms {
+			if value == "" {
+				return fmt.Errorf("empty synonym for tag %q", t.Tag)
+			}
+		}
+	}
+
+	if _, err := newTagRewriter(r.renames, r.drops); err != nil {
+		return err
+	}
+	if _, err := newTagNormalizers(r.tags); err != nil {
+		return err
+	}
+	if _, err := newFieldDrops(r.fields); err != nil {
+		return err
+	}
+	if _, err := newStringLimits(r.limits); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Apply replaces the transform rules of cfg by r, once they are validated
+func (r *Rules) Apply(cfg *HTTPConfig) error {
+	if cfg == nil {
+		return errors.New("no HTTP relay configuration")
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	// the maps are copied, r can still be extended
+	c := RulesOf(HTTPConfig{TagRename: r.renames})
+	cfg.TagRename = c.renames
+	cfg.TagDrop = append([]string(nil), r.drops...)
+	cfg.TagNormalize = RulesOf(HTTPConfig{TagNormalize: r.tags}).tags
+	cfg.FieldDrop = append([]FieldDropConfig(nil), r.fields...)
+	cfg.StringLimits = append([]StringLimitConfig(nil), r.limits...)
+	return nil
+}
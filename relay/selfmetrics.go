@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	selfMetricsRelayMeasurement   = "relay"
+	selfMetricsBackendMeasurement = "relay_backend"
+)
+
+// backendLatency accumulates the durations of the posts of the client
+// writes to a backend, the self metrics report and reset them
+type backendLatency struct {
+	mu    sync.Mutex
+	count int64
+	sum   time.Duration
+	max   time.Duration
+}
+
+func (l *backendLatency) observe(d time.Duration) {
+	l.mu.Lock()
+	l.count++
+	l.sum += d
+	if d > l.max {
+		l.max = d
+	}
+	l.mu.Unlock()
+}
+
+// reset returns the posts accounted for since the last reset
+func (l *backendLatency) reset() (count int64, sum, max time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count, sum, max = l.count, l.sum, l.max
+	l.count, l.sum, l.max = 0, 0, 0
+	return count, sum, max
+}
+
+// selfMetrics periodically writes the operational metrics of an HTTP relay
+// to all of its backends, as a relay point and one relay_backend point per
+// backend. Like the heartbeats, the points go through the posters of the
+// backends and their timestamps are truncated to the interval.
+type selfMetrics struct {
+	interval time.Duration
+	query    string
+
+	closing chan struct{}
+}
+
+// newSelfMetrics returns nil when no interval is configured
+func newSelfMetrics(cfg HTTPConfig) (*selfMetrics, error) {
+	if cfg.SelfMetricsInterval == "" {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(cfg.SelfMetricsInterval)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing self-metrics interval '%v'", err)
+	}
+	if d <= 0 {
+		return nil, errors.New("self-metrics interval must be positive")
+	}
+	if cfg.SelfMetricsDatabase == "" {
+		return nil, errors.New("self-metrics-interval requires self-metrics-database")
+	}
+
+	q := url.Values{"db": {cfg.SelfMetricsDatabase}}
+	if cfg.DefaultRetentionPolicy != "" {
+		q.Set("rp", cfg.DefaultRetentionPolicy)
+	}
+
+	return &selfMetrics{
+		interval: d,
+		query:    q.Encode(),
+		closing:  make(chan struct{}),
+	}, nil
+}
+
+// run writes the metrics of h until stop is called
+func (sm *selfMetrics) run(h *HTTP) {
+	ticker := time.NewTicker(sm.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			sm.write(h, t)
+		case <-sm.closing:
+			return
+		}
+	}
+}
+
+func (sm *selfMetrics) stop() {
+	close(sm.closing)
+}
+
+// write sends the metrics of h to every backend, without waiting for them
+func (sm *selfMetrics) write(h *HTTP, now time.Time) {
+	now = now.Truncate(sm.interval)
+
+	var points []models.Point
+	add := func(name string, tags models.Tags, fields models.Fields) {
+		p, err := models.NewPoint(name, tags, fields, now)
+		if err != nil {
+			log.Printf("Problem creating self metrics of relay %q: %v", h.Name(), err)
+			return
+		}
+		points = append(points, p)
+	}
+
+	add(selfMetricsRelayMeasurement, models.Tags{"relay": h.Name()}, models.Fields{
+		"requests":      atomic.LoadInt64(&h.requests),
+		"skipped_lines": atomic.LoadInt64(&h.skippedLines),
+	})
+
+	for _, b := range h.backends {
+		var errs, dropped int64
+		for class, n := range b.errorCounts() {
+			switch class {
+			case errClassBufferFull, errClassRejected:
+				dropped += n
+			default:
+				errs += n
+			}
+		}
+
+		fields := models.Fields{
+			"errors":  errs,
+			"dropped": dropped,
+		}
+
+		count, sum, max := b.latency.reset()
+		fields["posts"] = count
+		if count > 0 {
+			fields["latency_mean_ms"] = sum.Seconds() * 1000 / float64(count)
+			fields["latency_max_ms"] = max.Seconds() * 1000
+		}
+
+		if rb, ok := b.poster.(*retryBuffer); ok {
+			size, batches := rb.buffered()
+			fields["buffer_bytes"] = int64(size)
+			fields["buffer_batches"] = int64(batches)
+			fields["buffer_level"] = int64(rb.bufferLevel())
+		}
+
+		add(selfMetricsBackendMeasurement, models.Tags{"relay": h.Name(), "backend": b.name}, fields)
+	}
+
+	for _, b := range h.backends {
+		buf := getBuf()
+		for _, p := range points {
+			buf.WriteString(p.PrecisionString(""))
+			buf.WriteByte('\n')
+		}
+
+		b := b
+		pl := newPayload(buf)
+		go func() {
+			defer pl.release()
+			resp, err := b.post(pl, sm.query, "")
+			b.observe(h.Name(), resp, err)
+		}()
+	}
+}
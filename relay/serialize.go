@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// Re-serializing every point with PrecisionString allocates a string per
+// point, which dominates the allocations of the write path at high point
+// rates. As long as a point isn't modified, the line it was parsed from is
+// written out instead and only the missing timestamp is appended.
+
+// rawLines iterates over the lines of a write body which hold a point,
+// in the order ParsePoints returns them
+type rawLines struct {
+	buf []byte
+}
+
+func (r *rawLines) next() []byte {
+	for len(r.buf) > 0 {
+		var line []byte
+		line, r.buf = nextLine(r.buf)
+
+		line = bytes.TrimRight(line, " \t\r")
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		return line
+	}
+	return nil
+}
+
+// nextLine returns the first line of buf and the rest after its newline.
+// A line ends at the first newline outside of a quoted string field value,
+// the way ParsePoints scans them, so a point may span several lines.
+func nextLine(buf []byte) (line, rest []byte) {
+	quoted, fields := false, false
+	equals, commas := 0, 0
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if c == '\\' && i+2 < len(buf) {
+			i++
+			continue
+		}
+		if c == ' ' {
+			fields = true
+		}
+		if fields {
+			switch {
+			case !quoted && c == '=':
+				equals++
+				continue
+			case !quoted && c == ',':
+				commas++
+				continue
+			case c == '"' && equals > commas:
+				quoted = !quoted
+				continue
+			}
+		}
+		if c == '\n' && !quoted {
+			return buf[:i], buf[i+1:]
+		}
+	}
+	return buf, nil
+}
+
+// count returns the number of lines left, without consuming them
+func (r *rawLines) count() int {
+	c := *r
+	n := 0
+	for c.next() != nil {
+		n++
+	}
+	return n
+}
+
+// hasTimestamp reports whether the line has a third section after the
+// measurement/tags and fields sections
+func hasTimestamp(line []byte) bool {
+	line = bytes.Trim(line, " \t\r")
+
+	sections := 0
+	quoted := false
+	space := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			i++
+			space = false
+		case c == '"' && sections == 1:
+			quoted = !quoted
+			space = false
+		case (c == ' ' || c == '\t') && !quoted:
+			if !space {
+				sections++
+			}
+			space = true
+		default:
+			space = false
+		}
+	}
+
+	return sections >= 2
+}
+
+// precisionMultiplier returns the number of nanoseconds in a unit of precision
+func precisionMultiplier(precision string) int64 {
+	switch precision {
+	case "u":
+		return 1e3
+	case "ms":
+		return 1e6
+	case "s":
+		return 1e9
+	case "m":
+		return 60 * 1e9
+	case "h":
+		return 3600 * 1e9
+	}
+	return 1
+}
+
+// writeLine writes p to out, reusing the line it was parsed from. The
+// result is equivalent to p.PrecisionString(precision).
+func writeLine(out *bytes.Buffer, line []byte, p models.Point, precision string) {
+	out.Write(line)
+	if !hasTimestamp(line) {
+		var scratch [24]byte
+		out.WriteByte(' ')
+		out.Write(strconv.AppendInt(scratch[:0], p.UnixNano()/precisionMultiplier(precision), 10))
+	}
+	out.WriteByte('\n')
+}
+
+// writePoint writes p to out, without reusing its line
+func writePoint(out *bytes.Buffer, p models.Point, precision string) {
+	out.WriteString(p.PrecisionString(precision))
+	out.WriteByte('\n')
+}
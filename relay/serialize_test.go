@@ -0,0 +1,34 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNextLine(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"lines", "cpu value=1\nmem used=2\n", []string{"cpu value=1", "mem used=2"}},
+		{"no trailing newline", "cpu value=1\nmem used=2", []string{"cpu value=1", "mem used=2"}},
+		{"empty lines", "cpu value=1\n\nmem used=2", []string{"cpu value=1", "", "mem used=2"}},
+		{"quoted newline", "log msg=\"a\nb\" 1\ncpu value=1", []string{"log msg=\"a\nb\" 1", "cpu value=1"}},
+		{"escaped quote", "log msg=\"a\\\"\nb\",n=1i\ncpu value=1", []string{"log msg=\"a\\\"\nb\",n=1i", "cpu value=1"}},
+		{"quote in a tag", "log,t=a\"b value=1\ncpu value=1", []string{"log,t=a\"b value=1", "cpu value=1"}},
+		{"unterminated quote", "log msg=\"a\ncpu value=1", []string{"log msg=\"a\ncpu value=1"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for rest := []byte(tt.body); len(rest) > 0; {
+			var line []byte
+			line, rest = nextLine(rest)
+			got = append(got, string(line))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverConfig are the timeouts and limits of the HTTP server of a
+// listener, zero meaning none (or the default of net/http for
+// maxHeaderBytes)
+type serverConfig struct {
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+func newServerConfig(cfg HTTPConfig) (serverConfig, error) {
+	var c serverConfig
+	for _, t := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"read timeout", cfg.ReadTimeout, &c.readTimeout},
+		{"read header timeout", cfg.ReadHeaderTimeout, &c.readHeaderTimeout},
+		{"write timeout", cfg.WriteTimeout, &c.writeTimeout},
+		{"idle timeout", cfg.IdleTimeout, &c.idleTimeout},
+	} {
+		if t.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(t.value)
+		if err != nil {
+			return c, fmt.Errorf("error parsing %s '%v'", t.name, err)
+		}
+		*t.d = d
+	}
+
+	if cfg.MaxHeaderBytes < 0 {
+		return c, fmt.Errorf("negative max-header-bytes %d", cfg.MaxHeaderBytes)
+	}
+	c.maxHeaderBytes = cfg.MaxHeaderBytes
+	return c, nil
+}
+
+// newServer returns the server of handler with the settings c
+func newServer(handler http.Handler, c serverConfig) *http.Server {
+	srv := &http.Server{
+		Handler:        handler,
+		ReadTimeout:    c.readTimeout,
+		WriteTimeout:   c.writeTimeout,
+		MaxHeaderBytes: c.maxHeaderBytes,
+	}
+	setServerLimits(srv, c)
+	return srv
+}
+
+// managedServer serves the listener of a relay. Once stopped the listener
+// is closed and the requests being served are given shutdownTimeout to
+// complete, serve only returning when they did so that the process doesn't
+// exit under them. The connections of the clients are counted as they come
+// and go.
+type managedServer struct {
+	srv             *http.Server
+	shutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	l       net.Listener
+	stopped bool
+	drained chan struct{}
+
+	conns int64
+}
+
+func newManagedServer(handler http.Handler, c serverConfig, shutdownTimeout time.Duration) *managedServer {
+	s := &managedServer{
+		srv:             newServer(handler, c),
+		shutdownTimeout: shutdownTimeout,
+		drained:         make(chan struct{}),
+	}
+	s.srv.ConnState = s.connState
+	return s
+}
+
+// serve serves l until stop is called, it returns nil once stopped
+func (s *managedServer) serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.l = l
+	s.mu.Unlock()
+
+	err := s.srv.Serve(l)
+
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+
+	if stopped {
+		<-s.drained
+		return nil
+	}
+	return err
+}
+
+func (s *managedServer) stop() error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	l := s.l
+	s.mu.Unlock()
+
+	var err error
+	if l != nil {
+		err = shutdownServer(s.srv, l, s.shutdownTimeout)
+	}
+	close(s.drained)
+	return err
+}
+
+func (s *managedServer) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&s.conns, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&s.conns, -1)
+	}
+}
+
+// openConns returns the number of connections of the clients
+func (s *managedServer) openConns() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
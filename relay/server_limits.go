@@ -0,0 +1,17 @@
+//go:build go1.8
+// +build go1.8
+
+package relay
+
+import "net/http"
+
+func checkServerLimits(c serverConfig) error {
+	return nil
+}
+
+// setServerLimits applies the settings of c net/http only has in recent
+// versions
+func setServerLimits(srv *http.Server, c serverConfig) {
+	srv.ReadHeaderTimeout = c.readHeaderTimeout
+	srv.IdleTimeout = c.idleTimeout
+}
@@ -0,0 +1,22 @@
+//go:build !go1.8
+// +build !go1.8
+
+package relay
+
+import (
+	"errors"
+	"net/http"
+)
+
+// checkServerLimits rejects read-header-timeout and idle-timeout, which
+// net/http doesn't support before Go 1.8
+func checkServerLimits(c serverConfig) error {
+	if c.readHeaderTimeout > 0 || c.idleTimeout > 0 {
+		return errors.New("read-header-timeout and idle-timeout require a relay built with Go 1.8 or later")
+	}
+	return nil
+}
+
+// setServerLimits does nothing before Go 1.8, the headers are read within
+// read-timeout and idle connections are kept until read-timeout
+func setServerLimits(srv *http.Server, c serverConfig) {}
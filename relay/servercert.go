@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	DefaultACMEHTTPAddr  = ":80"
+
+	// the ACME certificates are renewed when they expire within that
+	acmeRenewBefore = 30 * 24 * time.Hour
+)
+
+// serverCert locates the certificate and key of an HTTPS listener, either
+// in a single PEM file, in separate certificate, key and chain files, or
+// obtained from an ACME CA for a list of domains. It's comparable, to tell
+// whether relays use the same certificate.
+type serverCert struct {
+	combined string
+	cert     string
+	key      string
+	chain    string
+
+	// comma separated list of domains, empty when ACME isn't used
+	acmeDomains   string
+	acmeCacheDir  string
+	acmeEmail     string
+	acmeDirectory string
+	acmeHTTPAddr  string
+}
+
+func newServerCert(cfg HTTPConfig) (serverCert, error) {
+	c := serverCert{
+		combined: cfg.SSLCombinedPem,
+		cert:     cfg.SSLCert,
+		key:      cfg.SSLKey,
+		chain:    cfg.SSLChain,
+	}
+
+	if len(cfg.ACMEDomains) > 0 {
+		if c.combined != "" || c.cert != "" {
+			return c, errors.New("acme-domains can't be used with ssl-combined-pem or ssl-cert")
+		}
+
+		domains := make([]string, len(cfg.ACMEDomains))
+		for i, d := range cfg.ACMEDomains {
+			domains[i] = strings.ToLower(strings.TrimSuffix(d, "."))
+			if domains[i] == "" || strings.ContainsAny(domains[i], ", /:") {
+				return c, fmt.Errorf("invalid acme domain %q", d)
+			}
+		}
+
+		c.acmeDomains = strings.Join(domains, ",")
+		c.acmeCacheDir = cfg.ACMECacheDir
+		c.acmeEmail = cfg.ACMEEmail
+		c.acmeDirectory = cfg.ACMEDirectory
+		if c.acmeDirectory == "" {
+			c.acmeDirectory = DefaultACMEDirectory
+		}
+		c.acmeHTTPAddr = cfg.ACMEHTTPAddr
+		if c.acmeHTTPAddr == "" {
+			c.acmeHTTPAddr = DefaultACMEHTTPAddr
+		}
+		return c, nil
+	}
+
+	switch {
+	case c.combined != "" && (c.cert != "" || c.key != "" || c.chain != ""):
+		return c, errors.New("ssl-combined-pem can't be used with ssl-cert, ssl-key or ssl-chain")
+	case (c.cert == "") != (c.key == ""):
+		return c, errors.New("ssl-cert and ssl-key must be set together")
+	case c.chain != "" && c.cert == "":
+		return c, errors.New("ssl-chain requires ssl-cert and ssl-key")
+	}
+	return c, nil
+}
+
+// enabled reports whether the listener serves HTTPS
+func (c serverCert) enabled() bool {
+	return c.combined != "" || c.cert != "" || c.acmeDomains != ""
+}
+
+// getter returns the tls.Config GetCertificate of the listeners presenting
+// the certificate, static ones being loaded once. release must be called
+// once the listener stops, to close the ACME challenge listener.
+func (c serverCert) getter() (get func(*tls.ClientHelloInfo) (*tls.Certificate, error), release func(), err error) {
+	if c.acmeDomains != "" {
+		return acquireACME(c)
+	}
+
+	kp, err := c.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return kp, nil
+	}, func() {}, nil
+}
+
+// load reads the certificate and key, followed by the intermediate
+// certificates of the chain file. ACME certificates are handled by getter.
+func (c serverCert) load() (*tls.Certificate, error) {
+	if c.combined != "" {
+		kp, err := tls.LoadX509KeyPair(c.combined, c.combined)
+		return &kp, err
+	}
+
+	kp, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.chain != "" {
+		data, err := ioutil.ReadFile(c.chain)
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				kp.Certificate = append(kp.Certificate, block.Bytes)
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no certificate found in %q", c.chain)
+		}
+	}
+
+	return &kp, nil
+}
@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A shadow backend gets the writes the way the other ones do, but the
+// writes aren't waiting for it: it never answers the client, neither by its
+// status nor by its latency, and it has no retry buffer, a write it failed
+// is only logged and reported by /status. It's meant for experimental
+// destinations, e.g. trying another storage with the real traffic.
+
+// shadow posts pl to the shadow backends among backends without waiting for
+// them, and returns the other ones
+func (h *HTTP) shadow(pl *payload, backends []*httpBackend, query string, authHeader string) []*httpBackend {
+	out := make([]*httpBackend, 0, len(backends))
+	for _, b := range backends {
+		if !b.shadow {
+			out = append(out, b)
+			continue
+		}
+
+		b := b
+		pl.retain()
+		atomic.AddInt64(&b.inflight, 1)
+		go func() {
+			defer pl.release()
+			defer atomic.AddInt64(&b.inflight, -1)
+
+			var resp *responseData
+			var err error
+			posted := time.Now()
+			if b.aggregate != nil {
+				resp, err = b.aggregate.post(pl, query, authHeader)
+			} else {
+				resp, err = b.post(pl, query, authHeader)
+			}
+			b.latency.observe(time.Since(posted))
+			b.observe(h.Name(), resp, err)
+		}()
+	}
+	return out
+}
+
+// hasShadows reports whether some backends of h, or its subscribers, are
+// shadows
+func (h *HTTP) hasShadows() bool {
+	return h.shadowed || len(h.subscriptions.list()) > 0
+}
+
+// pickWithShadows returns the backend picked by the balancer among
+// backends, along with the shadows which get every write. The balancer
+// stays on its turn for a preview.
+func (h *HTTP) pickWithShadows(backends []*httpBackend, now time.Time, preview bool) []*httpBackend {
+	var others, shadows []*httpBackend
+	for _, b := range backends {
+		if b.shadow {
+			shadows = append(shadows, b)
+		} else {
+			others = append(others, b)
+		}
+	}
+	pick := h.balancer.pick
+	if preview {
+		pick = h.balancer.peek
+	}
+	return append(pick(others, now), shadows...)
+}
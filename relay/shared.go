@@ -0,0 +1,340 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Several HTTP relays can share a listener, each one being served for its
+// own virtual host and/or path prefix, e.g. metrics.eu.example.com/write or
+// /tenantA/write. The listener is a relay of its own, started with the
+// service. With HTTPS, the certificate of the relay matching the SNI name
+// of the client is presented, the one of the listener otherwise.
+
+// sharedRoute selects the requests handled by a relay on a shared listener,
+// an empty host matches every host
+type sharedRoute struct {
+	host   string
+	prefix string
+}
+
+// sharedListener is a listener shared by several relays, it dispatches the
+// requests to the relay with the best matching route: an exact host is
+// preferred over any host, then the longest path prefix wins
+type sharedListener struct {
+	addr          string
+	cert          serverCert
+	clientAuth    clientAuth
+	proxyProtocol bool
+	reusePort     bool
+	serverConfig  serverConfig
+
+	server *managedServer
+
+	// certificate of the listener, for the hosts without one of their own
+	defaultCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	mu        sync.RWMutex
+	relays    map[sharedRoute]*HTTP
+	hostCerts map[string]func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// release of the certificates of the hosts, see serverCert.getter
+	hostReleases map[string]func()
+}
+
+func newSharedListener(addr string, cert serverCert, ca clientAuth, proxyProtocol, reusePort bool, sc serverConfig) *sharedListener {
+	m := &sharedListener{
+		addr:          addr,
+		cert:          cert,
+		clientAuth:    ca,
+		proxyProtocol: proxyProtocol,
+		reusePort:     reusePort,
+		serverConfig:  sc,
+		relays:        make(map[sharedRoute]*HTTP),
+		hostCerts:     make(map[string]func(*tls.ClientHelloInfo) (*tls.Certificate, error)),
+		hostReleases:  make(map[string]func()),
+	}
+	m.server = newManagedServer(m, sc, DefaultShutdownTimeout)
+	return m
+}
+
+func (m *sharedListener) Name() string {
+	return "listener " + m.addr
+}
+
+func (m *sharedListener) Run() error {
+	l, err := listen("tcp", m.addr, m.reusePort)
+	if err != nil {
+		return err
+	}
+
+	if m.proxyProtocol {
+		l = newProxyListener(l)
+	}
+
+	if m.cert.enabled() {
+		t, release, err := m.clientAuth.tlsConfig(m.cert)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		defer release()
+		m.defaultCert = t.GetCertificate
+		t.GetCertificate = m.certificate
+
+		l = tls.NewListener(l, t)
+	}
+
+	log.Printf("Starting shared listener on %v", m.addr)
+
+	return m.server.serve(l)
+}
+
+func (m *sharedListener) Stop() error {
+	return m.server.stop()
+}
+
+// certificate returns the certificate of the virtual host asked for by the
+// client, or the one of the listener
+func (m *sharedListener) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	get := m.hostCerts[strings.ToLower(hello.ServerName)]
+	m.mu.RUnlock()
+
+	if get == nil {
+		get = m.defaultCert
+	}
+	return get(hello)
+}
+
+func (m *sharedListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	host := requestHost(r.Host)
+
+	var h *HTTP
+	var best sharedRoute
+	m.mu.RLock()
+	for route, relay := range m.relays {
+		if route.host != "" && route.host != host {
+			continue
+		}
+		if route.prefix != "" && !strings.HasPrefix(path, route.prefix+"/") {
+			continue
+		}
+
+		if h == nil ||
+			route.host != "" && best.host == "" ||
+			route.host == best.host && len(route.prefix) > len(best.prefix) {
+			h, best = relay, route
+		}
+	}
+	m.mu.RUnlock()
+
+	if h == nil {
+		jsonError(w, http.StatusNotFound, "no relay for this host and path")
+		return
+	}
+
+	r.URL.Path = path[len(best.prefix):]
+	h.ServeHTTP(w, r)
+}
+
+// add routes the requests matching route to h, presenting the certificate
+// cert to the clients asking for the host of the route over HTTPS
+func (m *sharedListener) add(route sharedRoute, h *HTTP, cert serverCert) error {
+	var c func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	release := func() {}
+	if route.host != "" && cert.enabled() && cert != m.cert {
+		get, r, err := cert.getter()
+		if err != nil {
+			return err
+		}
+		c, release = get, r
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.relays[route] != nil {
+		release()
+		return fmt.Errorf("virtual host %q and path prefix %q already served on %v", route.host, route.prefix, m.addr)
+	}
+	m.relays[route] = h
+	if c != nil && m.hostCerts[route.host] == nil {
+		m.hostCerts[route.host] = c
+		m.hostReleases[route.host] = release
+	} else {
+		release()
+	}
+	return nil
+}
+
+func (m *sharedListener) remove(route sharedRoute) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.relays, route)
+	for r := range m.relays {
+		if r.host == route.host {
+			return
+		}
+	}
+	delete(m.hostCerts, route.host)
+	if release := m.hostReleases[route.host]; release != nil {
+		release()
+		delete(m.hostReleases, route.host)
+	}
+}
+
+// requestHost returns the lowercased host of a Host header, without port
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// normalizePathPrefix returns prefix with a leading slash and without a
+// trailing one
+func normalizePathPrefix(prefix string) (string, error) {
+	p := "/" + strings.Trim(prefix, "/")
+	if p == "/" || strings.ContainsAny(p, "?#") {
+		return "", fmt.Errorf("invalid path prefix %q", prefix)
+	}
+	return p, nil
+}
+
+// sharedRelay is an HTTP relay served by a shared listener. Its route is
+// taken when the relay is created, and given back when it's stopped or
+// removed from the service.
+type sharedRelay struct {
+	*HTTP
+	mux   *sharedListener
+	route sharedRoute
+	done  chan struct{}
+
+	// Stop may be called again, e.g. by a removal racing with Service.Stop
+	stopOnce sync.Once
+}
+
+func newSharedRelay(h *HTTP, mux *sharedListener, route sharedRoute, cert serverCert) (*sharedRelay, error) {
+	if err := mux.add(route, h, cert); err != nil {
+		return nil, err
+	}
+	return &sharedRelay{HTTP: h, mux: mux, route: route, done: make(chan struct{})}, nil
+}
+
+func (p *sharedRelay) Run() error {
+	log.Printf("Starting relay %q on %v for host %q and path prefix %q", p.Name(), p.mux.addr, p.route.host, p.route.prefix)
+
+	if p.heartbeat != nil {
+		go p.heartbeat.run(p.HTTP)
+	}
+	if p.selfMetrics != nil {
+		go p.selfMetrics.run(p.HTTP)
+	}
+	if p.versions != nil {
+		go p.versions.run()
+	}
+
+	<-p.done
+	return nil
+}
+
+func (p *sharedRelay) Stop() error {
+	p.stopOnce.Do(func() {
+		if p.heartbeat != nil {
+			p.heartbeat.stop()
+		}
+		if p.selfMetrics != nil {
+			p.selfMetrics.stop()
+		}
+		if p.versions != nil {
+			p.versions.stop()
+		}
+		p.mux.remove(p.route)
+		close(p.done)
+	})
+	return nil
+}
+
+// listener returns the shared listener of addr, creating it when needed.
+// The relays of a listener are either all served over HTTPS or none, with
+// the same client certificate verification, PROXY protocol, reuse-port and
+// server timeouts settings, and only the ones with a virtual host may bring
+// another certificate.
+func (s *Service) listener(addr string, cert serverCert, ca clientAuth, proxyProtocol, reusePort bool, sc serverConfig, virtualHost bool) (*sharedListener, error) {
+	s.mu.Lock()
+	m := s.listeners[addr]
+	s.mu.Unlock()
+
+	if m != nil {
+		if m.cert.enabled() != cert.enabled() || !virtualHost && m.cert != cert {
+			return nil, fmt.Errorf("conflicting certificates for the shared listener on %v", addr)
+		}
+		if m.clientAuth != ca {
+			return nil, fmt.Errorf("conflicting client certificate settings for the shared listener on %v", addr)
+		}
+		if m.proxyProtocol != proxyProtocol {
+			return nil, fmt.Errorf("conflicting accept-proxy-protocol for the shared listener on %v", addr)
+		}
+		if m.reusePort != reusePort {
+			return nil, fmt.Errorf("conflicting reuse-port for the shared listener on %v", addr)
+		}
+		if m.serverConfig != sc {
+			return nil, fmt.Errorf("conflicting server timeouts for the shared listener on %v", addr)
+		}
+		return m, nil
+	}
+
+	m = newSharedListener(addr, cert, ca, proxyProtocol, reusePort, sc)
+	if err := s.AddRelay(m); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.listeners[addr] = m
+	s.mu.Unlock()
+	return m, nil
+}
+
+// addHTTP adds the HTTP relay of cfg to the service, on the shared listener
+// of its address when it has a virtual host or a path prefix
+func (s *Service) addHTTP(cfg HTTPConfig, prefix string) error {
+	r, err := NewHTTP(cfg)
+	if err != nil {
+		return err
+	}
+
+	if prefix == "" && cfg.VirtualHost == "" {
+		return s.AddRelay(r)
+	}
+
+	route := sharedRoute{host: strings.ToLower(cfg.VirtualHost)}
+	if prefix != "" {
+		if route.prefix, err = normalizePathPrefix(prefix); err != nil {
+			return err
+		}
+	}
+
+	h := r.(*HTTP)
+	m, err := s.listener(cfg.Addr, h.cert, h.clientAuth, cfg.AcceptProxyProtocol, cfg.ReusePort, h.serverConfig, route.host != "")
+	if err != nil {
+		return err
+	}
+
+	sr, err := newSharedRelay(h, m, route, h.cert)
+	if err != nil {
+		return err
+	}
+	if err := s.AddRelay(sr); err != nil {
+		m.remove(route)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build go1.8
+// +build go1.8
+
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownServer closes the listener of srv, and waits up to timeout for
+// the requests being served to complete
+func shutdownServer(srv *http.Server, l net.Listener, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
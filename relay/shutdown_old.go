@@ -0,0 +1,16 @@
+//go:build !go1.8
+// +build !go1.8
+
+package relay
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownServer only closes the listener before Go 1.8, the requests being
+// served are cut short when the process exits
+func shutdownServer(srv *http.Server, l net.Listener, timeout time.Duration) error {
+	return l.Close()
+}
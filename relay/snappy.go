@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Prometheus remote_write bodies use the snappy block format, which is
+// simple enough to be decoded here rather than pulling in another dependency.
+// See https://github.com/google/snappy/blob/master/format_description.txt
+
+const (
+	snappyLiteral = 0
+	snappyCopy1   = 1
+	snappyCopy2   = 2
+	snappyCopy4   = 3
+
+	// upper limit on the decoded size of a block, to protect the relay from
+	// small bodies claiming to expand to huge ones
+	maxSnappyDecodedLen = 64 * MB
+)
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, l := binary.Uvarint(src)
+	if l <= 0 || n > maxSnappyDecodedLen {
+		return nil, errSnappyCorrupt
+	}
+	src = src[l:]
+
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyLiteral:
+			length = int(tag >> 2)
+			if length >= 60 {
+				// the length is stored in the next 1 to 4 bytes
+				b := length - 59
+				if len(src) < b {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := b - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[b:]
+			}
+			length++
+
+			if length <= 0 || length > len(src) || len(dst)+length > int(n) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case snappyCopy1:
+			if len(src) < 1 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[0])
+			src = src[1:]
+
+		case snappyCopy2:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+
+		case snappyCopy4:
+			if len(src) < 4 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src))
+			src = src[4:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errSnappyCorrupt
+		}
+
+		// copies may overlap with the bytes they produce
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != int(n) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// snappyEncode writes src as a sequence of literals. That's a valid block
+// any decoder accepts, trading compression for a trivial encoder.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/65536*3+3)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	for len(src) > 0 {
+		chunk := src
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		src = src[len(chunk):]
+
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n)<<2|snappyLiteral)
+		case n < 1<<8:
+			dst = append(dst, 60<<2|snappyLiteral, byte(n))
+		default:
+			dst = append(dst, 61<<2|snappyLiteral, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+
+	return dst
+}
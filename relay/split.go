@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"bytes"
+)
+
+// splitPoster posts the writes larger than max in several sequential posts
+// cut on line boundaries, for backends (or proxies in front of them)
+// rejecting the large requests with a 413. A line larger than max is posted
+// on its own.
+type splitPoster struct {
+	max int
+	p   poster
+}
+
+// post stops at the first part which isn't written, the write is then
+// failed or retried as a whole, the parts already written being written
+// again (which InfluxDB handles as an overwrite of the same points)
+func (s *splitPoster) post(p *payload, query string, auth string) (*responseData, error) {
+	data := p.Bytes()
+	if len(data) <= s.max {
+		return s.p.post(p, query, auth)
+	}
+
+	var resp *responseData
+	for len(data) > 0 {
+		n := splitAt(data, s.max)
+
+		buf := getBuf()
+		buf.Write(data[:n])
+		data = data[n:]
+
+		part := newPayload(buf)
+		var err error
+		resp, err = s.p.post(part, query, auth)
+		part.release()
+		if err != nil || resp.StatusCode/100 != 2 {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// splitAt returns the length of the first part of data, the lines fitting
+// in max or the first line if it doesn't
+func splitAt(data []byte, max int) int {
+	if len(data) <= max {
+		return len(data)
+	}
+
+	if i := bytes.LastIndexByte(data[:max], '\n'); i >= 0 {
+		return i + 1
+	}
+	if i := bytes.IndexByte(data[max:], '\n'); i >= 0 {
+		return max + i + 1
+	}
+	return len(data)
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errSpoolClosed = errors.New("spool closed, its relay was removed")
+
+const (
+	DefaultSpoolRotateSizeMB   = 64
+	DefaultSpoolRotateInterval = time.Hour
+)
+
+// spoolPoster appends the writes it receives to local files, one set of
+// files per database, retention policy and precision. Files are rotated by
+// size and age, and are never removed by the relay.
+type spoolPoster struct {
+	dir            string
+	rotateSize     int64
+	rotateInterval time.Duration
+
+	mu    sync.Mutex
+	files map[string]*spoolFile
+
+	// set once the relay is removed, the later writes fail
+	closed bool
+}
+
+type spoolFile struct {
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newSpoolPoster(cfg *HTTPOutputConfig) (*spoolPoster, error) {
+	s := &spoolPoster{
+		dir:            cfg.Location,
+		rotateSize:     DefaultSpoolRotateSizeMB * MB,
+		rotateInterval: DefaultSpoolRotateInterval,
+		files:          make(map[string]*spoolFile),
+	}
+
+	if cfg.RotateSizeMB > 0 {
+		s.rotateSize = int64(cfg.RotateSizeMB) * MB
+	}
+
+	if cfg.RotateInterval != "" {
+		d, err := time.ParseDuration(cfg.RotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rotate interval '%v'", err)
+		}
+		s.rotateInterval = d
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *spoolPoster) post(p *payload, query string, auth string) (*responseData, error) {
+	buf := p.Bytes()
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// the credentials must not end up in the file names
+	key := url.Values{}
+	for _, k := range []string{"db", "rp", "precision"} {
+		if v := params.Get(k); v != "" {
+			key.Set(k, v)
+		}
+	}
+	name := key.Encode()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errSpoolClosed
+	}
+
+	sf, err := s.file(name, len(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := sf.f.Write(buf)
+	sf.size += int64(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responseData{StatusCode: 204}, nil
+}
+
+// file returns the file the next n bytes for name are written to, rotating
+// the current one when needed
+func (s *spoolPoster) file(name string, n int) (*spoolFile, error) {
+	now := time.Now()
+
+	sf := s.files[name]
+	if sf != nil && sf.size > 0 && (sf.size+int64(n) > s.rotateSize || now.Sub(sf.opened) >= s.rotateInterval) {
+		sf.f.Close()
+		sf = nil
+	}
+
+	if sf == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("%s-%s.lp", name, now.UTC().Format("20060102T150405.000000000")))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			delete(s.files, name)
+			return nil, err
+		}
+
+		sf = &spoolFile{f: f, opened: now}
+		s.files[name] = sf
+	}
+
+	return sf, nil
+}
+
+// close closes the current files once the relay is removed
+func (s *spoolPoster) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, sf := range s.files {
+		sf.f.Close()
+		delete(s.files, name)
+	}
+	s.closed = true
+}
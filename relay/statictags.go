@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// staticTags are added to every point, e.g. to record the relay and the
+// environment the points went through. They replace the tags of the same
+// name set by the agents.
+type staticTags map[string]string
+
+func newStaticTags(tags map[string]string) (staticTags, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	s := make(staticTags, len(tags))
+	for k, v := range tags {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid static tag %q=%q", k, v)
+		}
+		if k == "time" || strings.HasPrefix(k, "_") {
+			return nil, fmt.Errorf("reserved static tag name %q", k)
+		}
+		s[k] = v
+	}
+	return s, nil
+}
+
+// apply adds the tags to p. The point is returned unchanged when it already
+// has them, along with a description of every change.
+func (s staticTags) apply(p models.Point) (models.Point, []string, error) {
+	if len(s) == 0 {
+		return p, nil, nil
+	}
+
+	tags := p.Tags()
+	var transforms []string
+
+	for k, v := range s {
+		old, ok := tags[k]
+		switch {
+		case !ok:
+			transforms = append(transforms, fmt.Sprintf("added tag %q=%q", k, v))
+		case old != v:
+			transforms = append(transforms, fmt.Sprintf("replaced tag %q from %q to %q", k, old, v))
+		default:
+			continue
+		}
+		tags[k] = v
+	}
+
+	if transforms == nil {
+		return p, nil, nil
+	}
+
+	np, err := models.NewPoint(p.Name(), tags, p.Fields(), p.Time())
+	if err != nil {
+		return nil, nil, err
+	}
+	return np, transforms, nil
+}
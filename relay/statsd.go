@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultStatsDInterval = 10 * time.Second
+	DefaultStatsDPrefix   = "influxdb_relay"
+
+	// keeps the datagrams under the usual MTU
+	statsdMaxPacket = 1432
+)
+
+// statsdEmitter periodically sends the counters of the relays to a statsd
+// server: the requests of the HTTP relays, the failures of every backend per
+// class, and the bytes held by their retry buffers and their level. The
+// counters are sent as their increase since the last emission.
+type statsdEmitter struct {
+	s        *Service
+	interval time.Duration
+	prefix   string
+
+	// send the relay, backend and class as DogStatsD tags rather than in the
+	// metric names, along with the tags of the config
+	dogstatsd bool
+	tags      []string
+
+	conn net.Conn
+
+	// last value of every counter, by metric
+	last map[string]int64
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newStatsdEmitter(cfg StatsDConfig, s *Service) (*statsdEmitter, error) {
+	e := &statsdEmitter{
+		s:         s,
+		interval:  DefaultStatsDInterval,
+		prefix:    DefaultStatsDPrefix,
+		dogstatsd: cfg.DogStatsD,
+		tags:      cfg.Tags,
+		last:      make(map[string]int64),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid statsd interval %q", cfg.Interval)
+		}
+		e.interval = d
+	}
+	if cfg.Prefix != "" {
+		e.prefix = strings.TrimSuffix(cfg.Prefix, ".")
+	}
+
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+	e.conn = conn
+
+	return e, nil
+}
+
+func (e *statsdEmitter) Run() error {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.emit()
+		case <-e.closing:
+			e.emit()
+			return e.conn.Close()
+		}
+	}
+}
+
+func (e *statsdEmitter) Stop() error {
+	close(e.closing)
+	<-e.done
+	return nil
+}
+
+// statsdTag is a tag of a metric, part of its name with plain statsd
+type statsdTag struct {
+	key, value string
+}
+
+// emit sends the current counters and gauges of the relays
+func (e *statsdEmitter) emit() {
+	var packet bytes.Buffer
+	var failed error
+
+	send := func(line string) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				failed = err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	counter := func(name string, value int64, tags ...statsdTag) {
+		line := e.metric(name, tags)
+		delta := value - e.last[line]
+		if delta < 0 {
+			// the relay was recreated, e.g. a tenant
+			delta = value
+		}
+		e.last[line] = value
+		if delta != 0 {
+			send(e.format(line, delta, "c", tags))
+		}
+	}
+
+	gauge := func(name string, value int64, tags ...statsdTag) {
+		send(e.format(e.metric(name, tags), value, "g", tags))
+	}
+
+	relays := e.s.relayList()
+	sort.Sort(relaysByName(relays))
+
+	for _, r := range relays {
+		relay := statsdTag{"relay", r.Name()}
+
+		var h *HTTP
+		switch r := r.(type) {
+		case *HTTP:
+			h = r
+		case *sharedRelay:
+			h = r.HTTP
+		}
+		if h != nil {
+			counter("requests", atomic.LoadInt64(&h.requests), relay)
+		}
+
+		hr, ok := r.(httpBackendRelay)
+		if !ok {
+			continue
+		}
+		for _, b := range hr.httpBackends() {
+			backend := statsdTag{"backend", b.name}
+
+			counts := b.errorCounts()
+			classes := make([]string, 0, len(counts))
+			for class := range counts {
+				classes = append(classes, class)
+			}
+			sort.Strings(classes)
+			for _, class := range classes {
+				counter("backend_errors", counts[class], relay, backend, statsdTag{"class", class})
+			}
+
+			if rb, ok := b.poster.(*retryBuffer); ok {
+				size, _ := rb.buffered()
+				gauge("buffer_bytes", int64(size), relay, backend)
+				gauge("buffer_level", int64(rb.bufferLevel()), relay, backend)
+			}
+		}
+	}
+
+	if packet.Len() > 0 {
+		if _, err := e.conn.Write(packet.Bytes()); err != nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		log.Printf("Problem sending metrics to statsd: %v", failed)
+	}
+}
+
+// metric returns the name of a metric, with its tags as plain statsd
+func (e *statsdEmitter) metric(name string, tags []statsdTag) string {
+	parts := []string{e.prefix, name}
+	if !e.dogstatsd {
+		for _, t := range tags {
+			parts = append(parts, statsdName(t.value))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// format returns the statsd line of a metric, e.g. "relay.requests:3|c" or
+// "relay.requests:3|c|#relay:http" with DogStatsD
+func (e *statsdEmitter) format(metric string, value int64, kind string, tags []statsdTag) string {
+	line := fmt.Sprintf("%s:%d|%s", metric, value, kind)
+	if !e.dogstatsd || len(tags)+len(e.tags) == 0 {
+		return line
+	}
+
+	all := make([]string, 0, len(tags)+len(e.tags))
+	for _, t := range tags {
+		all = append(all, t.key+":"+statsdTagValue(t.value))
+	}
+	all = append(all, e.tags...)
+	return line + "|#" + strings.Join(all, ",")
+}
+
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdTagValue replaces the characters of a DogStatsD tag value which are
+// part of the protocol
+func statsdTagValue(v string) string {
+	return statsdTagReplacer.Replace(v)
+}
+
+// statsdName replaces the characters of a name part which aren't safe in a
+// plain statsd metric name, e.g. the dots and colons of a backend location
+func statsdName(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, v)
+}
+
+type relaysByName []Relay
+
+func (r relaysByName) Len() int           { return len(r) }
+func (r relaysByName) Less(i, j int) bool { return r[i].Name() < r[j].Name() }
+func (r relaysByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// serviceStatus is the snapshot of the service returned by /status
+type serviceStatus struct {
+	UptimeSeconds float64                `json:"uptime_seconds"`
+	Relays        map[string]relayStatus `json:"relays"`
+}
+
+type relayStatus struct {
+	UptimeSeconds float64                  `json:"uptime_seconds"`
+	Connections   *int64                   `json:"connections,omitempty"`
+	Failover      *failoverStatus          `json:"failover,omitempty"`
+	Backends      map[string]backendStatus `json:"backends,omitempty"`
+}
+
+// backendStatus is the state of an HTTP backend, the buffer fields are only
+// set for the backends with a retry buffer
+type backendStatus struct {
+	InFlight        int64      `json:"in_flight"`
+	Buffering       *bool      `json:"buffering,omitempty"`
+	BufferedBytes   *int       `json:"buffered_bytes,omitempty"`
+	BufferedBatches *int       `json:"buffered_batches,omitempty"`
+	BufferLevel     string     `json:"buffer_level,omitempty"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	LastFailure     *time.Time `json:"last_failure,omitempty"`
+}
+
+func (b *httpBackend) status() backendStatus {
+	st := backendStatus{InFlight: atomic.LoadInt64(&b.inflight)}
+
+	b.errors.mu.Lock()
+	if t := b.errors.lastSuccess; !t.IsZero() {
+		st.LastSuccess = &t
+	}
+	if t := b.errors.lastFailure; !t.IsZero() {
+		st.LastFailure = &t
+	}
+	b.errors.mu.Unlock()
+
+	if rb, ok := b.poster.(*retryBuffer); ok {
+		buffering := rb.isBuffering()
+		size, batches := rb.buffered()
+		st.Buffering, st.BufferedBytes, st.BufferedBatches = &buffering, &size, &batches
+		st.BufferLevel = bufferLevelNames[rb.bufferLevel()]
+	}
+	return st
+}
+
+// status returns the snapshot of the service and its relays at now
+func (s *Service) status(now time.Time) serviceStatus {
+	s.mu.RLock()
+	st := serviceStatus{Relays: make(map[string]relayStatus, len(s.relays))}
+	if s.running {
+		st.UptimeSeconds = now.Sub(s.runSince).Seconds()
+	}
+	started := make(map[string]time.Time, len(s.started))
+	for name, t := range s.started {
+		started[name] = t
+	}
+	s.mu.RUnlock()
+
+	for _, r := range s.relayList() {
+		var rs relayStatus
+		if t, ok := started[r.Name()]; ok {
+			rs.UptimeSeconds = now.Sub(t).Seconds()
+		}
+
+		// the relays served by a shared listener have no connections of
+		// their own
+		var server *managedServer
+		switch r := r.(type) {
+		case *HTTP:
+			server = r.server
+			if r.failover != nil {
+				fs := r.failover.status()
+				rs.Failover = &fs
+			}
+		case *sharedListener:
+			server = r.server
+		}
+		if server != nil {
+			n := server.openConns()
+			rs.Connections = &n
+		}
+
+		if hr, ok := r.(httpBackendRelay); ok {
+			rs.Backends = make(map[string]backendStatus)
+			for _, b := range hr.httpBackends() {
+				rs.Backends[b.name] = b.status()
+			}
+		}
+		st.Relays[r.Name()] = rs
+	}
+	return st
+}
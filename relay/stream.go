@@ -0,0 +1,189 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// The writes larger than stream-threshold-kb are streamed to the backends
+// as they're read from the client, instead of being read in memory, parsed
+// and serialized again. Their points are forwarded unchanged, so the
+// relays with point transforms, deduplication, coalescing, rate limits, quotas
+// or a migration can't stream, and neither can the backends which must keep the
+// write to post it again (retry buffer, immediate-retries) or change it.
+
+var errStreamTooLarge = errors.New("request body too large")
+
+// checkUnparsed returns why the writes of the relay can't be forwarded
+// without parsing their points, as needed by setting, nil if they can
+func (h *HTTP) checkUnparsed(setting string) error {
+	var features []string
+	if h.limit != nil {
+		features = append(features, "max-line-length")
+	}
+	if h.tagRewrite != nil || len(h.tagNormalize) > 0 || len(h.staticTags) > 0 || len(h.fieldDrops) > 0 || len(h.stringLimits) > 0 {
+		features = append(features, "point transforms")
+	}
+	if h.dedup != nil {
+		features = append(features, "dedup-window")
+	}
+	if h.batcher != nil {
+		features = append(features, "batch-wait")
+	}
+	if h.rate != nil || h.clientRate != nil {
+		features = append(features, "rate-limit")
+	}
+	if h.quotas != nil {
+		features = append(features, "quota")
+	}
+	if h.migration != nil {
+		features = append(features, "migration")
+	}
+	if h.auth != nil && h.auth.measurements() {
+		features = append(features, "auth grants of measurements")
+	}
+	if len(features) > 0 {
+		return fmt.Errorf("%s can't be used with %s", setting, strings.Join(features, ", "))
+	}
+
+	for _, b := range h.backends {
+		if _, ok := b.poster.(*simplePoster); !ok || b.aggregate != nil {
+			return fmt.Errorf("%s can't be used with backend %q, only influxdb outputs without buffer, immediate-retries, max-post-size-kb, query rewriting or aggregates can get unparsed writes", setting, b.name)
+		}
+	}
+	return nil
+}
+
+// passthrough forwards the gzip body of r without decompressing it, streamed
+// or read in memory. The points of the write can't be looked at, its size
+// limit applies to the compressed body.
+func (h *HTTP) passthrough(w http.ResponseWriter, r *http.Request, backends []*httpBackend, query string, verbose bool) {
+	var body io.Reader = r.Body
+	if h.maxBodySize > 0 {
+		body = io.LimitReader(body, h.maxBodySize+1)
+	}
+
+	if h.streams(r) {
+		h.stream(w, body, "gzip", backends, query, r.Header.Get("Authorization"))
+		return
+	}
+
+	buf := getBuf()
+	if _, err := buf.ReadFrom(body); err != nil {
+		putBuf(buf)
+		jsonError(w, http.StatusInternalServerError, "problem reading request body")
+		return
+	}
+	if h.maxBodySize > 0 && int64(buf.Len()) > h.maxBodySize {
+		putBuf(buf)
+		jsonError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	}
+
+	pl := newPayload(buf)
+	pl.encoding = "gzip"
+	h.forwardPayload(w, pl, backends, query, r.Header.Get("Authorization"), verbose)
+}
+
+// streams reports whether the write of r is streamed
+func (h *HTTP) streams(r *http.Request) bool {
+	// the usage export counts the points and series of the writes
+	return h.streamThreshold > 0 && r.ContentLength > h.streamThreshold && h.usage == nil
+}
+
+// streamWriter is the end of the pipe to a backend, it stops writing to it
+// once the backend stopped reading, without failing the others
+type streamWriter struct {
+	pw  *io.PipeWriter
+	err error
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.pw.Write(b)
+	}
+	return len(b), nil
+}
+
+// stream copies body, of the given Content-Encoding, to the backends and
+// answers w the way forward does
+func (h *HTTP) stream(w http.ResponseWriter, body io.Reader, encoding string, backends []*httpBackend, query string, authHeader string) {
+	backends = h.participants(backends)
+	responses := make(chan *responseData, len(backends))
+	writers := make([]io.Writer, len(backends))
+	pipes := make([]*io.PipeWriter, len(backends))
+
+	for i, b := range backends {
+		b := b
+		pr, pw := io.Pipe()
+		writers[i] = &streamWriter{pw: pw}
+		pipes[i] = pw
+
+		atomic.AddInt64(&b.inflight, 1)
+		go func() {
+			defer atomic.AddInt64(&b.inflight, -1)
+			if b.shadow {
+				// the answer doesn't wait for it, only the copy of the body
+				responses <- nil
+			}
+			resp, err := b.poster.(*simplePoster).postStream(pr, encoding, query, authHeader)
+			// unblock the copy if the post failed before reading the body
+			pr.CloseWithError(io.ErrClosedPipe)
+			b.observe(h.Name(), resp, err)
+			if b.shadow {
+				return
+			}
+			if b.secondary && resp != nil && resp.StatusCode/100 != 2 {
+				resp = nil
+			}
+			responses <- resp
+		}()
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), body)
+	if err == nil && h.maxBodySize > 0 && n > h.maxBodySize {
+		err = errStreamTooLarge
+	}
+	for _, pw := range pipes {
+		// the backends get a truncated request rather than a partial write
+		pw.CloseWithError(err)
+	}
+
+	switch {
+	case err == errStreamTooLarge:
+		jsonError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	case err != nil:
+		jsonError(w, http.StatusInternalServerError, "problem reading request body")
+		return
+	}
+
+	var errResponse *responseData
+	for range backends {
+		resp := <-responses
+		if resp == nil {
+			continue
+		}
+
+		switch resp.StatusCode / 100 {
+		case 2:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case 4:
+			resp.Write(w)
+			return
+		default:
+			errResponse = resp
+		}
+	}
+
+	if errResponse == nil {
+		jsonError(w, http.StatusServiceUnavailable, "unable to write points")
+		return
+	}
+	errResponse.Write(w)
+}
@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"fmt"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	stringLimitTruncate  = "truncate"
+	stringLimitDropField = "drop-field"
+	stringLimitDropPoint = "drop-point"
+
+	// stringLimitAny matches every string field without a limit of its own
+	stringLimitAny = "*"
+)
+
+type stringLimit struct {
+	max    int
+	action string
+}
+
+// stringLimits caps the length of string field values, see StringLimitConfig
+type stringLimits map[string]stringLimit
+
+func newStringLimits(cfgs []StringLimitConfig) (stringLimits, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	s := make(stringLimits)
+	for _, cfg := range cfgs {
+		field := cfg.Field
+		if field == "" {
+			field = stringLimitAny
+		}
+
+		if cfg.MaxLength <= 0 {
+			return nil, fmt.Errorf("invalid max-length %d for string field %q", cfg.MaxLength, field)
+		}
+
+		action := cfg.Action
+		switch action {
+		case "":
+			action = stringLimitTruncate
+		case stringLimitTruncate, stringLimitDropField, stringLimitDropPoint:
+		default:
+			return nil, fmt.Errorf("unknown action %q for string field %q", action, field)
+		}
+
+		if _, ok := s[field]; ok {
+			return nil, fmt.Errorf("duplicate limit for string field %q", field)
+		}
+		s[field] = stringLimit{max: cfg.MaxLength, action: action}
+	}
+
+	return s, nil
+}
+
+// apply enforces the limits on the string fields of p. The point is
+// returned unchanged when every value fits and nil when it is dropped,
+// along with a description of what was done.
+func (s stringLimits) apply(p models.Point) (models.Point, []string, error) {
+	if len(s) == 0 {
+		return p, nil, nil
+	}
+
+	var fields models.Fields
+	var transforms []string
+
+	for k, v := range p.Fields() {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		l, ok := s[k]
+		if !ok {
+			if l, ok = s[stringLimitAny]; !ok {
+				continue
+			}
+		}
+
+		if len(str) <= l.max {
+			continue
+		}
+
+		if fields == nil {
+			fields = p.Fields()
+		}
+
+		switch l.action {
+		case stringLimitTruncate:
+			fields[k] = truncateString(str, l.max)
+			transforms = append(transforms, fmt.Sprintf("truncated string field %q to %d bytes", k, l.max))
+		case stringLimitDropField:
+			delete(fields, k)
+			transforms = append(transforms, fmt.Sprintf("dropped string field %q", k))
+		case stringLimitDropPoint:
+			return nil, append(transforms, fmt.Sprintf("dropped point, string field %q is too long", k)), nil
+		}
+	}
+
+	if fields == nil {
+		return p, nil, nil
+	}
+
+	if len(fields) == 0 {
+		return nil, append(transforms, "dropped point without fields"), nil
+	}
+
+	np, err := models.NewPoint(p.Name(), p.Tags(), fields, p.Time())
+	if err != nil {
+		return nil, nil, err
+	}
+	return np, transforms, nil
+}
@@ -0,0 +1,193 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// A subscriber output pushes the writes of some databases and measurements
+// to a downstream service over HTTP, in line protocol, the way the
+// subscriptions of InfluxDB did. Subscribers are shadows: the writes never
+// wait for them, and a push they failed is lost. They're configured as
+// outputs of type "subscriber", or registered at runtime with the
+// /subscriptions endpoint of the admin listener.
+
+const outputSubscriber = "subscriber"
+
+// subscriberPoster only posts the points of the measurements matching its
+// patterns, every point when there's none
+type subscriberPoster struct {
+	measurements []string
+	p            poster
+}
+
+func (s *subscriberPoster) post(pl *payload, query string, auth string) (*responseData, error) {
+	if len(s.measurements) == 0 {
+		return s.p.post(pl, query, auth)
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	precision := params.Get("precision")
+
+	points, err := models.ParsePointsWithPrecision(pl.Bytes(), time.Now(), precision)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := getBuf()
+	matched := 0
+	for _, p := range points {
+		if matchAny(s.measurements, p.Name()) {
+			writePoint(buf, p, precision)
+			matched++
+		}
+	}
+
+	switch matched {
+	case 0:
+		// nothing the subscriber wants, as if it was pushed
+		putBuf(buf)
+		return &responseData{StatusCode: 204}, nil
+	case len(points):
+		putBuf(buf)
+		return s.p.post(pl, query, auth)
+	}
+
+	sp := newPayload(buf)
+	defer sp.release()
+	return s.p.post(sp, query, auth)
+}
+
+// checkPatterns checks path.Match patterns, what they match being named by
+// what in the errors
+func checkPatterns(what string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("invalid %s pattern %q", what, p)
+		}
+	}
+	return nil
+}
+
+// subscriptions are the subscribers of a relay registered at runtime
+type subscriptions struct {
+	mu   sync.RWMutex
+	subs []subscription
+	// the backends of subs, replaced rather than modified
+	backends []*httpBackend
+}
+
+type subscription struct {
+	info subscriptionInfo
+	b    *httpBackend
+}
+
+// subscriptionInfo describes a subscriber registered at runtime, as listed
+// by /subscriptions
+type subscriptionInfo struct {
+	Relay        string   `json:"relay"`
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Databases    []string `json:"databases,omitempty"`
+	Measurements []string `json:"measurements,omitempty"`
+}
+
+// list returns the backends of the subscribers
+func (s *subscriptions) list() []*httpBackend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends
+}
+
+// subscribe registers a subscriber of h, pushed the writes from now on
+func (h *HTTP) subscribe(info subscriptionInfo) error {
+	if info.Name == "" || info.URL == "" {
+		return errors.New("subscription without name or url")
+	}
+	if u, err := url.Parse(info.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid subscription url %q", info.URL)
+	}
+	if h.streamThreshold > 0 || h.gzipPassthrough {
+		return errors.New("the writes of the relay aren't parsed, they can't be pushed to subscribers")
+	}
+	for _, b := range h.backends {
+		if b.name == info.Name {
+			return fmt.Errorf("relay %q already has an output %q", h.Name(), info.Name)
+		}
+	}
+
+	b, err := newHTTPBackend(&HTTPOutputConfig{
+		Name:         info.Name,
+		Location:     info.URL,
+		Type:         outputSubscriber,
+		Databases:    info.Databases,
+		Measurements: info.Measurements,
+	})
+	if err != nil {
+		return err
+	}
+
+	s := &h.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if sub.info.Name == info.Name {
+			return fmt.Errorf("relay %q already has a subscription %q", h.Name(), info.Name)
+		}
+	}
+	info.Relay = h.Name()
+	s.subs = append(s.subs, subscription{info: info, b: b})
+	s.backends = append(append([]*httpBackend(nil), s.backends...), b)
+	return nil
+}
+
+// unsubscribe removes the named subscriber of h registered at runtime
+func (h *HTTP) unsubscribe(name string) error {
+	s := &h.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sub := range s.subs {
+		if sub.info.Name != name {
+			continue
+		}
+		s.subs = append(s.subs[:i:i], s.subs[i+1:]...)
+		backends := make([]*httpBackend, 0, len(s.subs))
+		for _, sub := range s.subs {
+			backends = append(backends, sub.b)
+		}
+		s.backends = backends
+		return nil
+	}
+	return fmt.Errorf("unknown subscription %q", name)
+}
+
+// subscriptionStatus is a subscriber registered at runtime and the state of
+// its pushes, reported by /subscriptions
+type subscriptionStatus struct {
+	subscriptionInfo
+	backendStatus
+}
+
+// subscriptionStatus returns the subscribers of h registered at runtime
+func (h *HTTP) subscriptionStatus() []subscriptionStatus {
+	s := &h.subscriptions
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []subscriptionStatus
+	for _, sub := range s.subs {
+		out = append(out, subscriptionStatus{subscriptionInfo: sub.info, backendStatus: sub.b.status()})
+	}
+	return out
+}
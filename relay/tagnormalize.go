@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// tagNormalizeAny matches every tag without rules of its own
+const tagNormalizeAny = "*"
+
+type tagNormalizer struct {
+	lowercase bool
+	trimSpace bool
+	booleans  bool
+	synonyms  map[string]string
+}
+
+// booleanTagValues are the spellings rewritten to true or false
+var booleanTagValues = map[string]string{
+	"true": "true", "t": "true", "yes": "true", "y": "true", "on": "true", "1": "true",
+	"false": "false", "f": "false", "no": "false", "n": "false", "off": "false", "0": "false",
+}
+
+// tagNormalizers rewrites tag values, see TagNormalizeConfig
+type tagNormalizers map[string]*tagNormalizer
+
+func newTagNormalizers(cfgs []TagNormalizeConfig) (tagNormalizers, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	t := make(tagNormalizers)
+	for _, cfg := range cfgs {
+		tag := cfg.Tag
+		if tag == "" {
+			tag = tagNormalizeAny
+		}
+
+		if _, ok := t[tag]; ok {
+			return nil, fmt.Errorf("duplicate normalization for tag %q", tag)
+		}
+
+		t[tag] = &tagNormalizer{
+			lowercase: cfg.Lowercase,
+			trimSpace: cfg.TrimSpace,
+			booleans:  cfg.Booleans,
+			synonyms:  cfg.Synonyms,
+		}
+	}
+
+	return t, nil
+}
+
+func (n *tagNormalizer) normalize(v string) string {
+	if n.trimSpace {
+		v = strings.TrimSpace(v)
+	}
+	if n.lowercase {
+		v = strings.ToLower(v)
+	}
+	if n.booleans {
+		if b, ok := booleanTagValues[strings.ToLower(v)]; ok {
+			v = b
+		}
+	}
+	if s, ok := n.synonyms[v]; ok {
+		v = s
+	}
+	return v
+}
+
+// apply rewrites the tag values of p. The point is returned unchanged when
+// no value is modified, along with a description of every change.
+func (t tagNormalizers) apply(p models.Point) (models.Point, []string, error) {
+	if len(t) == 0 {
+		return p, nil, nil
+	}
+
+	tags := p.Tags()
+	var transforms []string
+
+	for k, v := range tags {
+		n, ok := t[k]
+		if !ok {
+			if n, ok = t[tagNormalizeAny]; !ok {
+				continue
+			}
+		}
+
+		nv := n.normalize(v)
+		if nv == v {
+			continue
+		}
+
+		// tags can't have empty values
+		if nv == "" {
+			delete(tags, k)
+			transforms = append(transforms, fmt.Sprintf("dropped empty tag %q", k))
+			continue
+		}
+
+		tags[k] = nv
+		transforms = append(transforms, fmt.Sprintf("normalized tag %q from %q to %q", k, v, nv))
+	}
+
+	if transforms == nil {
+		return p, nil, nil
+	}
+
+	np, err := models.NewPoint(p.Name(), tags, p.Fields(), p.Time())
+	if err != nil {
+		return nil, nil, err
+	}
+	return np, transforms, nil
+}
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"fmt"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// tagRewriter renames and drops tags, e.g. to align the tags of agents with
+// the ones of the others, or to remove the high cardinality ones
+type tagRewriter struct {
+	renames map[string]string
+	drops   map[string]bool
+}
+
+func newTagRewriter(renames map[string]string, drops []string) (*tagRewriter, error) {
+	if len(renames) == 0 && len(drops) == 0 {
+		return nil, nil
+	}
+
+	t := &tagRewriter{
+		renames: make(map[string]string, len(renames)),
+		drops:   make(map[string]bool, len(drops)),
+	}
+	for _, tag := range drops {
+		if tag == "" {
+			return nil, fmt.Errorf("invalid dropped tag %q", tag)
+		}
+		t.drops[tag] = true
+	}
+	targets := make(map[string]bool, len(renames))
+	for from, to := range renames {
+		if from == "" || to == "" || from == to {
+			return nil, fmt.Errorf("invalid tag rename %q to %q", from, to)
+		}
+		if t.drops[from] {
+			return nil, fmt.Errorf("tag %q is both renamed and dropped", from)
+		}
+		if targets[to] {
+			return nil, fmt.Errorf("several tags renamed to %q", to)
+		}
+		targets[to] = true
+		t.renames[from] = to
+	}
+	return t, nil
+}
+
+// apply renames and drops the tags of p. A renamed tag replaces the tag of
+// its new name. The point is returned unchanged when it has none of the
+// tags, along with a description of every change.
+func (t *tagRewriter) apply(p models.Point) (models.Point, []string, error) {
+	if t == nil {
+		return p, nil, nil
+	}
+
+	tags := p.Tags()
+	var transforms []string
+
+	for k := range t.drops {
+		if _, ok := tags[k]; ok {
+			delete(tags, k)
+			transforms = append(transforms, fmt.Sprintf("dropped tag %q", k))
+		}
+	}
+
+	// the renames are read from the tags of the point, so that chained
+	// renames (a to b, b to c) don't depend on the order of the map
+	renamed := make(map[string]string)
+	for from, to := range t.renames {
+		if v, ok := tags[from]; ok {
+			renamed[to] = v
+			delete(tags, from)
+			transforms = append(transforms, fmt.Sprintf("renamed tag %q to %q", from, to))
+		}
+	}
+	for k, v := range renamed {
+		tags[k] = v
+	}
+
+	if transforms == nil {
+		return p, nil, nil
+	}
+
+	np, err := models.NewPoint(p.Name(), tags, p.Fields(), p.Time())
+	if err != nil {
+		return nil, nil, err
+	}
+	return np, transforms, nil
+}
@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isTelegraf reports whether r comes from Telegraf, whose User-Agent is
+// Telegraf/<version>
+func isTelegraf(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("User-Agent"), "Telegraf/")
+}
+
+// telegrafWriter answers the writes of Telegraf, which only takes a 204 as
+// a successful write: the 202 of partial-success = "accepted" would be
+// retried until the write succeeds on every backend, writing it again to
+// the ones which took it.
+type telegrafWriter struct {
+	http.ResponseWriter
+}
+
+func (w telegrafWriter) WriteHeader(code int) {
+	if code == http.StatusAccepted {
+		code = http.StatusNoContent
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
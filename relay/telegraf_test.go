@@ -0,0 +1,348 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestHTTP returns a relay writing to a backend counting its posts, the
+// backend must be closed
+func newTestHTTP(t *testing.T, cfg HTTPConfig) (*HTTP, *httptest.Server, *int64) {
+	return newTestHTTPBackend(t, cfg, HTTPOutputConfig{}, http.StatusNoContent, "")
+}
+
+// newTestHTTPBackend is newTestHTTP with a backend answering status and
+// body, and the settings of out for its output
+func newTestHTTPBackend(t *testing.T, cfg HTTPConfig, out HTTPOutputConfig, status int, body string) (*HTTP, *httptest.Server, *int64) {
+	var posts int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		if body != "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+
+	cfg.Name = "test"
+	cfg.Addr = "127.0.0.1:0"
+	out.Name = "local"
+	out.Location = backend.URL + "/write"
+	cfg.Outputs = []HTTPOutputConfig{out}
+
+	r, err := NewHTTP(cfg)
+	if err != nil {
+		backend.Close()
+		t.Fatal(err)
+	}
+	return r.(*HTTP), backend, &posts
+}
+
+func serveTest(h *HTTP, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// checkError checks an error the way Telegraf reads it: the status, the
+// error of the JSON body and the X-Influxdb-Error header
+func checkError(t *testing.T, w *httptest.ResponseRecorder, code int, message string) {
+	t.Helper()
+
+	if w.Code != code {
+		t.Fatalf("status %d, want %d", w.Code, code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid error body %q: %v", w.Body.String(), err)
+	}
+	if !strings.Contains(body.Error, message) {
+		t.Errorf("error %q, want it to mention %q", body.Error, message)
+	}
+	if h := w.Header().Get("X-Influxdb-Error"); h != body.Error {
+		t.Errorf("X-Influxdb-Error %q, want %q", h, body.Error)
+	}
+}
+
+func TestTelegrafBodyTooLarge(t *testing.T) {
+	h, backend, posts := newTestHTTP(t, HTTPConfig{MaxBodySizeKB: 1})
+	defer backend.Close()
+	body := strings.Repeat("cpu value=1\n", 100)
+
+	w := serveTest(h, httptest.NewRequest("POST", "/write?db=telegraf", strings.NewReader(body)))
+	checkError(t, w, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+
+	// the limit is on the decompressed body
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(body))
+	zw.Close()
+	if gz.Len() > KB {
+		t.Fatalf("compressed body of %d bytes", gz.Len())
+	}
+
+	r := httptest.NewRequest("POST", "/write?db=telegraf", &gz)
+	r.Header.Set("Content-Encoding", "GZIP")
+	checkError(t, serveTest(h, r), http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+
+	if n := atomic.LoadInt64(posts); n != 0 {
+		t.Errorf("%d posts to the backend, want none", n)
+	}
+}
+
+func TestTelegrafErrorBody(t *testing.T) {
+	h, backend, _ := newTestHTTP(t, HTTPConfig{MaxLineLength: 16})
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		code    int
+		message string
+	}{
+		{"missing database", "POST", "/write", "cpu value=1", http.StatusBadRequest, "missing parameter: db"},
+		{"line too long", "POST", "/write?db=telegraf", "cpu,host=server01 value=1", http.StatusBadRequest, "unable to parse"},
+		{"invalid method", "GET", "/write?db=telegraf", "", http.StatusMethodNotAllowed, "invalid write method"},
+		{"invalid endpoint", "POST", "/read?db=telegraf", "cpu value=1", http.StatusNotFound, "invalid write endpoint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(h, httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body)))
+			checkError(t, w, tt.code, tt.message)
+			if w.Header().Get("X-Influxdb-Version") == "" {
+				t.Error("no X-Influxdb-Version header")
+			}
+		})
+	}
+}
+
+func TestTelegrafPing(t *testing.T) {
+	h, backend, _ := newTestHTTP(t, HTTPConfig{})
+	defer backend.Close()
+
+	w := serveTest(h, httptest.NewRequest("GET", "/ping", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w.Header().Get("X-Influxdb-Version") == "" {
+		t.Error("no X-Influxdb-Version header")
+	}
+}
+
+func TestTelegrafUserAgent(t *testing.T) {
+	tests := []struct {
+		agent string
+		want  bool
+	}{
+		{"Telegraf/1.4.0", true},
+		{"Telegraf/1.30.1 Go/1.22.2", true},
+		{"telegraf", false},
+		{"influxdb-client-go/2.12.3", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/write", nil)
+		r.Header.Set("User-Agent", tt.agent)
+		if got := isTelegraf(r); got != tt.want {
+			t.Errorf("isTelegraf(%q) = %v, want %v", tt.agent, got, tt.want)
+		}
+	}
+}
+
+func TestTelegrafAccepted(t *testing.T) {
+	for _, code := range []int{http.StatusAccepted, http.StatusNoContent, http.StatusBadRequest, http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		telegrafWriter{rec}.WriteHeader(code)
+
+		want := code
+		if code == http.StatusAccepted {
+			want = http.StatusNoContent
+		}
+		if rec.Code != want {
+			t.Errorf("status %d answered as %d, want %d", code, rec.Code, want)
+		}
+	}
+}
+
+// telegrafAction is what the influxdb outputs of Telegraf do with a batch
+// once its write is answered
+type telegrafAction string
+
+const (
+	telegrafWritten telegrafAction = "written"
+	telegrafDropped telegrafAction = "dropped"
+	telegrafRetried telegrafAction = "retried"
+	telegrafSplit   telegrafAction = "split"
+)
+
+// telegrafVersion is a release of Telegraf, the endpoint its output writes
+// to, and how it reads the answers after the retry rules of that release
+type telegrafVersion struct {
+	name   string
+	path   string
+	action func(code int, message string) telegrafAction
+}
+
+var telegrafVersions = []telegrafVersion{
+	// the influxdb output used the InfluxDB client, which takes a 200 or a
+	// 204, and only dropped the batches with a field type conflict
+	{"1.4.0", "/write?db=telegraf", func(code int, message string) telegrafAction {
+		switch {
+		case code == http.StatusOK || code == http.StatusNoContent:
+			return telegrafWritten
+		case strings.Contains(message, "field type conflict"):
+			return telegrafDropped
+		}
+		return telegrafRetried
+	}},
+	{"1.10.0", "/write?db=telegraf", telegrafInfluxDBAction},
+	{"1.30.1", "/write?db=telegraf", telegrafInfluxDBAction},
+	// the influxdb_v2 output takes any 2xx, splits the batches answered
+	// with a 413, and drops the ones answered with another 4xx but the
+	// authentication and rate limiting ones
+	{"1.30.1 influxdb_v2", "/api/v2/write?bucket=telegraf&org=telegraf", func(code int, message string) telegrafAction {
+		switch {
+		case code/100 == 2:
+			return telegrafWritten
+		case code == http.StatusRequestEntityTooLarge:
+			return telegrafSplit
+		case code == http.StatusUnauthorized, code == http.StatusForbidden, code == http.StatusTooManyRequests:
+			return telegrafRetried
+		case code/100 == 4:
+			return telegrafDropped
+		}
+		return telegrafRetried
+	}},
+}
+
+// telegrafInfluxDBAction reads the answers the way the influxdb output does
+// since it has its own client: only a 204 is written, and the batches whose
+// points can't be written whatever the retries are dropped
+func telegrafInfluxDBAction(code int, message string) telegrafAction {
+	if code == http.StatusNoContent || strings.Contains(message, "hinted handoff queue not empty") {
+		return telegrafWritten
+	}
+	for _, s := range []string{"partial write", "points beyond retention policy", "unable to parse"} {
+		if strings.Contains(message, s) {
+			return telegrafDropped
+		}
+	}
+	return telegrafRetried
+}
+
+// TestTelegrafVersions checks that every release of Telegraf does with the
+// answers of the relay what it does with the ones of InfluxDB
+func TestTelegrafVersions(t *testing.T) {
+	line := "cpu,host=server01 value=1\n"
+
+	tests := []struct {
+		name   string
+		cfg    HTTPConfig
+		out    HTTPOutputConfig
+		status int
+		body   string
+		write  string
+
+		// by release, every release of Telegraf does the same when nil
+		want   map[string]telegrafAction
+		action telegrafAction
+	}{
+		{
+			name:   "written",
+			status: http.StatusNoContent,
+			write:  line,
+			action: telegrafWritten,
+		},
+		{
+			// the 202 of a write held by a retry buffer would be retried
+			// by the influxdb output
+			name:   "buffered",
+			cfg:    HTTPConfig{PartialSuccess: partialSuccessAccepted},
+			out:    HTTPOutputConfig{BufferSizeMB: 1},
+			status: http.StatusServiceUnavailable,
+			write:  line,
+			action: telegrafWritten,
+		},
+		{
+			name:   "backend unavailable",
+			status: http.StatusServiceUnavailable,
+			write:  line,
+			action: telegrafRetried,
+		},
+		{
+			name:   "field type conflict",
+			status: http.StatusBadRequest,
+			body:   `{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=1"}`,
+			write:  "cpu,host=server01 value=1i\n",
+			action: telegrafDropped,
+		},
+		{
+			name:   "unparsable line",
+			cfg:    HTTPConfig{MaxLineLength: 16},
+			status: http.StatusNoContent,
+			write:  line,
+			want: map[string]telegrafAction{
+				"1.4.0":              telegrafRetried,
+				"1.10.0":             telegrafDropped,
+				"1.30.1":             telegrafDropped,
+				"1.30.1 influxdb_v2": telegrafDropped,
+			},
+		},
+		{
+			name:   "body too large",
+			cfg:    HTTPConfig{MaxBodySizeKB: 1},
+			status: http.StatusNoContent,
+			write:  strings.Repeat(line, 100),
+			want: map[string]telegrafAction{
+				"1.4.0":              telegrafRetried,
+				"1.10.0":             telegrafRetried,
+				"1.30.1":             telegrafRetried,
+				"1.30.1 influxdb_v2": telegrafSplit,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, backend, _ := newTestHTTPBackend(t, tt.cfg, tt.out, tt.status, tt.body)
+			defer backend.Close()
+			defer h.close()
+
+			for _, v := range telegrafVersions {
+				r := httptest.NewRequest("POST", v.path, strings.NewReader(tt.write))
+				r.Header.Set("User-Agent", "Telegraf/"+strings.Fields(v.name)[0])
+				w := serveTest(h, r)
+
+				var body struct {
+					Error   string `json:"error"`
+					Message string `json:"message"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &body)
+
+				want := tt.action
+				if tt.want != nil {
+					want = tt.want[v.name]
+				}
+				if got := v.action(w.Code, body.Error+body.Message); got != want {
+					t.Errorf("Telegraf %s: %s on status %d and body %q, want %s", v.name, got, w.Code, w.Body.String(), want)
+				}
+			}
+		})
+	}
+}
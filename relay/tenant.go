@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Tenants are HTTP relays created from a template, either with a listener
+// of their own or served under a path prefix on the listener of the
+// template, e.g. /acme/write. The template holds everything the tenants
+// share (outputs, transformations, limits), the tenant its name, address,
+// database and rate limits.
+
+type tenantTemplate struct {
+	cfg HTTPConfig
+
+	// mux serves the tenants without a listener of their own, nil when the
+	// template has no bind-addr
+	mux *sharedListener
+}
+
+func (s *Service) addTemplate(cfg HTTPConfig) error {
+	if cfg.Name == "" {
+		return errors.New("missing http-template name")
+	}
+	if s.templates[cfg.Name] != nil {
+		return fmt.Errorf("duplicate http-template: %q", cfg.Name)
+	}
+
+	t := &tenantTemplate{cfg: cfg}
+	if cfg.Addr != "" {
+		cert, err := newServerCert(cfg)
+		if err != nil {
+			return err
+		}
+		ca, err := newClientAuth(cfg, cert)
+		if err != nil {
+			return err
+		}
+		sc, err := newServerConfig(cfg)
+		if err != nil {
+			return err
+		}
+		m, err := s.listener(cfg.Addr, cert, ca, cfg.AcceptProxyProtocol, cfg.ReusePort, sc, cfg.VirtualHost != "")
+		if err != nil {
+			return err
+		}
+		t.mux = m
+	}
+
+	s.templates[cfg.Name] = t
+	return nil
+}
+
+// httpConfig returns the configuration of the relay of tenant
+func (t *tenantTemplate) httpConfig(tenant TenantConfig) HTTPConfig {
+	cfg := t.cfg
+	// newHTTPBackend fills in the missing output names, the template must
+	// not be shared with the relays
+	cfg.Outputs = append([]HTTPOutputConfig(nil), t.cfg.Outputs...)
+
+	cfg.Name = tenant.Name
+	cfg.Addr = tenant.Addr
+	cfg.PathPrefix = ""
+	if tenant.Database != "" {
+		cfg.Database = tenant.Database
+	}
+	if tenant.RateLimit > 0 {
+		cfg.RateLimit = tenant.RateLimit
+	}
+	if tenant.RateBurst > 0 {
+		cfg.RateBurst = tenant.RateBurst
+	}
+	return cfg
+}
+
+// AddTenant creates the relay of a tenant from its template and adds it to
+// the service
+func (s *Service) AddTenant(cfg TenantConfig) error {
+	t := s.templates[cfg.Template]
+	if t == nil {
+		return fmt.Errorf("unknown http-template: %q", cfg.Template)
+	}
+
+	if cfg.Name == "" || strings.ContainsAny(cfg.Name, "/?#") {
+		return fmt.Errorf("invalid tenant name: %q", cfg.Name)
+	}
+
+	hc := t.httpConfig(cfg)
+	var err error
+	if cfg.Addr == "" {
+		if t.mux == nil {
+			return fmt.Errorf("tenant %q has no bind-addr and http-template %q has none to share", cfg.Name, cfg.Template)
+		}
+		hc.Addr = t.mux.addr
+		err = s.addHTTP(hc, cfg.Name)
+	} else {
+		err = s.addHTTP(hc, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tenants[cfg.Name] = cfg
+	s.mu.Unlock()
+	return nil
+}
+
+// RemoveTenant stops the relay of the named tenant and removes it
+func (s *Service) RemoveTenant(name string) error {
+	s.mu.Lock()
+	_, ok := s.tenants[name]
+	delete(s.tenants, name)
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown tenant: %q", name)
+	}
+	return s.RemoveRelay(name)
+}
+
+// Tenants returns the configuration of the tenants of the service
+func (s *Service) Tenants() []TenantConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenants := make([]TenantConfig, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantHeader maps the tenant identified by a request header, e.g. set by
+// an API gateway, to the database and retention policy its writes go to,
+// and optionally to some of the backends. The requests without the header
+// or of an unknown tenant are rejected.
+type tenantHeader struct {
+	header  string
+	tenants map[string]*tenantMapping
+}
+
+type tenantMapping struct {
+	database string
+	rp       string
+
+	// backends the writes of the tenant are forwarded to, all when nil
+	backends []*httpBackend
+}
+
+// newTenantHeader returns nil when tenant-header isn't set
+func newTenantHeader(cfg HTTPConfig, h *HTTP) (*tenantHeader, error) {
+	if cfg.TenantHeader == "" {
+		if len(cfg.TenantMap) > 0 {
+			return nil, errors.New("tenant-map requires tenant-header")
+		}
+		return nil, nil
+	}
+
+	t := &tenantHeader{
+		header:  http.CanonicalHeaderKey(strings.TrimSpace(cfg.TenantHeader)),
+		tenants: make(map[string]*tenantMapping),
+	}
+	for _, m := range cfg.TenantMap {
+		if m.Tenant == "" {
+			return nil, errors.New("tenant-map without tenant")
+		}
+		if t.tenants[m.Tenant] != nil {
+			return nil, fmt.Errorf("duplicate tenant-map of tenant %q", m.Tenant)
+		}
+		if m.Database == "" {
+			return nil, fmt.Errorf("tenant-map of tenant %q without database", m.Tenant)
+		}
+
+		tm := &tenantMapping{database: m.Database, rp: m.RetentionPolicy}
+		for _, o := range m.Outputs {
+			var found *httpBackend
+			for _, b := range h.backends {
+				if b.name == o {
+					found = b
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("tenant-map of tenant %q to unknown output %q", m.Tenant, o)
+			}
+			tm.backends = append(tm.backends, found)
+		}
+		// the acknowledgment parity is of every backend
+		if tm.backends != nil && h.migration != nil {
+			return nil, fmt.Errorf("tenant-map outputs of tenant %q can't be used with a migration", m.Tenant)
+		}
+
+		t.tenants[m.Tenant] = tm
+	}
+	return t, nil
+}
+
+// tenant returns the mapping of the tenant of r, nil if unknown
+func (t *tenantHeader) tenant(r *http.Request) *tenantMapping {
+	return t.tenants[strings.TrimSpace(r.Header.Get(t.header))]
+}
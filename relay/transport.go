@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxIdleConnsPerHost is the number of idle connections kept open
+	// to a backend. The default of net/http (2) is too low for thousands of
+	// writes per second, most connections would be closed after their request.
+	DefaultMaxIdleConnsPerHost = 64
+
+	DefaultIdleConnTimeout = 90 * time.Second
+	DefaultDialTimeout     = 30 * time.Second
+)
+
+// transportConfig are the settings of the transport to a backend. Backends
+// with the same settings share their transport, and so their idle
+// connections when they are on the same host.
+type transportConfig struct {
+	skipTLSVerification bool
+	disableHTTP2        bool
+
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	dialTimeout         time.Duration
+}
+
+// defaultTransportConfig is used for the writes of the relay itself
+var defaultTransportConfig = transportConfig{
+	maxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+	idleConnTimeout:     DefaultIdleConnTimeout,
+	dialTimeout:         DefaultDialTimeout,
+}
+
+func newTransportConfig(cfg *HTTPOutputConfig) (transportConfig, error) {
+	c := defaultTransportConfig
+	c.skipTLSVerification = cfg.SkipTLSVerification
+	c.disableHTTP2 = cfg.DisableHTTP2
+
+	if cfg.MaxIdleConnsPerHost < 0 || cfg.MaxConnsPerHost < 0 {
+		return c, fmt.Errorf("negative connection limit for backend %q", cfg.Name)
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		c.maxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	c.maxConnsPerHost = cfg.MaxConnsPerHost
+	if err := checkConnLimits(c); err != nil {
+		return c, err
+	}
+
+	if cfg.IdleConnTimeout != "" {
+		d, err := time.ParseDuration(cfg.IdleConnTimeout)
+		if err != nil {
+			return c, fmt.Errorf("error parsing idle connection timeout '%v'", err)
+		}
+		c.idleConnTimeout = d
+	}
+	if cfg.DialTimeout != "" {
+		d, err := time.ParseDuration(cfg.DialTimeout)
+		if err != nil {
+			return c, fmt.Errorf("error parsing dial timeout '%v'", err)
+		}
+		c.dialTimeout = d
+	}
+	return c, nil
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[transportConfig]*http.Transport)
+)
+
+// sharedTransport returns the transport of the settings c
+func sharedTransport(c transportConfig) *http.Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if t, ok := transports[c]; ok {
+		return t
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// Used for support skip-tls-verification option
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: c.skipTLSVerification,
+		},
+		Dial: (&net.Dialer{
+			Timeout:   c.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: DefaultHTTPTimeout,
+		MaxIdleConnsPerHost: c.maxIdleConnsPerHost,
+	}
+	setConnLimits(t, c)
+	if !c.disableHTTP2 {
+		// negotiated by ALPN, backends without HTTP/2 and plain http
+		// locations keep using HTTP/1.1
+		enableHTTP2(t)
+	}
+
+	transports[c] = t
+	return t
+}
@@ -0,0 +1,10 @@
+//go:build !go1.13
+// +build !go1.13
+
+package relay
+
+import "net/http"
+
+// enableHTTP2 does nothing before Go 1.13, a transport with a custom TLS
+// configuration can't attempt HTTP/2 without golang.org/x/net/http2
+func enableHTTP2(t *http.Transport) {}
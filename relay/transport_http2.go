@@ -0,0 +1,12 @@
+//go:build go1.13
+// +build go1.13
+
+package relay
+
+import "net/http"
+
+// enableHTTP2 offers HTTP/2 to the backends, which net/http doesn't do on its
+// own for a transport with a custom TLS configuration
+func enableHTTP2(t *http.Transport) {
+	t.ForceAttemptHTTP2 = true
+}
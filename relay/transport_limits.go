@@ -0,0 +1,17 @@
+//go:build go1.11
+// +build go1.11
+
+package relay
+
+import "net/http"
+
+func checkConnLimits(c transportConfig) error {
+	return nil
+}
+
+// setConnLimits applies the settings of c net/http only has in recent
+// versions
+func setConnLimits(t *http.Transport, c transportConfig) {
+	t.IdleConnTimeout = c.idleConnTimeout
+	t.MaxConnsPerHost = c.maxConnsPerHost
+}
@@ -0,0 +1,22 @@
+//go:build !go1.11
+// +build !go1.11
+
+package relay
+
+import (
+	"errors"
+	"net/http"
+)
+
+// checkConnLimits rejects max-conns-per-host, which net/http doesn't
+// support before Go 1.11
+func checkConnLimits(c transportConfig) error {
+	if c.maxConnsPerHost > 0 {
+		return errors.New("max-conns-per-host requires a relay built with Go 1.11 or later")
+	}
+	return nil
+}
+
+// setConnLimits does nothing before Go 1.11, idle connections are kept
+// until the backend closes them
+func setConnLimits(t *http.Transport, c transportConfig) {}
@@ -3,8 +3,10 @@ package relay
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,6 +16,15 @@ import (
 
 const (
 	defaultMTU = 1024
+
+	DefaultUDPFlushInterval = time.Second
+	DefaultUDPBatchSizeKB   = 64
+
+	// the kernel drops are checked, and the read buffer raised, every
+	// udpTuneInterval. The read buffer is assumed to be the usual default
+	// of linux when not set.
+	udpTuneInterval      = 10 * time.Second
+	udpDefaultReadBuffer = 208 * KB
 )
 
 // UDP is a relay for UDP influxdb writes
@@ -22,11 +33,56 @@ type UDP struct {
 	name      string
 	precision string
 
+	limit   *lineLimit
+	sampler *udpSampler
+
+	// size of the read buffer, raised up to readBufferMax when the kernel
+	// drops datagrams
+	readBuffer    int64
+	readBufferMax int64
+
 	closing int64
 	l       *net.UDPConn
 	c       *net.UDPConn
 
 	backends []*udpBackend
+
+	// HTTP backends the datagrams are posted to in batches, along with the
+	// number of datagrams each of them wrote or lost
+	query         string
+	batchSize     int
+	flushInterval time.Duration
+	httpOutputs   []*httpBackend
+	httpStats     []*udpHTTPStats
+
+	stats udpStats
+}
+
+// udpStats counts the datagrams received by a UDP relay, and those dropped
+// before reaching the backends
+type udpStats struct {
+	received   int64
+	queueFull  int64
+	unparsable int64
+
+	// datagrams dropped by the kernel since the start of the relay, -1
+	// when unknown
+	kernel int64
+
+	// datagrams and points dropped by the sampling
+	sampled       int64
+	sampledPoints int64
+
+	// batches posted to the HTTP backends, and the datagrams they held
+	batches int64
+	batched int64
+}
+
+// udpHTTPStats counts the datagrams of the batches an HTTP backend wrote,
+// and of those it failed to write
+type udpHTTPStats struct {
+	written int64
+	lost    int64
 }
 
 func NewUDP(config UDPConfig) (Relay, error) {
@@ -35,8 +91,14 @@ func NewUDP(config UDPConfig) (Relay, error) {
 	u.name = config.Name
 	u.addr = config.Addr
 	u.precision = config.Precision
+	u.limit = newLineLimit(config.MaxLineLength, config.TruncateLongLines)
+	u.sampler = newUDPSampler(config.SampleRate, config.SampleRates)
 
-	l, err := net.ListenPacket("udp", u.addr)
+	if err := checkReusePort(config.ReusePort); err != nil {
+		return nil, err
+	}
+
+	l, err := listenPacket("udp", u.addr, config.ReusePort)
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +113,12 @@ func NewUDP(config UDPConfig) (Relay, error) {
 			return nil, err
 		}
 	}
+	u.readBuffer = int64(config.ReadBuffer)
+	if u.readBuffer == 0 {
+		u.readBuffer = udpDefaultReadBuffer
+	}
+	u.readBufferMax = int64(config.ReadBufferMax)
+	u.stats.kernel = -1
 
 	u.l = ul
 
@@ -71,12 +139,78 @@ func NewUDP(config UDPConfig) (Relay, error) {
 			cfg.MTU = defaultMTU
 		}
 
+		// a buffered backend keeps the datagrams until its location
+		// resolves
 		addr, err := net.ResolveUDPAddr("udp", cfg.Location)
+		if err != nil && cfg.BufferSizeKB <= 0 {
+			return nil, err
+		}
+
+		b := &udpBackend{
+			u:         u,
+			name:      cfg.Name,
+			addr:      addr,
+			mtu:       cfg.MTU,
+			precision: cfg.Precision,
+			location:  cfg.Location,
+		}
+		if b.precision == "" {
+			b.precision = u.precision
+		}
+
+		if cfg.BufferSizeKB > 0 {
+			max := DefaultMaxDelayInterval
+			if cfg.MaxDelayInterval != "" {
+				m, err := time.ParseDuration(cfg.MaxDelayInterval)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing max retry time %v", err)
+				}
+				max = m
+			}
+			b.retry = newUDPRetry(b, cfg.BufferSizeKB*KB, max)
+		}
+
+		u.backends = append(u.backends, b)
+	}
+
+	if len(config.HTTPOutputs) > 0 {
+		if config.Database == "" {
+			return nil, fmt.Errorf("udp relay %q has http outputs but no database", u.Name())
+		}
+
+		q := url.Values{}
+		q.Set("db", config.Database)
+		if config.RetentionPolicy != "" {
+			q.Set("rp", config.RetentionPolicy)
+		}
+		if u.precision != "" {
+			q.Set("precision", u.precision)
+		}
+		u.query = q.Encode()
+
+		u.batchSize = DefaultUDPBatchSizeKB * KB
+		if config.BatchSizeKB > 0 {
+			u.batchSize = config.BatchSizeKB * KB
+		}
+
+		u.flushInterval = DefaultUDPFlushInterval
+		if config.FlushInterval != "" {
+			d, err := time.ParseDuration(config.FlushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing flush interval '%v'", err)
+			}
+			u.flushInterval = d
+		}
+	}
+
+	for i := range config.HTTPOutputs {
+		backend, err := newHTTPBackend(&config.HTTPOutputs[i])
 		if err != nil {
 			return nil, err
 		}
 
-		u.backends = append(u.backends, &udpBackend{u, cfg.Name, addr, cfg.MTU})
+		u.httpOutputs = append(u.httpOutputs, backend)
+		u.httpStats = append(u.httpStats, new(udpHTTPStats))
 	}
 
 	return u, nil
@@ -117,16 +251,17 @@ func (u *UDP) Run() error {
 
 	// arbitrary queue size for now
 	queue := make(chan packet, 1024)
-
-	var wg sync.WaitGroup
+	done := make(chan struct{})
 
 	go func() {
-		for p := range queue {
-			u.post(&p)
-			wg.Done()
-		}
+		defer close(done)
+		u.process(queue)
 	}()
 
+	stopTune := make(chan struct{})
+	defer close(stopTune)
+	go u.tune(stopTune)
+
 	log.Printf("Starting UDP relay %q on %v", u.Name(), u.l.LocalAddr())
 
 	for {
@@ -138,19 +273,147 @@ func (u *UDP) Run() error {
 				err = nil
 			}
 			close(queue)
-			wg.Wait()
+			<-done
 			return err
 		}
 		start := time.Now()
+		atomic.AddInt64(&u.stats.received, 1)
 
-		wg.Add(1)
+		if u.sampler != nil && !u.sampler.keepDatagram() {
+			atomic.AddInt64(&u.stats.sampled, 1)
+			continue
+		}
 
 		// copy the data into a buffer and queue it for processing
 		b := getUDPBuf()
 		b.Grow(n)
 		// bytes.Buffer.Write always returns a nil error, and will panic if out of memory
 		_, _ = b.Write(buf[:n])
-		queue <- packet{start, b, remote}
+
+		// the datagrams received while the queue is full are dropped here
+		// rather than by the kernel, so that they're accounted for
+		select {
+		case queue <- packet{start, b, remote}:
+		default:
+			atomic.AddInt64(&u.stats.queueFull, 1)
+			putUDPBuf(b)
+		}
+	}
+}
+
+// process handles the queued packets, and posts them to the HTTP backends
+// in batches, whenever the batch grows past batchSize or every flushInterval
+func (u *UDP) process(queue <-chan packet) {
+	var tick <-chan time.Time
+	if len(u.httpOutputs) > 0 {
+		ticker := time.NewTicker(u.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := getBuf()
+	n := 0
+	for {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				u.flush(batch, n)
+				return
+			}
+
+			if u.post(&p, batch) {
+				n++
+			}
+			if batch.Len() >= u.batchSize {
+				u.flush(batch, n)
+				batch, n = getBuf(), 0
+			}
+
+		case <-tick:
+			if n > 0 {
+				u.flush(batch, n)
+				batch, n = getBuf(), 0
+			}
+		}
+	}
+}
+
+// flush posts a batch of n datagrams to every HTTP backend without waiting
+// for them, the buffer is returned to the pool once all of them are done
+func (u *UDP) flush(batch *bytes.Buffer, n int) {
+	if n == 0 || len(u.httpOutputs) == 0 {
+		putBuf(batch)
+		return
+	}
+
+	atomic.AddInt64(&u.stats.batches, 1)
+	atomic.AddInt64(&u.stats.batched, int64(n))
+
+	pl := newPayload(batch)
+	defer pl.release()
+
+	for i, b := range u.httpOutputs {
+		b, stats := b, u.httpStats[i]
+		pl.retain()
+		go func() {
+			defer pl.release()
+			resp, err := b.post(pl, u.query, "")
+			if err == nil && resp.StatusCode/100 == 2 {
+				atomic.AddInt64(&stats.written, int64(n))
+			} else {
+				atomic.AddInt64(&stats.lost, int64(n))
+			}
+			b.observe(u.Name(), resp, err)
+		}()
+	}
+}
+
+func (u *UDP) httpBackends() []*httpBackend {
+	return u.httpOutputs
+}
+
+// tune keeps the count of the datagrams dropped by the kernel, and doubles
+// the read buffer up to readBufferMax whenever it dropped some
+func (u *UDP) tune(stop <-chan struct{}) {
+	port := u.l.LocalAddr().(*net.UDPAddr).Port
+	base, ok := udpKernelDrops(port)
+	if !ok {
+		return
+	}
+	atomic.StoreInt64(&u.stats.kernel, 0)
+
+	t := time.NewTicker(udpTuneInterval)
+	defer t.Stop()
+
+	last := base
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		drops, ok := udpKernelDrops(port)
+		if !ok {
+			continue
+		}
+		atomic.StoreInt64(&u.stats.kernel, drops-base)
+
+		current := atomic.LoadInt64(&u.readBuffer)
+		if drops > last && current < u.readBufferMax {
+			size := current * 2
+			if size > u.readBufferMax {
+				size = u.readBufferMax
+			}
+			if err := u.l.SetReadBuffer(int(size)); err != nil {
+				log.Printf("Problem raising the read buffer of UDP relay %q to %d bytes: %v", u.Name(), size, err)
+				u.readBufferMax = current
+			} else {
+				log.Printf("Raised the read buffer of UDP relay %q to %d bytes, %d datagrams were dropped by the kernel", u.Name(), size, drops-last)
+				atomic.StoreInt64(&u.readBuffer, size)
+			}
+		}
+		last = drops
 	}
 }
 
@@ -159,39 +422,142 @@ func (u *UDP) Stop() error {
 	return u.l.Close()
 }
 
-func (u *UDP) post(p *packet) {
-	points, err := models.ParsePointsWithPrecision(p.data.Bytes(), p.timestamp, u.precision)
+// post writes a packet to the UDP backends and appends it to batch for the
+// HTTP ones, it reports whether the packet was added to the batch
+func (u *UDP) post(p *packet, batch *bytes.Buffer) bool {
+	data, long := u.limit.apply(p.data.Bytes(), p.timestamp, u.precision)
+	if len(long) > 0 {
+		log.Printf("Dropped %d lines exceeding max-line-length in relay %q from %v", len(long), u.Name(), p.from)
+	}
+
+	points, err := models.ParsePointsWithPrecision(data, p.timestamp, u.precision)
 	if err != nil {
 		log.Printf("Error parsing packet in relay %q from %v: %v", u.Name(), p.from, err)
+		atomic.AddInt64(&u.stats.unparsable, 1)
 		putUDPBuf(p.data)
-		return
+		return false
 	}
 
+	lines := rawLines{data}
+	reuse := lines.count() == len(points)
+
 	out := getUDPBuf()
+	out.Grow(len(data))
+	kept := points[:0]
 	for _, pt := range points {
-		if _, err = out.WriteString(pt.PrecisionString(u.precision)); err != nil {
-			break
+		var line []byte
+		if reuse {
+			line = lines.next()
 		}
-		if err = out.WriteByte('\n'); err != nil {
-			break
+		if u.sampler != nil && !u.sampler.keepPoint(pt.Name()) {
+			atomic.AddInt64(&u.stats.sampledPoints, 1)
+			continue
+		}
+		kept = append(kept, pt)
+
+		if reuse {
+			writeLine(out, line, pt, u.precision)
+		} else {
+			writePoint(out, pt, u.precision)
 		}
 	}
+	points = kept
 
 	putUDPBuf(p.data)
 
-	if err != nil {
-		putUDPBuf(out)
-		log.Printf("Error writing points in relay %q: %v", u.Name(), err)
-		return
-	}
-
+	// the points are serialized once per precision of the backends which
+	// differs from the one of the relay
+	var converted map[string]*bytes.Buffer
 	for _, b := range u.backends {
-		if err := b.post(out.Bytes()); err != nil {
+		data := out.Bytes()
+		if precisionMultiplier(b.precision) != precisionMultiplier(u.precision) {
+			c := converted[b.precision]
+			if c == nil {
+				c = getUDPBuf()
+				for _, pt := range points {
+					writePoint(c, pt, b.precision)
+				}
+				if converted == nil {
+					converted = make(map[string]*bytes.Buffer)
+				}
+				converted[b.precision] = c
+			}
+			data = c.Bytes()
+		}
+
+		if err := b.post(data); err != nil {
 			log.Printf("Error writing points in relay %q to backend %q: %v", u.Name(), b.name, err)
 		}
 	}
+	for _, c := range converted {
+		putUDPBuf(c)
+	}
+
+	added := len(u.httpOutputs) > 0 && out.Len() > 0
+	if added {
+		batch.Write(out.Bytes())
+	}
 
 	putUDPBuf(out)
+	return added
+}
+
+// udpStatsInfo is the accounting of a UDP relay reported by /udp-stats
+type udpStatsInfo struct {
+	Received          int64   `json:"received"`
+	DroppedQueueFull  int64   `json:"dropped_queue_full"`
+	DroppedUnparsable int64   `json:"dropped_unparsable"`
+	DroppedKernel     int64   `json:"dropped_kernel"`
+	DroppedSampled    int64   `json:"dropped_sampled"`
+	SampledPoints     int64   `json:"dropped_sampled_points"`
+	ReadBuffer        int64   `json:"read_buffer"`
+	HTTPBatches       int64   `json:"http_batches"`
+	HTTPBatched       int64   `json:"http_batched"`
+	DatagramsPerBatch float64 `json:"datagrams_per_batch"`
+
+	// written and lost datagrams, per HTTP backend
+	HTTPOutputs map[string]map[string]int64 `json:"http_outputs,omitempty"`
+
+	// buffers of the buffered UDP backends
+	Outputs map[string]udpRetryInfo `json:"outputs,omitempty"`
+}
+
+func (u *UDP) statsInfo() udpStatsInfo {
+	s := udpStatsInfo{
+		Received:          atomic.LoadInt64(&u.stats.received),
+		DroppedQueueFull:  atomic.LoadInt64(&u.stats.queueFull),
+		DroppedUnparsable: atomic.LoadInt64(&u.stats.unparsable),
+		DroppedKernel:     atomic.LoadInt64(&u.stats.kernel),
+		DroppedSampled:    atomic.LoadInt64(&u.stats.sampled),
+		SampledPoints:     atomic.LoadInt64(&u.stats.sampledPoints),
+		ReadBuffer:        atomic.LoadInt64(&u.readBuffer),
+		HTTPBatches:       atomic.LoadInt64(&u.stats.batches),
+		HTTPBatched:       atomic.LoadInt64(&u.stats.batched),
+	}
+	if s.HTTPBatches > 0 {
+		s.DatagramsPerBatch = float64(s.HTTPBatched) / float64(s.HTTPBatches)
+	}
+
+	if len(u.httpOutputs) > 0 {
+		s.HTTPOutputs = make(map[string]map[string]int64)
+		for i, b := range u.httpOutputs {
+			s.HTTPOutputs[b.name] = map[string]int64{
+				"written": atomic.LoadInt64(&u.httpStats[i].written),
+				"lost":    atomic.LoadInt64(&u.httpStats[i].lost),
+			}
+		}
+	}
+
+	for _, b := range u.backends {
+		if b.retry == nil {
+			continue
+		}
+		if s.Outputs == nil {
+			s.Outputs = make(map[string]udpRetryInfo)
+		}
+		s.Outputs[b.name] = b.retry.info()
+	}
+	return s
 }
 
 type udpBackend struct {
@@ -199,26 +565,56 @@ type udpBackend struct {
 	name string
 	addr *net.UDPAddr
 	mtu  int
+
+	precision string
+
+	// location is resolved again on every send until it succeeds when it
+	// couldn't be at startup, only for buffered backends
+	location string
+
+	// buffer of the datagrams which couldn't be sent, nil when disabled
+	retry *udpRetry
 }
 
 var errPacketTooLarge = errors.New("payload larger than MTU")
 
 func (b *udpBackend) post(data []byte) error {
+	if b.retry != nil {
+		return b.retry.post(data)
+	}
+	_, err := b.send(data)
+	return err
+}
+
+// send writes data in datagrams of at most mtu bytes, split on line
+// boundaries, and returns what wasn't sent when it fails
+func (b *udpBackend) send(data []byte) ([]byte, error) {
+	if b.addr == nil {
+		addr, err := net.ResolveUDPAddr("udp", b.location)
+		if err != nil {
+			return data, err
+		}
+		b.addr = addr
+	}
+
 	var err error
 	for len(data) > b.mtu {
 		// find the last line that will fit within the MTU
 		idx := bytes.LastIndexByte(data[:b.mtu], '\n')
 		if idx < 0 {
 			// first line is larger than MTU
-			return errPacketTooLarge
+			return data, errPacketTooLarge
 		}
 		_, err = b.u.c.WriteToUDP(data[:idx+1], b.addr)
 		if err != nil {
-			return err
+			return data, err
 		}
 		data = data[idx+1:]
 	}
 
 	_, err = b.u.c.WriteToUDP(data, b.addr)
-	return err
+	if err != nil {
+		return data, err
+	}
+	return nil, nil
 }
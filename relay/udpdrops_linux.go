@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package relay
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// udpKernelDrops returns the datagrams dropped by the kernel for the UDP
+// sockets bound to port, as reported by the last column of /proc/net/udp
+// and /proc/net/udp6, mostly because their receive buffer was full
+func udpKernelDrops(port int) (int64, bool) {
+	var drops int64
+	found := false
+	for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+
+		s := bufio.NewScanner(f)
+		s.Scan() // header
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 13 {
+				continue
+			}
+
+			// local_address is hex ip:port
+			i := strings.LastIndex(fields[1], ":")
+			p, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+			if err != nil || int(p) != port {
+				continue
+			}
+
+			n, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err != nil {
+				continue
+			}
+			drops += n
+			found = true
+		}
+		f.Close()
+	}
+	return drops, found
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package relay
+
+// udpKernelDrops isn't known outside of linux
+func udpKernelDrops(port int) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpRetry buffers the datagrams a UDP backend failed to send (e.g. with
+// ENOBUFS, or as its location couldn't be resolved), up to maxSize bytes,
+// and sends them again in order. The datagrams which don't fit in the
+// buffer are dropped. Unlike the HTTP retry buffer the writes don't wait
+// for the datagrams to be sent, the relay never answers them.
+type udpRetry struct {
+	b           *udpBackend
+	maxSize     int
+	maxInterval time.Duration
+
+	cond      *sync.Cond
+	queue     [][]byte
+	size      int
+	buffering bool
+
+	// datagrams sent after a failure, and dropped as the buffer was full
+	retried int64
+	dropped int64
+}
+
+func newUDPRetry(b *udpBackend, size int, max time.Duration) *udpRetry {
+	r := &udpRetry{
+		b:           b,
+		maxSize:     size,
+		maxInterval: max,
+		cond:        sync.NewCond(new(sync.Mutex)),
+	}
+	go r.run()
+	return r
+}
+
+// post sends data right away unless earlier datagrams are still waiting to
+// be sent, and buffers what couldn't be sent
+func (r *udpRetry) post(data []byte) error {
+	r.cond.L.Lock()
+	buffering := r.buffering
+	r.cond.L.Unlock()
+
+	if !buffering {
+		rest, err := r.b.send(data)
+		if err == nil || err == errPacketTooLarge {
+			return err
+		}
+		data = rest
+	}
+
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+
+	if r.size+len(data) > r.maxSize {
+		atomic.AddInt64(&r.dropped, 1)
+		return ErrBufferFull
+	}
+
+	r.queue = append(r.queue, append([]byte(nil), data...))
+	r.size += len(data)
+	r.buffering = true
+	r.cond.Signal()
+	return nil
+}
+
+// run sends the buffered datagrams one at a time, the delay between the
+// attempts doubling after every failure up to maxInterval
+func (r *udpRetry) run() {
+	interval := retryInitial
+	for {
+		r.cond.L.Lock()
+		for len(r.queue) == 0 {
+			// the next writes are sent by post again
+			r.buffering = false
+			r.cond.Wait()
+		}
+		data := r.queue[0]
+		r.cond.L.Unlock()
+
+		rest, err := r.b.send(data)
+
+		r.cond.L.Lock()
+		if err == nil || err == errPacketTooLarge {
+			r.queue[0] = nil
+			r.queue = r.queue[1:]
+			r.size -= len(data)
+		} else {
+			// the lines which were sent aren't sent again
+			r.queue[0] = rest
+			r.size -= len(data) - len(rest)
+		}
+		r.cond.L.Unlock()
+
+		switch err {
+		case nil:
+			atomic.AddInt64(&r.retried, 1)
+			interval = retryInitial
+			continue
+		case errPacketTooLarge:
+			log.Printf("Dropped a buffered datagram of backend %q: %v", r.b.name, err)
+			continue
+		}
+
+		time.Sleep(interval)
+		interval *= retryMultiplier
+		if interval > r.maxInterval {
+			interval = r.maxInterval
+		}
+	}
+}
+
+// udpRetryInfo is the state of the buffer of a UDP backend reported by /udp-stats
+type udpRetryInfo struct {
+	Buffering     bool  `json:"buffering"`
+	BufferedBytes int64 `json:"buffered_bytes"`
+	Retried       int64 `json:"retried"`
+	Dropped       int64 `json:"dropped_buffer_full"`
+}
+
+func (r *udpRetry) info() udpRetryInfo {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+
+	return udpRetryInfo{
+		Buffering:     r.buffering,
+		BufferedBytes: int64(r.size),
+		Retried:       atomic.LoadInt64(&r.retried),
+		Dropped:       atomic.LoadInt64(&r.dropped),
+	}
+}
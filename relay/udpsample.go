@@ -0,0 +1,38 @@
+package relay
+
+import "math/rand"
+
+// udpSampler down-samples the writes of a high volume UDP source: it keeps
+// 1 in rate datagrams at random, dropping the others before they're parsed,
+// and 1 in the rate of their measurement of the points of the measurements
+// with a rate of their own
+type udpSampler struct {
+	rate  int
+	rates map[string]int
+}
+
+// newUDPSampler returns nil when nothing is sampled
+func newUDPSampler(rate int, rates map[string]int) *udpSampler {
+	s := &udpSampler{rate: rate}
+	for m, r := range rates {
+		if r > 1 {
+			if s.rates == nil {
+				s.rates = make(map[string]int)
+			}
+			s.rates[m] = r
+		}
+	}
+	if s.rate <= 1 && s.rates == nil {
+		return nil
+	}
+	return s
+}
+
+func (s *udpSampler) keepDatagram() bool {
+	return s.rate <= 1 || rand.Intn(s.rate) == 0
+}
+
+func (s *udpSampler) keepPoint(measurement string) bool {
+	r, ok := s.rates[measurement]
+	return !ok || rand.Intn(r) == 0
+}
@@ -0,0 +1,220 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	DefaultUsageInterval = time.Hour
+
+	usageFormatCSV  = "csv"
+	usageFormatLine = "line"
+
+	usageMeasurement = "relay_usage"
+)
+
+// dbUsage accumulates what was written to a database during one interval
+type dbUsage struct {
+	points int64
+	bytes  int64
+	series map[string]struct{}
+}
+
+// usageExporter periodically exports the usage of every database written
+// through the HTTP relays, so the shared pipeline can be charged back
+type usageExporter struct {
+	interval time.Duration
+	format   string
+
+	file   string
+	poster poster
+	query  string
+
+	mu    sync.Mutex
+	usage map[string]*dbUsage
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newUsageExporter(cfg UsageConfig) (*usageExporter, error) {
+	u := &usageExporter{
+		interval: DefaultUsageInterval,
+		format:   cfg.Format,
+		file:     cfg.File,
+		usage:    make(map[string]*dbUsage),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing usage interval '%v'", err)
+		}
+		u.interval = d
+	}
+
+	switch u.format {
+	case "":
+		u.format = usageFormatCSV
+	case usageFormatCSV, usageFormatLine:
+	default:
+		return nil, fmt.Errorf("unknown usage format %q", u.format)
+	}
+
+	if cfg.Location != "" {
+		if cfg.Database == "" {
+			return nil, errors.New("usage export to a location requires a database")
+		}
+		u.poster = newSimplePoster(cfg.Location, DefaultHTTPTimeout, defaultTransportConfig)
+		u.query = "db=" + cfg.Database
+	}
+
+	if u.file == "" && u.poster == nil {
+		return nil, errors.New("usage export requires a file or a location")
+	}
+
+	return u, nil
+}
+
+// record accounts for a write of points, totalling size bytes, to db
+func (u *usageExporter) record(db string, points int, size int, series []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	d := u.usage[db]
+	if d == nil {
+		d = &dbUsage{series: make(map[string]struct{})}
+		u.usage[db] = d
+	}
+
+	d.points += int64(points)
+	d.bytes += int64(size)
+	for _, s := range series {
+		d.series[s] = struct{}{}
+	}
+}
+
+func (u *usageExporter) Run() error {
+	defer close(u.done)
+
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			u.export(t)
+		case <-u.closing:
+			u.export(time.Now())
+			return nil
+		}
+	}
+}
+
+func (u *usageExporter) Stop() error {
+	close(u.closing)
+	<-u.done
+	return nil
+}
+
+// export writes out the usage accumulated since the last export and resets it
+func (u *usageExporter) export(now time.Time) {
+	u.mu.Lock()
+	usage := u.usage
+	u.usage = make(map[string]*dbUsage)
+	u.mu.Unlock()
+
+	if len(usage) == 0 {
+		return
+	}
+
+	dbs := make([]string, 0, len(usage))
+	for db := range usage {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+
+	if u.file != "" {
+		if err := u.writeFile(now, dbs, usage); err != nil {
+			log.Printf("Problem exporting usage to %q: %v", u.file, err)
+		}
+	}
+
+	if u.poster != nil {
+		buf := getBuf()
+		u.writeLines(buf, now, dbs, usage)
+
+		pl := newPayload(buf)
+		resp, err := u.poster.post(pl, u.query, "")
+		pl.release()
+		if err != nil {
+			log.Printf("Problem exporting usage: %v", err)
+		} else if resp.StatusCode/100 != 2 {
+			log.Printf("Non-2xx response exporting usage: %v", resp.StatusCode)
+		}
+	}
+}
+
+func (u *usageExporter) writeFile(now time.Time, dbs []string, usage map[string]*dbUsage) error {
+	f, err := os.OpenFile(u.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if u.format == usageFormatLine {
+		u.writeLines(&buf, now, dbs, usage)
+	} else {
+		w := csv.NewWriter(&buf)
+		// start new files with a header
+		if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+			w.Write([]string{"time", "db", "points", "bytes", "series"})
+		}
+		for _, db := range dbs {
+			d := usage[db]
+			w.Write([]string{
+				now.UTC().Format(time.RFC3339),
+				db,
+				strconv.FormatInt(d.points, 10),
+				strconv.FormatInt(d.bytes, 10),
+				strconv.Itoa(len(d.series)),
+			})
+		}
+		w.Flush()
+	}
+
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+func (u *usageExporter) writeLines(buf *bytes.Buffer, now time.Time, dbs []string, usage map[string]*dbUsage) {
+	for _, db := range dbs {
+		d := usage[db]
+		p, err := models.NewPoint(usageMeasurement, models.Tags{"db": db}, models.Fields{
+			"points": d.points,
+			"bytes":  d.bytes,
+			"series": int64(len(d.series)),
+		}, now)
+		if err != nil {
+			log.Printf("Problem exporting usage of %q: %v", db, err)
+			continue
+		}
+
+		buf.WriteString(p.PrecisionString(""))
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,617 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError lists the problems found in a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%d problem(s) in config:\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+// Validate checks the configuration without opening any listener or file,
+// and returns every problem found as a ValidationError, or nil
+func (cfg Config) Validate() error {
+	v := &validator{
+		names:     make(map[string]bool),
+		listeners: make(map[string]bool),
+		routes:    make(map[string]bool),
+	}
+
+	for _, h := range cfg.HTTPRelays {
+		where := fmt.Sprintf("http relay %q", h.Name)
+		v.name(where, h.Name)
+		v.addr(where, "bind-addr", h.Addr, true)
+		v.listener(where, h.Addr, h.VirtualHost, h.PathPrefix)
+		v.http(where, h)
+	}
+
+	templates := make(map[string]HTTPConfig)
+	for _, t := range cfg.HTTPTemplates {
+		where := fmt.Sprintf("http-template %q", t.Name)
+		if t.Name == "" {
+			v.add("%s: missing name", where)
+		} else if _, dup := templates[t.Name]; dup {
+			v.add("%s: duplicate http-template name", where)
+		}
+		templates[t.Name] = t
+
+		v.addr(where, "bind-addr", t.Addr, false)
+		if shared, used := v.listeners[t.Addr]; used && !shared {
+			v.add("%s: bind-addr %q already used by a relay without virtual-host or path-prefix", where, t.Addr)
+		} else if t.Addr != "" {
+			v.listeners[t.Addr] = true
+		}
+		if t.PathPrefix != "" {
+			v.add("%s: path-prefix can't be set on a template", where)
+		}
+		v.http(where, t)
+	}
+
+	for _, t := range cfg.Tenants {
+		where := fmt.Sprintf("tenant %q", t.Name)
+		v.name(where, t.Name)
+		if strings.ContainsAny(t.Name, "/?#") {
+			v.add("%s: invalid name", where)
+		}
+		v.addr(where, "bind-addr", t.Addr, false)
+		if t.RateLimit < 0 {
+			v.add("%s: negative rate-limit", where)
+		}
+		v.nonNegative(where, "rate-burst", t.RateBurst)
+
+		tmpl, ok := templates[t.Template]
+		switch {
+		case !ok:
+			v.add("%s: unknown http-template %q", where, t.Template)
+		case t.Addr != "":
+			v.listener(where, t.Addr, tmpl.VirtualHost, "")
+		case tmpl.Addr == "":
+			v.add("%s: missing bind-addr, http-template %q has none to share", where, t.Template)
+		default:
+			v.listener(where, tmpl.Addr, tmpl.VirtualHost, t.Name)
+		}
+	}
+
+	for _, u := range cfg.UDPRelays {
+		where := fmt.Sprintf("udp relay %q", u.Name)
+		v.name(where, u.Name)
+		v.addr(where, "bind-addr", u.Addr, true)
+		v.precision(where, u.Precision)
+		v.nonNegative(where, "read-buffer", u.ReadBuffer)
+		v.nonNegative(where, "read-buffer-max", u.ReadBufferMax)
+		if err := checkReusePort(u.ReusePort); err != nil {
+			v.add("%s: %v", where, err)
+		}
+		v.nonNegative(where, "sample-rate", u.SampleRate)
+		for m, r := range u.SampleRates {
+			v.nonNegative(where, fmt.Sprintf("sample-rates of measurement %q", m), r)
+		}
+		v.nonNegative(where, "max-line-length", u.MaxLineLength)
+
+		names := make(map[string]bool)
+		for _, o := range u.Outputs {
+			ow := fmt.Sprintf("output %q of %s", o.Name, where)
+			if names[o.Name] {
+				v.add("%s: duplicate output name", ow)
+			}
+			names[o.Name] = true
+			v.addr(ow, "location", o.Location, true)
+			v.nonNegative(ow, "mtu", o.MTU)
+			v.precision(ow, o.Precision)
+			v.nonNegative(ow, "buffer-size-kb", o.BufferSizeKB)
+			v.duration(ow, "max-delay-interval", o.MaxDelayInterval)
+		}
+
+		if len(u.HTTPOutputs) > 0 {
+			if u.Database == "" {
+				v.add("%s: http-output requires a database", where)
+			}
+			v.nonNegative(where, "batch-size-kb", u.BatchSizeKB)
+			v.duration(where, "flush-interval", u.FlushInterval)
+			v.outputs(where, u.HTTPOutputs)
+		}
+	}
+
+	for _, c := range cfg.CollectdRelays {
+		where := fmt.Sprintf("collectd relay %q", c.Name)
+		v.name(where, c.Name)
+		v.addr(where, "bind-addr", c.Addr, true)
+		v.nonNegative(where, "read-buffer", c.ReadBuffer)
+		v.nonNegative(where, "batch-size-kb", c.BatchSizeKB)
+		v.duration(where, "flush-interval", c.FlushInterval)
+		v.outputs(where, c.Outputs)
+	}
+
+	for _, m := range cfg.MQTTRelays {
+		where := fmt.Sprintf("mqtt relay %q", m.Name)
+		v.name(where, m.Name)
+		v.url(where, "broker", m.Broker, "tcp", "ssl", "tls")
+		v.duration(where, "keep-alive", m.KeepAlive)
+		v.precision(where, m.Precision)
+		if len(m.Topics) == 0 {
+			v.add("%s: no topic", where)
+		}
+		for _, t := range m.Topics {
+			if t.Topic == "" {
+				v.add("%s: empty topic", where)
+			}
+			if t.QoS < 0 || t.QoS > 1 {
+				v.add("%s: unsupported QoS %d for topic %q", where, t.QoS, t.Topic)
+			}
+		}
+		v.outputs(where, m.Outputs)
+	}
+
+	v.addr("admin", "bind-addr", cfg.Admin.Addr, false)
+	v.duration("admin", "purge-grace-period", cfg.Admin.PurgeGracePeriod)
+	for _, t := range cfg.Admin.Tokens {
+		if t == "" {
+			v.add("admin: empty token")
+		}
+	}
+
+	v.nonNegative("buffer-pool", "max-buffer-kb", cfg.BufferPool.MaxBufferKB)
+	v.nonNegative("buffer-pool", "size-mb", cfg.BufferPool.SizeMB)
+
+	v.addr("statsd", "addr", cfg.StatsD.Addr, false)
+	v.duration("statsd", "interval", cfg.StatsD.Interval)
+	if len(cfg.StatsD.Tags) > 0 && !cfg.StatsD.DogStatsD {
+		v.add("statsd: tags require dogstatsd")
+	}
+
+	v.duration("notify", "interval", cfg.Notify.Interval)
+	for i, w := range cfg.Notify.Webhooks {
+		where := fmt.Sprintf("notify.webhook[%d]", i)
+		if err := checkNotifierType(w.Type); err != nil {
+			v.add("%s: %v", where, err)
+		}
+		if w.Type != notifierPagerDuty || w.URL != "" {
+			v.url(where, "url", w.URL, "http", "https")
+		}
+		if w.Type == notifierPagerDuty && w.RoutingKey == "" {
+			v.add("%s: pagerduty without routing-key", where)
+		}
+		v.duration(where, "timeout", w.Timeout)
+		for _, e := range w.Events {
+			if !notifyEvents[e] {
+				v.add("%s: unknown event %q", where, e)
+			}
+		}
+		if _, err := newOutputHeaders(w.Headers); err != nil {
+			v.add("%s: %v", where, err)
+		}
+	}
+
+	v.duration("usage", "interval", cfg.Usage.Interval)
+	switch cfg.Usage.Format {
+	case "", usageFormatCSV, usageFormatLine:
+	default:
+		v.add("usage: unknown format %q", cfg.Usage.Format)
+	}
+	if cfg.Usage.Location != "" {
+		v.url("usage", "location", cfg.Usage.Location, "http", "https")
+	}
+
+	if len(v.problems) > 0 {
+		return v.problems
+	}
+	return nil
+}
+
+// http checks the settings of an HTTP relay or template, but its name and address
+func (v *validator) http(where string, h HTTPConfig) {
+	v.duration(where, "fanout-timeout", h.FanoutTimeout)
+	v.duration(where, "latency-budget", h.LatencyBudget)
+	v.nonNegative(where, "max-body-size-kb", h.MaxBodySizeKB)
+	v.nonNegative(where, "stream-threshold-kb", h.StreamThresholdKB)
+	if _, err := newCIDRList(h.TrustedProxies); err != nil {
+		v.add("%s: invalid trusted-proxies: %v", where, err)
+	}
+	if _, err := newCIDRList(h.AllowedClients); err != nil {
+		v.add("%s: invalid allowed-clients: %v", where, err)
+	}
+	if _, err := newCIDRList(h.DeniedClients); err != nil {
+		v.add("%s: invalid denied-clients: %v", where, err)
+	}
+	for _, t := range h.Auth.Tokens {
+		if t == "" {
+			v.add("%s: empty auth token", where)
+		}
+	}
+	for _, g := range h.Auth.Grants {
+		if g.Token == "" {
+			v.add("%s: auth grant without token", where)
+		}
+		if _, err := newAuthGrant(g.Databases, g.Measurements); err != nil {
+			v.add("%s: %v", where, err)
+		}
+	}
+	v.duration(where, "verify-cache-ttl", h.Auth.VerifyCacheTTL)
+	if _, err := newCORS(h.CORS); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if h.TenantHeader == "" && len(h.TenantMap) > 0 {
+		v.add("%s: tenant-map requires tenant-header", where)
+	}
+	tenants := make(map[string]bool)
+	for _, m := range h.TenantMap {
+		switch {
+		case m.Tenant == "":
+			v.add("%s: tenant-map without tenant", where)
+		case tenants[m.Tenant]:
+			v.add("%s: duplicate tenant-map of tenant %q", where, m.Tenant)
+		case m.Database == "":
+			v.add("%s: tenant-map of tenant %q without database", where, m.Tenant)
+		}
+		tenants[m.Tenant] = true
+	}
+	if b := h.Auth.VerifyBackend; b != "" {
+		found := false
+		for _, o := range h.Outputs {
+			found = found || o.Name == b || o.Name == "" && o.Location == b
+		}
+		if !found {
+			v.add("%s: unknown verify-backend %q", where, b)
+		}
+	}
+	switch h.EmptyBody {
+	case "", emptyBodyAccept, emptyBodyReject:
+	default:
+		v.add("%s: unknown empty-body %q", where, h.EmptyBody)
+	}
+	switch h.PartialSuccess {
+	case "", partialSuccessNoContent, partialSuccessAccepted, partialSuccessWarning:
+	default:
+		v.add("%s: unknown partial-success %q", where, h.PartialSuccess)
+	}
+	if _, err := newBucketMap(h.BucketMap); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newPinger(h); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if h.PingBackend != "" && h.PingMode != pingProxy {
+		v.add("%s: ping-backend requires ping-mode \"proxy\"", where)
+	}
+	if h.ProxyQueries {
+		if _, err := checkQueryBackends(h); err != nil {
+			v.add("%s: %v", where, err)
+		}
+	} else if len(h.QueryBackends) > 0 {
+		v.add("%s: query-backends without proxy-queries", where)
+	}
+	if _, err := checkFluxBackend(h); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	v.duration(where, "query-timeout", h.QueryTimeout)
+	if err := checkReusePort(h.ReusePort); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	v.duration(where, "shutdown-timeout", h.ShutdownTimeout)
+	v.duration(where, "failover-delay", h.FailoverDelay)
+	v.nonNegative(where, "failover-buffer-mb", h.FailoverBufferMB)
+	v.duration(where, "read-timeout", h.ReadTimeout)
+	v.duration(where, "read-header-timeout", h.ReadHeaderTimeout)
+	v.duration(where, "write-timeout", h.WriteTimeout)
+	v.duration(where, "idle-timeout", h.IdleTimeout)
+	v.nonNegative(where, "max-header-bytes", h.MaxHeaderBytes)
+	if sc, err := newServerConfig(h); err == nil {
+		if err := checkServerLimits(sc); err != nil {
+			v.add("%s: %v", where, err)
+		}
+	}
+	v.nonNegative(where, "max-line-length", h.MaxLineLength)
+	if h.RateLimit < 0 {
+		v.add("%s: negative rate-limit", where)
+	}
+	v.nonNegative(where, "rate-burst", h.RateBurst)
+	if _, err := newQuotas(h.Quotas); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if len(h.ACMEDomains) > 0 {
+		v.addr(where, "acme-http-addr", h.ACMEHTTPAddr, false)
+		v.url(where, "acme-directory", h.ACMEDirectory, "https")
+	}
+	if cert, err := newServerCert(h); err != nil {
+		v.add("%s: %v", where, err)
+	} else if _, err := newClientAuth(h, cert); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if ok, err := checkMigration(h.Outputs); err != nil {
+		v.add("%s: %v", where, err)
+	} else if !ok && h.MigrationReport != "" {
+		v.add("%s: migration-report requires outputs with a migration role", where)
+	}
+	if _, err := newHeartbeat(h); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newSelfMetrics(h); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	v.duration(where, "batch-wait", h.BatchWait)
+	v.nonNegative(where, "batch-size-kb", h.BatchSizeKB)
+	v.duration(where, "dedup-window", h.DedupWindow)
+	if _, err := newDBRenames(h.DatabaseRename); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newTagRewriter(h.TagRename, h.TagDrop); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newTagNormalizers(h.TagNormalize); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newStaticTags(h.Tags); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := checkAggregates(h.Aggregate, h.Outputs); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newFieldDrops(h.FieldDrop); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	if _, err := newStringLimits(h.StringLimits); err != nil {
+		v.add("%s: %v", where, err)
+	}
+	v.outputs(where, h.Outputs)
+	full, primary := false, false
+	for _, o := range h.Outputs {
+		standby := o.Role == roleStandby || o.Shadow || o.Type == outputSubscriber
+		full = full || !standby && len(o.Databases) == 0 && (o.Percentage <= 0 || o.Percentage >= 100)
+		primary = primary || !standby
+	}
+	if len(h.Outputs) > 0 && !primary {
+		v.add("%s: every output is a standby or a shadow, none answers the writes", where)
+	} else if len(h.Outputs) > 0 && !full {
+		v.add("%s: every output has a percentage or databases, some writes would be written nowhere", where)
+	}
+	if err := checkMode(h.Mode); err != nil {
+		v.add("%s: %v", where, err)
+	} else if h.Mode != "" && h.Mode != modeMirror {
+		for _, o := range h.Outputs {
+			if o.Percentage > 0 && o.Percentage < 100 {
+				v.add("%s: percentage of output %q with mode %q", where, o.Name, h.Mode)
+			}
+		}
+	}
+}
+
+type validator struct {
+	problems ValidationError
+	names    map[string]bool
+
+	// listeners tells whether the HTTP listeners are shared, by address,
+	// and routes holds the virtual hosts and path prefixes taken on them
+	listeners map[string]bool
+	routes    map[string]bool
+}
+
+func (v *validator) add(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// name checks the name of a relay, which must be unique across relay types
+func (v *validator) name(where, name string) {
+	if name == "" {
+		v.add("%s: missing name", where)
+		return
+	}
+	if v.names[name] {
+		v.add("%s: duplicate relay name", where)
+	}
+	v.names[name] = true
+}
+
+// listener checks that the HTTP listener on addr is either used by a single
+// relay, or shared by relays with distinct virtual hosts or path prefixes
+func (v *validator) listener(where, addr, host, prefix string) {
+	if addr == "" {
+		return
+	}
+
+	shared, used := v.listeners[addr]
+	if host == "" && prefix == "" {
+		if used {
+			v.add("%s: bind-addr %q already used", where, addr)
+		}
+		v.listeners[addr] = false
+		return
+	}
+
+	if prefix != "" {
+		p, err := normalizePathPrefix(prefix)
+		if err != nil {
+			v.add("%s: %v", where, err)
+			return
+		}
+		prefix = p
+	}
+	if used && !shared {
+		v.add("%s: bind-addr %q already used by a relay without virtual-host or path-prefix", where, addr)
+	}
+
+	route := addr + " " + strings.ToLower(host) + " " + prefix
+	if v.routes[route] {
+		v.add("%s: duplicate virtual-host %q and path-prefix %q on %q", where, host, prefix, addr)
+	}
+	v.listeners[addr] = true
+	v.routes[route] = true
+}
+
+func (v *validator) addr(where, key, addr string, required bool) {
+	if addr == "" {
+		if required {
+			v.add("%s: missing %s", where, key)
+		}
+		return
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add("%s: invalid %s %q: %v", where, key, addr, err)
+		return
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		v.add("%s: invalid port in %s %q", where, key, addr)
+	}
+}
+
+func (v *validator) url(where, key, location string, schemes ...string) {
+	if location == "" {
+		v.add("%s: missing %s", where, key)
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		v.add("%s: invalid %s %q: %v", where, key, location, err)
+		return
+	}
+
+	for _, s := range schemes {
+		if u.Scheme == s {
+			if u.Host == "" {
+				v.add("%s: missing host in %s %q", where, key, location)
+			}
+			return
+		}
+	}
+	v.add("%s: unsupported scheme %q in %s %q", where, u.Scheme, key, location)
+}
+
+func (v *validator) duration(where, key, value string) {
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil {
+		v.add("%s: invalid %s %q: %v", where, key, value, err)
+	} else if d < 0 {
+		v.add("%s: negative %s %q", where, key, value)
+	}
+}
+
+func (v *validator) nonNegative(where, key string, value int) {
+	if value < 0 {
+		v.add("%s: negative %s %d", where, key, value)
+	}
+}
+
+func (v *validator) precision(where, precision string) {
+	switch precision {
+	case "", "n", "u", "ms", "s", "m", "h":
+	default:
+		v.add("%s: unknown precision %q", where, precision)
+	}
+}
+
+// outputs checks the HTTP backends of a relay
+func (v *validator) outputs(where string, outputs []HTTPOutputConfig) {
+	if len(outputs) == 0 {
+		v.add("%s: no output", where)
+	}
+
+	names := make(map[string]bool)
+	for _, o := range outputs {
+		name := o.Name
+		if name == "" {
+			name = o.Location
+		}
+		ow := fmt.Sprintf("output %q of %s", name, where)
+		if names[name] {
+			v.add("%s: duplicate output name", ow)
+		}
+		names[name] = true
+
+		switch o.Type {
+		case "", "influxdb", "prometheus", "victoriametrics", outputSubscriber:
+			v.url(ow, "location", o.Location, "http", "https")
+		case "file":
+			if o.Location == "" {
+				v.add("%s: missing location", ow)
+			}
+			v.nonNegative(ow, "rotate-size-mb", o.RotateSizeMB)
+			v.duration(ow, "rotate-interval", o.RotateInterval)
+		default:
+			v.add("%s: unknown type %q", ow, o.Type)
+		}
+
+		if o.ExtraQuery != "" {
+			if _, err := url.ParseQuery(o.ExtraQuery); err != nil {
+				v.add("%s: invalid extra-query %q: %v", ow, o.ExtraQuery, err)
+			}
+		}
+
+		v.duration(ow, "timeout", o.Timeout)
+		v.nonNegative(ow, "buffer-size-mb", o.BufferSizeMB)
+		v.nonNegative(ow, "max-batch-kb", o.MaxBatchKB)
+		v.nonNegative(ow, "max-post-size-kb", o.MaxPostSizeKB)
+		if err := checkBufferOrder(o.BufferOrder); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if err := checkBufferFull(o.BufferFull); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if err := checkBufferThresholds(o.BufferWarningPercent, o.BufferCriticalPercent); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		v.nonNegative(ow, "replay-workers", o.ReplayWorkers)
+		if _, err := newRetryStatuses(o.RetryStatuses); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if o.DeadLetterFile != "" && o.BufferSizeMB <= 0 {
+			v.add("%s: dead-letter-file without buffer-size-mb", ow)
+		}
+		if (o.BufferWarningPercent != 0 || o.BufferCriticalPercent != 0) && o.BufferSizeMB <= 0 {
+			v.add("%s: buffer thresholds without buffer-size-mb", ow)
+		}
+		v.nonNegative(ow, "immediate-retries", o.ImmediateRetries)
+		if o.Percentage < 0 || o.Percentage > 100 {
+			v.add("%s: percentage %v not between 0 and 100", ow, o.Percentage)
+		}
+		if err := checkRole(o.Role); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if err := checkPatterns("database", o.Databases); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if err := checkPatterns("measurement", o.Measurements); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if len(o.Measurements) > 0 && o.Type != outputSubscriber {
+			v.add("%s: measurements of an output which isn't a subscriber", ow)
+		}
+		if (o.Shadow || o.Type == outputSubscriber) && o.BufferSizeMB > 0 {
+			v.add("%s: shadow with buffer-size-mb", ow)
+		}
+		if o.Password != "" && o.Username == "" {
+			v.add("%s: password without username", ow)
+		}
+		if _, err := newOutputHeaders(o.Headers); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if _, err := newQueryRewriter(&o, nil); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+		if o.Type == "file" && len(o.Headers) > 0 {
+			v.add("%s: headers are not supported by file outputs", ow)
+		}
+		v.duration(ow, "max-delay-interval", o.MaxDelayInterval)
+		v.duration(ow, "error-log-interval", o.ErrorLogInterval)
+		v.duration(ow, "clock-skew-threshold", o.ClockSkewThreshold)
+
+		v.nonNegative(ow, "max-idle-conns-per-host", o.MaxIdleConnsPerHost)
+		v.nonNegative(ow, "max-conns-per-host", o.MaxConnsPerHost)
+		v.duration(ow, "idle-conn-timeout", o.IdleConnTimeout)
+		v.duration(ow, "dial-timeout", o.DialTimeout)
+		if err := checkConnLimits(transportConfig{maxConnsPerHost: o.MaxConnsPerHost}); err != nil {
+			v.add("%s: %v", ow, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInfluxDBVersion = "relay"
+
+	// influxdb-version detecting the version of the backends
+	influxDBVersionAuto = "auto"
+
+	versionDetectInterval = time.Minute
+)
+
+// versionDetector keeps the lowest version reported by the /ping of the
+// InfluxDB backends of a relay, which is the one the clients may rely on.
+// The backends are pinged at start and every versionDetectInterval.
+type versionDetector struct {
+	targets []versionTarget
+
+	mu      sync.RWMutex
+	version string
+
+	closing chan struct{}
+}
+
+type versionTarget struct {
+	client   *http.Client
+	location string
+}
+
+func newVersionDetector(outputs []HTTPOutputConfig) (*versionDetector, error) {
+	d := &versionDetector{closing: make(chan struct{})}
+	for i := range outputs {
+		o := &outputs[i]
+		if o.Type != "" && o.Type != "influxdb" {
+			continue
+		}
+
+		u, err := url.Parse(o.Location)
+		if err != nil {
+			return nil, err
+		}
+		// the ping endpoint next to the write one
+		u.Path = strings.TrimSuffix(u.Path, "write") + "ping"
+		u.RawQuery = ""
+
+		tc, err := newTransportConfig(o)
+		if err != nil {
+			return nil, err
+		}
+		d.targets = append(d.targets, versionTarget{
+			client:   &http.Client{Timeout: pingTimeout, Transport: sharedTransport(tc)},
+			location: u.String(),
+		})
+	}
+	return d, nil
+}
+
+// current returns the lowest version of the backends, empty until one of
+// them reported its version
+func (d *versionDetector) current() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.version
+}
+
+func (d *versionDetector) run() {
+	d.detect()
+
+	ticker := time.NewTicker(versionDetectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.detect()
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+func (d *versionDetector) stop() {
+	close(d.closing)
+}
+
+// detect pings every backend, the version is kept as it is when none of
+// them answers
+func (d *versionDetector) detect() {
+	var lowest string
+	for _, t := range d.targets {
+		resp, err := t.client.Get(t.location)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		v := resp.Header.Get("X-Influxdb-Version")
+		if v != "" && (lowest == "" || compareVersions(v, lowest) < 0) {
+			lowest = v
+		}
+	}
+
+	if lowest != "" {
+		d.mu.Lock()
+		d.version = lowest
+		d.mu.Unlock()
+	}
+}
+
+// compareVersions compares the numeric parts of two versions such as
+// "1.8.10" or "v2.7.1", a build suffix after a '-' is ignored
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v = v[:i]
+	}
+
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// influxDBVersion returns the X-Influxdb-Version header of the answers of h
+func (h *HTTP) influxDBVersion() string {
+	if h.versions != nil {
+		if v := h.versions.current(); v != "" {
+			return v
+		}
+		return DefaultInfluxDBVersion
+	}
+	return h.version
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// vmPoster writes to the InfluxDB compatible /write endpoint of
+// VictoriaMetrics. VictoriaMetrics has no retention policies and stores the
+// database as a label, so only the db and precision parameters are passed on,
+// along with the extra arguments configured for the output (extra_label...).
+type vmPoster struct {
+	*simplePoster
+	extra url.Values
+}
+
+func newVMPoster(cfg *HTTPOutputConfig, timeout time.Duration, tc transportConfig) (*vmPoster, error) {
+	extra, err := url.ParseQuery(cfg.ExtraQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing extra query '%v'", err)
+	}
+
+	return &vmPoster{
+		simplePoster: newSimplePoster(cfg.Location, timeout, tc),
+		extra:        extra,
+	}, nil
+}
+
+func (b *vmPoster) post(p *payload, query string, auth string) (*responseData, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	for _, k := range []string{"db", "precision"} {
+		if v := params.Get(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	for k, vs := range b.extra {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+
+	return b.simplePoster.post(p, q.Encode(), auth)
+}
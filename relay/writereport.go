@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backendResult is the outcome of the post of a write to a backend
+type backendResult struct {
+	index   int
+	resp    *responseData
+	err     error
+	latency time.Duration
+}
+
+// writeReport is the answer to a verbose write: the outcome of every
+// backend, and the error of the write when it failed. A backend whose retry
+// buffer took the write is reported as buffered without waiting for it.
+type writeReport struct {
+	Error    string          `json:"error,omitempty"`
+	Backends []backendReport `json:"backends"`
+}
+
+type backendReport struct {
+	Name      string  `json:"name"`
+	Status    int     `json:"status,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+	Buffered  bool    `json:"buffered"`
+	Error     string  `json:"error,omitempty"`
+
+	// no answer before the fan-out deadline
+	Pending bool `json:"pending,omitempty"`
+}
+
+func newWriteReport(backends []*httpBackend) *writeReport {
+	r := &writeReport{Backends: make([]backendReport, len(backends))}
+	for i, b := range backends {
+		r.Backends[i] = backendReport{Name: b.name, Pending: true}
+	}
+	return r
+}
+
+func (r *writeReport) buffered(i int, latency time.Duration) {
+	b := &r.Backends[i]
+	b.Buffered, b.Pending = true, false
+	b.LatencyMs = latency.Seconds() * 1000
+}
+
+func (r *writeReport) result(res backendResult) {
+	b := &r.Backends[res.index]
+	b.Pending = false
+	b.LatencyMs = res.latency.Seconds() * 1000
+
+	switch {
+	case res.err != nil:
+		b.Error = res.err.Error()
+	case res.resp != nil:
+		b.Status = res.resp.StatusCode
+		if res.resp.StatusCode/100 != 2 {
+			b.Error = responseError(res.resp)
+		}
+	}
+}
+
+// degraded returns the number of primary backends which failed or didn't
+// answer, and of those which buffered the write
+func (r *writeReport) degraded(backends []*httpBackend) (failed int, buffered int) {
+	for i, b := range r.Backends {
+		switch {
+		case backends[i].secondary:
+		case b.Buffered:
+			buffered++
+		case b.Pending || b.Error != "" || b.Status/100 != 2:
+			failed++
+		}
+	}
+	return failed, buffered
+}
+
+// setHeaders adds an X-Relay-Backend-<name> header per backend to the
+// answer, with the status of its response, or "buffered", "pending" or
+// "error" when the post failed
+func (r *writeReport) setHeaders(w http.ResponseWriter) {
+	for _, b := range r.Backends {
+		v := strconv.Itoa(b.Status)
+		switch {
+		case b.Buffered:
+			v = "buffered"
+		case b.Pending:
+			v = "pending"
+		case b.Status == 0:
+			v = "error"
+		}
+		w.Header().Set("X-Relay-Backend-"+headerToken(b.Name), v)
+	}
+}
+
+// headerToken replaces the characters of a backend name which can't be part
+// of a header name, e.g. the slashes and colons of a location
+func headerToken(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// answer writes the report with the status the write would have got
+// otherwise, code when it succeeded, but a 200 rather than a 204 as the
+// report is the body
+func (r *writeReport) answer(w http.ResponseWriter, code int, succeeded bool, userError, errResponse *responseData, fullRetry time.Duration) {
+	if code == http.StatusNoContent {
+		code = http.StatusOK
+	}
+
+	switch {
+	case succeeded:
+	case userError != nil:
+		code, r.Error = userError.StatusCode, responseError(userError)
+	case errResponse != nil:
+		code, r.Error = errResponse.StatusCode, responseError(errResponse)
+	case fullRetry > 0:
+		code, r.Error = http.StatusServiceUnavailable, ErrBufferFull.Error()
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(fullRetry), 10))
+	default:
+		code, r.Error = http.StatusServiceUnavailable, "unable to write points"
+	}
+
+	if r.Error != "" {
+		w.Header().Set("X-Influxdb-Error", r.Error)
+	}
+	writeJSON(w, code, r)
+}
+
+// responseError returns the error message of a response of InfluxDB, or
+// its body when it isn't a JSON error
+func responseError(resp *responseData) string {
+	if resp.ContentEncoding != "" {
+		return http.StatusText(resp.StatusCode)
+	}
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(resp.Body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	if body := strings.TrimSpace(string(resp.Body)); body != "" {
+		return body
+	}
+	return http.StatusText(resp.StatusCode)
+}
+
+// verboseWrite reports whether the client asked for a verbose answer, with
+// the verbose parameter or the X-Relay-Verbose header. The parameter isn't
+// forwarded to the backends.
+func verboseWrite(r *http.Request, params url.Values) bool {
+	v := r.Header.Get("X-Relay-Verbose")
+	if p, ok := params["verbose"]; ok {
+		delete(params, "verbose")
+		if len(p) > 0 {
+			v = p[0]
+		}
+	}
+	verbose, _ := strconv.ParseBool(v)
+	return verbose
+}
@@ -0,0 +1,356 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML decodes the subset of YAML used by configuration files: block
+// mappings and sequences, single line flow collections, plain and quoted
+// scalars, and comments. Anchors, tags and multi-line scalars aren't
+// supported. Mappings are returned as map[string]interface{}, sequences as
+// []interface{} and scalars as string, bool, int64, float64 or nil.
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(stripYAMLComment(l), " \t\r")
+		text := strings.TrimLeft(l, " ")
+		if text == "" || text == "---" || text == "..." {
+			continue
+		}
+		if text[0] == '\t' {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(l) - len(text), text: text, num: i + 1})
+	}
+
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the node starting on the current line, at indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	l := p.lines[p.pos]
+	if isYAMLSeqItem(l.text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.mapping(indent)
+	}
+
+	p.pos++
+	v, err := parseYAMLScalar(l.text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", l.num, err)
+	}
+	return v, nil
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for p.pos < len(p.lines) {
+		l := &p.lines[p.pos]
+		if l.indent < indent || l.indent == indent && !isYAMLSeqItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		var v interface{}
+		var err error
+		if rest := strings.TrimLeft(l.text[1:], " "); rest != "" {
+			// the item starts on the line of the dash, as a node
+			// indented to its column
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			v, err = p.block(l.indent)
+		} else {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err = p.block(p.lines[p.pos].indent)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || isYAMLSeqItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+
+		k, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a key", l.num)
+		}
+		if _, dup := m[k]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, k)
+		}
+		p.pos++
+
+		var v interface{}
+		var err error
+		switch {
+		case value != "":
+			if v, err = parseYAMLScalar(value); err != nil {
+				err = fmt.Errorf("line %d: %v", l.num, err)
+			}
+		case p.pos < len(p.lines):
+			// the value is a nested block, sequences may be indented as
+			// much as their key
+			next := p.lines[p.pos]
+			if next.indent > indent || next.indent == indent && isYAMLSeqItem(next.text) {
+				v, err = p.block(next.indent)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a "key: value" line, ok is false when text isn't one
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+
+	rest := text
+	if text[0] == '"' || text[0] == '\'' {
+		n := yamlQuotedLen(text)
+		if n < 0 {
+			return "", "", false
+		}
+		k, err := parseYAMLScalar(text[:n])
+		if err != nil {
+			return "", "", false
+		}
+		key, rest = k.(string), text[n:]
+		if !strings.HasPrefix(rest, ":") || len(rest) > 1 && rest[1] != ' ' {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == ':' && (i == len(rest)-1 || rest[i+1] == ' ') {
+			return strings.TrimSpace(rest[:i]), strings.TrimSpace(rest[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlQuotedLen returns the length of the quoted scalar s starts with, or -1
+// when it isn't terminated
+func yamlQuotedLen(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes a trailing comment which isn't part of a quoted
+// scalar. Unlike TOML, a # only starts a comment after whitespace.
+func stripYAMLComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:-[{,", line[i-1]) >= 0):
+			n := yamlQuotedLen(line[i:])
+			if n < 0 {
+				return line
+			}
+			i += n - 1
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch s[0] {
+	case '[', '{':
+		v, rest, err := parseYAMLFlow(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after flow collection", rest)
+		}
+		return v, nil
+	case '"':
+		if yamlQuotedLen(s) != len(s) {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strconv.Unquote(s)
+	case '\'':
+		if yamlQuotedLen(s) != len(s) {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case '|', '>':
+		return nil, fmt.Errorf("multi-line strings are not supported")
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+
+	if c := s[0]; c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+// parseYAMLFlow parses the flow collection or scalar s starts with, and
+// returns what follows it
+func parseYAMLFlow(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return nil, "", fmt.Errorf("unterminated flow collection")
+	}
+
+	switch s[0] {
+	case '[':
+		seq := []interface{}{}
+		s = strings.TrimLeft(s[1:], " ")
+		for !strings.HasPrefix(s, "]") {
+			v, rest, err := parseYAMLFlow(s)
+			if err != nil {
+				return nil, "", err
+			}
+			seq = append(seq, v)
+			if s, err = yamlFlowNext(rest, ']'); err != nil {
+				return nil, "", err
+			}
+		}
+		return seq, s[1:], nil
+
+	case '{':
+		m := make(map[string]interface{})
+		s = strings.TrimLeft(s[1:], " ")
+		for !strings.HasPrefix(s, "}") {
+			token, rest, err := yamlFlowToken(s, ":,}")
+			if err != nil {
+				return nil, "", err
+			}
+			if !strings.HasPrefix(rest, ":") {
+				return nil, "", fmt.Errorf("expected a key in flow mapping")
+			}
+			k, err := parseYAMLScalar(token)
+			if err != nil {
+				return nil, "", err
+			}
+
+			v, rest, err := parseYAMLFlow(rest[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			m[fmt.Sprint(k)] = v
+			if s, err = yamlFlowNext(rest, '}'); err != nil {
+				return nil, "", err
+			}
+		}
+		return m, s[1:], nil
+	}
+
+	token, rest, err := yamlFlowToken(s, ",]}")
+	if err != nil {
+		return nil, "", err
+	}
+	v, err := parseYAMLScalar(token)
+	return v, rest, err
+}
+
+// yamlFlowNext skips the separator after an entry of a flow collection
+func yamlFlowNext(s string, end byte) (string, error) {
+	s = strings.TrimLeft(s, " ")
+	switch {
+	case strings.HasPrefix(s, ","):
+		return strings.TrimLeft(s[1:], " "), nil
+	case s != "" && s[0] == end:
+		return s, nil
+	}
+	return "", fmt.Errorf("unterminated flow collection")
+}
+
+// yamlFlowToken returns the scalar s starts with, ending before one of stops
+func yamlFlowToken(s string, stops string) (string, string, error) {
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		n := yamlQuotedLen(s)
+		if n < 0 {
+			return "", "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return s[:n], strings.TrimLeft(s[n:], " "), nil
+	}
+
+	i := strings.IndexAny(s, stops)
+	if i < 0 {
+		return "", "", fmt.Errorf("unterminated flow collection")
+	}
+	token := strings.TrimSpace(s[:i])
+	if token == "" {
+		return "", "", fmt.Errorf("empty value in flow collection")
+	}
+	return token, s[i:], nil
+}